@@ -0,0 +1,212 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+// appendfsync policies.
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNo       = "no"
+)
+
+var (
+	ErrRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+	ErrInvalidFsync      = errors.New("invalid appendfsync policy")
+)
+
+type Config struct {
+	// Dir is the working directory of the server, the aof files are in Dir/DirName.
+	Dir            string
+	DirName        string
+	FileName       string
+	Fsync          string
+	UseRdbPreamble bool
+	LoadTruncated  bool
+}
+
+// AOF appends every write command executed by the server to a file,
+// so that the dataset can be rebuilt by replaying the file at startup.
+//
+// The aof is made of multiple files tracked by a manifest: a base file and
+// incremental files. A rewrite switches to a new incremental file and writes
+// a new base file from a snapshot, so it never copies the commands executed
+// during the rewrite.
+type AOF struct {
+	conf Config
+
+	mu       sync.Mutex
+	manifest *manifest
+	// the last incremental file, write commands are appended to it.
+	f *os.File
+	// there is data written to f but not fsynced yet.
+	dirty bool
+	// the replication offset of the data written, and of the data fsynced, see SetOffset.
+	offset        int
+	fsyncedOffset int
+
+	rewriting bool
+
+	done chan struct{}
+}
+
+func New(conf Config) (*AOF, error) {
+	switch conf.Fsync {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+	default:
+		return nil, ErrInvalidFsync
+	}
+	return &AOF{conf: conf, done: make(chan struct{})}, nil
+}
+
+func (a *AOF) dir() string {
+	return filepath.Join(a.conf.Dir, a.conf.DirName)
+}
+
+func (a *AOF) path(name string) string {
+	return filepath.Join(a.dir(), name)
+}
+
+func (a *AOF) manifestPath() string {
+	return a.path(a.conf.FileName + manifestSuffix)
+}
+
+// Open opens the last incremental file to append commands to,
+// and creates the aof directory and the manifest if they don't exist.
+func (a *AOF) Open() error {
+	if err := os.MkdirAll(a.dir(), 0755); err != nil {
+		return err
+	}
+	m, err := loadManifest(a.manifestPath())
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &manifest{}
+	}
+	if len(m.incrs) == 0 {
+		m.newIncr(a.conf.FileName)
+		if err := writeManifest(a.manifestPath(), m); err != nil {
+			return err
+		}
+	}
+
+	incr := m.incrs[len(m.incrs)-1]
+	f, err := os.OpenFile(a.path(incr.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	a.manifest = m
+	a.f = f
+	a.deleteHistory()
+
+	if a.conf.Fsync == FsyncEverySec {
+		go a.fsyncEverySec()
+	}
+	return nil
+}
+
+// Feed appends a write command to the aof file.
+// With `appendfsync always`, the command is on disk when Feed returns.
+func (a *AOF) Feed(args [][]byte) error {
+	b := encode(args)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.f.Write(b); err != nil {
+		return err
+	}
+	if a.conf.Fsync == FsyncAlways {
+		return a.f.Sync()
+	}
+	a.dirty = true
+	return nil
+}
+
+// SetOffset records that the data written so far is up to the replication offset `offset`,
+// which is the fsynced offset once the data is on disk.
+// With `appendfsync no`, the data is considered on disk once written, the os flushes it.
+func (a *AOF) SetOffset(offset int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.offset = offset
+	if !a.dirty || a.conf.Fsync != FsyncEverySec {
+		a.fsyncedOffset = offset
+	}
+}
+
+// FsyncedOffset returns the replication offset of the data fsynced, see SetOffset.
+func (a *AOF) FsyncedOffset() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.fsyncedOffset
+}
+
+func (a *AOF) fsyncEverySec() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			if a.dirty {
+				if err := a.f.Sync(); err != nil {
+					fmt.Println("aof fsync error: ", err.Error())
+				} else {
+					a.dirty = false
+					a.fsyncedOffset = a.offset
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+func (a *AOF) Close() error {
+	close(a.done)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	return a.f.Close()
+}
+
+// deleteHistory deletes the files left by the last rewrite.
+// It must be called with a.mu held or before the aof is used.
+func (a *AOF) deleteHistory() {
+	if len(a.manifest.history) == 0 {
+		return
+	}
+	for _, info := range a.manifest.history {
+		if err := os.Remove(a.path(info.name)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("delete aof history file %s error: %s\n", info.name, err.Error())
+		}
+	}
+	a.manifest.history = nil
+	if err := writeManifest(a.manifestPath(), a.manifest); err != nil {
+		fmt.Println("write aof manifest error: ", err.Error())
+	}
+}
+
+// encode returns the RESP array of args, the format of a command in the aof file.
+func encode(args [][]byte) []byte {
+	b := proto.ArrayHeader(len(args))
+	for _, arg := range args {
+		b = append(b, proto.String(string(arg))...)
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fukua95/gedis/rdb"
+)
+
+// FileStatus is the result of checking an aof file.
+type FileStatus struct {
+	Path string
+	Size int64
+	// Valid is the size of the valid prefix of the file.
+	Valid int64
+	Err   error
+}
+
+// Truncated reports whether the file is valid except a truncated tail,
+// it can be fixed by truncating the file to Valid bytes.
+func (s *FileStatus) Truncated() bool {
+	return s.Err == io.EOF || s.Err == io.ErrUnexpectedEOF
+}
+
+// CheckFile validates an aof file in aof or rdb format.
+func CheckFile(path string) *FileStatus {
+	status := &FileStatus{Path: path}
+	f, err := os.Open(path)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	status.Size = stat.Size()
+
+	br := bufio.NewReader(f)
+	if isRdb(br) {
+		err := rdb.NewRdb(br).Load(func(rdb.Entry) error { return nil })
+		if err == nil {
+			status.Valid = status.Size
+		} else {
+			status.Err = fmt.Errorf("invalid rdb format: %w", err)
+		}
+		return status
+	}
+
+	status.Valid, err = scanCommands(br, nil)
+	if err != io.EOF || status.Valid != status.Size {
+		status.Err = err
+	}
+	return status
+}
+
+// CheckManifest validates all the files listed in a manifest, in loading order.
+func CheckManifest(path string) ([]*FileStatus, error) {
+	m, err := loadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, fmt.Errorf("manifest %s doesn't exist", path)
+	}
+	dir := filepath.Dir(path)
+	res := []*FileStatus{}
+	for _, info := range m.files() {
+		res = append(res, CheckFile(filepath.Join(dir, info.name)))
+	}
+	return res, nil
+}
+
+func IsManifest(path string) bool {
+	return strings.HasSuffix(path, manifestSuffix)
+}
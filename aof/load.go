@@ -0,0 +1,128 @@
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/rdb"
+)
+
+var ErrTruncated = errors.New("unexpected end of file reading the append only file")
+
+// Loader applies the content of the aof files.
+type Loader struct {
+	// Command applies a command of an aof format file.
+	Command func(args [][]byte) error
+	// Entry applies a key-value pair of a base file in rdb format.
+	Entry func(e rdb.Entry) error
+}
+
+// Load replays the files listed in the manifest in order.
+// No manifest is an empty dataset.
+// If the last command of the last file is truncated (e.g. the server crashed while
+// writing it), Load truncates the file to the last complete command when
+// `aof-load-truncated` is yes, otherwise it returns ErrTruncated.
+func (a *AOF) Load(loader Loader) error {
+	if err := a.upgrade(); err != nil {
+		return err
+	}
+	m, err := loadManifest(a.manifestPath())
+	if err != nil || m == nil {
+		return err
+	}
+
+	files := m.files()
+	for i, info := range files {
+		last := i == len(files)-1
+		if err := a.loadFile(a.path(info.name), last && a.conf.LoadTruncated, loader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgrade moves the aof file of the old single file layout into the aof directory
+// as the base file.
+func (a *AOF) upgrade() error {
+	old := filepath.Join(a.conf.Dir, a.conf.FileName)
+	if _, err := os.Stat(a.manifestPath()); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(old); err != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(a.dir(), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(old, a.path(a.conf.FileName)); err != nil {
+		return err
+	}
+	m := &manifest{
+		base:    &aofInfo{name: a.conf.FileName, seq: 1, typ: typeBase},
+		baseSeq: 1,
+	}
+	fmt.Printf("upgrading the aof file %s to the multi-part aof\n", a.conf.FileName)
+	return writeManifest(a.manifestPath(), m)
+}
+
+func (a *AOF) loadFile(path string, truncateTail bool, loader Loader) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if isRdb(br) {
+		return rdb.NewRdb(br).Load(loader.Entry)
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	valid, err := scanCommands(br, loader.Command)
+	if err == nil || (err == io.EOF && valid == stat.Size()) {
+		return nil
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("bad file format reading the append only file %s at offset %d: %w", path, valid, err)
+	}
+	if !truncateTail {
+		return fmt.Errorf("%w %s at offset %d", ErrTruncated, path, valid)
+	}
+	fmt.Printf("!!! Warning: short read while loading the AOF file %s, truncating it to %d bytes !!!\n", path, valid)
+	return os.Truncate(path, valid)
+}
+
+// isRdb reports whether the file is in rdb format.
+func isRdb(br *bufio.Reader) bool {
+	magic, err := br.Peek(len(rdb.Magic))
+	return err == nil && string(magic) == rdb.Magic
+}
+
+// scanCommands calls fn for every command until an error happens,
+// it returns the size of the valid commands and the error.
+// A clean end of the commands returns io.EOF.
+func scanCommands(rd io.Reader, fn func(args [][]byte) error) (int64, error) {
+	r := proto.NewReader(rd)
+	var valid int64
+	for {
+		args, err := r.ReadSlice()
+		if err != nil {
+			return valid, err
+		}
+		if fn != nil {
+			if err := fn(args); err != nil {
+				return valid, err
+			}
+		}
+		valid += int64(len(encode(args)))
+	}
+}
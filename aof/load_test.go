@@ -0,0 +1,179 @@
+package aof
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testConfig(t *testing.T, loadTruncated bool) Config {
+	return Config{
+		Dir:           t.TempDir(),
+		DirName:       "appendonlydir",
+		FileName:      "appendonly.aof",
+		Fsync:         FsyncNo,
+		LoadTruncated: loadTruncated,
+	}
+}
+
+func commands(cmds ...string) [][][]byte {
+	res := [][][]byte{}
+	for _, cmd := range cmds {
+		args := [][]byte{}
+		for _, arg := range strings.Fields(cmd) {
+			args = append(args, []byte(arg))
+		}
+		res = append(res, args)
+	}
+	return res
+}
+
+func encodeCommands(cmds [][][]byte) []byte {
+	b := []byte{}
+	for _, args := range cmds {
+		b = append(b, encode(args)...)
+	}
+	return b
+}
+
+// writeFiles writes the incremental files with the contents and the manifest of them.
+func writeFiles(t *testing.T, a *AOF, contents ...[]byte) []string {
+	t.Helper()
+	if err := os.MkdirAll(a.dir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	m := &manifest{}
+	paths := []string{}
+	for _, content := range contents {
+		info := m.newIncr(a.conf.FileName)
+		paths = append(paths, a.path(info.name))
+		if err := os.WriteFile(paths[len(paths)-1], content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeManifest(a.manifestPath(), m); err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func load(a *AOF) ([][][]byte, error) {
+	got := [][][]byte{}
+	err := a.Load(Loader{Command: func(args [][]byte) error {
+		got = append(got, args)
+		return nil
+	}})
+	return got, err
+}
+
+func TestLoad(t *testing.T) {
+	a, _ := New(testConfig(t, false))
+	// no manifest is an empty dataset.
+	if got, err := load(a); err != nil || len(got) != 0 {
+		t.Fatalf("Load() without a manifest = %d commands, %v", len(got), err)
+	}
+
+	first := commands("set a 1", "set b 2")
+	second := commands("del a", "incr b")
+	writeFiles(t, a, encodeCommands(first), encodeCommands(second))
+	got, err := load(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(first, second...); !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadTruncated(t *testing.T) {
+	cmds := commands("set a 1", "set b 2")
+	valid := encodeCommands(cmds)
+	tails := []string{
+		"*",
+		"*3\r\n",
+		"*3\r\n$3\r\nset\r\n$1\r\nc",
+		"*3\r\n$3\r\nset\r\n$1\r\nc\r\n$1\r\n3\r",
+	}
+	for _, tail := range tails {
+		content := append(append([]byte{}, valid...), tail...)
+
+		a, _ := New(testConfig(t, false))
+		paths := writeFiles(t, a, content)
+		if _, err := load(a); !errors.Is(err, ErrTruncated) {
+			t.Errorf("Load(%q) error = %v, want ErrTruncated", tail, err)
+		}
+		if b, _ := os.ReadFile(paths[0]); len(b) != len(content) {
+			t.Errorf("Load(%q) changes the file without aof-load-truncated", tail)
+		}
+		if status := CheckFile(paths[0]); !status.Truncated() || status.Valid != int64(len(valid)) {
+			t.Errorf("CheckFile(%q) = valid %d, %v, want the truncated tail at %d", tail, status.Valid, status.Err, len(valid))
+		}
+
+		// the file is truncated to the last complete command.
+		a, _ = New(testConfig(t, true))
+		paths = writeFiles(t, a, content)
+		got, err := load(a)
+		if err != nil || !reflect.DeepEqual(got, cmds) {
+			t.Errorf("Load(%q) with aof-load-truncated = %q, %v, want %q", tail, got, err, cmds)
+		}
+		if b, _ := os.ReadFile(paths[0]); string(b) != string(valid) {
+			t.Errorf("the file is truncated to %q, want %q", b, valid)
+		}
+		if status := CheckFile(paths[0]); status.Err != nil || status.Valid != status.Size {
+			t.Errorf("CheckFile(%q) after truncating = valid %d of %d, %v", tail, status.Valid, status.Size, status.Err)
+		}
+	}
+}
+
+func TestLoadTruncatedNotLast(t *testing.T) {
+	// only the tail of the last file can be truncated.
+	a, _ := New(testConfig(t, true))
+	content := append(encodeCommands(commands("set a 1")), "*3\r\n$3\r\nset"...)
+	paths := writeFiles(t, a, content, encodeCommands(commands("set b 2")))
+	if _, err := load(a); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Load() error = %v, want ErrTruncated", err)
+	}
+	if b, _ := os.ReadFile(paths[0]); len(b) != len(content) {
+		t.Errorf("Load() truncates a file which isn't the last one")
+	}
+}
+
+func TestLoadBadFormat(t *testing.T) {
+	a, _ := New(testConfig(t, true))
+	content := append(encodeCommands(commands("set a 1")), "*1\r\n+set\r\n"...)
+	paths := writeFiles(t, a, content)
+	_, err := load(a)
+	if err == nil || errors.Is(err, ErrTruncated) || !strings.Contains(err.Error(), "bad file format") {
+		t.Errorf("Load() error = %v, want bad file format", err)
+	}
+	if b, _ := os.ReadFile(paths[0]); len(b) != len(content) {
+		t.Errorf("Load() truncates a file in bad format")
+	}
+	if status := CheckFile(paths[0]); status.Err == nil || status.Truncated() {
+		t.Errorf("CheckFile() = %v, want a format error", status.Err)
+	}
+}
+
+func TestLoadUpgrade(t *testing.T) {
+	// the aof file of the old single file layout becomes the base file.
+	a, _ := New(testConfig(t, false))
+	cmds := commands("set a 1")
+	old := filepath.Join(a.conf.Dir, a.conf.FileName)
+	if err := os.WriteFile(old, encodeCommands(cmds), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := load(a)
+	if err != nil || !reflect.DeepEqual(got, cmds) {
+		t.Errorf("Load() = %q, %v, want %q", got, err, cmds)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("the old aof file is not moved: %v", err)
+	}
+	m, err := loadManifest(a.manifestPath())
+	if err != nil || m == nil || m.base == nil || m.base.name != a.conf.FileName {
+		t.Errorf("the manifest after upgrading = %+v, %v", m, err)
+	}
+}
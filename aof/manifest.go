@@ -0,0 +1,208 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// type of a file in the manifest.
+const (
+	typeBase    = "b"
+	typeHistory = "h"
+	typeIncr    = "i"
+)
+
+const (
+	baseSuffix     = ".base"
+	incrSuffix     = ".incr"
+	rdbFormat      = ".rdb"
+	aofFormat      = ".aof"
+	manifestSuffix = ".manifest"
+)
+
+// aofInfo is a file line in the manifest, e.g.
+// `file appendonly.aof.1.base.rdb seq 1 type b`
+type aofInfo struct {
+	name string
+	seq  int
+	typ  string
+}
+
+// manifest tracks the files of a multi-part aof:
+// one base file, the dataset when the last rewrite started, in rdb or aof format,
+// and the incremental files, the commands executed since then, in order.
+// history files are left by the last rewrite and will be deleted.
+type manifest struct {
+	base    *aofInfo
+	incrs   []*aofInfo
+	history []*aofInfo
+
+	// the largest seq of base and incr files ever used.
+	baseSeq int
+	incrSeq int
+}
+
+// loadManifest returns nil if the manifest doesn't exist.
+func loadManifest(path string) (*manifest, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	sc := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		info, err := parseAofInfo(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aof manifest file %s at line %d: %w", path, lineNum, err)
+		}
+		switch info.typ {
+		case typeBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("invalid aof manifest file %s: found duplicate base file information", path)
+			}
+			m.base = info
+			m.baseSeq = info.seq
+		case typeIncr:
+			m.incrs = append(m.incrs, info)
+			m.incrSeq = info.seq
+		case typeHistory:
+			m.history = append(m.history, info)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseAofInfo(line string) (*aofInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid line %q", line)
+	}
+	info := &aofInfo{}
+	for i := 0; i < len(fields); i += 2 {
+		v := fields[i+1]
+		switch fields[i] {
+		case "file":
+			if strings.ContainsAny(v, "/\\") {
+				return nil, fmt.Errorf("file name %q can't contain a path", v)
+			}
+			info.name = v
+		case "seq":
+			seq, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, err
+			}
+			info.seq = seq
+		case "type":
+			info.typ = v
+		}
+	}
+	if info.name == "" || info.seq == 0 {
+		return nil, fmt.Errorf("invalid line %q", line)
+	}
+	switch info.typ {
+	case typeBase, typeIncr, typeHistory:
+	default:
+		return nil, fmt.Errorf("unknown file type %q", info.typ)
+	}
+	return info, nil
+}
+
+func (m *manifest) encode() []byte {
+	var b bytes.Buffer
+	line := func(info *aofInfo, typ string) {
+		fmt.Fprintf(&b, "file %s seq %d type %s\n", info.name, info.seq, typ)
+	}
+	if m.base != nil {
+		line(m.base, typeBase)
+	}
+	for _, info := range m.history {
+		line(info, typeHistory)
+	}
+	for _, info := range m.incrs {
+		line(info, typeIncr)
+	}
+	return b.Bytes()
+}
+
+// files returns the files to load in order.
+func (m *manifest) files() []*aofInfo {
+	files := []*aofInfo{}
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *manifest) newIncr(name string) *aofInfo {
+	m.incrSeq++
+	info := &aofInfo{
+		name: fmt.Sprintf("%s.%d%s%s", name, m.incrSeq, incrSuffix, aofFormat),
+		seq:  m.incrSeq,
+		typ:  typeIncr,
+	}
+	m.incrs = append(m.incrs, info)
+	return info
+}
+
+func (m *manifest) newBase(name string, rdbPreamble bool) *aofInfo {
+	m.baseSeq++
+	format := aofFormat
+	if rdbPreamble {
+		format = rdbFormat
+	}
+	return &aofInfo{
+		name: fmt.Sprintf("%s.%d%s%s", name, m.baseSeq, baseSuffix, format),
+		seq:  m.baseSeq,
+		typ:  typeBase,
+	}
+}
+
+// writeManifest replaces the manifest atomically,
+// so a crash leaves either the old or the new manifest.
+func writeManifest(path string, m *manifest) error {
+	tmp := filepath.Join(filepath.Dir(path), "temp-"+filepath.Base(path))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(m.encode()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return fsyncDir(filepath.Dir(path))
+}
+
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,130 @@
+package aof
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAofInfo(t *testing.T) {
+	tests := []struct {
+		line string
+		want *aofInfo
+		err  string
+	}{
+		{"file appendonly.aof.1.base.rdb seq 1 type b", &aofInfo{name: "appendonly.aof.1.base.rdb", seq: 1, typ: typeBase}, ""},
+		{"file appendonly.aof.2.incr.aof seq 2 type i", &aofInfo{name: "appendonly.aof.2.incr.aof", seq: 2, typ: typeIncr}, ""},
+		// the order of the fields doesn't matter.
+		{"type h seq 3 file appendonly.aof.3.base.aof", &aofInfo{name: "appendonly.aof.3.base.aof", seq: 3, typ: typeHistory}, ""},
+		// the unknown fields are ignored.
+		{"file a seq 1 type i startoffset 100", &aofInfo{name: "a", seq: 1, typ: typeIncr}, ""},
+		{"file a seq 1 type", nil, "invalid line"},
+		{"file ../a seq 1 type i", nil, "can't contain a path"},
+		{"file a\\b seq 1 type i", nil, "can't contain a path"},
+		{"file a seq x type i", nil, "invalid syntax"},
+		{"file a seq 0 type i", nil, "invalid line"},
+		{"seq 1 type i", nil, "invalid line"},
+		{"file a seq 1", nil, "unknown file type"},
+		{"file a seq 1 type x", nil, "unknown file type"},
+	}
+	for _, tt := range tests {
+		got, err := parseAofInfo(tt.line)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseAofInfo(%q) error = %v, want %q", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAofInfo(%q) = %+v, %v, want %+v", tt.line, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+	if m, err := loadManifest(path); m != nil || err != nil {
+		t.Errorf("loadManifest() of a missing file = %+v, %v, want nil, nil", m, err)
+	}
+
+	content := "# comment\n" +
+		"file appendonly.aof.2.base.rdb seq 2 type b\n" +
+		"\n" +
+		"  file appendonly.aof.1.base.aof seq 1 type h  \n" +
+		"file appendonly.aof.3.incr.aof seq 3 type i\n" +
+		"file appendonly.aof.4.incr.aof seq 4 type i\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.base.name != "appendonly.aof.2.base.rdb" || len(m.history) != 1 || len(m.incrs) != 2 {
+		t.Errorf("loadManifest() = base %+v, history %d, incrs %d", m.base, len(m.history), len(m.incrs))
+	}
+	if m.baseSeq != 2 || m.incrSeq != 4 {
+		t.Errorf("baseSeq, incrSeq = %d, %d, want 2, 4", m.baseSeq, m.incrSeq)
+	}
+	names := []string{}
+	for _, info := range m.files() {
+		names = append(names, info.name)
+	}
+	want := []string{"appendonly.aof.2.base.rdb", "appendonly.aof.3.incr.aof", "appendonly.aof.4.incr.aof"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("files() = %q, want %q", names, want)
+	}
+
+	// the manifest written is loaded back the same.
+	if err := writeManifest(path, m); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := loadManifest(path); err != nil || !reflect.DeepEqual(got, m) {
+		t.Errorf("loadManifest() of the manifest written = %+v, %v, want %+v", got, err, m)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), "temp-appendonly.aof.manifest")); !os.IsNotExist(err) {
+		t.Errorf("the temp manifest is left: %v", err)
+	}
+}
+
+func TestLoadManifestInvalid(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"file a seq 1 type b\nfile b seq 2 type b\n", "duplicate base file"},
+		{"# comment\nfile a seq 1 type i\nfile b seq 2\n", "at line 3"},
+		{"file a seq 1 type i\nfile\n", "at line 2"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "appendonly.aof.manifest")
+		if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadManifest(path); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("loadManifest(%q) error = %v, want %q", tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestManifestNewFiles(t *testing.T) {
+	m := &manifest{baseSeq: 2, incrSeq: 4}
+	if info := m.newIncr("appendonly.aof"); info.name != "appendonly.aof.5.incr.aof" || info.seq != 5 || info.typ != typeIncr {
+		t.Errorf("newIncr() = %+v", info)
+	}
+	if len(m.incrs) != 1 {
+		t.Errorf("newIncr() doesn't add the file")
+	}
+	if info := m.newBase("appendonly.aof", true); info.name != "appendonly.aof.3.base.rdb" || info.seq != 3 || info.typ != typeBase {
+		t.Errorf("newBase() in rdb format = %+v", info)
+	}
+	if info := m.newBase("appendonly.aof", false); info.name != "appendonly.aof.4.base.aof" || info.seq != 4 {
+		t.Errorf("newBase() in aof format = %+v", info)
+	}
+	// the base file is set by the rewrite when it's done.
+	if m.base != nil {
+		t.Errorf("newBase() sets the base file")
+	}
+}
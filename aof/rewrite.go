@@ -0,0 +1,169 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/fukua95/gedis/rdb"
+	"github.com/fukua95/gedis/storage"
+)
+
+func (a *AOF) IsRewriting() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rewriting
+}
+
+// StartRewrite switches to a new incremental file, the commands fed from now on
+// are not in the new base file.
+// The caller should take a snapshot of the dataset at the same point,
+// and then call Rewrite with it.
+func (a *AOF) StartRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rewriting {
+		return ErrRewriteInProgress
+	}
+
+	m := *a.manifest
+	m.incrs = append([]*aofInfo{}, a.manifest.incrs...)
+	incr := m.newIncr(a.conf.FileName)
+	f, err := os.OpenFile(a.path(incr.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(a.manifestPath(), &m); err != nil {
+		f.Close()
+		os.Remove(a.path(incr.name))
+		return err
+	}
+
+	if err := a.f.Sync(); err != nil {
+		fmt.Println("aof fsync error: ", err.Error())
+	}
+	a.f.Close()
+	a.f = f
+	a.dirty = false
+	a.manifest = &m
+	a.rewriting = true
+	return nil
+}
+
+// Rewrite writes the snapshot as a new base file, and then replaces the base file
+// and the incremental files before the one created by StartRewrite with it.
+func (a *AOF) Rewrite(snapshot *storage.Store) error {
+	defer func() {
+		a.mu.Lock()
+		a.rewriting = false
+		a.mu.Unlock()
+	}()
+
+	tmp := a.path(fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+	if err := a.writeBase(tmp, snapshot); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := *a.manifest
+	base := m.newBase(a.conf.FileName, a.conf.UseRdbPreamble)
+	if err := os.Rename(tmp, a.path(base.name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// the last incremental file is the one created by StartRewrite.
+	last := len(m.incrs) - 1
+	m.history = append([]*aofInfo{}, m.history...)
+	if m.base != nil {
+		m.history = append(m.history, m.base)
+	}
+	m.history = append(m.history, m.incrs[:last]...)
+	m.incrs = m.incrs[last:]
+	m.base = base
+	if err := writeManifest(a.manifestPath(), &m); err != nil {
+		os.Remove(a.path(base.name))
+		return err
+	}
+	a.manifest = &m
+	a.deleteHistory()
+	return nil
+}
+
+func (a *AOF) writeBase(path string, snapshot *storage.Store) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if a.conf.UseRdbPreamble {
+		err = rdb.Save(f, snapshot, map[string]string{"aof-base": "1"})
+	} else {
+		w := bufio.NewWriter(f)
+		if err = writeStore(w, snapshot); err == nil {
+			err = w.Flush()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// writeStore writes the commands rebuilding the store.
+func writeStore(w *bufio.Writer, store *storage.Store) error {
+	var err error
+	write := func(args ...string) {
+		if err != nil {
+			return
+		}
+		b := make([][]byte, len(args))
+		for i, arg := range args {
+			b[i] = []byte(arg)
+		}
+		_, err = w.Write(encode(b))
+	}
+
+	store.ForEachString(func(key string, val string, ex int64) {
+		if ex > 0 {
+			write("SET", key, val, "PXAT", fmt.Sprint(ex))
+		} else {
+			write("SET", key, val)
+		}
+	})
+	store.ForEachStream(func(key string, stream *storage.Stream) {
+		stream.ForEach(storage.NewID(0, 0), storage.MaxID, false, func(e *storage.Entry) bool {
+			args := []string{"XADD", key, e.ID.String()}
+			for _, kv := range e.KVs {
+				args = append(args, kv.K, kv.V)
+			}
+			write(args...)
+			return true
+		})
+		// create an empty stream by trimming an entry, like redis.
+		if stream.Len() == 0 {
+			write("XADD", key, "MAXLEN", "0", "0-1", "x", "y")
+		}
+		// the last ID may be greater than the last entry after XDEL.
+		write("XSETID", key, stream.LastID.String(), "ENTRIESADDED", fmt.Sprint(stream.EntriesAdded),
+			"MAXDELETEDID", stream.MaxDeletedID.String())
+		for _, name := range stream.GroupNames() {
+			g := stream.Group(name)
+			write("XGROUP", "CREATE", key, name, g.LastID.String(), "MKSTREAM", "ENTRIESREAD", fmt.Sprint(g.EntriesRead))
+			for _, cname := range g.ConsumerNames() {
+				c := g.Consumer(cname)
+				write("XGROUP", "CREATECONSUMER", key, name, cname)
+				c.PEL.Range(storage.NewID(0, 0), storage.MaxID, func(pe *storage.PendingEntry) bool {
+					write("XCLAIM", key, name, cname, "0", pe.ID.String(), "TIME", fmt.Sprint(pe.DeliveryTime),
+						"RETRYCOUNT", fmt.Sprint(pe.DeliveryCount), "JUSTID", "FORCE")
+					return true
+				})
+			}
+		}
+	})
+	return err
+}
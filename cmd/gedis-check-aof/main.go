@@ -0,0 +1,61 @@
+// gedis-check-aof validates the aof files of gedis, and fixes a truncated tail.
+//
+//	gedis-check-aof [--fix] <file.manifest|file.aof|file.rdb>
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fukua95/gedis/aof"
+)
+
+func main() {
+	fix := false
+	path := ""
+	switch {
+	case len(os.Args) == 2:
+		path = os.Args[1]
+	case len(os.Args) == 3 && os.Args[1] == "--fix":
+		fix = true
+		path = os.Args[2]
+	default:
+		fmt.Printf("Usage: %s [--fix] <file.manifest|file.aof|file.rdb>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	var files []*aof.FileStatus
+	if aof.IsManifest(path) {
+		var err error
+		if files, err = aof.CheckManifest(path); err != nil {
+			fmt.Println("Error: ", err.Error())
+			os.Exit(1)
+		}
+	} else {
+		files = []*aof.FileStatus{aof.CheckFile(path)}
+	}
+
+	for i, f := range files {
+		if f.Err == nil {
+			fmt.Printf("%s is valid, size %d\n", f.Path, f.Size)
+			continue
+		}
+		fmt.Printf("%s is invalid: %v, valid size %d of %d\n", f.Path, f.Err, f.Valid, f.Size)
+
+		// only the tail of the last file can be truncated by a crash,
+		// other errors need to be inspected by hand.
+		if !f.Truncated() || i != len(files)-1 {
+			fmt.Println("Error: the aof can't be fixed automatically")
+			os.Exit(1)
+		}
+		if !fix {
+			fmt.Println("Run with --fix to truncate the file to the valid size")
+			os.Exit(1)
+		}
+		if err := os.Truncate(f.Path, f.Valid); err != nil {
+			fmt.Println("Error: failed to truncate the file: ", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("Successfully truncated %s to %d bytes\n", f.Path, f.Valid)
+	}
+}
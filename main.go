@@ -9,6 +9,13 @@ import (
 
 func main() {
 	conf := server.NewConfig(os.Args)
+	if conf.SentinelMode() {
+		if err := server.NewSentinel(conf).ListenAndServe(); err != nil {
+			fmt.Println("sentinel error: ", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
 	server := server.NewServer(conf)
 	if err := server.ListenAndServe(); err != nil {
@@ -41,29 +41,152 @@ const (
 	CmdXAdd     = "XADD"
 	CmdXRange   = "XRANGE"
 	CmdXRead    = "XREAD"
+
+	CmdXLen      = "XLEN"
+	CmdXDel      = "XDEL"
+	CmdXTrim     = "XTRIM"
+	CmdXRevRange = "XREVRANGE"
+	CmdXSetID    = "XSETID"
+
+	CmdXGroup     = "XGROUP"
+	CmdXReadGroup = "XREADGROUP"
+	CmdXAck       = "XACK"
+	CmdXPending   = "XPENDING"
+	CmdXClaim     = "XCLAIM"
+	CmdXAutoClaim = "XAUTOCLAIM"
+	CmdXInfo      = "XINFO"
+
+	CmdBgRewriteAof = "BGREWRITEAOF"
+	CmdReplicaOf    = "REPLICAOF"
+	CmdSlaveOf      = "SLAVEOF"
+	CmdAuth         = "AUTH"
+	CmdHello        = "HELLO"
+
+	CmdDel       = "DEL"
+	CmdExpire    = "EXPIRE"
+	CmdPExpire   = "PEXPIRE"
+	CmdExpireAt  = "EXPIREAT"
+	CmdPExpireAt = "PEXPIREAT"
+	CmdTTL       = "TTL"
+	CmdPTTL      = "PTTL"
+	CmdWaitAof   = "WAITAOF"
+	CmdFailover  = "FAILOVER"
+
+	CmdSubscribe   = "SUBSCRIBE"
+	CmdUnsubscribe = "UNSUBSCRIBE"
+	CmdPublish     = "PUBLISH"
+	CmdSentinel    = "SENTINEL"
+
+	CmdDump          = "DUMP"
+	CmdRestore       = "RESTORE"
+	CmdRestoreAsking = "RESTORE-ASKING"
+	CmdMigrate       = "MIGRATE"
+	CmdSelect        = "SELECT"
+
+	CmdCluster   = "CLUSTER"
+	CmdAsking    = "ASKING"
+	CmdReadOnly  = "READONLY"
+	CmdReadWrite = "READWRITE"
+
+	CmdClient = "CLIENT"
 )
 
 const (
 	OptionSetEx          = "px"
+	OptionSetExAt        = "pxat"
+	OptionSetExSec       = "ex"
+	OptionSetExAtSec     = "exat"
+	OptionSetNX          = "nx"
+	OptionSetXX          = "xx"
+	OptionSetKeepTTL     = "keepttl"
 	OptionInfoRep        = "replication"
+	OptionInfoServer     = "server"
+	OptionInfoCluster    = "cluster"
 	OptionReplLPort      = "listening-port"
 	OptionReplCapa       = "capa"
+	CapaPsync2           = "psync2"
 	OptionGetAck         = "GETACK"
 	OptionAck            = "ACK"
+	OptionFAck           = "FACK"
 	OptionDir            = "dir"
 	OptionDBFile         = "dbfilename"
+	OptionAppendOnly     = "appendonly"
+	OptionAppendFsync    = "appendfsync"
 	OptionBlock          = "block"
+	OptionStreams        = "streams"
+	OptionTo             = "to"
+	OptionForce          = "force"
+	OptionAbort          = "abort"
+	OptionTimeout        = "timeout"
+	OptionTakeover       = "takeover"
+	OptionHard           = "hard"
+	OptionSoft           = "soft"
+	OptionCopy           = "copy"
+	OptionReplace        = "replace"
+	OptionAuth           = "auth"
+	OptionAuth2          = "auth2"
+	OptionKeys           = "keys"
+	OptionAbsTTL         = "absttl"
+	OptionIdleTime       = "idletime"
+	OptionFreq           = "freq"
+	OptionImporting      = "importing"
+	OptionMigrating      = "migrating"
+	OptionNode           = "node"
+	OptionStable         = "stable"
+	OptionGroup          = "group"
+	OptionCount          = "count"
+	OptionNoAck          = "noack"
+	OptionMkStream       = "mkstream"
+	OptionIdle           = "idle"
+	OptionTime           = "time"
+	OptionRetryCount     = "retrycount"
+	OptionJustID         = "justid"
+	OptionLastID         = "lastid"
+	OptionFull           = "full"
+	OptionNoMkStream     = "nomkstream"
+	OptionMaxLen         = "maxlen"
+	OptionMinID          = "minid"
+	OptionLimit          = "limit"
+	OptionEntriesAdded   = "entriesadded"
+	OptionMaxDeletedID   = "maxdeletedid"
+	OptionEntriesRead    = "entriesread"
+	OptionStreamIDNew    = ">"
+	OptionFailover       = "FAILOVER"
 	OptionStreamIDNewest = "$"
+	OptionStreamIDLast   = "+"
+	OptionType           = "type"
+	OptionID             = "id"
+	OptionAddr           = "addr"
+	OptionLAddr          = "laddr"
+	OptionSkipMe         = "skipme"
+	OptionUser           = "user"
+	OptionMaxAge         = "maxage"
+	OptionWrite          = "write"
+	OptionAll            = "all"
+	OptionOn             = "on"
+	OptionOff            = "off"
+	OptionSkip           = "skip"
+	OptionYes            = "yes"
+	OptionNo             = "no"
+	OptionLibName        = "lib-name"
+	OptionLibVer         = "lib-ver"
+	OptionRedirect       = "redirect"
+	OptionBCast          = "bcast"
+	OptionPrefix         = "prefix"
+	OptionOptIn          = "optin"
+	OptionOptOut         = "optout"
+	OptionNoLoop         = "noloop"
+	OptionSetName        = "setname"
 )
 
 const (
 	ReplyFullResync = "FULLRESYNC"
+	ReplyContinue   = "CONTINUE"
 )
 
 var (
 	ErrStreamIDInvalid = errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
 	ErrStreamIDIllegal = errors.New("The ID specified in XADD must be greater than 0-0")
-	ErrInvalidCommand  = errors.New("invalid command")
 	ErrInvalidReply    = errors.New("invalid reply")
 )
 
@@ -91,10 +214,91 @@ func Error(e string) []byte {
 	return []byte(fmt.Sprintf("%cERR %s\r\n", RespError, e))
 }
 
+func ErrorCode(code string, e string) []byte {
+	return []byte(fmt.Sprintf("%c%s %s\r\n", RespError, code, e))
+}
+
 func NilString() []byte {
 	return []byte(fmt.Sprintf("%c-1\r\n", RespString))
 }
 
+func NilArray() []byte {
+	return []byte(fmt.Sprintf("%c-1\r\n", RespArray))
+}
+
+// the versions of the protocol, see HELLO.
+const (
+	Resp2 = 2
+	Resp3 = 3
+)
+
+// The functions below encode a reply in the version of the protocol resp, the RESP3 types
+// are encoded as the closest RESP2 types in RESP2, like redis.
+
+// PushHeader is the header of a push message, sent out of band of the replies,
+// e.g. a message published to a channel, it's an array in RESP2.
+func PushHeader(l int, resp int) []byte {
+	if resp < Resp3 {
+		return ArrayHeader(l)
+	}
+	return []byte(fmt.Sprintf("%c%s\r\n", RespPush, util.Itoa(l)))
+}
+
+// MapHeader is the header of a map of l pairs, it's an array of the keys and the values in RESP2.
+func MapHeader(l int, resp int) []byte {
+	if resp < Resp3 {
+		return ArrayHeader(2 * l)
+	}
+	return []byte(fmt.Sprintf("%c%s\r\n", RespMap, util.Itoa(l)))
+}
+
+// SetHeader is the header of a set, it's an array in RESP2.
+func SetHeader(l int, resp int) []byte {
+	if resp < Resp3 {
+		return ArrayHeader(l)
+	}
+	return []byte(fmt.Sprintf("%c%s\r\n", RespSet, util.Itoa(l)))
+}
+
+// Null is the null of RESP3.
+func Null() []byte {
+	return []byte(fmt.Sprintf("%c\r\n", RespNil))
+}
+
+// NullBulk and NullArray are the null bulk string and the null array of RESP2,
+// both are the null in RESP3.
+func NullBulk(resp int) []byte {
+	if resp < Resp3 {
+		return NilString()
+	}
+	return Null()
+}
+
+func NullArray(resp int) []byte {
+	if resp < Resp3 {
+		return NilArray()
+	}
+	return Null()
+}
+
+// Verbatim is a verbatim string of the format of 3 characters, e.g. `txt`, it's a bulk string in RESP2.
+func Verbatim(format string, s string, resp int) []byte {
+	if resp < Resp3 {
+		return String(s)
+	}
+	return []byte(fmt.Sprintf("%c%s\r\n%s:%s\r\n", RespVerbatim, util.Itoa(len(s)+len(format)+1), format, s))
+}
+
+const (
+	// the rdb file of a diskless sync is sent as `$EOF:<mark>\r\n<rdb><mark>`.
+	RdbEOFPrefix  = "EOF:"
+	RdbEOFMarkLen = 40
+)
+
+func RdbEOFHeader(mark string) []byte {
+	return []byte(fmt.Sprintf("%c%s%s\r\n", RespString, RdbEOFPrefix, mark))
+}
+
 // without tail `\r\n`
 func RdbContent(content []byte) []byte {
 	return []byte(fmt.Sprintf("%c%s\r\n%s", RespString, util.Itoa(len(content)), content))
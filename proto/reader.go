@@ -2,16 +2,89 @@ package proto
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/big"
+	"slices"
 	"strconv"
+)
+
+// RedisError is an error reply, e.g. `-ERR unknown command`.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// ProtocolError is a malformed request or reply, e.g. `invalid bulk length`.
+type ProtocolError string
 
-	"github.com/fukua95/gedis/util"
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// VerbatimString is a verbatim string reply, Format is e.g. `txt` or `mkd`.
+type VerbatimString struct {
+	Format string
+	Text   string
+}
+
+// Push is a push message, sent out of band of the replies in RESP3.
+type Push []interface{}
+
+// Attributed is a reply with the attributes sent before it, e.g. the popularity of a key.
+type Attributed struct {
+	Attrs map[interface{}]interface{}
+	Value interface{}
+}
+
+// the capacity of an aggregate allocated in advance, it grows as the elements are read,
+// so a huge length doesn't allocate before the elements arrive.
+const maxPreallocLen = 1024
+
+// a bulk string larger than bigBulkLen is allocated as it's read, so a huge length doesn't
+// allocate before the bytes arrive, like PROTO_MBULK_BIG_ARG of redis.
+const bigBulkLen = 32 * 1024
+
+// the max length of an inline command, and of the `*<n>` and `$<len>` lines of a command.
+const InlineMaxSize = 64 * 1024
+
+// ErrQueryBufferLimit is returned by ReadCommand if the command is larger than
+// Limits.MaxQueryBuf, the client is closed without a reply.
+var ErrQueryBufferLimit = errors.New("max query buffer length reached")
+
+// errLineTooLong is returned by readRawLine if the line is longer than the limit.
+var errLineTooLong = errors.New("line too long")
+
+// Limits are the limits of the commands read by ReadCommand and ReadSlice, 0 means the lengths
+// are at most math.MaxInt32, and the size of a command isn't limited.
+type Limits struct {
+	// the max length of an argument, see proto-max-bulk-len.
+	MaxBulkLen int64
+	// the max number of the arguments.
+	MaxMultiBulkLen int64
+	// the max size of a command, see client-query-buffer-limit.
+	MaxQueryBuf int64
+	// a client not authenticated can only send a small command, so it can't make
+	// the server allocate a lot of memory.
+	Unauthenticated bool
+}
+
+// the limits of a command of a client not authenticated, like redis.
+const (
+	unauthMultiBulkLen = 10
+	unauthBulkLen      = 16384
 )
 
 type Reader struct {
-	rd *bufio.Reader
+	rd     *bufio.Reader
+	limits Limits
+	// the raw bytes read are recorded if recording is true.
+	recording bool
+	raw       []byte
 }
 
 func NewReader(rd io.Reader) *Reader {
@@ -20,8 +93,51 @@ func NewReader(rd io.Reader) *Reader {
 	}
 }
 
+// Buffered returns the number of the bytes read from the connection but not parsed,
+// and Size returns the size of the buffer.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// Peek waits until a byte can be read without consuming it, it detects the connection
+// closed while the reader isn't reading.
+func (r *Reader) Peek() error {
+	_, err := r.rd.Peek(1)
+	return err
+}
+
+func (r *Reader) Size() int {
+	return r.rd.Size()
+}
+
+// SetLimits sets the limits of the commands read.
+func (r *Reader) SetLimits(l Limits) {
+	r.limits = l
+}
+
+// ReadReply reads a reply of any type of RESP2 and RESP3, the types are:
+//   - simple and bulk string: string, nil for the null bulk string;
+//   - integer: int64, big number: *big.Int, double: float64, boolean: bool;
+//   - null: nil;
+//   - error and blob error: RedisError, which is returned as the error at the top level,
+//     and as a value in an aggregate;
+//   - verbatim string: VerbatimString;
+//   - array and set: []interface{}, nil for the null array, push: Push;
+//   - map: map[interface{}]interface{};
+//   - a reply with attributes: *Attributed.
 func (r *Reader) ReadReply() (interface{}, error) {
-	line, err := r.readLine()
+	v, err := r.readValue()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := v.(RedisError); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+func (r *Reader) readValue() (interface{}, error) {
+	line, err := r.readLine(0)
 	if err != nil {
 		return nil, err
 	}
@@ -29,49 +145,106 @@ func (r *Reader) ReadReply() (interface{}, error) {
 	switch line[0] {
 	case RespStatus:
 		return string(line[1:]), nil
+	case RespError:
+		return RedisError(line[1:]), nil
 	case RespInt:
-		return strconv.ParseInt(string(line[1:]), 10, 64)
+		n, ok := parseInt(line[1:])
+		if !ok {
+			return nil, ProtocolError(fmt.Sprintf("can't parse int reply: %.100q", line))
+		}
+		return n, nil
+	case RespNil:
+		if len(line) != 1 {
+			return nil, ProtocolError(fmt.Sprintf("can't parse null reply: %.100q", line))
+		}
+		return nil, nil
 	case RespFloat:
 		return r.float(line)
 	case RespBool:
 		return r.bool(line)
-	case RespString:
-		return r.readStringContent(line)
-	case RespArray, RespSet, RespPush:
-		return r.readSlice(line)
+	case RespBigInt:
+		n, ok := new(big.Int).SetString(string(line[1:]), 10)
+		if !ok {
+			return nil, ProtocolError(fmt.Sprintf("can't parse big number reply: %.100q", line))
+		}
+		return n, nil
+	case RespString, RespBlobError, RespVerbatim:
+		b, err := r.readBulk(line)
+		if err != nil || b == nil {
+			return nil, err
+		}
+		switch line[0] {
+		case RespBlobError:
+			return RedisError(b), nil
+		case RespVerbatim:
+			if len(b) < 4 || b[3] != ':' {
+				return nil, ProtocolError(fmt.Sprintf("can't parse verbatim string reply: %.100q", b))
+			}
+			return VerbatimString{Format: string(b[:3]), Text: string(b[4:])}, nil
+		}
+		return string(b), nil
+	case RespArray, RespSet:
+		return r.readAggregate(line)
+	case RespPush:
+		v, err := r.readAggregate(line)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		return Push(v.([]interface{})), nil
 	case RespMap:
 		return r.readMap(line)
-		// case RespBigInt, RespVerbatim.
-	}
-	return nil, fmt.Errorf("redis: can't parse %.100q", line)
-}
-
-// readLine returns an error if:
-// - there is a pending read error;
-// - or line does not end with \r\n
-func (r *Reader) readLine() ([]byte, error) {
-	b, err := r.rd.ReadSlice('\n')
-	if err != nil {
-		if err != bufio.ErrBufferFull {
+	case RespAttr:
+		attrs, err := r.readMap(line)
+		if err != nil {
 			return nil, err
 		}
-
-		full := make([]byte, len(b))
-		copy(full, b)
-		b, err = r.rd.ReadBytes('\n')
+		v, err := r.readValue()
 		if err != nil {
 			return nil, err
 		}
+		return &Attributed{Attrs: attrs, Value: v}, nil
+	}
+	return nil, ProtocolError(fmt.Sprintf("can't parse %.100q", line))
+}
 
-		full = append(full, b...)
-		b = full
+// readLine reads a line ending with \r\n, and returns it without \r\n.
+// The line can't be longer than limit, 0 means no limit.
+func (r *Reader) readLine(limit int) ([]byte, error) {
+	b, err := r.readRawLine(limit)
+	if err != nil {
+		return nil, err
 	}
-	if len(b) <= 2 || b[len(b)-1] != '\n' || b[len(b)-2] != '\r' {
-		return nil, fmt.Errorf("redis: invalid reply: %q", b)
+	if len(b) <= 2 || b[len(b)-2] != '\r' {
+		return nil, ProtocolError(fmt.Sprintf("invalid line: %.100q", b))
 	}
 	return b[:len(b)-2], nil
 }
 
+// readRawLine reads a line ending with \n, the line is valid until the next read.
+// It returns errLineTooLong without reading the whole line if it's longer than limit.
+func (r *Reader) readRawLine(limit int) ([]byte, error) {
+	b, err := r.rd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		full := bytes.Clone(b)
+		for err == bufio.ErrBufferFull && (limit == 0 || len(full) <= limit) {
+			b, err = r.rd.ReadSlice('\n')
+			full = append(full, b...)
+		}
+		b = full
+	}
+	// the line is too long even if it's not complete, like redis checks the query buffer.
+	if limit > 0 && len(b) > limit {
+		return nil, errLineTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.recording {
+		r.raw = append(r.raw, b...)
+	}
+	return b, nil
+}
+
 func (r *Reader) float(line []byte) (float64, error) {
 	v := string(line[1:])
 	switch v {
@@ -82,7 +255,11 @@ func (r *Reader) float(line []byte) (float64, error) {
 	case "nan", "-nan":
 		return math.NaN(), nil
 	}
-	return strconv.ParseFloat(v, 64)
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, ProtocolError(fmt.Sprintf("can't parse double reply: %.100q", line))
+	}
+	return f, nil
 }
 
 func (r *Reader) bool(line []byte) (bool, error) {
@@ -92,141 +269,481 @@ func (r *Reader) bool(line []byte) (bool, error) {
 	case "f":
 		return false, nil
 	}
-	return false, fmt.Errorf("redis: can't parse bool reply: %q", line)
+	return false, ProtocolError(fmt.Sprintf("can't parse bool reply: %q", line))
 }
 
-func (r *Reader) readStringContent(line []byte) (string, error) {
-	n, err := parseLen(line)
-	if err != nil {
-		return "", err
+// readBulk reads the content of a bulk string, a blob error or a verbatim string,
+// it returns nil for the null bulk string `$-1`.
+func (r *Reader) readBulk(line []byte) ([]byte, error) {
+	n, ok := parseInt(line[1:])
+	// the length is bounded before it's allocated, a peer can't make the server panic.
+	if !ok || n < -1 || (n == -1 && line[0] != RespString) || n > r.maxBulkLen() {
+		return nil, ProtocolError(fmt.Sprintf("invalid bulk length: %.100q", line))
+	}
+	if n == -1 {
+		return nil, nil
 	}
+	return r.readBulkContent(int(n))
+}
 
-	b := make([]byte, n+2)
-	_, err = io.ReadFull(r.rd, b)
-	if err != nil {
-		return "", err
+// readBulkContent reads n bytes and \r\n, a big bulk string grows as it's read.
+func (r *Reader) readBulkContent(n int) ([]byte, error) {
+	b := make([]byte, min(n+2, bigBulkLen))
+	for read := 0; ; {
+		m, err := io.ReadFull(r.rd, b[read:])
+		read += m
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if read == n+2 {
+			break
+		}
+		grow := min(n+2-len(b), len(b))
+		b = slices.Grow(b, grow)[:len(b)+grow]
+	}
+	if r.recording {
+		r.raw = append(r.raw, b...)
 	}
-	return string(b[:n]), nil
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return nil, ProtocolError("bulk string not terminated by CRLF")
+	}
+	return b[:n:n], nil
 }
 
-func (r *Reader) readSlice(line []byte) ([]interface{}, error) {
-	n, err := parseLen(line)
-	if err != nil {
+// readAggregate reads the elements of an array, a set or a push message,
+// it returns nil for the null array `*-1`.
+func (r *Reader) readAggregate(line []byte) (interface{}, error) {
+	n, err := parseAggregateLen(line)
+	if err != nil || n == -1 {
 		return nil, err
 	}
-	val := make([]interface{}, n)
+	val := make([]interface{}, 0, min(n, maxPreallocLen))
 	for i := 0; i < n; i++ {
-		v, err := r.ReadReply()
+		v, err := r.readValue()
 		if err != nil {
 			return nil, err
 		}
-		val[i] = v
+		val = append(val, v)
 	}
 	return val, nil
 }
 
+// readMap reads the pairs of a map or the attributes.
 func (r *Reader) readMap(line []byte) (map[interface{}]interface{}, error) {
-	n, err := parseLen(line)
+	n, err := parseAggregateLen(line)
 	if err != nil {
 		return nil, err
 	}
-	m := make(map[interface{}]interface{}, n)
+	if n == -1 {
+		return nil, ProtocolError(fmt.Sprintf("invalid map length: %.100q", line))
+	}
+	m := make(map[interface{}]interface{}, min(n, maxPreallocLen))
 	for i := 0; i < n; i++ {
-		k, err := r.ReadReply()
+		k, err := r.readValue()
 		if err != nil {
 			return nil, err
 		}
-		v, err := r.ReadReply()
+		v, err := r.readValue()
 		if err != nil {
 			return nil, err
 		}
+		// an aggregate can't be the key of a Go map.
+		switch k.(type) {
+		case []interface{}, Push, map[interface{}]interface{}:
+			return nil, ProtocolError(fmt.Sprintf("unsupported map key type %T", k))
+		}
 		m[k] = v
 	}
 	return m, nil
 }
 
 func (r *Reader) ReadInt() (int64, error) {
-	line, err := r.readLine()
+	v, err := r.ReadReply()
 	if err != nil {
 		return 0, err
 	}
-	switch line[0] {
-	case RespInt, RespStatus:
-		return strconv.ParseInt(string(line[1:]), 10, 64)
-	case RespString:
-		s, err := r.readStringContent(line)
-		if err != nil {
-			return 0, err
-		}
-		return strconv.ParseInt(s, 10, 64)
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
 	}
-	return 0, fmt.Errorf("redis: can't parse int reply: %.100q", line)
+	return 0, fmt.Errorf("redis: can't parse int reply: %.100v", v)
 }
 
 func (r *Reader) ReadString() (string, error) {
-	line, err := r.readLine()
+	v, err := r.ReadReply()
 	if err != nil {
 		return "", err
 	}
-	switch line[0] {
-	case RespStatus, RespInt, RespFloat:
-		return string(line[1:]), nil
-	case RespString:
-		return r.readStringContent(line)
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case VerbatimString:
+		return v.Text, nil
 	}
-	return "", fmt.Errorf("redis: can't parse reply=%.100q reading string", line)
+	return "", fmt.Errorf("redis: can't parse reply=%.100v reading string", v)
 }
 
 func (r *Reader) ReadRdb() ([]byte, error) {
-	line, err := r.readLine()
+	rd, err := r.RdbReader()
 	if err != nil {
 		return nil, err
 	}
-	if line[0] != RespString {
-		return nil, ErrInvalidCommand
-	}
-	n, err := parseLen(line)
+	return io.ReadAll(rd)
+}
+
+// RdbReader returns a reader of the rdb file sent in a full resynchronization, which is
+// `$<len>\r\n<rdb>`, or `$EOF:<mark>\r\n<rdb><mark>` if the master doesn't know the length
+// in advance, e.g. in a diskless sync. The reader returns io.EOF at the end of the rdb file.
+func (r *Reader) RdbReader() (io.Reader, error) {
+	line, err := r.readLine(0)
 	if err != nil {
 		return nil, err
 	}
+	if line[0] != RespString {
+		return nil, ProtocolError(fmt.Sprintf("expected '$', got '%c'", line[0]))
+	}
+	if mark, ok := bytes.CutPrefix(line[1:], []byte(RdbEOFPrefix)); ok {
+		if len(mark) != RdbEOFMarkLen {
+			return nil, ProtocolError(fmt.Sprintf("invalid rdb eof mark: %q", line))
+		}
+		return &eofMarkReader{rd: r.rd, mark: bytes.Clone(mark)}, nil
+	}
+	n, ok := parseInt(line[1:])
+	if !ok || n < 0 {
+		return nil, ProtocolError(fmt.Sprintf("invalid rdb length: %.100q", line))
+	}
+	return io.LimitReader(r.rd, n), nil
+}
 
-	b := make([]byte, n)
-	if _, err = io.ReadFull(r.rd, b); err != nil {
-		return nil, err
+// eofMarkReader reads until the mark, the mark is consumed but not returned.
+type eofMarkReader struct {
+	rd   *bufio.Reader
+	mark []byte
+	// the bytes read which may be the beginning of the mark.
+	tail []byte
+	// the bytes before tail, ready to return.
+	out  []byte
+	done bool
+}
+
+func (r *eofMarkReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
 	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
 
-	return b, nil
+// fill reads the buffered bytes, but doesn't read past the mark.
+func (r *eofMarkReader) fill() error {
+	if _, err := r.rd.Peek(1); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	chunk, _ := r.rd.Peek(r.rd.Buffered())
+	data := append(r.tail, chunk...)
+	if i := bytes.Index(data, r.mark); i >= 0 {
+		r.out = data[:i]
+		r.tail = nil
+		r.done = true
+		r.rd.Discard(i + len(r.mark) - (len(data) - len(chunk)))
+		return nil
+	}
+	keep := min(len(r.mark)-1, len(data))
+	r.out = data[:len(data)-keep]
+	r.tail = bytes.Clone(data[len(data)-keep:])
+	r.rd.Discard(len(chunk))
+	return nil
 }
 
+// ReadSlice reads a command in the multibulk format `*<n>\r\n$<len>\r\n<arg>\r\n...`,
+// e.g. from the aof file or the master.
 func (r *Reader) ReadSlice() ([][]byte, error) {
-	line, err := r.readLine()
+	line, err := r.readCommandLine("too big mbulk count string")
 	if err != nil {
 		return nil, err
 	}
-	slice, err := r.readSlice(line)
+	if line[0] != RespArray {
+		return nil, ProtocolError(fmt.Sprintf("expected '*', got '%c'", line[0]))
+	}
+	args, err := r.readMultiBulk(line)
 	if err != nil {
 		return nil, err
 	}
-	res := make([][]byte, len(slice))
-	for i := 0; i < len(slice); i++ {
-		res[i] = slice[i].([]byte)
+	if len(args) == 0 {
+		return nil, ProtocolError("invalid multibulk length")
 	}
-	return res, nil
+	return args, nil
 }
 
-func parseLen(line []byte) (n int, err error) {
-	n, err = util.Atoi(line[1:])
-	if err != nil {
-		return 0, err
+// ReadSliceRaw reads a command like ReadSlice, and also returns the raw bytes of it,
+// e.g. a replica forwards the exact replication stream to its replicas.
+func (r *Reader) ReadSliceRaw() ([][]byte, []byte, error) {
+	r.recording, r.raw = true, nil
+	defer func() { r.recording = false }()
+	args, err := r.ReadSlice()
+	return args, r.raw, err
+}
+
+// ReadCommand reads a command of a client, in the multibulk format, or the inline format
+// `arg arg ...\r\n` typed via telnet, like processInlineBuffer of redis. The empty commands
+// are skipped. A malformed command, or a command exceeding the limits, returns a ProtocolError,
+// and a command larger than the query buffer limit returns ErrQueryBufferLimit.
+func (r *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		b, err := r.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		var args [][]byte
+		if b[0] == RespArray {
+			line, err := r.readCommandLine("too big mbulk count string")
+			if err != nil {
+				return nil, err
+			}
+			args, err = r.readMultiBulk(line)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			line, err := r.readRawLine(InlineMaxSize)
+			if err == errLineTooLong {
+				return nil, ProtocolError("too big inline request")
+			}
+			if err != nil {
+				return nil, err
+			}
+			// \r is optional, e.g. netcat sends \n.
+			line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+			var ok bool
+			if args, ok = splitInlineArgs(line); !ok {
+				return nil, ProtocolError("unbalanced quotes in request")
+			}
+		}
+		if len(args) > 0 {
+			return args, nil
+		}
 	}
-	if n < -1 {
-		return 0, fmt.Errorf("redis: invalid reply: %q", line)
+}
+
+// maxMultiBulkLen and maxBulkLen return the limits of a command, they're math.MaxInt32 if
+// there's no limit.
+func (r *Reader) maxMultiBulkLen() int64 {
+	if r.limits.MaxMultiBulkLen > 0 {
+		return r.limits.MaxMultiBulkLen
 	}
-	switch line[0] {
-	case RespString, RespVerbatim, RespArray, RespSet, RespPush, RespMap, RespAttr:
-		if n == -1 {
-			return 0, nil
+	return math.MaxInt32
+}
+
+func (r *Reader) maxBulkLen() int64 {
+	if r.limits.MaxBulkLen > 0 {
+		return r.limits.MaxBulkLen
+	}
+	return math.MaxInt32
+}
+
+// readCommandLine reads a `*<n>` or `$<len>` line of a command, it returns ProtocolError(msg)
+// if the line is longer than InlineMaxSize.
+func (r *Reader) readCommandLine(msg string) ([]byte, error) {
+	line, err := r.readLine(InlineMaxSize)
+	if err == errLineTooLong {
+		return nil, ProtocolError(msg)
+	}
+	return line, err
+}
+
+// readMultiBulk reads the arguments of a command after the `*<n>` line, the arguments
+// must be bulk strings.
+func (r *Reader) readMultiBulk(line []byte) ([][]byte, error) {
+	n, ok := parseInt(line[1:])
+	if !ok || n > r.maxMultiBulkLen() {
+		return nil, ProtocolError("invalid multibulk length")
+	}
+	if r.limits.Unauthenticated && n > unauthMultiBulkLen {
+		return nil, ProtocolError("unauthenticated multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	// the size of the command read, including the \r\n.
+	size := int64(len(line) + 2)
+	args := make([][]byte, 0, min(int(n), maxPreallocLen))
+	for i := 0; i < int(n); i++ {
+		line, err := r.readCommandLine("too big bulk count string")
+		if err != nil {
+			return nil, err
+		}
+		if line[0] != RespString {
+			return nil, ProtocolError(fmt.Sprintf("expected '$', got '%c'", line[0]))
+		}
+		l, ok := parseInt(line[1:])
+		if !ok || l < 0 || l > r.maxBulkLen() {
+			return nil, ProtocolError("invalid bulk length")
+		}
+		if r.limits.Unauthenticated && l > unauthBulkLen {
+			return nil, ProtocolError("unauthenticated bulk length")
+		}
+		size += int64(len(line)+2) + l + 2
+		if r.limits.MaxQueryBuf > 0 && size > r.limits.MaxQueryBuf {
+			return nil, ErrQueryBufferLimit
 		}
+		arg, err := r.readBulkContent(int(l))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
 	}
-	return n, nil
+	return args, nil
+}
+
+// splitInlineArgs splits an inline command like sdssplitargs of redis, the arguments are
+// separated by spaces, and may be quoted: "..." supports the escapes \n, \r, \t, \b, \a
+// and \xHH, '...' supports \'. It returns false if the quotes are unbalanced.
+func splitInlineArgs(line []byte) ([][]byte, bool) {
+	args := [][]byte{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, true
+		}
+		arg := []byte{}
+		inq, insq := false, false
+		for done := false; !done; {
+			switch {
+			case inq:
+				if i == len(line) {
+					return nil, false
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]):
+					arg = append(arg, unhex(line[i+2])<<4|unhex(line[i+3]))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					switch c = line[i]; c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					}
+					arg = append(arg, c)
+				case c == '"':
+					// the closing quote must be followed by a space or nothing.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case insq:
+				if i == len(line) {
+					return nil, false
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					arg = append(arg, '\'')
+					i++
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					continue
+				}
+				switch c := line[i]; c {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// parseInt parses a strict base 10 integer like string2ll of redis, no spaces, no `+`
+// and no leading zeros.
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 20 || (b[0] == '0' && len(b) > 1) {
+		return 0, false
+	}
+	if b[0] == '-' && (len(b) == 1 || b[1] == '0') {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	return n, err == nil && b[0] != '+'
+}
+
+// parseAggregateLen parses the length of an aggregate, -1 is the null array in RESP2.
+func parseAggregateLen(line []byte) (int, error) {
+	n, ok := parseInt(line[1:])
+	if !ok || n < -1 || n > math.MaxInt32 {
+		return 0, ProtocolError(fmt.Sprintf("invalid aggregate length: %.100q", line))
+	}
+	return int(n), nil
 }
@@ -0,0 +1,49 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the seeds are in testdata/fuzz, run with `go test -fuzz FuzzReadReply ./proto`.
+
+func FuzzReadReply(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nget\r\n$1\r\nk\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer func() {
+			if v := recover(); v != nil {
+				t.Fatalf("ReadReply(%q) panics: %v", data, v)
+			}
+		}()
+		r := NewReader(bytes.NewReader(data))
+		// read until the input is consumed or malformed.
+		for i := 0; i <= len(data); i++ {
+			if _, err := r.ReadReply(); err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return
+				}
+			}
+		}
+	})
+}
+
+func FuzzReadCommand(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nget\r\n$1\r\nk\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer func() {
+			if v := recover(); v != nil {
+				t.Fatalf("ReadCommand(%q) panics: %v", data, v)
+			}
+		}()
+		r := NewReader(bytes.NewReader(data))
+		for i := 0; i <= len(data); i++ {
+			args, err := r.ReadCommand()
+			if err != nil {
+				return
+			}
+			if len(args) == 0 {
+				t.Fatalf("ReadCommand(%q) returns an empty command", data)
+			}
+		}
+	})
+}
@@ -0,0 +1,317 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{":-42\r\n", int64(-42)},
+		{"$5\r\nhello\r\n", "hello"},
+		{"$0\r\n\r\n", ""},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+		{"_\r\n", nil},
+		{",1.5\r\n", 1.5},
+		{",inf\r\n", math.Inf(1)},
+		{",-inf\r\n", math.Inf(-1)},
+		{"#t\r\n", true},
+		{"#f\r\n", false},
+		{"=8\r\ntxt:some\r\n", VerbatimString{Format: "txt", Text: "some"}},
+		{"*2\r\n:1\r\n$1\r\na\r\n", []interface{}{int64(1), "a"}},
+		{"*0\r\n", []interface{}{}},
+		{"~2\r\n+a\r\n+b\r\n", []interface{}{"a", "b"}},
+		{">2\r\n+invalidate\r\n*1\r\n$1\r\nk\r\n", Push{"invalidate", []interface{}{"k"}}},
+		{"%2\r\n+a\r\n:1\r\n:2\r\n#t\r\n", map[interface{}]interface{}{"a": int64(1), int64(2): true}},
+		// the errors nested in an aggregate are values.
+		{"*2\r\n-ERR x\r\n!3\r\nERR\r\n", []interface{}{RedisError("ERR x"), RedisError("ERR")}},
+		{"|1\r\n+ttl\r\n:3600\r\n$1\r\nv\r\n", &Attributed{Attrs: map[interface{}]interface{}{"ttl": int64(3600)}, Value: "v"}},
+		// a bulk string larger than bigBulkLen grows as it's read.
+		{"$100000\r\n" + strings.Repeat("x", 100000) + "\r\n", strings.Repeat("x", 100000)},
+	}
+	for _, tt := range tests {
+		got, err := NewReader(strings.NewReader(tt.in)).ReadReply()
+		if err != nil {
+			t.Errorf("ReadReply(%.50q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadReply(%.50q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadReplyTypes(t *testing.T) {
+	v, err := NewReader(strings.NewReader("(3492890328409238509324850943850943825024385\r\n")).ReadReply()
+	if n, ok := v.(*big.Int); err != nil || !ok || n.String() != "3492890328409238509324850943850943825024385" {
+		t.Errorf("big number = %#v, %v", v, err)
+	}
+	v, err = NewReader(strings.NewReader(",nan\r\n")).ReadReply()
+	if f, ok := v.(float64); err != nil || !ok || !math.IsNaN(f) {
+		t.Errorf("nan = %#v, %v", v, err)
+	}
+	// a top level error is returned as the error.
+	for _, in := range []string{"-ERR unknown\r\n", "!11\r\nERR unknown\r\n"} {
+		v, err := NewReader(strings.NewReader(in)).ReadReply()
+		if v != nil || err != RedisError("ERR unknown") {
+			t.Errorf("ReadReply(%q) = %#v, %v", in, v, err)
+		}
+	}
+}
+
+func TestReadReplyMalformed(t *testing.T) {
+	tests := []string{
+		"",
+		"+OK",
+		"+OK\n",
+		":abc\r\n",
+		":01\r\n",
+		"$-2\r\n",
+		"$3\r\nab\r\n",
+		"$2\r\nabcd\r\n",
+		"!-1\r\n",
+		// the lengths are bounded before allocating, n+2 overflows for MaxInt64.
+		"$2147483648\r\n",
+		"$9223372036854775807\r\n",
+		"!9223372036854775807\r\n",
+		"=9223372036854775807\r\n",
+		"=3\r\ntxt\r\n",
+		"#x\r\n",
+		"_x\r\n",
+		"(12a\r\n",
+		"*2\r\n:1\r\n",
+		"%-1\r\n",
+		"%1\r\n*1\r\n:1\r\n:1\r\n",
+		"?\r\n",
+	}
+	for _, in := range tests {
+		if v, err := NewReader(strings.NewReader(in)).ReadReply(); err == nil {
+			t.Errorf("ReadReply(%q) = %#v, want an error", in, v)
+		}
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"*2\r\n$3\r\nget\r\n$1\r\nk\r\n", []string{"get", "k"}},
+		{"*1\r\n$0\r\n\r\n", []string{""}},
+		{"PING\r\n", []string{"PING"}},
+		{"PING\n", []string{"PING"}},
+		{"  set  k   v \r\n", []string{"set", "k", "v"}},
+		{`set "a b" "x\ty\x41\"\\"` + "\r\n", []string{"set", "a b", "x\tyA\"\\"}},
+		{`set 'it\'s' '\n'` + "\r\n", []string{"set", "it's", `\n`}},
+		{`set "" ''` + "\r\n", []string{"set", "", ""}},
+		// the empty commands are skipped.
+		{"\r\n\n*0\r\n*-1\r\nPING\r\n", []string{"PING"}},
+	}
+	for _, tt := range tests {
+		args, err := NewReader(strings.NewReader(tt.in)).ReadCommand()
+		if err != nil {
+			t.Errorf("ReadCommand(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got := toStrings(args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadCommand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadCommandPipeline(t *testing.T) {
+	r := NewReader(strings.NewReader("PING\r\n*2\r\n$4\r\necho\r\n$2\r\nhi\r\nget k\n"))
+	want := [][]string{{"PING"}, {"echo", "hi"}, {"get", "k"}}
+	for _, w := range want {
+		args, err := r.ReadCommand()
+		if err != nil || !reflect.DeepEqual(toStrings(args), w) {
+			t.Fatalf("ReadCommand() = %q, %v, want %q", args, err, w)
+		}
+	}
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("ReadCommand() at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadCommandProtocolError(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`set "a b` + "\r\n", "unbalanced quotes in request"},
+		{`set "a"b` + "\r\n", "unbalanced quotes in request"},
+		{`set 'a` + "\r\n", "unbalanced quotes in request"},
+		{"*x\r\n", "invalid multibulk length"},
+		{"*1\r\n:1\r\n", "expected '$', got ':'"},
+		{"*1\r\n$-1\r\n", "invalid bulk length"},
+		{"*1\r\n$x\r\n", "invalid bulk length"},
+		{"*1\r\n$1\r\nabc\r\n", "bulk string not terminated by CRLF"},
+	}
+	for _, tt := range tests {
+		_, err := NewReader(strings.NewReader(tt.in)).ReadCommand()
+		if err != ProtocolError(tt.want) {
+			t.Errorf("ReadCommand(%q) error = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestReadSlice(t *testing.T) {
+	args, err := NewReader(strings.NewReader("*2\r\n$3\r\nget\r\n$1\r\nk\r\n")).ReadSlice()
+	if err != nil || !reflect.DeepEqual(toStrings(args), []string{"get", "k"}) {
+		t.Errorf("ReadSlice() = %q, %v", args, err)
+	}
+	// ReadSlice doesn't accept the inline commands and the empty commands.
+	for _, in := range []string{"get k\r\n", "*0\r\n"} {
+		var perr ProtocolError
+		if _, err := NewReader(strings.NewReader(in)).ReadSlice(); !errors.As(err, &perr) {
+			t.Errorf("ReadSlice(%q) error = %v, want a protocol error", in, err)
+		}
+	}
+}
+
+func TestReadSliceRaw(t *testing.T) {
+	in := "*2\r\n$3\r\nget\r\n$1\r\nk\r\n"
+	r := NewReader(strings.NewReader(in + in))
+	for i := 0; i < 2; i++ {
+		args, raw, err := r.ReadSliceRaw()
+		if err != nil || len(args) != 2 || string(raw) != in {
+			t.Fatalf("ReadSliceRaw() = %q, %q, %v", args, raw, err)
+		}
+	}
+}
+
+func TestSplitInlineArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{"", []string{}, true},
+		{"   ", []string{}, true},
+		{"a b\tc", []string{"a", "b", "c"}, true},
+		{`"\x4a\x4B" "\xZZ"`, []string{"JK", "xZZ"}, true},
+		{`"\n\r\t\b\a"`, []string{"\n\r\t\b\a"}, true},
+		{`'a\nb'`, []string{`a\nb`}, true},
+		{`"a`, nil, false},
+		{`'a"`, nil, false},
+		{`"a"b`, nil, false},
+		{`'a'b`, nil, false},
+	}
+	for _, tt := range tests {
+		args, ok := splitInlineArgs([]byte(tt.in))
+		if ok != tt.ok || (ok && !reflect.DeepEqual(toStrings(args), tt.want)) {
+			t.Errorf("splitInlineArgs(%q) = %q, %v, want %q, %v", tt.in, args, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"-1", -1, true},
+		{"9223372036854775807", math.MaxInt64, true},
+		{"9223372036854775808", 0, false},
+		{"", 0, false},
+		{"-", 0, false},
+		{"-0", 0, false},
+		{"01", 0, false},
+		{"+1", 0, false},
+		{" 1", 0, false},
+	}
+	for _, tt := range tests {
+		if n, ok := parseInt([]byte(tt.in)); ok != tt.ok || (ok && n != tt.want) {
+			t.Errorf("parseInt(%q) = %d, %v, want %d, %v", tt.in, n, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	limits := Limits{MaxBulkLen: 10, MaxMultiBulkLen: 3, MaxQueryBuf: 40}
+	tests := []struct {
+		in     string
+		limits Limits
+		want   error
+	}{
+		{"*4\r\n", limits, ProtocolError("invalid multibulk length")},
+		{"*2147483648\r\n", Limits{}, ProtocolError("invalid multibulk length")},
+		{"*1\r\n$11\r\n", limits, ProtocolError("invalid bulk length")},
+		{"*1\r\n$2147483648\r\n", Limits{}, ProtocolError("invalid bulk length")},
+		// the lengths greater than math.MaxInt32 are allowed by the limits.
+		{"*2147483648\r\n", Limits{MaxMultiBulkLen: 1 << 32}, io.EOF},
+		{"*1\r\n$4294967296\r\nabc", Limits{MaxBulkLen: 1 << 33}, io.ErrUnexpectedEOF},
+		{"*3\r\n$10\r\n0123456789\r\n$10\r\n0123456789\r\n$1\r\na\r\n", limits, ErrQueryBufferLimit},
+		{"*11\r\n", Limits{Unauthenticated: true}, ProtocolError("unauthenticated multibulk length")},
+		{"*1\r\n$16385\r\n", Limits{Unauthenticated: true}, ProtocolError("unauthenticated bulk length")},
+		{strings.Repeat("a", InlineMaxSize+1), Limits{}, ProtocolError("too big inline request")},
+		{"*" + strings.Repeat("1", InlineMaxSize+1), Limits{}, ProtocolError("too big mbulk count string")},
+		{"*1\r\n$" + strings.Repeat("1", InlineMaxSize+1), Limits{}, ProtocolError("too big bulk count string")},
+	}
+	for _, tt := range tests {
+		r := NewReader(strings.NewReader(tt.in))
+		r.SetLimits(tt.limits)
+		if _, err := r.ReadCommand(); err != tt.want {
+			t.Errorf("ReadCommand(%.50q) with %+v error = %v, want %v", tt.in, tt.limits, err, tt.want)
+		}
+	}
+
+	// the commands within the limits are read.
+	r := NewReader(strings.NewReader("*3\r\n$10\r\n0123456789\r\n$1\r\na\r\n$1\r\nb\r\n"))
+	r.SetLimits(limits)
+	if args, err := r.ReadCommand(); err != nil || len(args) != 3 {
+		t.Errorf("ReadCommand() within the limits = %q, %v", args, err)
+	}
+}
+
+func TestReadBulkContent(t *testing.T) {
+	for _, n := range []int{0, 1, bigBulkLen - 2, bigBulkLen - 1, bigBulkLen, bigBulkLen + 1, 5*bigBulkLen + 3} {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		b, err := NewReader(bytes.NewReader(append(data, '\r', '\n'))).readBulkContent(n)
+		if err != nil || !bytes.Equal(b, data) {
+			t.Errorf("readBulkContent(%d) = %d bytes, %v", n, len(b), err)
+		}
+	}
+	if _, err := NewReader(strings.NewReader("abcxx")).readBulkContent(3); err != ProtocolError("bulk string not terminated by CRLF") {
+		t.Errorf("readBulkContent() without CRLF error = %v", err)
+	}
+}
+
+func TestReadBulkContentGrows(t *testing.T) {
+	// a huge length allocates as the bytes arrive, not in advance.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := NewReader(strings.NewReader(strings.Repeat("x", 100))).readBulkContent(1 << 30)
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("readBulkContent() error = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("readBulkContent() allocates %d bytes for 100 bytes read", n)
+	}
+}
+
+func toStrings(args [][]byte) []string {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		s[i] = string(arg)
+	}
+	return s
+}
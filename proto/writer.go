@@ -7,14 +7,22 @@ import (
 
 type Writer struct {
 	w bufio.Writer
+	// the version of the protocol of the replies, see HELLO.
+	resp int
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		w: *bufio.NewWriter(w),
+		w:    *bufio.NewWriter(w),
+		resp: Resp2,
 	}
 }
 
+// SetProtocol sets the version of the protocol, the RESP3 types are written as RESP2 types in RESP2.
+func (w *Writer) SetProtocol(resp int) {
+	w.resp = resp
+}
+
 func (w *Writer) WriteStatus(b string) error {
 	_, err := w.w.Write(Status(b))
 	return err
@@ -26,7 +34,22 @@ func (w *Writer) WriteError(e string) error {
 }
 
 func (w *Writer) WriteNilBulkString() error {
-	_, err := w.w.Write(NilString())
+	_, err := w.w.Write(NullBulk(w.resp))
+	return err
+}
+
+func (w *Writer) WriteNilArray() error {
+	_, err := w.w.Write(NullArray(w.resp))
+	return err
+}
+
+func (w *Writer) WriteMapHeader(l int) error {
+	_, err := w.w.Write(MapHeader(l, w.resp))
+	return err
+}
+
+func (w *Writer) WriteVerbatim(format string, s string) error {
+	_, err := w.w.Write(Verbatim(format, s, w.resp))
 	return err
 }
 
@@ -64,6 +87,11 @@ func (w *Writer) WriteRawBytes(b []byte) error {
 	return err
 }
 
+// Buffered returns the number of the bytes written but not flushed.
+func (w *Writer) Buffered() int {
+	return w.w.Buffered()
+}
+
 func (w *Writer) Flush() error {
 	return w.w.Flush()
 }
@@ -0,0 +1,62 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/fukua95/gedis/util"
+)
+
+var ErrBadPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// Dump serializes the value of the entry like DUMP, the key and the expiration are not included:
+// <type> <value> <rdb version, 2 bytes> <crc64 of the bytes before, 8 bytes>, little endian.
+func Dump(e Entry) []byte {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if e.Stream != nil {
+		w.writeByte(GedisStream4)
+		w.writeStreamValue(e.Stream)
+	} else {
+		w.writeByte(String)
+		w.writeString(e.V)
+	}
+	version := make([]byte, 2)
+	binary.LittleEndian.PutUint16(version, Version)
+	w.write(version)
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, w.crc)
+	w.w.Write(crc)
+	w.w.Flush()
+	return buf.Bytes()
+}
+
+// Restore deserializes the payload of DUMP, it checks the version and the checksum first.
+func Restore(payload []byte) (Entry, error) {
+	if len(payload) < 10 {
+		return Entry{}, ErrBadPayload
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > Version {
+		return Entry{}, ErrBadPayload
+	}
+	if util.Crc64(0, payload[:len(payload)-8]) != binary.LittleEndian.Uint64(footer[2:]) {
+		return Entry{}, ErrBadPayload
+	}
+
+	r := NewRdb(bytes.NewReader(payload[:len(payload)-10]))
+	t, err := r.readByte()
+	if err != nil {
+		return Entry{}, err
+	}
+	e, err := r.readValue(t, "")
+	if err != nil {
+		return Entry{}, err
+	}
+	// the value must be followed by the footer only.
+	if _, err := r.readByte(); err == nil {
+		return Entry{}, errors.New("trailing data after the value")
+	}
+	return e, nil
+}
@@ -1,14 +1,16 @@
 package rdb
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
+	"strconv"
 
+	"github.com/fukua95/gedis/storage"
 	"github.com/fukua95/gedis/util"
 )
 
@@ -25,6 +27,11 @@ func EmptyRdb() []byte {
 	return rdb
 }
 
+const (
+	Magic   = "REDIS"
+	Version = 11
+)
+
 const (
 	EOF          uint8 = 0xFF
 	SELECTDB     uint8 = 0xFE
@@ -46,40 +53,65 @@ const (
 	SortedSetInZiplist uint8 = 12
 	HashmapInZiplist   uint8 = 13
 	ListInQuicklist    uint8 = 14
+
+	// gedis doesn't encode streams as listpacks like redis,
+	// so it uses a type redis doesn't know, see writeStream.
+	GedisStream uint8 = 0xE0
+	// the stream with the last ID and the consumer groups.
+	GedisStream2 uint8 = 0xE1
+	// the stream with the max deleted ID and the entries added counter too.
+	GedisStream3 uint8 = 0xE2
+	// the stream with the entries read counter of the consumer groups too.
+	GedisStream4 uint8 = 0xE3
+)
+
+// length encoding, the two most significant bits of the first byte.
+const (
+	len6Bit  uint8 = 0
+	len14Bit uint8 = 1
+	len32Bit uint8 = 0x80
+	len64Bit uint8 = 0x81
+	encVal   uint8 = 3
+)
+
+// special string encodings, when the two most significant bits are `encVal`.
+const (
+	encInt8  uint8 = 0
+	encInt16 uint8 = 1
+	encInt32 uint8 = 2
+	encLzf   uint8 = 3
 )
 
-var ErrDBEOF = errors.New("DB EOF")
+var (
+	ErrDBEOF       = errors.New("DB EOF")
+	ErrBadChecksum = errors.New("rdb checksum mismatch")
+)
 
+// Entry is a key-value pair in the rdb file.
+// V holds the value of a string, Stream holds the value of a stream.
 type Entry struct {
-	K  string
-	V  string
-	Ex int64
+	K      string
+	V      string
+	Stream *storage.Stream
+	Ex     int64
 }
 
 type Rdb struct {
-	f *os.File
+	r *bufio.Reader
+	// checksum of the bytes read so far.
+	crc uint64
 }
 
-func NewRdb(f *os.File) *Rdb {
-	return &Rdb{f: f}
+func NewRdb(r io.Reader) *Rdb {
+	return &Rdb{r: bufio.NewReader(r)}
 }
 
 func (r *Rdb) readBytes(n int) ([]byte, error) {
 	b := make([]byte, n)
-	l, err := r.f.Read(b)
-	if err == io.EOF {
-		fmt.Println("read rdb EOF")
-		return nil, err
-	}
-	if err != nil {
-		fmt.Println("read rdb error: ", err.Error())
+	if _, err := io.ReadFull(r.r, b); err != nil {
 		return nil, err
 	}
-	fmt.Printf("read %v str=%q, bytes=%v\n", l, string(b), b)
-	if l != n {
-		fmt.Printf("read byte size error, wanted=%v, has=%v\n", n, l)
-		return nil, errors.New("read size error")
-	}
+	r.crc = util.Crc64(r.crc, b)
 	return b, nil
 }
 
@@ -91,68 +123,93 @@ func (r *Rdb) readByte() (byte, error) {
 	return b[0], nil
 }
 
+func (r *Rdb) peekByte() (byte, error) {
+	b, err := r.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
 func (r *Rdb) readHeader() (string, int, error) {
 	b, err := r.readBytes(9)
 	if err != nil {
 		return "", 0, err
 	}
+	if string(b[0:5]) != Magic {
+		return "", 0, fmt.Errorf("wrong signature trying to load rdb: %q", b[0:5])
+	}
 	version, _ := util.Atoi(b[5:9])
 	return string(b[0:5]), version, nil
 }
 
+// Load reads the rdb file and calls fn for every key-value pair.
 // rdb file format: https://rdb.fnordig.de/file_format.html
-func (r *Rdb) Read(kvCh chan<- Entry) {
-	defer func() {
-		close(kvCh)
-	}()
-
+func (r *Rdb) Load(fn func(Entry) error) error {
 	magic, version, err := r.readHeader()
 	if err != nil {
-		return
+		return err
 	}
 	fmt.Printf("rdb magic number=%s, version=%v\n", magic, version)
 
 	for {
 		b, err := r.readByte()
 		if err != nil {
-			return
+			return err
 		}
 		switch b {
 		case AUX:
 			for i := 0; i < 2; i++ {
 				if _, err := r.readString(); err != nil {
-					return
+					return err
 				}
 			}
 		case SELECTDB:
-			if err := r.readData(kvCh); err != nil {
-				return
+			if err := r.readData(fn); err != nil {
+				return err
 			}
 		case EOF:
-			return
+			return r.readChecksum()
 		default:
-			panic(fmt.Sprintf("read impossible byte=%v", b))
+			return fmt.Errorf("read impossible byte=%v", b)
 		}
 	}
 }
 
-func (r *Rdb) readData(kvCh chan<- Entry) error {
-	dbNum, err := r.readLen()
+// readChecksum checks the 8 bytes checksum at the end of the file,
+// a zero checksum means the checksum is disabled.
+func (r *Rdb) readChecksum() error {
+	expected := r.crc
+	b, err := r.readBytes(8)
+	if err == io.EOF {
+		// rdb version < 5 doesn't have a checksum.
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	b, err := r.readByte()
+	crc := binary.LittleEndian.Uint64(b)
+	if crc != 0 && crc != expected {
+		return ErrBadChecksum
+	}
+	return nil
+}
+
+func (r *Rdb) readData(fn func(Entry) error) error {
+	dbNum, err := r.readLen()
 	if err != nil {
 		return err
 	}
-
-	if b != RESIZEDB {
-		panic("missing FB op codes")
+	b, err := r.peekByte()
+	if err != nil {
+		return err
 	}
-	for i := 0; i < 2; i++ {
-		_, err = r.readLen()
-		if err != nil {
-			return err
+	if b == RESIZEDB {
+		r.readByte()
+		for i := 0; i < 2; i++ {
+			if _, err = r.readLen(); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -165,83 +222,292 @@ func (r *Rdb) readData(kvCh chan<- Entry) error {
 		if err != nil {
 			return err
 		}
-		kvCh <- entry
+		if err := fn(entry); err != nil {
+			return err
+		}
 	}
 }
 
 func (r *Rdb) readEntry() (Entry, error) {
-	t, err := r.readByte()
+	t, err := r.peekByte()
 	if err != nil {
-		return Entry{}, nil
+		return Entry{}, err
+	}
+	if t == EOF || t == SELECTDB {
+		return Entry{}, ErrDBEOF
 	}
+	r.readByte()
 
 	switch t {
-	case EOF, SELECTDB:
-		r.f.Seek(-1, 1)
-		return Entry{}, ErrDBEOF
 	case EXPIRETIME:
 		ex, err := r.readBytes(4)
 		if err != nil {
 			return Entry{}, err
 		}
-		e, _ := r.readEntry()
-		e.Ex = int64(binary.LittleEndian.Uint32(ex))
-		return e, nil
+		e, err := r.readEntry()
+		e.Ex = int64(binary.LittleEndian.Uint32(ex)) * 1000
+		return e, err
 	case EXPIRETIMEMS:
 		ex, err := r.readBytes(8)
 		if err != nil {
 			return Entry{}, err
 		}
-		e, _ := r.readEntry()
+		e, err := r.readEntry()
 		e.Ex = int64(binary.LittleEndian.Uint64(ex))
-		return e, nil
+		return e, err
+	}
+
+	k, err := r.readString()
+	if err != nil {
+		return Entry{}, err
+	}
+	return r.readValue(t, k)
+}
+
+// readValue reads the value of key k, which is encoded as type t.
+func (r *Rdb) readValue(t uint8, k string) (Entry, error) {
+	switch t {
 	case String:
-		k, err := r.readString()
+		v, err := r.readString()
 		if err != nil {
 			return Entry{}, err
 		}
-		v, err := r.readString()
+		return Entry{K: k, V: v}, nil
+	case GedisStream, GedisStream2, GedisStream3, GedisStream4:
+		stream, err := r.readStream(t)
 		if err != nil {
 			return Entry{}, err
 		}
-		e := Entry{K: k, V: v, Ex: 0}
-		return e, nil
+		return Entry{K: k, Stream: stream}, nil
 	}
 	// ignore value types: set, map, &c.
-	panic("rdb file has other value type")
+	return Entry{}, fmt.Errorf("rdb file has unsupported value type %v", t)
+}
+
+func (r *Rdb) readStream(t uint8) (*storage.Stream, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	stream := storage.NewStream()
+	for i := 0; i < n; i++ {
+		ms, err := r.readUint64()
+		if err != nil {
+			return nil, err
+		}
+		seq, err := r.readUint64()
+		if err != nil {
+			return nil, err
+		}
+		kvLen, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		e := &storage.Entry{ID: storage.NewID(int64(ms), int64(seq)), KVs: make([]storage.KV, kvLen)}
+		for j := 0; j < kvLen; j++ {
+			if e.KVs[j].K, err = r.readString(); err != nil {
+				return nil, err
+			}
+			if e.KVs[j].V, err = r.readString(); err != nil {
+				return nil, err
+			}
+		}
+		stream.Add(e)
+	}
+	if t == GedisStream {
+		return stream, nil
+	}
+
+	lastID, err := r.readID()
+	if err != nil {
+		return nil, err
+	}
+	stream.LastID = lastID
+	if t >= GedisStream3 {
+		if stream.MaxDeletedID, err = r.readID(); err != nil {
+			return nil, err
+		}
+		added, err := r.readUint64()
+		if err != nil {
+			return nil, err
+		}
+		stream.EntriesAdded = int64(added)
+	}
+	groups, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < groups; i++ {
+		name, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		id, err := r.readID()
+		if err != nil {
+			return nil, err
+		}
+		entriesRead := int64(storage.InvalidEntriesRead)
+		if t >= GedisStream4 {
+			v, err := r.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			entriesRead = int64(v)
+		}
+		g := stream.CreateGroup(name, id, entriesRead)
+		if g == nil {
+			return nil, fmt.Errorf("duplicated consumer group %s", name)
+		}
+		consumers, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < consumers; j++ {
+			if err := r.readConsumer(g); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return stream, nil
+}
+
+// readConsumer reads a consumer and its pending entries:
+// <name> <seen time> <active time> <pel len> [<ms> <seq> <delivery time> <delivery count>]...
+func (r *Rdb) readConsumer(g *storage.ConsumerGroup) error {
+	name, err := r.readString()
+	if err != nil {
+		return err
+	}
+	seen, err := r.readUint64()
+	if err != nil {
+		return err
+	}
+	active, err := r.readUint64()
+	if err != nil {
+		return err
+	}
+	c := g.CreateConsumer(name, int64(seen))
+	if c == nil {
+		return fmt.Errorf("duplicated consumer %s", name)
+	}
+	c.ActiveTime = int64(active)
+	n, err := r.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		id, err := r.readID()
+		if err != nil {
+			return err
+		}
+		deliveryTime, err := r.readUint64()
+		if err != nil {
+			return err
+		}
+		deliveryCount, err := r.readUint64()
+		if err != nil {
+			return err
+		}
+		pe := g.Deliver(id, c, int64(deliveryTime), false)
+		pe.DeliveryCount = int64(deliveryCount)
+	}
+	return nil
+}
+
+func (r *Rdb) readID() (storage.ID, error) {
+	ms, err := r.readUint64()
+	if err != nil {
+		return storage.ID{}, err
+	}
+	seq, err := r.readUint64()
+	if err != nil {
+		return storage.ID{}, err
+	}
+	return storage.NewID(int64(ms), int64(seq)), nil
+}
+
+func (r *Rdb) readUint64() (uint64, error) {
+	b, err := r.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
 }
 
 func (r *Rdb) readString() (string, error) {
-	l, err := r.readLen()
+	l, encoded, err := r.readLenOrEncoding()
 	if err != nil {
 		return "", err
 	}
-	b, err := r.readBytes(l)
-	return string(b), err
+	if !encoded {
+		b, err := r.readBytes(l)
+		return string(b), err
+	}
+
+	switch uint8(l) {
+	case encInt8:
+		b, err := r.readBytes(1)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int8(b[0]))), nil
+	case encInt16:
+		b, err := r.readBytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case encInt32:
+		b, err := r.readBytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	}
+	return "", fmt.Errorf("rdb file has unsupported string encoding %v", l)
 }
 
 func (r *Rdb) readLen() (int, error) {
-	b, err := r.readByte()
+	l, encoded, err := r.readLenOrEncoding()
 	if err != nil {
 		return 0, err
 	}
-	t := uint8(b) >> 6
-	switch t {
-	case 0:
-		return int(uint8(b)), nil
-	case 3:
-		tl := uint8(b) - (1 << 7) - (1 << 6)
-		switch tl {
-		case 0:
-			return 1, nil
-		case 1:
-			return 2, nil
-		case 2:
-			return 4, nil
-		default:
-			panic(fmt.Sprintf("rdb file has other len encoding cases, t=%v, b=%v", t, uint8(b)))
+	if encoded {
+		return 0, fmt.Errorf("rdb file has an encoded value where a length is expected")
+	}
+	return l, nil
+}
+
+// readLenOrEncoding reads a length, or the special encoding of the following string
+// when `encoded` is true.
+func (r *Rdb) readLenOrEncoding() (l int, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case len6Bit:
+		return int(b & 0x3F), false, nil
+	case len14Bit:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return int(b&0x3F)<<8 | int(next), false, nil
+	case encVal:
+		return int(b & 0x3F), true, nil
+	}
+
+	switch b {
+	case len32Bit:
+		v, err := r.readBytes(4)
+		if err != nil {
+			return 0, false, err
 		}
-	default:
-		panic(fmt.Sprintf("rdb file has other len encoding cases, t=%v, b=%v", t, uint8(b)))
+		return int(binary.BigEndian.Uint32(v)), false, nil
+	case len64Bit:
+		v, err := r.readUint64()
+		return int(v), false, err
 	}
+	return 0, false, fmt.Errorf("rdb file has unknown length encoding %v", b)
 }
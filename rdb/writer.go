@@ -0,0 +1,293 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/fukua95/gedis/storage"
+	"github.com/fukua95/gedis/util"
+)
+
+// Writer encodes a dataset in the rdb format.
+type Writer struct {
+	w *bufio.Writer
+	// checksum of the bytes written so far.
+	crc uint64
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Save writes the store as a complete rdb file.
+// `aux` are extra auxiliary fields, e.g. `aof-base`.
+func Save(w io.Writer, store *storage.Store, aux map[string]string) error {
+	rw := NewWriter(w)
+	if err := rw.WriteHeader(aux); err != nil {
+		return err
+	}
+	if err := rw.WriteStore(store); err != nil {
+		return err
+	}
+	return rw.WriteFooter()
+}
+
+func (w *Writer) write(b []byte) error {
+	w.crc = util.Crc64(w.crc, b)
+	_, err := w.w.Write(b)
+	return err
+}
+
+func (w *Writer) writeByte(b uint8) error {
+	return w.write([]byte{b})
+}
+
+func (w *Writer) WriteHeader(aux map[string]string) error {
+	if err := w.write([]byte(fmt.Sprintf("%s%04d", Magic, Version))); err != nil {
+		return err
+	}
+	fields := [][2]string{
+		{"redis-ver", "7.2.0"},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	for k, v := range aux {
+		fields = append(fields, [2]string{k, v})
+	}
+	for _, f := range fields {
+		if err := w.writeByte(AUX); err != nil {
+			return err
+		}
+		if err := w.writeString(f[0]); err != nil {
+			return err
+		}
+		if err := w.writeString(f[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteStore writes all the key-value pairs of the store as db 0.
+func (w *Writer) WriteStore(store *storage.Store) error {
+	var err error
+	strings, streams := store.Len()
+
+	if err = w.writeByte(SELECTDB); err != nil {
+		return err
+	}
+	if err = w.writeLen(0); err != nil {
+		return err
+	}
+	if err = w.writeByte(RESIZEDB); err != nil {
+		return err
+	}
+	if err = w.writeLen(strings + streams); err != nil {
+		return err
+	}
+	if err = w.writeLen(store.ExpiresLen()); err != nil {
+		return err
+	}
+
+	store.ForEachString(func(key string, val string, ex int64) {
+		if err == nil {
+			err = w.WriteString(key, val, ex)
+		}
+	})
+	store.ForEachStream(func(key string, stream *storage.Stream) {
+		if err == nil {
+			err = w.WriteStream(key, stream)
+		}
+	})
+	return err
+}
+
+// WriteString writes a string key-value pair, `ex` is the unix time in milliseconds
+// the key expires at, or 0 if the key doesn't expire.
+func (w *Writer) WriteString(key string, val string, ex int64) error {
+	if err := w.writeExpire(ex); err != nil {
+		return err
+	}
+	if err := w.writeByte(String); err != nil {
+		return err
+	}
+	if err := w.writeString(key); err != nil {
+		return err
+	}
+	return w.writeString(val)
+}
+
+// WriteStream writes a stream as:
+// <entries len> [<ms> <seq> <fields len> [<field> <value>]...]... <last ms> <last seq>
+// <max deleted ms> <max deleted seq> <entries added> <groups len>
+// [<name> <last ms> <last seq> <entries read> <consumers len> [<consumer>]...]...
+// ms and seq are 8 bytes big endian, entries read is -1 if it's unknown, see writeConsumer for the consumers.
+func (w *Writer) WriteStream(key string, stream *storage.Stream) error {
+	if err := w.writeByte(GedisStream4); err != nil {
+		return err
+	}
+	if err := w.writeString(key); err != nil {
+		return err
+	}
+	return w.writeStreamValue(stream)
+}
+
+func (w *Writer) writeStreamValue(stream *storage.Stream) error {
+	if err := w.writeLen(stream.Len()); err != nil {
+		return err
+	}
+	var err error
+	stream.ForEach(storage.NewID(0, 0), storage.MaxID, false, func(e *storage.Entry) bool {
+		err = w.writeEntry(e)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.writeID(stream.LastID); err != nil {
+		return err
+	}
+	if err := w.writeID(stream.MaxDeletedID); err != nil {
+		return err
+	}
+	if err := w.writeUint64(uint64(stream.EntriesAdded)); err != nil {
+		return err
+	}
+	if err := w.writeLen(len(stream.Groups)); err != nil {
+		return err
+	}
+	for _, name := range stream.GroupNames() {
+		g := stream.Group(name)
+		if err := w.writeString(name); err != nil {
+			return err
+		}
+		if err := w.writeID(g.LastID); err != nil {
+			return err
+		}
+		if err := w.writeUint64(uint64(g.EntriesRead)); err != nil {
+			return err
+		}
+		if err := w.writeLen(len(g.Consumers)); err != nil {
+			return err
+		}
+		for _, name := range g.ConsumerNames() {
+			if err := w.writeConsumer(g.Consumer(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeEntry(e *storage.Entry) error {
+	if err := w.writeID(e.ID); err != nil {
+		return err
+	}
+	if err := w.writeLen(len(e.KVs)); err != nil {
+		return err
+	}
+	for _, kv := range e.KVs {
+		if err := w.writeString(kv.K); err != nil {
+			return err
+		}
+		if err := w.writeString(kv.V); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeConsumer writes a consumer and its pending entries:
+// <name> <seen time> <active time> <pel len> [<ms> <seq> <delivery time> <delivery count>]...
+func (w *Writer) writeConsumer(c *storage.Consumer) error {
+	if err := w.writeString(c.Name); err != nil {
+		return err
+	}
+	if err := w.writeUint64(uint64(c.SeenTime)); err != nil {
+		return err
+	}
+	if err := w.writeUint64(uint64(c.ActiveTime)); err != nil {
+		return err
+	}
+	if err := w.writeLen(c.PEL.Len()); err != nil {
+		return err
+	}
+	var err error
+	c.PEL.Range(storage.NewID(0, 0), storage.MaxID, func(pe *storage.PendingEntry) bool {
+		if err = w.writeID(pe.ID); err != nil {
+			return false
+		}
+		if err = w.writeUint64(uint64(pe.DeliveryTime)); err != nil {
+			return false
+		}
+		err = w.writeUint64(uint64(pe.DeliveryCount))
+		return err == nil
+	})
+	return err
+}
+
+func (w *Writer) writeID(id storage.ID) error {
+	if err := w.writeUint64(uint64(id.Ms())); err != nil {
+		return err
+	}
+	return w.writeUint64(uint64(id.Seq()))
+}
+
+// WriteFooter writes the EOF opcode and the checksum, and flushes the writer.
+func (w *Writer) WriteFooter() error {
+	if err := w.writeByte(EOF); err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, w.crc)
+	if err := w.write(b); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func (w *Writer) writeExpire(ex int64) error {
+	if ex <= 0 {
+		return nil
+	}
+	if err := w.writeByte(EXPIRETIMEMS); err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(ex))
+	return w.write(b)
+}
+
+func (w *Writer) writeUint64(v uint64) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return w.write(b)
+}
+
+func (w *Writer) writeString(s string) error {
+	if err := w.writeLen(len(s)); err != nil {
+		return err
+	}
+	return w.write([]byte(s))
+}
+
+func (w *Writer) writeLen(l int) error {
+	switch {
+	case l < 1<<6:
+		return w.writeByte(uint8(l))
+	case l < 1<<14:
+		return w.write([]byte{len14Bit<<6 | uint8(l>>8), uint8(l)})
+	case l <= 1<<32-1:
+		b := []byte{len32Bit, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(l))
+		return w.write(b)
+	}
+	if err := w.writeByte(len64Bit); err != nil {
+		return err
+	}
+	return w.writeUint64(uint64(l))
+}
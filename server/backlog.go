@@ -0,0 +1,64 @@
+package server
+
+// backlog is a circular buffer of the latest replication stream.
+// A replica reconnecting continues from its offset if the offset is still
+// in the backlog, instead of a full resynchronization.
+type backlog struct {
+	buf []byte
+	// the position of the next byte to write in buf.
+	idx int
+	// the number of valid bytes in buf.
+	histlen int
+	// the replication offset of the first valid byte.
+	offset int
+}
+
+// newBacklog creates a backlog whose next byte is at replication offset `next`.
+func newBacklog(size int, next int) *backlog {
+	return &backlog{
+		buf:    make([]byte, size),
+		offset: next,
+	}
+}
+
+func (b *backlog) size() int {
+	return len(b.buf)
+}
+
+func (b *backlog) feed(p []byte) {
+	size := len(b.buf)
+	if len(p) > size {
+		// only the tail fits.
+		b.offset += len(p) - size
+		p = p[len(p)-size:]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % size
+		p = p[n:]
+		b.histlen += n
+	}
+	if b.histlen > size {
+		b.offset += b.histlen - size
+		b.histlen = size
+	}
+}
+
+// contains reports whether the stream from offset `next` on is in the backlog.
+func (b *backlog) contains(next int) bool {
+	return next >= b.offset && next <= b.offset+b.histlen
+}
+
+// readFrom returns the stream from offset `next` on, next must be contained.
+func (b *backlog) readFrom(next int) []byte {
+	skip := next - b.offset
+	n := b.histlen - skip
+	res := make([]byte, 0, n)
+	// the first valid byte is histlen bytes before idx.
+	start := (b.idx - b.histlen + skip + len(b.buf)) % len(b.buf)
+	if start+n <= len(b.buf) {
+		return append(res, b.buf[start:start+n]...)
+	}
+	res = append(res, b.buf[start:]...)
+	return append(res, b.buf[:n-(len(b.buf)-start)]...)
+}
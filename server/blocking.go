@@ -0,0 +1,106 @@
+package server
+
+import (
+	"time"
+)
+
+// keysWaiter blocks a client on keys until one of them is written, for XREAD and
+// XREADGROUP with BLOCK, like the blocking of redis.
+// The client checks the keys and blocks on them with s.mu held, so no write is missed,
+// then it waits without s.mu, and checks the keys again when they're ready.
+type keysWaiter struct {
+	s     *Server
+	conn  *Conn
+	keys  []string
+	ready chan struct{}
+	timer *time.Timer
+	// nil if blocking forever.
+	timeout <-chan time.Time
+}
+
+// newKeysWaiter returns a waiter timing out after blockMS milliseconds, 0 means forever.
+func (s *Server) newKeysWaiter(conn *Conn, keys []string, blockMS int) *keysWaiter {
+	w := &keysWaiter{s: s, conn: conn, keys: keys, ready: make(chan struct{}, 1)}
+	if blockMS > 0 {
+		w.timer = time.NewTimer(time.Duration(blockMS) * time.Millisecond)
+		w.timeout = w.timer.C
+	}
+	return w
+}
+
+// block registers the waiter on its keys.
+// It must be called with s.mu held.
+func (w *keysWaiter) block() {
+	w.conn.blocked = true
+	for _, key := range w.keys {
+		waiters, ok := w.s.blockingKeys[key]
+		if !ok {
+			waiters = map[chan struct{}]struct{}{}
+			w.s.blockingKeys[key] = waiters
+		}
+		waiters[w.ready] = struct{}{}
+	}
+}
+
+// wait waits until a key is signaled as ready, it returns false on timeout, or if the client
+// disconnects or is killed, then the client fails to read and is cleaned up.
+// It must be called without s.mu held.
+func (w *keysWaiter) wait() bool {
+	closed, stopWatch := w.conn.watchClose()
+	ok := true
+	select {
+	case <-w.ready:
+	case <-w.timeout:
+		ok = false
+	case <-closed:
+		ok = false
+	}
+	stopWatch()
+	w.s.mu.Lock()
+	w.conn.blocked = false
+	for _, key := range w.keys {
+		if waiters, has := w.s.blockingKeys[key]; has {
+			delete(waiters, w.ready)
+			if len(waiters) == 0 {
+				delete(w.s.blockingKeys, key)
+			}
+		}
+	}
+	w.s.mu.Unlock()
+	// drop the signal sent after the timeout.
+	select {
+	case <-w.ready:
+	default:
+	}
+	return ok
+}
+
+func (w *keysWaiter) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// signalKeysAsReady wakes up the clients blocked on the keys of a write command.
+// It must be called with s.mu held.
+func (s *Server) signalKeysAsReady(spec *commandSpec, cmd Command) {
+	if len(s.blockingKeys) == 0 {
+		return
+	}
+	for _, i := range spec.keys(cmd) {
+		s.signalKeyAsReady(string(cmd.At(i)))
+	}
+}
+
+// signalKeyAsReady wakes up the clients blocked on the key, they check the key again,
+// and block again if there is still nothing to serve.
+// It must be called with s.mu held.
+func (s *Server) signalKeyAsReady(key string) {
+	for ready := range s.blockingKeys[key] {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}
+	delete(s.blockingKeys, key)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// waitFor waits until cond holds, cond is called with s.mu held.
+func waitFor(t *testing.T, s *Server, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		ok := cond()
+		s.mu.Unlock()
+		if ok {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func TestBlockedClientClosed(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(s *Server, blocked *testClient, id int64)
+	}{
+		{"disconnect", func(s *Server, blocked *testClient, id int64) {
+			blocked.conn.Close()
+		}},
+		{"client kill", func(s *Server, blocked *testClient, id int64) {
+			c := newTestClient(t, s)
+			if got := c.do("CLIENT", "KILL", "ID", fmt.Sprint(id)); got != int64(1) {
+				t.Errorf("CLIENT KILL = %#v, want 1", got)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t)
+		blocked := newTestClient(t, s)
+		id := blocked.do("CLIENT", "ID").(int64)
+		blocked.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+		waitFor(t, s, "blocking", func() bool { return len(s.blockingKeys["s"]) == 1 })
+
+		tt.close(s, blocked, id)
+		// the goroutine serving the client wakes up, unblocks the keys and cleans up the client.
+		waitFor(t, s, tt.name+" cleaning up", func() bool {
+			return len(s.blockingKeys) == 0 && s.clients[id] == nil
+		})
+	}
+}
+
+func TestBlockedClientPipeline(t *testing.T) {
+	// the command sent while blocked is served after the blocking command.
+	s := newTestServer(t)
+	blocked := newTestClient(t, s)
+	blocked.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	waitFor(t, s, "blocking", func() bool { return len(s.blockingKeys["s"]) == 1 })
+	blocked.send("PING")
+
+	newTestClient(t, s).do("XADD", "s", "1-1", "f", "v")
+	want := []interface{}{[]interface{}{"s", []interface{}{[]interface{}{"1-1", []interface{}{"f", "v"}}}}}
+	if got := blocked.reply(); !reflect.DeepEqual(got, want) {
+		t.Errorf("XREAD BLOCK = %#v, want %#v", got, want)
+	}
+	if got := blocked.reply(); got != "PONG" {
+		t.Errorf("PING = %#v, want PONG", got)
+	}
+}
@@ -0,0 +1,527 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+// the types of the clients, see CLIENT LIST TYPE.
+const (
+	clientTypeNormal  = "normal"
+	clientTypeMaster  = "master"
+	clientTypeReplica = "replica"
+	clientTypePubSub  = "pubsub"
+)
+
+// the commands with subcommands, CLIENT LIST shows the command like `client|list`.
+var containerCommands = map[string]bool{
+	proto.CmdClient:  true,
+	proto.CmdConfig:  true,
+	proto.CmdCluster: true,
+	proto.CmdXGroup:  true,
+	proto.CmdXInfo:   true,
+}
+
+// clientsPause is the pause of the clients by CLIENT PAUSE.
+type clientsPause struct {
+	// all the commands are paused, or only the writes.
+	all   bool
+	end   time.Time
+	timer *time.Timer
+	// closed when the pause ends.
+	done chan struct{}
+}
+
+// linkClient assigns an ID to the client and adds it to the clients.
+// It must be called with s.mu held.
+func (s *Server) linkClient(conn *Conn) {
+	s.nextClientID++
+	conn.id = s.nextClientID
+	conn.ctime = time.Now()
+	conn.lastInteraction = conn.ctime
+	s.clients[conn.id] = conn
+}
+
+// unlinkClient removes the client from the clients.
+// It must be called with s.mu held.
+func (s *Server) unlinkClient(conn *Conn) {
+	s.disableTracking(conn)
+	delete(s.clients, conn.id)
+}
+
+// commandRead records the command read and the buffers, see CLIENT LIST.
+// It must be called with s.mu held.
+func (conn *Conn) commandRead(spec *commandSpec, cmd Command) {
+	name := strings.ToLower(spec.name)
+	if containerCommands[spec.name] && len(cmd.Args()) > 1 {
+		name += "|" + strings.ToLower(string(cmd.At(1)))
+	}
+	conn.lastCmd = name
+	conn.lastInteraction = time.Now()
+	conn.argvMem = 0
+	for _, arg := range cmd.Args() {
+		conn.argvMem += len(arg)
+	}
+	if conn.r != nil {
+		conn.qbuf = conn.r.Buffered()
+	}
+}
+
+// beforeCommand and afterCommand skip the reply of the command after CLIENT REPLY SKIP.
+func (conn *Conn) beforeCommand() {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	conn.replySkip, conn.replySkipNext = conn.replySkipNext, false
+}
+
+func (conn *Conn) afterCommand() {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	conn.replySkip = false
+}
+
+// clientType returns the type of the client.
+// It must be called with s.mu held.
+func (conn *Conn) clientType() string {
+	switch {
+	case conn.fromMaster:
+		return clientTypeMaster
+	case conn.replica != nil:
+		return clientTypeReplica
+	case conn.subscribed():
+		return clientTypePubSub
+	}
+	return clientTypeNormal
+}
+
+// clientFlags returns the flags of CLIENT LIST, like `clientFlags` of redis.
+// It must be called with s.mu held.
+func (conn *Conn) clientFlags() string {
+	flags := ""
+	if conn.replica != nil {
+		flags += "S"
+	}
+	if conn.fromMaster {
+		flags += "M"
+	}
+	if conn.subscribed() {
+		flags += "P"
+	}
+	if conn.blocked {
+		flags += "b"
+	}
+	if conn.tracking != nil {
+		flags += "t"
+		if conn.tracking.brokenRedirect {
+			flags += "R"
+		}
+		if conn.tracking.bcast {
+			flags += "B"
+		}
+	}
+	if conn.closeAfterReply {
+		flags += "c"
+	}
+	if conn.readOnly {
+		flags += "r"
+	}
+	if conn.noEvict {
+		flags += "e"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	return flags
+}
+
+// clientInfo returns the line of the client in CLIENT LIST.
+// It must be called with s.mu held.
+func (conn *Conn) clientInfo(now time.Time) string {
+	addr, laddr := "", ""
+	if conn.netConn != nil {
+		addr, laddr = conn.netConn.RemoteAddr().String(), conn.netConn.LocalAddr().String()
+	}
+	qbufFree, obl := 0, 0
+	if conn.r != nil {
+		qbufFree = conn.r.Size() - conn.qbuf
+	}
+	if conn.w != nil {
+		conn.wmu.Lock()
+		obl = conn.w.Buffered()
+		conn.wmu.Unlock()
+	}
+	redir := int64(-1)
+	if conn.tracking != nil {
+		redir = conn.tracking.redirect
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=0 sub=%d psub=0 ssub=0 multi=-1 watch=0 "+
+		"qbuf=%d qbuf-free=%d argv-mem=%d obl=%d oll=0 omem=0 events=r cmd=%s user=default redir=%d resp=%d lib-name=%s lib-ver=%s\n",
+		conn.id, addr, laddr, conn.name, int(now.Sub(conn.ctime).Seconds()), int(now.Sub(conn.lastInteraction).Seconds()),
+		conn.clientFlags(), len(conn.channels), conn.qbuf, qbufFree, conn.argvMem, obl, conn.lastCmd, redir, conn.resp, conn.libName, conn.libVer)
+}
+
+// sortedClients returns the clients ordered by ID.
+// It must be called with s.mu held.
+func (s *Server) sortedClients() []*Conn {
+	clients := make([]*Conn, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+// parseClientType returns the type of CLIENT LIST and CLIENT KILL, `slave` is `replica`.
+func parseClientType(arg []byte) (string, bool) {
+	t := strings.ToLower(string(arg))
+	switch t {
+	case clientTypeNormal, clientTypeMaster, clientTypeReplica, clientTypePubSub:
+		return t, true
+	case "slave":
+		return clientTypeReplica, true
+	}
+	return "", false
+}
+
+// validClientString reports whether the name or the lib info has no spaces, newlines or special characters.
+func validClientString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '!' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// client handles the CLIENT subcommands: LIST [TYPE type] [ID id [id ...]], INFO, ID,
+// SETNAME name, GETNAME, SETINFO LIB-NAME|LIB-VER value, KILL, PAUSE timeout [WRITE|ALL],
+// UNPAUSE, NO-EVICT ON|OFF, REPLY ON|OFF|SKIP, and TRACKING, CACHING, TRACKINGINFO and GETREDIR
+// of the client side caching.
+func (s *Server) client(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	sub := strings.ToLower(string(args[1]))
+	arity := map[string]int{
+		"list":         -2,
+		"info":         2,
+		"id":           2,
+		"setname":      3,
+		"getname":      2,
+		"setinfo":      4,
+		"kill":         -3,
+		"pause":        -3,
+		"unpause":      2,
+		"no-evict":     3,
+		"reply":        3,
+		"tracking":     -3,
+		"caching":      3,
+		"trackinginfo": 2,
+		"getredir":     2,
+	}
+	n, ok := arity[sub]
+	if !ok || (n > 0 && len(args) != n) || len(args) < -n {
+		return conn.WriteError(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%s'. Try CLIENT HELP.", args[1]))
+	}
+
+	switch sub {
+	case "list":
+		return s.clientList(conn, args)
+	case "info":
+		return conn.WriteVerbatim(conn.clientInfo(time.Now()))
+	case "id":
+		return conn.WriteInt(int(conn.id))
+	case "setname":
+		name := string(args[2])
+		if !validClientString(name) {
+			return conn.WriteError("Client names cannot contain spaces, newlines or special characters.")
+		}
+		conn.name = name
+		return conn.WriteStatusOK()
+	case "getname":
+		if conn.name == "" {
+			return conn.WriteNilBulkString()
+		}
+		return conn.WriteString(conn.name)
+	case "setinfo":
+		attr, val := strings.ToLower(string(args[2])), string(args[3])
+		if attr != proto.OptionLibName && attr != proto.OptionLibVer {
+			return conn.WriteError(fmt.Sprintf("Unrecognized option '%s'", args[2]))
+		}
+		if !validClientString(val) {
+			return conn.WriteError(fmt.Sprintf("%s cannot contain spaces, newlines or special characters.", attr))
+		}
+		if attr == proto.OptionLibName {
+			conn.libName = val
+		} else {
+			conn.libVer = val
+		}
+		return conn.WriteStatusOK()
+	case "kill":
+		return s.clientKill(conn, args)
+	case "tracking":
+		return s.clientTrackingCmd(conn, args)
+	case "caching":
+		return s.clientCaching(conn, args)
+	case "trackinginfo":
+		return s.clientTrackingInfo(conn)
+	case "getredir":
+		if conn.tracking == nil {
+			return conn.WriteInt(-1)
+		}
+		return conn.WriteInt(int(conn.tracking.redirect))
+	case "pause":
+		timeout, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return conn.WriteError("timeout is not an integer or out of range")
+		}
+		if timeout < 0 {
+			return conn.WriteError("timeout is negative")
+		}
+		all := true
+		if len(args) == 4 {
+			switch strings.ToLower(string(args[3])) {
+			case proto.OptionWrite:
+				all = false
+			case proto.OptionAll:
+			default:
+				return conn.WriteError("CLIENT PAUSE mode must be WRITE or ALL")
+			}
+		} else if len(args) > 4 {
+			return conn.WriteError("syntax error")
+		}
+		s.pauseClients(time.Now().Add(time.Duration(timeout)*time.Millisecond), all)
+		return conn.WriteStatusOK()
+	case "unpause":
+		s.unpauseClients()
+		return conn.WriteStatusOK()
+	case "no-evict":
+		switch strings.ToLower(string(args[2])) {
+		case proto.OptionOn:
+			conn.noEvict = true
+		case proto.OptionOff:
+			conn.noEvict = false
+		default:
+			return conn.WriteError("syntax error")
+		}
+		return conn.WriteStatusOK()
+	case "reply":
+		mode := strings.ToLower(string(args[2]))
+		conn.wmu.Lock()
+		switch mode {
+		case proto.OptionOn:
+			conn.replyOff, conn.replySkipNext = false, false
+		case proto.OptionOff:
+			conn.replyOff = true
+		case proto.OptionSkip:
+			// the reply of the next command is skipped, as well as this one.
+			if !conn.replyOff {
+				conn.replySkip, conn.replySkipNext = true, true
+			}
+		}
+		conn.wmu.Unlock()
+		switch mode {
+		case proto.OptionOn:
+			return conn.WriteStatusOK()
+		case proto.OptionOff, proto.OptionSkip:
+			return nil
+		}
+		return conn.WriteError("syntax error")
+	}
+	return nil
+}
+
+// clientList handles `CLIENT LIST [TYPE normal|master|replica|pubsub] [ID id [id ...]]`.
+func (s *Server) clientList(conn *Conn, args [][]byte) error {
+	typ := ""
+	var ids map[int64]bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == proto.OptionType && i+1 < len(args):
+			t, ok := parseClientType(args[i+1])
+			if !ok {
+				return conn.WriteError(fmt.Sprintf("Unknown client type '%s'", args[i+1]))
+			}
+			typ = t
+			i++
+		case opt == proto.OptionID && i+1 < len(args):
+			ids = map[int64]bool{}
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseInt(string(args[i]), 10, 64)
+				if err != nil || id <= 0 {
+					return conn.WriteError("Invalid client ID")
+				}
+				ids[id] = true
+			}
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+	now := time.Now()
+	var b strings.Builder
+	for _, c := range s.sortedClients() {
+		if (typ != "" && c.clientType() != typ) || (ids != nil && !ids[c.id]) {
+			continue
+		}
+		b.WriteString(c.clientInfo(now))
+	}
+	return conn.WriteVerbatim(b.String())
+}
+
+// clientKill handles `CLIENT KILL addr:port`, which replies OK, and `CLIENT KILL
+// [ID id] [TYPE type] [USER username] [ADDR addr:port] [LADDR addr:port] [SKIPME yes|no]
+// [MAXAGE seconds]`, which replies the number of the clients killed.
+func (s *Server) clientKill(conn *Conn, args [][]byte) error {
+	if len(args) == 3 {
+		addr := string(args[2])
+		for _, c := range s.sortedClients() {
+			if c.netConn != nil && c.netConn.RemoteAddr().String() == addr {
+				s.killClient(conn, c)
+				return conn.WriteStatusOK()
+			}
+		}
+		return conn.WriteError("No such client")
+	}
+	if len(args)%2 != 0 {
+		return conn.WriteError("syntax error")
+	}
+
+	var id int64
+	typ, addr, laddr := "", "", ""
+	skipMe := true
+	maxAge := int64(0)
+	for i := 2; i < len(args); i += 2 {
+		val := args[i+1]
+		switch strings.ToLower(string(args[i])) {
+		case proto.OptionID:
+			v, err := strconv.ParseInt(string(val), 10, 64)
+			if err != nil || v <= 0 {
+				return conn.WriteError("client-id should be greater than 0")
+			}
+			id = v
+		case proto.OptionType:
+			t, ok := parseClientType(val)
+			if !ok {
+				return conn.WriteError(fmt.Sprintf("Unknown client type '%s'", val))
+			}
+			typ = t
+		case proto.OptionUser:
+			// there is only the default user.
+			if string(val) != "default" {
+				return conn.WriteError(fmt.Sprintf("No such user '%s'", val))
+			}
+		case proto.OptionAddr:
+			addr = string(val)
+		case proto.OptionLAddr:
+			laddr = string(val)
+		case proto.OptionSkipMe:
+			switch strings.ToLower(string(val)) {
+			case proto.OptionYes:
+				skipMe = true
+			case proto.OptionNo:
+				skipMe = false
+			default:
+				return conn.WriteError("syntax error")
+			}
+		case proto.OptionMaxAge:
+			v, err := strconv.ParseInt(string(val), 10, 64)
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			maxAge = v
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+
+	now := time.Now()
+	killed := 0
+	for _, c := range s.sortedClients() {
+		switch {
+		case id != 0 && c.id != id,
+			typ != "" && c.clientType() != typ,
+			addr != "" && (c.netConn == nil || c.netConn.RemoteAddr().String() != addr),
+			laddr != "" && (c.netConn == nil || c.netConn.LocalAddr().String() != laddr),
+			skipMe && c == conn,
+			maxAge > 0 && int64(now.Sub(c.ctime).Seconds()) < maxAge:
+			continue
+		}
+		s.killClient(conn, c)
+		killed++
+	}
+	return conn.WriteInt(killed)
+}
+
+// killClient closes the connection of the client, the client killing itself is closed
+// after the reply.
+// It must be called with s.mu held.
+func (s *Server) killClient(self *Conn, c *Conn) {
+	if c == self {
+		c.closeAfterReply = true
+		return
+	}
+	// the goroutine serving the client fails to read, and cleans up.
+	if c.netConn != nil {
+		c.netConn.Close()
+	}
+}
+
+// pauseClients pauses the clients until end, a pause in progress is extended,
+// and ALL takes precedence over WRITE.
+// It must be called with s.mu held.
+func (s *Server) pauseClients(end time.Time, all bool) {
+	p := s.clientsPause
+	if p == nil {
+		p = &clientsPause{done: make(chan struct{})}
+		s.clientsPause = p
+	} else {
+		p.timer.Stop()
+	}
+	p.all = p.all || all
+	if end.After(p.end) {
+		p.end = end
+	}
+	p.timer = time.AfterFunc(time.Until(p.end), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// the pause may be ended, or extended after the timer fired.
+		if s.clientsPause == p && !time.Now().Before(p.end) {
+			s.unpauseClients()
+		}
+	})
+}
+
+// unpauseClients ends the pause by CLIENT PAUSE.
+// It must be called with s.mu held.
+func (s *Server) unpauseClients() {
+	if p := s.clientsPause; p != nil {
+		p.timer.Stop()
+		close(p.done)
+		s.clientsPause = nil
+	}
+}
+
+// pausedUntil returns a channel closed when the command of the client isn't paused,
+// nil if it's not paused. The writes are paused during a failover, see FAILOVER,
+// and the clients are paused by CLIENT PAUSE, except CLIENT UNPAUSE.
+// It must be called with s.mu held.
+func (s *Server) pausedUntil(conn *Conn, spec *commandSpec, cmd Command) <-chan struct{} {
+	if conn.fromMaster {
+		return nil
+	}
+	write := spec.flags&(flagWrite|flagMayReplicate) != 0
+	if write && s.failoverJob != nil {
+		return s.failoverJob.done
+	}
+	p := s.clientsPause
+	if p == nil || (!p.all && !write) {
+		return nil
+	}
+	if spec.name == proto.CmdClient && strings.EqualFold(string(cmd.At(1)), "unpause") {
+		return nil
+	}
+	return p.done
+}
@@ -0,0 +1,1122 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/storage"
+	"github.com/fukua95/gedis/util"
+)
+
+const (
+	clusterSlots = 16384
+	// the cluster bus port is the client port + clusterPortIncr.
+	clusterPortIncr = 10000
+)
+
+type clusterNodeFlag int
+
+const (
+	nodeMyself clusterNodeFlag = 1 << iota
+	nodeMaster
+	nodeReplica
+	// the node is possibly failing, it doesn't reply in node timeout.
+	nodePFail
+	// the majority of the masters agree the node is failing.
+	nodeFail
+	// the node is met, but the handshake isn't done, it doesn't have the real id yet.
+	nodeHandshake
+	nodeNoAddr
+	// MEET is sent instead of PING on the handshake.
+	nodeMeet
+)
+
+var clusterNodeFlagNames = []struct {
+	flag clusterNodeFlag
+	name string
+}{
+	{nodeMyself, "myself"},
+	{nodeMaster, "master"},
+	{nodeReplica, "slave"},
+	{nodePFail, "fail?"},
+	{nodeFail, "fail"},
+	{nodeHandshake, "handshake"},
+	{nodeNoAddr, "noaddr"},
+}
+
+// clusterNode is a node of the cluster, like `clusterNode` in redis.
+type clusterNode struct {
+	id    string
+	ip    string
+	port  int
+	cport int
+	flags clusterNodeFlag
+
+	// for a replica, the master it replicates.
+	master   *clusterNode
+	replicas []*clusterNode
+	// the slots served by a master.
+	slots    [clusterSlots / 8]byte
+	numSlots int
+
+	configEpoch  int
+	pingSent     time.Time
+	pongReceived time.Time
+	dataReceived time.Time
+	replOffset   int
+
+	// a node in handshake is deleted if the handshake isn't done in time.
+	ctime    time.Time
+	failTime time.Time
+	// the masters reporting the node as failing, and the time of their last report.
+	failReports map[*clusterNode]time.Time
+	// the last time this node voted for a replica of the master.
+	votedTime time.Time
+
+	// the outbound link of the cluster bus, nil if not connected.
+	link *Conn
+	// the goroutine of the link is running, see clusterLinkLoop.
+	linking bool
+	// increased to stop the goroutine of the link, see freeLink.
+	gen int
+}
+
+func newClusterNode(id string, flags clusterNodeFlag) *clusterNode {
+	if id == "" {
+		id = util.RandomHexString(40)
+	}
+	return &clusterNode{id: id, flags: flags, ctime: time.Now(), failReports: map[*clusterNode]time.Time{}}
+}
+
+func (n *clusterNode) is(flag clusterNodeFlag) bool {
+	return n.flags&flag != 0
+}
+
+func (n *clusterNode) hasSlot(slot int) bool {
+	return n.slots[slot/8]&(1<<(slot%8)) != 0
+}
+
+func (n *clusterNode) setSlot(slot int) {
+	if !n.hasSlot(slot) {
+		n.slots[slot/8] |= 1 << (slot % 8)
+		n.numSlots++
+	}
+}
+
+func (n *clusterNode) clearSlot(slot int) {
+	if n.hasSlot(slot) {
+		n.slots[slot/8] &^= 1 << (slot % 8)
+		n.numSlots--
+	}
+}
+
+// slotRanges returns the slots of the node as ranges [start, end].
+func (n *clusterNode) slotRanges() [][2]int {
+	ranges := [][2]int{}
+	for slot := 0; slot < clusterSlots; slot++ {
+		if !n.hasSlot(slot) {
+			continue
+		}
+		start := slot
+		for slot+1 < clusterSlots && n.hasSlot(slot+1) {
+			slot++
+		}
+		ranges = append(ranges, [2]int{start, slot})
+	}
+	return ranges
+}
+
+func (n *clusterNode) flagsString() string {
+	names := []string{}
+	for _, f := range clusterNodeFlagNames {
+		if n.is(f.flag) {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+func (n *clusterNode) addReplica(r *clusterNode) {
+	if !slices.Contains(n.replicas, r) {
+		n.replicas = append(n.replicas, r)
+	}
+}
+
+func (n *clusterNode) removeReplica(r *clusterNode) {
+	n.replicas = slices.DeleteFunc(n.replicas, func(x *clusterNode) bool { return x == r })
+}
+
+// clusterState is the view of the cluster of this node.
+// It's protected by Server.mu.
+type clusterState struct {
+	myself       *clusterNode
+	currentEpoch int
+	// the epoch this node voted in for a replica failover, a master votes once per epoch.
+	lastVoteEpoch int
+	nodes         map[string]*clusterNode
+	slots         [clusterSlots]*clusterNode
+	// the slot is migrating to another node, or importing from another node, see CLUSTER SETSLOT.
+	migratingTo   [clusterSlots]*clusterNode
+	importingFrom [clusterSlots]*clusterNode
+	ok            bool
+	// the nodes forgotten recently are not added back by gossip, see CLUSTER FORGET.
+	blacklist map[string]time.Time
+
+	// the election of this replica, see handleReplicaFailover.
+	failoverAuthTime  time.Time
+	failoverAuthCount int
+	failoverAuthSent  bool
+	failoverAuthRank  int
+	failoverAuthEpoch int
+
+	// the manual failover in progress, see CLUSTER FAILOVER.
+	mfEnd time.Time
+	// for a master, the replica failing over, and the job pausing the writes.
+	mfReplica *clusterNode
+	mfPause   *pendingFailover
+	// for a replica, the offset of the paused master, -1 until it's received.
+	mfMasterOffset int
+	mfCanStart     bool
+
+	// the config is saved, and the state is updated, before the lock is released.
+	todoSave        bool
+	todoUpdateState bool
+
+	configFile          string
+	nodeTimeout         time.Duration
+	validityFactor      int
+	requireFullCoverage bool
+}
+
+func newClusterState(conf *Config) *clusterState {
+	myself := newClusterNode("", nodeMyself|nodeMaster)
+	myself.port, _ = strconv.Atoi(conf.port)
+	myself.cport = conf.clusterPort
+	if myself.cport == 0 {
+		myself.cport = myself.port + clusterPortIncr
+	}
+	c := &clusterState{
+		myself:              myself,
+		nodes:               map[string]*clusterNode{myself.id: myself},
+		blacklist:           map[string]time.Time{},
+		mfMasterOffset:      -1,
+		configFile:          conf.clusterConfigFile,
+		nodeTimeout:         time.Duration(conf.clusterNodeTimeout) * time.Millisecond,
+		validityFactor:      conf.clusterReplicaValidityFactor,
+		requireFullCoverage: conf.clusterRequireFullCoverage,
+	}
+	c.updateState()
+	return c
+}
+
+// keyHashSlot maps the key to a slot. If the key contains `{...}` with at least one
+// character in between, only the hashtag is hashed, so related keys can be in the same slot.
+func keyHashSlot(key []byte) int {
+	if start := bytes.IndexByte(key, '{'); start >= 0 {
+		if end := bytes.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(util.Crc16(key)) % clusterSlots
+}
+
+// addSlot assigns the slot to the node, it returns false if the slot is assigned already.
+func (c *clusterState) addSlot(n *clusterNode, slot int) bool {
+	if c.slots[slot] != nil {
+		return false
+	}
+	n.setSlot(slot)
+	c.slots[slot] = n
+	return true
+}
+
+func (c *clusterState) delSlot(slot int) bool {
+	n := c.slots[slot]
+	if n == nil {
+		return false
+	}
+	n.clearSlot(slot)
+	c.slots[slot] = nil
+	return true
+}
+
+// bumpConfigEpochWithoutConsensus takes a new config epoch without the election, unless
+// this node has the greatest epoch already. It reports whether the epoch is changed.
+func (c *clusterState) bumpConfigEpochWithoutConsensus() bool {
+	maxEpoch := c.currentEpoch
+	for _, n := range c.nodes {
+		maxEpoch = max(maxEpoch, n.configEpoch)
+	}
+	if c.myself.configEpoch != 0 && c.myself.configEpoch == maxEpoch {
+		return false
+	}
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+	c.todoSave = true
+	return true
+}
+
+// updateState updates the state of the cluster: it's down if a slot isn't served,
+// unless cluster-require-full-coverage is no, or this node is in the minority partition.
+func (c *clusterState) updateState() {
+	c.todoUpdateState = false
+	ok := true
+	if c.requireFullCoverage {
+		for _, n := range c.slots {
+			if n == nil || n.is(nodeFail) {
+				ok = false
+				break
+			}
+		}
+	}
+	reachable := 0
+	for _, n := range c.nodes {
+		if n.is(nodeMaster) && n.numSlots > 0 && !n.is(nodePFail|nodeFail) {
+			reachable++
+		}
+	}
+	if reachable < c.size()/2+1 {
+		ok = false
+	}
+	if ok != c.ok {
+		fmt.Printf("Cluster state changed: %s\n", map[bool]string{true: "ok", false: "fail"}[ok])
+	}
+	c.ok = ok
+}
+
+// size returns the number of the masters serving at least a slot.
+func (c *clusterState) size() int {
+	n := 0
+	for _, node := range c.nodes {
+		if node.is(nodeMaster) && node.numSlots > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// addNode must be called with s.mu held, the link to the node is started by clusterCron.
+func (c *clusterState) addNode(n *clusterNode) {
+	c.nodes[n.id] = n
+	c.todoSave = true
+}
+
+// delNode deletes the node, and its slots and failure reports.
+func (c *clusterState) delNode(n *clusterNode) {
+	for slot := 0; slot < clusterSlots; slot++ {
+		if c.slots[slot] == n {
+			c.delSlot(slot)
+		}
+		if c.migratingTo[slot] == n {
+			c.migratingTo[slot] = nil
+		}
+		if c.importingFrom[slot] == n {
+			c.importingFrom[slot] = nil
+		}
+	}
+	for _, other := range c.nodes {
+		delete(other.failReports, n)
+	}
+	if n.master != nil {
+		n.master.removeReplica(n)
+	}
+	for _, r := range n.replicas {
+		r.master = nil
+	}
+	c.freeLink(n)
+	delete(c.nodes, n.id)
+	c.todoSave = true
+	c.todoUpdateState = true
+}
+
+// renameNode sets the real id of a node in handshake.
+func (c *clusterState) renameNode(n *clusterNode, id string) {
+	fmt.Printf("Renaming node %s into %s\n", n.id, id)
+	delete(c.nodes, n.id)
+	n.id = id
+	c.nodes[id] = n
+	c.todoSave = true
+}
+
+// freeLink closes the outbound link to the node, clusterCron starts a new one.
+func (c *clusterState) freeLink(n *clusterNode) {
+	n.gen++
+	n.linking = false
+	if n.link != nil {
+		n.link.Close()
+		n.link = nil
+	}
+}
+
+// delNodeSlots unassigns the slots of the node.
+func (c *clusterState) delNodeSlots(n *clusterNode) {
+	for slot := 0; slot < clusterSlots; slot++ {
+		if c.slots[slot] == n {
+			c.delSlot(slot)
+		}
+	}
+	c.todoUpdateState = true
+}
+
+// setNodeAsMaster turns a replica into a master.
+func (c *clusterState) setNodeAsMaster(n *clusterNode) {
+	if n.is(nodeMaster) {
+		return
+	}
+	if n.master != nil {
+		n.master.removeReplica(n)
+	}
+	n.master = nil
+	n.flags &^= nodeReplica
+	n.flags |= nodeMaster
+	c.todoSave = true
+	c.todoUpdateState = true
+}
+
+func (c *clusterState) sortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		nodes = append(nodes, n)
+	}
+	slices.SortFunc(nodes, func(a, b *clusterNode) int { return strings.Compare(a.id, b.id) })
+	return nodes
+}
+
+// nodeIP returns the ip of the node, this node doesn't know its own ip until other nodes
+// tell it, the address the client connected to is used meanwhile.
+func nodeIP(n *clusterNode, conn *Conn) string {
+	if n.ip == "" && n.is(nodeMyself) && conn != nil && conn.netConn != nil {
+		ip, _, _ := net.SplitHostPort(conn.netConn.LocalAddr().String())
+		return ip
+	}
+	return n.ip
+}
+
+func nodeAddr(n *clusterNode, conn *Conn) string {
+	return net.JoinHostPort(nodeIP(n, conn), strconv.Itoa(n.port))
+}
+
+// describeNode returns the line of the node in CLUSTER NODES and nodes.conf:
+// `<id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> ...`.
+func (c *clusterState) describeNode(n *clusterNode, conn *Conn) string {
+	master := "-"
+	if n.master != nil {
+		master = n.master.id
+	}
+	linkState := "connected"
+	if !n.is(nodeMyself) && n.link == nil {
+		linkState = "disconnected"
+	}
+	fields := []string{
+		n.id,
+		fmt.Sprintf("%s:%d@%d", nodeIP(n, conn), n.port, n.cport),
+		n.flagsString(),
+		master,
+		strconv.FormatInt(unixMilli(n.pingSent), 10),
+		strconv.FormatInt(unixMilli(n.pongReceived), 10),
+		strconv.Itoa(n.configEpoch),
+		linkState,
+	}
+	for _, r := range n.slotRanges() {
+		if r[0] == r[1] {
+			fields = append(fields, strconv.Itoa(r[0]))
+		} else {
+			fields = append(fields, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	if n.is(nodeMyself) {
+		for slot := 0; slot < clusterSlots; slot++ {
+			if to := c.migratingTo[slot]; to != nil {
+				fields = append(fields, fmt.Sprintf("[%d->-%s]", slot, to.id))
+			}
+			if from := c.importingFrom[slot]; from != nil {
+				fields = append(fields, fmt.Sprintf("[%d-<-%s]", slot, from.id))
+			}
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// getNodeByQuery finds out if the command can be served by this node, and returns the
+// error code and message of the redirection otherwise:
+//   - CROSSSLOT if the keys are in different slots;
+//   - MOVED if the slot is served by another node;
+//   - ASK if the slot is migrating, and a key is not here anymore;
+//   - CLUSTERDOWN if the slot isn't served, or the cluster is down.
+//
+// It must be called with s.mu held.
+func (s *Server) getNodeByQuery(conn *Conn, spec *commandSpec, cmd Command) (string, string) {
+	c := s.cluster
+	keys := spec.keys(cmd)
+	if len(keys) == 0 {
+		return "", ""
+	}
+	slot := -1
+	missing := 0
+	for _, pos := range keys {
+		key := cmd.At(pos)
+		ks := keyHashSlot(key)
+		if slot == -1 {
+			slot = ks
+		} else if ks != slot {
+			return "CROSSSLOT", "Keys in request don't hash to the same slot"
+		}
+		if !s.store.Exists(string(key)) {
+			missing++
+		}
+	}
+
+	n := c.slots[slot]
+	if n == nil {
+		return "CLUSTERDOWN", "Hash slot not served"
+	}
+	if !c.ok {
+		return "CLUSTERDOWN", "The cluster is down"
+	}
+
+	myself := c.myself
+	if n == myself && c.migratingTo[slot] != nil && missing > 0 {
+		if missing < len(keys) {
+			return "TRYAGAIN", "Multiple keys request during rehashing of slot"
+		}
+		return "ASK", fmt.Sprintf("%d %s", slot, nodeAddr(c.migratingTo[slot], conn))
+	}
+	asking := conn.asking || spec.flags&flagAsking != 0
+	if n != myself && c.importingFrom[slot] != nil && asking {
+		if len(keys) > 1 && missing > 0 {
+			return "TRYAGAIN", "Multiple keys request during rehashing of slot"
+		}
+		return "", ""
+	}
+	// a replica serves the reads of the slots of its master to the READONLY clients.
+	if n != myself && conn.readOnly && spec.flags&flagReadOnly != 0 &&
+		myself.is(nodeReplica) && myself.master == n {
+		return "", ""
+	}
+	if n != myself {
+		return "MOVED", fmt.Sprintf("%d %s", slot, nodeAddr(n, conn))
+	}
+	return "", ""
+}
+
+// infoCluster returns the cluster section of INFO.
+func (s *Server) infoCluster() string {
+	return fmt.Sprintf("# Cluster\r\ncluster_enabled:%d\r\n", boolToInt(s.cluster != nil))
+}
+
+// asking handles ASKING, the next command of the client is served if the slot is importing.
+func (s *Server) asking(conn *Conn, _ Command) error {
+	if s.cluster == nil {
+		return conn.WriteError("This instance has cluster support disabled")
+	}
+	conn.asking = true
+	return conn.WriteStatusOK()
+}
+
+// readonly handles READONLY, a replica serves the reads of the client.
+func (s *Server) readonly(conn *Conn, _ Command) error {
+	if s.cluster == nil {
+		return conn.WriteError("This instance has cluster support disabled")
+	}
+	conn.readOnly = true
+	return conn.WriteStatusOK()
+}
+
+func (s *Server) readwrite(conn *Conn, _ Command) error {
+	if s.cluster == nil {
+		return conn.WriteError("This instance has cluster support disabled")
+	}
+	conn.readOnly = false
+	return conn.WriteStatusOK()
+}
+
+// clusterCommand handles the CLUSTER subcommands.
+func (s *Server) clusterCommand(conn *Conn, cmd Command) error {
+	if s.cluster == nil {
+		return conn.WriteError("This instance has cluster support disabled")
+	}
+	c := s.cluster
+	// the config changed by the subcommand is saved before the reply.
+	defer s.clusterBeforeUnlock()
+	args := cmd.Args()
+	sub := strings.ToLower(string(args[1]))
+	arity := map[string]int{
+		"info":                  2,
+		"myid":                  2,
+		"nodes":                 2,
+		"slots":                 2,
+		"shards":                2,
+		"keyslot":               3,
+		"countkeysinslot":       3,
+		"getkeysinslot":         4,
+		"addslots":              -3,
+		"addslotsrange":         -4,
+		"delslots":              -3,
+		"delslotsrange":         -4,
+		"flushslots":            2,
+		"meet":                  -4,
+		"forget":                3,
+		"replicate":             3,
+		"replicas":              3,
+		"slaves":                3,
+		"count-failure-reports": 3,
+		"failover":              -2,
+		"reset":                 -2,
+		"saveconfig":            2,
+		"setslot":               -4,
+	}
+	n, ok := arity[sub]
+	if !ok || (n > 0 && len(args) != n) || len(args) < -n {
+		return conn.WriteError(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%s'. Try CLUSTER HELP.", args[1]))
+	}
+
+	switch sub {
+	case "info":
+		return conn.WriteVerbatim(s.clusterInfo())
+	case "myid":
+		return conn.WriteString(c.myself.id)
+	case "nodes":
+		lines := []string{}
+		for _, node := range c.sortedNodes() {
+			lines = append(lines, c.describeNode(node, conn))
+		}
+		return conn.WriteVerbatim(strings.Join(lines, "\n") + "\n")
+	case "slots":
+		return conn.WriteRawBytes(s.clusterSlotsReply(conn))
+	case "shards":
+		return conn.WriteRawBytes(s.clusterShardsReply(conn))
+	case "keyslot":
+		return conn.WriteInt(keyHashSlot(args[2]))
+	case "countkeysinslot", "getkeysinslot":
+		slot, err := strconv.Atoi(string(args[2]))
+		if err != nil || slot < 0 || slot >= clusterSlots {
+			return conn.WriteError("Invalid slot")
+		}
+		count := -1
+		if sub == "getkeysinslot" {
+			if count, err = strconv.Atoi(string(args[3])); err != nil || count < 0 {
+				return conn.WriteError("Invalid number of keys")
+			}
+		}
+		keys := s.keysInSlot(slot, count)
+		if sub == "countkeysinslot" {
+			return conn.WriteInt(len(keys))
+		}
+		return conn.WriteSlice(keys)
+	case "addslots", "delslots", "addslotsrange", "delslotsrange":
+		slots, msg := parseSlots(args[2:], strings.HasSuffix(sub, "range"))
+		if msg != "" {
+			return conn.WriteError(msg)
+		}
+		add := strings.HasPrefix(sub, "add")
+		for _, slot := range slots {
+			if add && c.slots[slot] != nil {
+				return conn.WriteError(fmt.Sprintf("Slot %d is already busy", slot))
+			}
+			if !add && c.slots[slot] == nil {
+				return conn.WriteError(fmt.Sprintf("Slot %d is already unassigned", slot))
+			}
+		}
+		for _, slot := range slots {
+			if add {
+				c.importingFrom[slot] = nil
+				c.addSlot(c.myself, slot)
+			} else {
+				c.delSlot(slot)
+			}
+		}
+		c.todoSave = true
+		c.updateState()
+		return conn.WriteStatusOK()
+	case "flushslots":
+		if s.keysCount() > 0 {
+			return conn.WriteError("DB must be empty to perform CLUSTER FLUSHSLOTS.")
+		}
+		c.delNodeSlots(c.myself)
+		c.todoSave = true
+		c.updateState()
+		return conn.WriteStatusOK()
+	case "meet":
+		return s.clusterMeet(conn, args[2:])
+	case "forget":
+		return s.clusterForget(conn, string(args[2]))
+	case "replicate":
+		return s.clusterReplicate(conn, string(args[2]))
+	case "replicas", "slaves":
+		node := c.nodes[string(args[2])]
+		if node == nil {
+			return conn.WriteError(fmt.Sprintf("Unknown node %s", args[2]))
+		}
+		if node.is(nodeReplica) {
+			return conn.WriteError("The specified node is not a master")
+		}
+		lines := []string{}
+		for _, r := range node.replicas {
+			lines = append(lines, c.describeNode(r, conn))
+		}
+		return conn.WriteSlice(lines)
+	case "count-failure-reports":
+		node := c.nodes[string(args[2])]
+		if node == nil {
+			return conn.WriteError(fmt.Sprintf("Unknown node %s", args[2]))
+		}
+		return conn.WriteInt(c.countFailureReports(node))
+	case "failover":
+		return s.clusterFailover(conn, args[2:])
+	case "reset":
+		return s.clusterReset(conn, args[2:])
+	case "setslot":
+		return s.clusterSetSlot(conn, args[2:])
+	case "saveconfig":
+		if err := s.clusterSaveConfig(); err != nil {
+			return conn.WriteError(fmt.Sprintf("error saving the cluster node config: %s", err.Error()))
+		}
+		return conn.WriteStatusOK()
+	}
+	return nil
+}
+
+// clusterMeet handles `CLUSTER MEET ip port [cluster-bus-port]`, the node is added to
+// the cluster once the handshake is done.
+func (s *Server) clusterMeet(conn *Conn, args [][]byte) error {
+	if len(args) > 3 {
+		return conn.WriteError("syntax error")
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return conn.WriteError(fmt.Sprintf("Invalid base port specified: %s", args[1]))
+	}
+	cport := port + clusterPortIncr
+	if len(args) == 3 {
+		if cport, err = strconv.Atoi(string(args[2])); err != nil {
+			return conn.WriteError(fmt.Sprintf("Invalid bus port specified: %s", args[2]))
+		}
+	}
+	if !s.cluster.startHandshake(string(args[0]), port, cport) {
+		return conn.WriteError(fmt.Sprintf("Invalid node address specified: %s:%s", args[0], args[1]))
+	}
+	return conn.WriteStatusOK()
+}
+
+// clusterForget handles `CLUSTER FORGET node-id`, the node isn't added back by
+// the gossip of the other nodes for a minute.
+func (s *Server) clusterForget(conn *Conn, id string) error {
+	c := s.cluster
+	n := c.nodes[id]
+	if n == nil {
+		return conn.WriteError(fmt.Sprintf("Unknown node %s", id))
+	}
+	if n == c.myself {
+		return conn.WriteError("I tried hard but I can't forget myself...")
+	}
+	if c.myself.is(nodeReplica) && c.myself.master == n {
+		return conn.WriteError("Can't forget my master!")
+	}
+	c.blacklist[id] = time.Now().Add(clusterBlacklistTTL)
+	c.delNode(n)
+	return conn.WriteStatusOK()
+}
+
+// clusterReplicate handles `CLUSTER REPLICATE node-id`, this node becomes a replica of the master.
+func (s *Server) clusterReplicate(conn *Conn, id string) error {
+	c := s.cluster
+	n := c.nodes[id]
+	if n == nil {
+		return conn.WriteError(fmt.Sprintf("Unknown node %s", id))
+	}
+	if n == c.myself {
+		return conn.WriteError("Can't replicate myself")
+	}
+	if n.is(nodeReplica) {
+		return conn.WriteError("I can only replicate a master, not a replica.")
+	}
+	if c.myself.is(nodeMaster) && (c.myself.numSlots != 0 || s.keysCount() > 0) {
+		return conn.WriteError("To set a master the node must be empty and without assigned slots.")
+	}
+	s.clusterSetMaster(n)
+	return conn.WriteStatusOK()
+}
+
+// clusterFailover handles `CLUSTER FAILOVER [FORCE | TAKEOVER]` sent to a replica:
+//   - by default, the master pauses the writes, and the replica starts the election once
+//     it catches up with the master;
+//   - FORCE starts the election at once, the master may be down;
+//   - TAKEOVER promotes the replica without the election, it takes a new config epoch.
+func (s *Server) clusterFailover(conn *Conn, args [][]byte) error {
+	c := s.cluster
+	force, takeover := false, false
+	if len(args) > 1 {
+		return conn.WriteError("syntax error")
+	}
+	if len(args) == 1 {
+		switch strings.ToLower(string(args[0])) {
+		case proto.OptionForce:
+			force = true
+		case proto.OptionTakeover:
+			takeover = true
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+	master := c.myself.master
+	if c.myself.is(nodeMaster) {
+		return conn.WriteError("You should send CLUSTER FAILOVER to a replica")
+	}
+	if master == nil {
+		return conn.WriteError("I'm a replica but my master is unknown to me")
+	}
+	if !force && !takeover && (master.is(nodeFail) || master.link == nil) {
+		return conn.WriteError("Master is down or failed, please use CLUSTER FAILOVER FORCE")
+	}
+
+	s.clusterResetManualFailover()
+	c.mfEnd = time.Now().Add(clusterMFTimeout)
+	switch {
+	case takeover:
+		fmt.Println("Taking over the master (user request).")
+		c.bumpConfigEpochWithoutConsensus()
+		s.clusterFailoverReplaceYourMaster()
+	case force:
+		fmt.Println("Forced failover user request accepted.")
+		c.mfCanStart = true
+	default:
+		fmt.Println("Manual failover user request accepted.")
+		master.link.WriteRawBytes(s.clusterBuildMsg(clusterMsgMFStart).encode())
+	}
+	return conn.WriteStatusOK()
+}
+
+// clusterSetSlot handles `CLUSTER SETSLOT slot IMPORTING node-id | MIGRATING node-id | NODE node-id | STABLE`,
+// the steps to move a slot between the masters:
+//  1. SETSLOT IMPORTING on the target, and SETSLOT MIGRATING on the source;
+//  2. MIGRATE the keys of the slot from the source to the target;
+//  3. SETSLOT NODE target on the target and the source, the target takes the slot with a new epoch.
+func (s *Server) clusterSetSlot(conn *Conn, args [][]byte) error {
+	c := s.cluster
+	myself := c.myself
+	if myself.is(nodeReplica) {
+		return conn.WriteError("Please use SETSLOT only with masters.")
+	}
+	slot, err := strconv.Atoi(string(args[0]))
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return conn.WriteError("Invalid or out of range slot")
+	}
+	action := strings.ToLower(string(args[1]))
+	var n *clusterNode
+	if action != proto.OptionStable {
+		if len(args) != 3 {
+			return conn.WriteError("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		}
+		if n = c.nodes[string(args[2])]; n == nil {
+			return conn.WriteError(fmt.Sprintf("I don't know about node %s", args[2]))
+		}
+		if n.is(nodeReplica) {
+			return conn.WriteError("Target node is not a master")
+		}
+	} else if len(args) != 2 {
+		return conn.WriteError("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+
+	switch action {
+	case proto.OptionMigrating:
+		if c.slots[slot] != myself {
+			return conn.WriteError(fmt.Sprintf("I'm not the owner of hash slot %d", slot))
+		}
+		c.migratingTo[slot] = n
+	case proto.OptionImporting:
+		if c.slots[slot] == myself {
+			return conn.WriteError(fmt.Sprintf("I'm already the owner of hash slot %d", slot))
+		}
+		c.importingFrom[slot] = n
+	case proto.OptionStable:
+		c.migratingTo[slot] = nil
+		c.importingFrom[slot] = nil
+	case proto.OptionNode:
+		hasKeys := len(s.keysInSlot(slot, 1)) > 0
+		if c.slots[slot] == myself && n != myself && hasKeys {
+			return conn.WriteError(fmt.Sprintf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		// the migration is done once all the keys are moved.
+		if !hasKeys {
+			c.migratingTo[slot] = nil
+		}
+		importing := c.importingFrom[slot] != nil
+		c.delSlot(slot)
+		c.addSlot(n, slot)
+		if n == myself && importing {
+			c.importingFrom[slot] = nil
+			// the other nodes accept the slot with the greatest epoch, the slot is taken without
+			// the election, like TAKEOVER.
+			if c.bumpConfigEpochWithoutConsensus() {
+				fmt.Printf("configEpoch updated after importing slot %d\n", slot)
+			}
+			s.clusterBroadcastPong(false)
+		}
+	default:
+		return conn.WriteError("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	c.todoSave = true
+	c.updateState()
+	return conn.WriteStatusOK()
+}
+
+// clusterReset handles `CLUSTER RESET [HARD | SOFT]`, the node forgets all the other nodes
+// and its slots, a replica becomes an empty master. HARD also resets the epochs and the id.
+func (s *Server) clusterReset(conn *Conn, args [][]byte) error {
+	c := s.cluster
+	hard := false
+	if len(args) > 1 {
+		return conn.WriteError("syntax error")
+	}
+	if len(args) == 1 {
+		switch strings.ToLower(string(args[0])) {
+		case proto.OptionHard:
+			hard = true
+		case proto.OptionSoft:
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+	if c.myself.is(nodeMaster) && s.keysCount() > 0 {
+		return conn.WriteError("CLUSTER RESET can't be called with master nodes containing keys")
+	}
+
+	myself := c.myself
+	if myself.is(nodeReplica) {
+		c.setNodeAsMaster(myself)
+		s.becomeMaster()
+		s.store = storage.NewStore()
+	}
+	s.clusterResetManualFailover()
+	for slot := 0; slot < clusterSlots; slot++ {
+		c.delSlot(slot)
+		c.migratingTo[slot] = nil
+		c.importingFrom[slot] = nil
+	}
+	for _, n := range c.nodes {
+		if n != myself {
+			c.delNode(n)
+		}
+	}
+	if hard {
+		c.currentEpoch = 0
+		c.lastVoteEpoch = 0
+		myself.configEpoch = 0
+		c.renameNode(myself, util.RandomHexString(40))
+	}
+	c.todoSave = true
+	c.updateState()
+	return conn.WriteStatusOK()
+}
+
+// parseSlots parses `slot [slot ...]`, or `start end [start end ...]` if ranges is true.
+func parseSlots(args [][]byte, ranges bool) ([]int, string) {
+	nums := make([]int, len(args))
+	for i, arg := range args {
+		v, err := strconv.Atoi(string(arg))
+		if err != nil || v < 0 || v >= clusterSlots {
+			return nil, "Invalid or out of range slot"
+		}
+		nums[i] = v
+	}
+	if !ranges {
+		seen := map[int]bool{}
+		for _, slot := range nums {
+			if seen[slot] {
+				return nil, fmt.Sprintf("Slot %d specified multiple times", slot)
+			}
+			seen[slot] = true
+		}
+		return nums, ""
+	}
+	if len(nums)%2 != 0 {
+		return nil, "wrong number of arguments for 'cluster|addslotsrange' command"
+	}
+	slots := []int{}
+	seen := map[int]bool{}
+	for i := 0; i < len(nums); i += 2 {
+		if nums[i] > nums[i+1] {
+			return nil, fmt.Sprintf("start slot number %d is greater than end slot number %d", nums[i], nums[i+1])
+		}
+		for slot := nums[i]; slot <= nums[i+1]; slot++ {
+			if seen[slot] {
+				return nil, fmt.Sprintf("Slot %d specified multiple times", slot)
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots, ""
+}
+
+// keysInSlot returns at most count keys of the slot, all of them if count < 0.
+func (s *Server) keysInSlot(slot int, count int) []string {
+	keys := []string{}
+	s.store.ForEachKey(func(key string) {
+		if keyHashSlot([]byte(key)) == slot {
+			keys = append(keys, key)
+		}
+	})
+	slices.Sort(keys)
+	if count >= 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+func (s *Server) keysCount() int {
+	strs, streams := s.store.Len()
+	return strs + streams
+}
+
+func (s *Server) clusterInfo() string {
+	c := s.cluster
+	assigned, pfail, fail := 0, 0, 0
+	for _, n := range c.slots {
+		if n == nil {
+			continue
+		}
+		assigned++
+		if n.is(nodeFail) {
+			fail++
+		} else if n.is(nodePFail) {
+			pfail++
+		}
+	}
+	state := "fail"
+	if c.ok {
+		state = "ok"
+	}
+	lines := []string{
+		fmt.Sprintf("cluster_state:%s", state),
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", len(c.nodes)),
+		fmt.Sprintf("cluster_size:%d", c.size()),
+		fmt.Sprintf("cluster_current_epoch:%d", c.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", c.myselfEpoch()),
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// myselfEpoch returns the config epoch of this node, or of its master if it's a replica.
+func (c *clusterState) myselfEpoch() int {
+	if c.myself.master != nil {
+		return c.myself.master.configEpoch
+	}
+	return c.myself.configEpoch
+}
+
+// clusterSlotsReply returns the reply of CLUSTER SLOTS:
+// `[[start, end, [ip, port, id, metadata], <replicas>...], ...]`.
+func (s *Server) clusterSlotsReply(conn *Conn) []byte {
+	type slotRange struct {
+		start, end int
+		master     *clusterNode
+	}
+	ranges := []slotRange{}
+	for _, n := range s.cluster.sortedNodes() {
+		if !n.is(nodeMaster) {
+			continue
+		}
+		for _, r := range n.slotRanges() {
+			ranges = append(ranges, slotRange{r[0], r[1], n})
+		}
+	}
+	slices.SortFunc(ranges, func(a, b slotRange) int { return a.start - b.start })
+
+	nodeReply := func(n *clusterNode) []byte {
+		b := proto.ArrayHeader(4)
+		b = append(b, proto.String(nodeIP(n, conn))...)
+		b = append(b, proto.Integer(n.port)...)
+		b = append(b, proto.String(n.id)...)
+		return append(b, proto.ArrayHeader(0)...)
+	}
+	b := proto.ArrayHeader(len(ranges))
+	for _, r := range ranges {
+		replicas := []*clusterNode{}
+		for _, replica := range r.master.replicas {
+			if !replica.is(nodeFail) {
+				replicas = append(replicas, replica)
+			}
+		}
+		b = append(b, proto.ArrayHeader(3+len(replicas))...)
+		b = append(b, proto.Integer(r.start)...)
+		b = append(b, proto.Integer(r.end)...)
+		b = append(b, nodeReply(r.master)...)
+		for _, replica := range replicas {
+			b = append(b, nodeReply(replica)...)
+		}
+	}
+	return b
+}
+
+// clusterShardsReply returns the reply of CLUSTER SHARDS, a shard is a master and its
+// replicas: `[["slots", [start, end, ...], "nodes", [<node>, ...]], ...]`, the shards and the nodes
+// are maps in RESP3.
+func (s *Server) clusterShardsReply(conn *Conn) []byte {
+	shards := []*clusterNode{}
+	for _, n := range s.cluster.sortedNodes() {
+		if n.is(nodeMaster) {
+			shards = append(shards, n)
+		}
+	}
+	nodeReply := func(n *clusterNode) []byte {
+		role, health := "master", "online"
+		if n.is(nodeReplica) {
+			role = "replica"
+		}
+		if n.is(nodeFail) || n.is(nodePFail) {
+			health = "fail"
+		}
+		offset := n.replOffset
+		if n.is(nodeMyself) {
+			offset = s.replOffset
+		}
+		b := conn.mapHeader(7)
+		for _, kv := range [][2]string{{"id", n.id}, {"ip", nodeIP(n, conn)}, {"endpoint", nodeIP(n, conn)}, {"role", role}, {"health", health}} {
+			b = append(b, proto.String(kv[0])...)
+			b = append(b, proto.String(kv[1])...)
+		}
+		b = append(b, proto.String("port")...)
+		b = append(b, proto.Integer(n.port)...)
+		b = append(b, proto.String("replication-offset")...)
+		return append(b, proto.Integer(offset)...)
+	}
+	b := proto.ArrayHeader(len(shards))
+	for _, m := range shards {
+		ranges := m.slotRanges()
+		b = append(b, conn.mapHeader(2)...)
+		b = append(b, proto.String("slots")...)
+		b = append(b, proto.ArrayHeader(2*len(ranges))...)
+		for _, r := range ranges {
+			b = append(b, proto.Integer(r[0])...)
+			b = append(b, proto.Integer(r[1])...)
+		}
+		b = append(b, proto.String("nodes")...)
+		b = append(b, proto.ArrayHeader(1+len(m.replicas))...)
+		b = append(b, nodeReply(m)...)
+		for _, r := range m.replicas {
+			b = append(b, nodeReply(r)...)
+		}
+	}
+	return b
+}
@@ -0,0 +1,957 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+const (
+	clusterTickInterval   = 100 * time.Millisecond
+	clusterConnectTimeout = time.Second
+	// a failure report is valid for node timeout * clusterFailReportValidityMult.
+	clusterFailReportValidityMult = 2
+	// a master failing is cleared after node timeout * clusterFailUndoTimeMult if it's reachable again.
+	clusterFailUndoTimeMult = 2
+	clusterBlacklistTTL     = time.Minute
+)
+
+// the types of the messages of the cluster bus.
+const (
+	clusterMsgPing = "ping"
+	clusterMsgPong = "pong"
+	// MEET is PING forcing the receiver to add the sender to the cluster.
+	clusterMsgMeet = "meet"
+	clusterMsgFail = "fail"
+	// UPDATE tells the sender of an old config the new config of the slots of a node.
+	clusterMsgUpdate              = "update"
+	clusterMsgFailoverAuthRequest = "failover-auth-request"
+	clusterMsgFailoverAuthAck     = "failover-auth-ack"
+	// MFSTART asks the master to pause the writes for a manual failover.
+	clusterMsgMFStart = "mfstart"
+)
+
+// the flags of a message about the manual failover.
+const (
+	// the master is paused for a manual failover.
+	clusterMsgFlagPaused = 1 << iota
+	// the master votes for the replica even if it isn't failing.
+	clusterMsgFlagForceAck
+)
+
+var errInvalidClusterMsg = errors.New("invalid cluster bus message")
+
+// clusterGossip is what the sender knows about another node.
+type clusterGossip struct {
+	id           string
+	pingSent     int64
+	pongReceived int64
+	ip           string
+	port         int
+	cport        int
+	flags        clusterNodeFlag
+}
+
+// clusterMsg is a message of the cluster bus, it's sent as a RESP array:
+// `<type> <sender> <current-epoch> <config-epoch> <offset> <ip> <port> <cport> <flags> <master>
+// <slots> <mflags> <count> [<gossip> ...] [<data> ...]`.
+// The sender reports the config epoch and the slots of its master if it's a replica.
+type clusterMsg struct {
+	typ          string
+	sender       string
+	currentEpoch int
+	configEpoch  int
+	offset       int
+	ip           string
+	port         int
+	cport        int
+	flags        clusterNodeFlag
+	master       string
+	slots        [clusterSlots / 8]byte
+	mflags       int
+	gossip       []clusterGossip
+
+	// the failing node of FAIL, or the node of UPDATE.
+	node            string
+	nodeConfigEpoch int
+	nodeSlots       [clusterSlots / 8]byte
+}
+
+func (msg *clusterMsg) encode() []byte {
+	args := []string{
+		msg.typ,
+		msg.sender,
+		strconv.Itoa(msg.currentEpoch),
+		strconv.Itoa(msg.configEpoch),
+		strconv.Itoa(msg.offset),
+		msg.ip,
+		strconv.Itoa(msg.port),
+		strconv.Itoa(msg.cport),
+		strconv.Itoa(int(msg.flags)),
+		msg.master,
+		string(msg.slots[:]),
+		strconv.Itoa(msg.mflags),
+		strconv.Itoa(len(msg.gossip)),
+	}
+	for _, g := range msg.gossip {
+		args = append(args, g.id, strconv.FormatInt(g.pingSent, 10), strconv.FormatInt(g.pongReceived, 10),
+			g.ip, strconv.Itoa(g.port), strconv.Itoa(g.cport), strconv.Itoa(int(g.flags)))
+	}
+	switch msg.typ {
+	case clusterMsgFail:
+		args = append(args, msg.node)
+	case clusterMsgUpdate:
+		args = append(args, msg.node, strconv.Itoa(msg.nodeConfigEpoch), string(msg.nodeSlots[:]))
+	}
+	return proto.Array(args)
+}
+
+// msgDecoder decodes the fields of a message one by one, the first error is kept.
+type msgDecoder struct {
+	args [][]byte
+	err  error
+}
+
+func (d *msgDecoder) next() []byte {
+	if len(d.args) == 0 {
+		d.err = errInvalidClusterMsg
+		return nil
+	}
+	b := d.args[0]
+	d.args = d.args[1:]
+	return b
+}
+
+func (d *msgDecoder) str() string {
+	return string(d.next())
+}
+
+func (d *msgDecoder) int() int {
+	v, err := strconv.Atoi(string(d.next()))
+	if err != nil && d.err == nil {
+		d.err = errInvalidClusterMsg
+	}
+	return v
+}
+
+func (d *msgDecoder) slots(dst *[clusterSlots / 8]byte) {
+	b := d.next()
+	if len(b) != len(dst) {
+		d.err = errInvalidClusterMsg
+		return
+	}
+	copy(dst[:], b)
+}
+
+func decodeClusterMsg(args [][]byte) (*clusterMsg, error) {
+	d := &msgDecoder{args: args}
+	msg := &clusterMsg{
+		typ:          d.str(),
+		sender:       d.str(),
+		currentEpoch: d.int(),
+		configEpoch:  d.int(),
+		offset:       d.int(),
+		ip:           d.str(),
+		port:         d.int(),
+		cport:        d.int(),
+		flags:        clusterNodeFlag(d.int()),
+		master:       d.str(),
+	}
+	d.slots(&msg.slots)
+	msg.mflags = d.int()
+	count := d.int()
+	for i := 0; i < count && d.err == nil; i++ {
+		msg.gossip = append(msg.gossip, clusterGossip{
+			id:           d.str(),
+			pingSent:     int64(d.int()),
+			pongReceived: int64(d.int()),
+			ip:           d.str(),
+			port:         d.int(),
+			cport:        d.int(),
+			flags:        clusterNodeFlag(d.int()),
+		})
+	}
+	switch msg.typ {
+	case clusterMsgFail:
+		msg.node = d.str()
+	case clusterMsgUpdate:
+		msg.node = d.str()
+		msg.nodeConfigEpoch = d.int()
+		d.slots(&msg.nodeSlots)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return msg, nil
+}
+
+// clusterBuildMsg builds a message with the header of this node.
+// It must be called with s.mu held.
+func (s *Server) clusterBuildMsg(typ string) *clusterMsg {
+	c := s.cluster
+	myself := c.myself
+	master := myself
+	if myself.is(nodeReplica) && myself.master != nil {
+		master = myself.master
+	}
+	msg := &clusterMsg{
+		typ:          typ,
+		sender:       myself.id,
+		currentEpoch: c.currentEpoch,
+		configEpoch:  master.configEpoch,
+		offset:       s.replOffset,
+		port:         myself.port,
+		cport:        myself.cport,
+		flags:        myself.flags,
+		slots:        master.slots,
+	}
+	if myself.master != nil {
+		msg.master = myself.master.id
+	}
+	if myself.is(nodeMaster) && !c.mfEnd.IsZero() {
+		msg.mflags |= clusterMsgFlagPaused
+	}
+	return msg
+}
+
+// clusterPingMsg builds PING, PONG or MEET, with the gossip about some random nodes
+// and all the nodes possibly failing, target is the receiver if it's known.
+// It must be called with s.mu held.
+func (s *Server) clusterPingMsg(typ string, target *clusterNode) []byte {
+	c := s.cluster
+	msg := s.clusterBuildMsg(typ)
+	candidates, pfail := []*clusterNode{}, []*clusterNode{}
+	for _, n := range c.nodes {
+		if n == c.myself || n == target || n.is(nodeHandshake|nodeNoAddr) || (n.link == nil && n.numSlots == 0) {
+			continue
+		}
+		if n.is(nodePFail) {
+			pfail = append(pfail, n)
+		} else {
+			candidates = append(candidates, n)
+		}
+	}
+	// about 1/10 of the nodes, at least 3.
+	wanted := min(max(3, len(c.nodes)/10), len(candidates))
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	for _, n := range append(candidates[:wanted], pfail...) {
+		msg.gossip = append(msg.gossip, clusterGossip{
+			id:           n.id,
+			pingSent:     unixMilli(n.pingSent),
+			pongReceived: unixMilli(n.pongReceived),
+			ip:           n.ip,
+			port:         n.port,
+			cport:        n.cport,
+			flags:        n.flags,
+		})
+	}
+	return msg.encode()
+}
+
+// clusterSendPing sends PING or MEET to the node with its outbound link.
+// It must be called with s.mu held.
+func (s *Server) clusterSendPing(n *clusterNode, typ string) {
+	if n.link == nil {
+		return
+	}
+	if typ == clusterMsgPing && n.pingSent.IsZero() {
+		n.pingSent = time.Now()
+	}
+	n.link.WriteRawBytes(s.clusterPingMsg(typ, n))
+}
+
+// clusterBroadcast sends the message to all the connected nodes.
+// It must be called with s.mu held.
+func (s *Server) clusterBroadcast(b []byte) {
+	for _, n := range s.cluster.nodes {
+		if n.link != nil && !n.is(nodeMyself|nodeHandshake) {
+			n.link.WriteRawBytes(b)
+		}
+	}
+}
+
+// clusterBroadcastPong sends PONG to all the connected nodes, so they learn the new config
+// of this node, or to the other replicas of the master only if localReplicas is true.
+// It must be called with s.mu held.
+func (s *Server) clusterBroadcastPong(localReplicas bool) {
+	c := s.cluster
+	for _, n := range c.nodes {
+		if n.link == nil || n.is(nodeMyself|nodeHandshake) {
+			continue
+		}
+		if localReplicas && (!n.is(nodeReplica) || n.master == nil || n.master != c.myself.master) {
+			continue
+		}
+		n.link.WriteRawBytes(s.clusterPingMsg(clusterMsgPong, n))
+	}
+}
+
+// clusterSendFail tells all the nodes the node is failing.
+// It must be called with s.mu held.
+func (s *Server) clusterSendFail(n *clusterNode) {
+	msg := s.clusterBuildMsg(clusterMsgFail)
+	msg.node = n.id
+	s.clusterBroadcast(msg.encode())
+}
+
+// clusterSendUpdate tells the node the config of the slots of another node.
+// It must be called with s.mu held.
+func (s *Server) clusterSendUpdate(to *clusterNode, n *clusterNode) {
+	if to.link == nil {
+		return
+	}
+	msg := s.clusterBuildMsg(clusterMsgUpdate)
+	msg.node = n.id
+	msg.nodeConfigEpoch = n.configEpoch
+	msg.nodeSlots = n.slots
+	to.link.WriteRawBytes(msg.encode())
+}
+
+// serveClusterBus accepts the inbound links of the cluster bus.
+func (s *Server) serveClusterBus(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			fmt.Println("cluster bus accept error: ", err.Error())
+			return
+		}
+		go func() {
+			conn := NewConn(c)
+			defer conn.Close()
+			s.clusterReadLink(conn, nil)
+		}()
+	}
+}
+
+// clusterLinkLoop keeps the outbound link to the node, and reconnects every tick
+// if it's broken, until the link is freed.
+func (s *Server) clusterLinkLoop(n *clusterNode, gen int) {
+	for {
+		s.mu.Lock()
+		if n.gen != gen {
+			s.mu.Unlock()
+			return
+		}
+		addr := net.JoinHostPort(n.ip, strconv.Itoa(n.cport))
+		s.mu.Unlock()
+
+		c, err := net.DialTimeout(s.network, addr, clusterConnectTimeout)
+		s.mu.Lock()
+		if n.gen != gen {
+			s.mu.Unlock()
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if err != nil {
+			// an unreachable node is flagged PFAIL after node timeout, like a node not replying.
+			if n.pingSent.IsZero() {
+				n.pingSent = time.Now()
+			}
+			s.mu.Unlock()
+			time.Sleep(clusterTickInterval)
+			continue
+		}
+		conn := NewConn(c)
+		n.link = conn
+		// the ping is sent right away, the pending ping of the old link is kept.
+		pingSent := n.pingSent
+		if n.is(nodeMeet) {
+			s.clusterSendPing(n, clusterMsgMeet)
+			n.flags &^= nodeMeet
+		} else {
+			s.clusterSendPing(n, clusterMsgPing)
+		}
+		if !pingSent.IsZero() {
+			n.pingSent = pingSent
+		}
+		s.mu.Unlock()
+
+		s.clusterReadLink(conn, n)
+		s.mu.Lock()
+		if n.link == conn {
+			n.link = nil
+		}
+		s.mu.Unlock()
+		conn.Close()
+		time.Sleep(clusterTickInterval)
+	}
+}
+
+// clusterReadLink reads and processes the messages of the link until it's broken,
+// n is the node of an outbound link, or nil for an inbound link.
+func (s *Server) clusterReadLink(conn *Conn, n *clusterNode) {
+	for {
+		cmd, err := conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		msg, err := decodeClusterMsg(cmd.Args())
+		if err != nil {
+			fmt.Printf("cluster bus error from %v: %s\n", conn.netConn.RemoteAddr(), err.Error())
+			return
+		}
+		s.mu.Lock()
+		if n != nil && n.link != conn {
+			s.mu.Unlock()
+			return
+		}
+		keep := s.clusterProcessMsg(conn, n, msg)
+		s.clusterBeforeUnlock()
+		s.mu.Unlock()
+		if !keep {
+			return
+		}
+	}
+}
+
+// clusterProcessMsg processes a message of the link, n is the node of an outbound link,
+// or nil for an inbound link. It returns false if the link must be closed.
+// It must be called with s.mu held.
+func (s *Server) clusterProcessMsg(conn *Conn, n *clusterNode, msg *clusterMsg) bool {
+	c := s.cluster
+	now := time.Now()
+	sender := c.nodes[msg.sender]
+	if sender != nil && sender.is(nodeHandshake) {
+		sender = nil
+	}
+	if sender != nil {
+		sender.dataReceived = now
+		if msg.currentEpoch > c.currentEpoch {
+			c.currentEpoch = msg.currentEpoch
+			c.todoSave = true
+		}
+		if msg.configEpoch > sender.configEpoch {
+			sender.configEpoch = msg.configEpoch
+			c.todoSave = true
+		}
+		sender.replOffset = msg.offset
+		// the master is paused for the manual failover of this replica, it tells its offset.
+		if !c.mfEnd.IsZero() && c.myself.is(nodeReplica) && c.myself.master == sender &&
+			msg.mflags&clusterMsgFlagPaused != 0 && c.mfMasterOffset == -1 {
+			c.mfMasterOffset = msg.offset
+			fmt.Printf("Received replication offset for paused master manual failover: %d\n", msg.offset)
+		}
+	}
+
+	switch msg.typ {
+	case clusterMsgPing, clusterMsgPong, clusterMsgMeet:
+		return s.clusterProcessPing(conn, n, sender, msg)
+
+	case clusterMsgFail:
+		if sender == nil {
+			return true
+		}
+		failing := c.nodes[msg.node]
+		if failing != nil && !failing.is(nodeMyself|nodeFail) {
+			fmt.Printf("FAIL message received from %s about %s\n", sender.id, failing.id)
+			failing.flags |= nodeFail
+			failing.flags &^= nodePFail
+			failing.failTime = now
+			c.todoSave = true
+			c.todoUpdateState = true
+		}
+
+	case clusterMsgUpdate:
+		if sender == nil {
+			return true
+		}
+		node := c.nodes[msg.node]
+		if node == nil || node.configEpoch >= msg.nodeConfigEpoch {
+			return true
+		}
+		c.setNodeAsMaster(node)
+		node.configEpoch = msg.nodeConfigEpoch
+		s.clusterUpdateSlotsConfigWith(node, msg.nodeConfigEpoch, &msg.nodeSlots)
+
+	case clusterMsgFailoverAuthRequest:
+		if sender != nil {
+			s.clusterSendFailoverAuthIfNeeded(sender, msg)
+		}
+
+	case clusterMsgFailoverAuthAck:
+		// only the votes of the masters serving slots are counted.
+		if sender != nil && sender.is(nodeMaster) && sender.numSlots > 0 && msg.currentEpoch >= c.failoverAuthEpoch {
+			c.failoverAuthCount++
+		}
+
+	case clusterMsgMFStart:
+		if sender == nil || sender.master != c.myself || !c.myself.is(nodeMaster) {
+			return true
+		}
+		s.clusterResetManualFailover()
+		c.mfEnd = now.Add(clusterMFTimeout)
+		c.mfReplica = sender
+		if s.failoverJob == nil {
+			c.mfPause = &pendingFailover{state: failoverWaitForSync, done: make(chan struct{})}
+			s.failoverJob = c.mfPause
+		}
+		fmt.Printf("Manual failover requested by replica %s.\n", sender.id)
+		s.clusterSendPing(sender, clusterMsgPing)
+	}
+	return true
+}
+
+// clusterProcessPing processes PING, PONG and MEET.
+// It must be called with s.mu held.
+func (s *Server) clusterProcessPing(conn *Conn, n *clusterNode, sender *clusterNode, msg *clusterMsg) bool {
+	c := s.cluster
+	now := time.Now()
+	if msg.typ != clusterMsgPong {
+		// this node learns its ip from the address the other nodes connect to.
+		if n == nil && (c.myself.ip == "" || msg.typ == clusterMsgMeet) {
+			if ip := connIP(conn.netConn.LocalAddr()); ip != c.myself.ip {
+				c.myself.ip = ip
+				c.todoSave = true
+				fmt.Printf("IP address for this node updated to %s\n", ip)
+			}
+		}
+		if sender == nil && msg.typ == clusterMsgMeet {
+			node := newClusterNode("", nodeHandshake)
+			node.ip = msg.ip
+			if node.ip == "" {
+				node.ip = connIP(conn.netConn.RemoteAddr())
+			}
+			node.port, node.cport = msg.port, msg.cport
+			c.addNode(node)
+		}
+		conn.WriteRawBytes(s.clusterPingMsg(clusterMsgPong, sender))
+	}
+
+	if n != nil {
+		if n.is(nodeHandshake) {
+			if sender != nil {
+				// the node is known already, e.g. it's met twice.
+				s.clusterUpdateAddress(sender, n.ip, msg.port, msg.cport)
+				c.delNode(n)
+				return false
+			}
+			c.renameNode(n, msg.sender)
+			n.flags &^= nodeHandshake
+			n.flags |= msg.flags & (nodeMaster | nodeReplica)
+			fmt.Printf("Handshake with node %s completed.\n", n.id)
+		} else if n.id != msg.sender {
+			// another node is at the address now, e.g. the node is reset.
+			fmt.Printf("PONG contains mismatching sender ID. About node %s added %d ms ago, having flags %d\n",
+				n.id, time.Since(n.ctime).Milliseconds(), n.flags)
+			n.flags |= nodeNoAddr
+			n.ip, n.port, n.cport = "", 0, 0
+			c.freeLink(n)
+			c.todoSave = true
+			return false
+		}
+	}
+
+	// the node pings this node from a new address.
+	if sender != nil && n == nil && msg.typ == clusterMsgPing {
+		s.clusterUpdateAddress(sender, connIP(conn.netConn.RemoteAddr()), msg.port, msg.cport)
+	}
+
+	if n != nil && msg.typ == clusterMsgPong {
+		n.pongReceived = now
+		n.pingSent = time.Time{}
+		if n.is(nodePFail) {
+			n.flags &^= nodePFail
+			c.todoUpdateState = true
+		} else if n.is(nodeFail) {
+			s.clusterClearNodeFailureIfNeeded(n)
+		}
+	}
+
+	if sender == nil {
+		return true
+	}
+	s.clusterUpdateRole(sender, msg)
+
+	senderMaster := sender
+	if sender.is(nodeReplica) {
+		senderMaster = sender.master
+	}
+	dirtySlots := senderMaster != nil && senderMaster.slots != msg.slots
+	if sender.is(nodeMaster) && dirtySlots {
+		s.clusterUpdateSlotsConfigWith(sender, msg.configEpoch, &msg.slots)
+	}
+	// the sender claims slots with an old config, it's told the new config.
+	if dirtySlots {
+		for slot := 0; slot < clusterSlots; slot++ {
+			if msg.slots[slot/8]&(1<<(slot%8)) == 0 {
+				continue
+			}
+			owner := c.slots[slot]
+			if owner == nil || owner == sender {
+				continue
+			}
+			if owner.configEpoch > msg.configEpoch {
+				s.clusterSendUpdate(sender, owner)
+				break
+			}
+		}
+	}
+	if sender.is(nodeMaster) && c.myself.is(nodeMaster) {
+		s.clusterHandleConfigEpochCollision(sender)
+	}
+	s.clusterProcessGossip(sender, msg)
+	return true
+}
+
+// clusterUpdateRole updates the role of the sender, and its master if it's a replica.
+// It must be called with s.mu held.
+func (s *Server) clusterUpdateRole(sender *clusterNode, msg *clusterMsg) {
+	c := s.cluster
+	if msg.master == "" {
+		c.setNodeAsMaster(sender)
+		return
+	}
+	if sender.is(nodeMaster) {
+		// the master is a replica now, e.g. after a failover.
+		c.delNodeSlots(sender)
+		sender.flags &^= nodeMaster
+		sender.flags |= nodeReplica
+		c.todoSave = true
+	}
+	master := c.nodes[msg.master]
+	if master != nil && sender.master != master {
+		if sender.master != nil {
+			sender.master.removeReplica(sender)
+		}
+		master.addReplica(sender)
+		sender.master = master
+		c.todoSave = true
+	}
+}
+
+// clusterUpdateSlotsConfigWith assigns the slots claimed by the master to it, if the
+// config epoch of the master is greater than the one of their current owner.
+// If this node, or its master, loses all its slots, it becomes a replica of the new owner.
+// It must be called with s.mu held.
+func (s *Server) clusterUpdateSlotsConfigWith(sender *clusterNode, configEpoch int, slots *[clusterSlots / 8]byte) {
+	c := s.cluster
+	if sender == c.myself {
+		fmt.Println("Discarding UPDATE message about myself.")
+		return
+	}
+	curMaster := c.myself
+	if c.myself.is(nodeReplica) && c.myself.master != nil {
+		curMaster = c.myself.master
+	}
+	var newMaster *clusterNode
+	dirty := []int{}
+	for slot := 0; slot < clusterSlots; slot++ {
+		if slots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		owner := c.slots[slot]
+		if owner == sender || c.importingFrom[slot] != nil {
+			continue
+		}
+		if owner != nil && owner.configEpoch >= configEpoch {
+			continue
+		}
+		// the keys of a slot lost are deleted, unless this node becomes a replica.
+		if owner == c.myself && len(s.keysInSlot(slot, 1)) > 0 {
+			dirty = append(dirty, slot)
+		}
+		if owner == curMaster {
+			newMaster = sender
+		}
+		c.delSlot(slot)
+		c.addSlot(sender, slot)
+		// the slot migrated to the sender is done.
+		c.migratingTo[slot] = nil
+		c.todoSave = true
+		c.todoUpdateState = true
+	}
+
+	if newMaster != nil && curMaster.numSlots == 0 {
+		fmt.Printf("Configuration change detected. Reconfiguring myself as a replica of %s\n", sender.id)
+		s.clusterSetMaster(sender)
+		return
+	}
+	for _, slot := range dirty {
+		s.delKeysInSlot(slot)
+	}
+}
+
+// delKeysInSlot deletes the keys of the slot, the deletions are propagated.
+// It must be called with s.mu held.
+func (s *Server) delKeysInSlot(slot int) {
+	for _, key := range s.keysInSlot(slot, -1) {
+		if s.store.Del(key) {
+			s.propagate(&command{args: [][]byte{[]byte(proto.CmdDel), []byte(key)}})
+		}
+	}
+}
+
+// clusterHandleConfigEpochCollision solves the collision of the config epochs of two
+// masters, e.g. both take slots with ADDSLOTS: the node with the smaller id takes a new epoch.
+// It must be called with s.mu held.
+func (s *Server) clusterHandleConfigEpochCollision(sender *clusterNode) {
+	c := s.cluster
+	if sender.configEpoch != c.myself.configEpoch || sender.id <= c.myself.id {
+		return
+	}
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+	c.todoSave = true
+	fmt.Printf("WARNING: configEpoch collision with node %s. configEpoch set to %d\n", sender.id, c.myself.configEpoch)
+}
+
+// clusterProcessGossip processes what the sender knows about the other nodes: the failure
+// reports of a master, and the nodes this node doesn't know yet.
+// It must be called with s.mu held.
+func (s *Server) clusterProcessGossip(sender *clusterNode, msg *clusterMsg) {
+	c := s.cluster
+	now := time.Now()
+	for _, g := range msg.gossip {
+		n := c.nodes[g.id]
+		if n == nil {
+			if g.flags&nodeNoAddr == 0 && g.ip != "" {
+				if _, ok := c.blacklist[g.id]; !ok {
+					c.startHandshake(g.ip, g.port, g.cport)
+				}
+			}
+			continue
+		}
+		if sender.is(nodeMaster) && n != c.myself {
+			if g.flags&(nodePFail|nodeFail) != 0 {
+				if _, ok := n.failReports[sender]; !ok {
+					fmt.Printf("Node %s reported node %s as not reachable.\n", sender.id, n.id)
+				}
+				n.failReports[sender] = now
+				s.clusterMarkNodeAsFailingIfNeeded(n)
+			} else if _, ok := n.failReports[sender]; ok {
+				delete(n.failReports, sender)
+				fmt.Printf("Node %s reported node %s is back online.\n", sender.id, n.id)
+			}
+		}
+		// a node reachable by the other nodes is fresh, even if this node doesn't ping it recently.
+		if !n.is(nodePFail|nodeFail) && n.pingSent.IsZero() && len(n.failReports) == 0 &&
+			g.pongReceived > unixMilli(n.pongReceived) && g.pongReceived <= now.UnixMilli()+500 {
+			n.pongReceived = time.UnixMilli(g.pongReceived)
+		}
+		// the failing node may be at another address now.
+		if n.is(nodeFail|nodeNoAddr) && n != c.myself && g.flags&nodeNoAddr == 0 && g.ip != "" &&
+			(n.ip != g.ip || n.port != g.port || n.cport != g.cport) {
+			n.ip, n.port, n.cport = g.ip, g.port, g.cport
+			n.flags &^= nodeNoAddr
+			c.freeLink(n)
+			c.todoSave = true
+		}
+	}
+}
+
+// startHandshake adds a node in handshake, which gets its real id from its first PONG.
+// It returns false if the address is invalid.
+// It must be called with s.mu held.
+func (c *clusterState) startHandshake(ip string, port int, cport int) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || port <= 0 || port > 65535 || cport <= 0 || cport > 65535 {
+		return false
+	}
+	ip = parsed.String()
+	for _, n := range c.nodes {
+		if n.is(nodeHandshake) && n.ip == ip && n.port == port && n.cport == cport {
+			return true
+		}
+	}
+	n := newClusterNode("", nodeHandshake|nodeMeet)
+	n.ip, n.port, n.cport = ip, port, cport
+	c.addNode(n)
+	return true
+}
+
+// clusterUpdateAddress updates the address of the node, and reconnects to it.
+// It must be called with s.mu held.
+func (s *Server) clusterUpdateAddress(n *clusterNode, ip string, port int, cport int) {
+	c := s.cluster
+	if n == c.myself || (n.ip == ip && n.port == port && n.cport == cport) {
+		return
+	}
+	n.ip, n.port, n.cport = ip, port, cport
+	n.flags &^= nodeNoAddr
+	c.freeLink(n)
+	c.todoSave = true
+	fmt.Printf("Address updated for node %s, now %s:%d\n", n.id, ip, port)
+	if c.myself.is(nodeReplica) && c.myself.master == n {
+		s.becomeReplica(nodeAddr(n, nil))
+	}
+}
+
+// clusterMarkNodeAsFailingIfNeeded flags the node FAIL if the majority of the masters
+// report it as failing, and tells all the nodes.
+// It must be called with s.mu held.
+func (s *Server) clusterMarkNodeAsFailingIfNeeded(n *clusterNode) {
+	c := s.cluster
+	if !n.is(nodePFail) || n.is(nodeFail) {
+		return
+	}
+	failures := c.countFailureReports(n)
+	if c.myself.is(nodeMaster) {
+		failures++
+	}
+	if failures < c.size()/2+1 {
+		return
+	}
+	fmt.Printf("Marking node %s as failing (quorum reached).\n", n.id)
+	n.flags &^= nodePFail
+	n.flags |= nodeFail
+	n.failTime = time.Now()
+	s.clusterSendFail(n)
+	c.todoSave = true
+	c.todoUpdateState = true
+}
+
+// countFailureReports removes the reports expired, and returns the number of the others.
+func (c *clusterState) countFailureReports(n *clusterNode) int {
+	validity := c.nodeTimeout * clusterFailReportValidityMult
+	for reporter, t := range n.failReports {
+		if time.Since(t) > validity {
+			delete(n.failReports, reporter)
+		}
+	}
+	return len(n.failReports)
+}
+
+// clusterClearNodeFailureIfNeeded clears FAIL of the node reachable again: at once for a
+// replica or a master without slots, or if its slots are not taken over for some time.
+// It must be called with s.mu held.
+func (s *Server) clusterClearNodeFailureIfNeeded(n *clusterNode) {
+	c := s.cluster
+	if n.is(nodeReplica) || n.numSlots == 0 {
+		fmt.Printf("Clear FAIL state for node %s: %s is reachable again.\n", n.id, map[bool]string{true: "replica", false: "master without slots"}[n.is(nodeReplica)])
+	} else if time.Since(n.failTime) > c.nodeTimeout*clusterFailUndoTimeMult {
+		fmt.Printf("Clear FAIL state for node %s: is reachable again and nobody is serving its slots after some time.\n", n.id)
+	} else {
+		return
+	}
+	n.flags &^= nodeFail
+	c.todoSave = true
+	c.todoUpdateState = true
+}
+
+// clusterCron runs the periodic jobs of the cluster every tick: the links, the pings,
+// the failure detection and the failover of a replica.
+func (s *Server) clusterCron() {
+	ticker := time.NewTicker(clusterTickInterval)
+	defer ticker.Stop()
+	for tick := 0; ; tick++ {
+		<-ticker.C
+		s.mu.Lock()
+		s.clusterCronTick(tick)
+		s.clusterBeforeUnlock()
+		s.mu.Unlock()
+	}
+}
+
+// clusterCronTick must be called with s.mu held.
+func (s *Server) clusterCronTick(tick int) {
+	c := s.cluster
+	now := time.Now()
+	for id, expire := range c.blacklist {
+		if now.After(expire) {
+			delete(c.blacklist, id)
+		}
+	}
+
+	handshakeTimeout := max(c.nodeTimeout, time.Second)
+	for _, n := range c.nodes {
+		if n.is(nodeMyself | nodeNoAddr) {
+			continue
+		}
+		if n.is(nodeHandshake) && now.Sub(n.ctime) > handshakeTimeout {
+			c.delNode(n)
+			continue
+		}
+		if !n.linking {
+			n.linking = true
+			go s.clusterLinkLoop(n, n.gen)
+		}
+	}
+
+	// every second, pings the node with the oldest pong among a few random nodes.
+	if tick%10 == 0 {
+		var oldest *clusterNode
+		candidates := []*clusterNode{}
+		for _, n := range c.nodes {
+			if n.link != nil && n.pingSent.IsZero() && !n.is(nodeMyself|nodeHandshake) {
+				candidates = append(candidates, n)
+			}
+		}
+		rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		for _, n := range candidates[:min(5, len(candidates))] {
+			if oldest == nil || n.pongReceived.Before(oldest.pongReceived) {
+				oldest = n
+			}
+		}
+		if oldest != nil {
+			s.clusterSendPing(oldest, clusterMsgPing)
+		}
+	}
+
+	for _, n := range c.nodes {
+		if n.is(nodeMyself | nodeNoAddr | nodeHandshake) {
+			continue
+		}
+		// the link is reconnected if the pong is not received for half of node timeout.
+		if n.link != nil && !n.pingSent.IsZero() && now.Sub(n.pingSent) > c.nodeTimeout/2 &&
+			now.Sub(n.dataReceived) > c.nodeTimeout/2 {
+			n.link.Close()
+			n.link = nil
+		}
+		if n.link != nil && n.pingSent.IsZero() && now.Sub(n.pongReceived) > c.nodeTimeout/2 {
+			s.clusterSendPing(n, clusterMsgPing)
+			continue
+		}
+		// the master tells its offset to the replica of the manual failover.
+		if !c.mfEnd.IsZero() && c.myself.is(nodeMaster) && c.mfReplica == n {
+			s.clusterSendPing(n, clusterMsgPing)
+			continue
+		}
+		if n.pingSent.IsZero() {
+			continue
+		}
+		// the node is alive if it sends any message.
+		delay := min(now.Sub(n.pingSent), now.Sub(n.dataReceived))
+		if delay > c.nodeTimeout && !n.is(nodePFail|nodeFail) {
+			fmt.Printf("*** NODE %s possibly failing\n", n.id)
+			n.flags |= nodePFail
+			c.todoUpdateState = true
+		}
+	}
+
+	if c.myself.is(nodeReplica) {
+		// e.g. the master is at another address, or this node became a replica of it.
+		if m := c.myself.master; m != nil && m.ip != "" && s.masterAddr != nodeAddr(m, nil) {
+			s.becomeReplica(nodeAddr(m, nil))
+		}
+		s.clusterHandleManualFailover()
+		s.clusterHandleReplicaFailover()
+	}
+	s.clusterManualFailoverCheckTimeout()
+}
+
+// clusterBeforeUnlock saves the config and updates the state of the cluster if they
+// changed, it's called before s.mu is released by the cluster bus and the CLUSTER command.
+// It must be called with s.mu held.
+func (s *Server) clusterBeforeUnlock() {
+	c := s.cluster
+	if c.todoUpdateState {
+		c.updateState()
+	}
+	if c.todoSave {
+		if err := s.clusterSaveConfig(); err != nil {
+			fmt.Println("cluster save config error: ", err.Error())
+		}
+	}
+}
+
+func connIP(addr net.Addr) string {
+	ip, _, _ := net.SplitHostPort(addr.String())
+	return ip
+}
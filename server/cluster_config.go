@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// clusterConfigPath returns the path of nodes.conf, in the working directory by default.
+func (s *Server) clusterConfigPath() string {
+	return filepath.Join(s.dir, s.cluster.configFile)
+}
+
+// clusterSaveConfig saves the view of the cluster to nodes.conf: a line per node like
+// CLUSTER NODES, and the epochs in the last line `vars currentEpoch <n> lastVoteEpoch <n>`.
+// It writes a temp file first, so the file is always complete.
+// It must be called with s.mu held.
+func (s *Server) clusterSaveConfig() error {
+	c := s.cluster
+	c.todoSave = false
+	lines := []string{}
+	for _, n := range c.sortedNodes() {
+		// the node in handshake is met again after a restart.
+		if n.is(nodeHandshake) {
+			continue
+		}
+		lines = append(lines, c.describeNode(n, nil))
+	}
+	lines = append(lines, fmt.Sprintf("vars currentEpoch %d lastVoteEpoch %d", c.currentEpoch, c.lastVoteEpoch))
+
+	path := s.clusterConfigPath()
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loadClusterConfig loads nodes.conf, a new one is created if it doesn't exist.
+func (s *Server) loadClusterConfig() error {
+	c := s.cluster
+	f, err := os.Open(s.clusterConfigPath())
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No cluster configuration found, I'm %s\n", c.myself.id)
+		return s.clusterSaveConfig()
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	port, cport := c.myself.port, c.myself.cport
+	c.nodes = map[string]*clusterNode{}
+	c.myself = nil
+	node := func(id string) *clusterNode {
+		n, ok := c.nodes[id]
+		if !ok {
+			n = newClusterNode(id, 0)
+			c.nodes[id] = n
+		}
+		return n
+	}
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				v, err := strconv.Atoi(fields[i+1])
+				if err != nil {
+					return fmt.Errorf("invalid var %s at line %d", fields[i], lineNo)
+				}
+				switch fields[i] {
+				case "currentEpoch":
+					c.currentEpoch = v
+				case "lastVoteEpoch":
+					c.lastVoteEpoch = v
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("unrecoverable error: corrupted cluster config file at line %d", lineNo)
+		}
+
+		n := node(fields[0])
+		// <ip>:<port>@<cport>
+		addr, cportStr, ok := strings.Cut(fields[1], "@")
+		colon := strings.LastIndexByte(addr, ':')
+		if !ok || colon < 0 {
+			return fmt.Errorf("invalid address %s at line %d", fields[1], lineNo)
+		}
+		n.ip = addr[:colon]
+		n.port, _ = strconv.Atoi(addr[colon+1:])
+		n.cport, _ = strconv.Atoi(cportStr)
+		for _, flag := range strings.Split(fields[2], ",") {
+			switch flag {
+			case "myself":
+				n.flags |= nodeMyself
+				c.myself = n
+			case "master":
+				n.flags |= nodeMaster
+			case "slave":
+				n.flags |= nodeReplica
+			case "fail?":
+				n.flags |= nodePFail
+			case "fail":
+				n.flags |= nodeFail
+			case "handshake":
+				n.flags |= nodeHandshake
+			case "noaddr":
+				n.flags |= nodeNoAddr
+			}
+		}
+		if fields[3] != "-" {
+			n.master = node(fields[3])
+			n.master.addReplica(n)
+		}
+		n.configEpoch, _ = strconv.Atoi(fields[6])
+
+		// <slot>, <start>-<end>, [<slot>->-<id>] migrating, [<slot>-<-<id>] importing.
+		for _, arg := range fields[8:] {
+			if strings.HasPrefix(arg, "[") {
+				arg = strings.Trim(arg, "[]")
+				if slotStr, id, ok := strings.Cut(arg, "->-"); ok {
+					slot, err := strconv.Atoi(slotStr)
+					if err != nil || slot < 0 || slot >= clusterSlots {
+						return fmt.Errorf("invalid slot %s at line %d", arg, lineNo)
+					}
+					c.migratingTo[slot] = node(id)
+				} else if slotStr, id, ok := strings.Cut(arg, "-<-"); ok {
+					slot, err := strconv.Atoi(slotStr)
+					if err != nil || slot < 0 || slot >= clusterSlots {
+						return fmt.Errorf("invalid slot %s at line %d", arg, lineNo)
+					}
+					c.importingFrom[slot] = node(id)
+				}
+				continue
+			}
+			startStr, endStr, isRange := strings.Cut(arg, "-")
+			start, err1 := strconv.Atoi(startStr)
+			end, err2 := start, error(nil)
+			if isRange {
+				end, err2 = strconv.Atoi(endStr)
+			}
+			if err1 != nil || err2 != nil || start < 0 || end >= clusterSlots || start > end {
+				return fmt.Errorf("invalid slot %s at line %d", arg, lineNo)
+			}
+			for slot := start; slot <= end; slot++ {
+				c.addSlot(n, slot)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if c.myself == nil {
+		return errors.New("myself node not found in cluster config file")
+	}
+	// the ports may be changed by the config.
+	c.myself.port, c.myself.cport = port, cport
+	fmt.Printf("Node configuration loaded, I'm %s\n", c.myself.id)
+	c.updateState()
+	return s.clusterSaveConfig()
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// the manual failover is aborted if it doesn't complete in time.
+const clusterMFTimeout = 5 * time.Second
+
+// clusterHandleReplicaFailover runs the election of this replica if its master is failing,
+// or a manual failover can start. The replica asks the masters for their votes in a new
+// epoch, and replaces its master once it gets the votes of the majority of them.
+// The replicas with a greater offset start the election earlier, so they likely win.
+// It must be called with s.mu held.
+func (s *Server) clusterHandleReplicaFailover() {
+	c := s.cluster
+	myself := c.myself
+	master := myself.master
+	if master == nil || (!master.is(nodeFail) && !c.mfCanStart) || master.numSlots == 0 {
+		return
+	}
+
+	now := time.Now()
+	authTimeout := max(c.nodeTimeout*2, 2*time.Second)
+	authRetryTime := authTimeout * 2
+
+	// the data of a replica disconnected from the master for too long is too old.
+	dataAge := time.Duration(0)
+	if s.replState != replConnected && !s.masterDownSince.IsZero() {
+		dataAge = now.Sub(s.masterDownSince)
+	}
+	if dataAge > c.nodeTimeout {
+		dataAge -= c.nodeTimeout
+	}
+	maxDataAge := time.Duration(s.replPingPeriod)*time.Second + c.nodeTimeout*time.Duration(c.validityFactor)
+	if !c.mfCanStart && c.validityFactor > 0 && dataAge > maxDataAge {
+		return
+	}
+
+	// the election is scheduled again if the last one is too old.
+	if now.Sub(c.failoverAuthTime) > authRetryTime {
+		c.failoverAuthTime = now.Add(500*time.Millisecond + time.Duration(rand.Intn(500))*time.Millisecond)
+		c.failoverAuthCount = 0
+		c.failoverAuthSent = false
+		c.failoverAuthRank = s.clusterReplicaRank()
+		c.failoverAuthTime = c.failoverAuthTime.Add(time.Duration(c.failoverAuthRank) * time.Second)
+		if c.mfCanStart {
+			c.failoverAuthTime = now
+			c.failoverAuthRank = 0
+		}
+		fmt.Printf("Start of election delayed for %d milliseconds (rank #%d, offset %d).\n",
+			c.failoverAuthTime.Sub(now).Milliseconds(), c.failoverAuthRank, s.replOffset)
+		// the other replicas learn the offset of this replica to compute their rank.
+		s.clusterBroadcastPong(true)
+		return
+	}
+
+	// the rank changes if the other replicas receive more data meanwhile.
+	if !c.failoverAuthSent && !c.mfCanStart {
+		if rank := s.clusterReplicaRank(); rank > c.failoverAuthRank {
+			c.failoverAuthTime = c.failoverAuthTime.Add(time.Duration(rank-c.failoverAuthRank) * time.Second)
+			c.failoverAuthRank = rank
+			fmt.Printf("Replica rank updated to #%d, added %d milliseconds of delay.\n", rank, c.failoverAuthTime.Sub(now).Milliseconds())
+		}
+	}
+	if now.Before(c.failoverAuthTime) || now.Sub(c.failoverAuthTime) > authTimeout {
+		return
+	}
+
+	if !c.failoverAuthSent {
+		c.currentEpoch++
+		c.failoverAuthEpoch = c.currentEpoch
+		fmt.Printf("Starting a failover election for epoch %d.\n", c.currentEpoch)
+		msg := s.clusterBuildMsg(clusterMsgFailoverAuthRequest)
+		if c.mfCanStart {
+			msg.mflags |= clusterMsgFlagForceAck
+		}
+		s.clusterBroadcast(msg.encode())
+		c.failoverAuthSent = true
+		c.todoSave = true
+		return
+	}
+
+	if c.failoverAuthCount >= c.size()/2+1 {
+		fmt.Println("Failover election won: I'm the new master.")
+		if myself.configEpoch < c.failoverAuthEpoch {
+			myself.configEpoch = c.failoverAuthEpoch
+			fmt.Printf("configEpoch set to %d after successful failover\n", myself.configEpoch)
+		}
+		s.clusterFailoverReplaceYourMaster()
+	}
+}
+
+// clusterReplicaRank returns the number of the other replicas of the master with
+// a greater offset than this replica.
+// It must be called with s.mu held.
+func (s *Server) clusterReplicaRank() int {
+	c := s.cluster
+	rank := 0
+	for _, r := range c.myself.master.replicas {
+		if r != c.myself && r.replOffset > s.replOffset {
+			rank++
+		}
+	}
+	return rank
+}
+
+// clusterFailoverReplaceYourMaster makes this replica a master, it takes the slots of
+// its master, and tells all the nodes its new config.
+// It must be called with s.mu held.
+func (s *Server) clusterFailoverReplaceYourMaster() {
+	c := s.cluster
+	old := c.myself.master
+	if c.myself.is(nodeMaster) || old == nil {
+		return
+	}
+	c.setNodeAsMaster(c.myself)
+	s.becomeMaster()
+	for slot := 0; slot < clusterSlots; slot++ {
+		if c.slots[slot] == old {
+			c.delSlot(slot)
+			c.addSlot(c.myself, slot)
+		}
+	}
+	c.updateState()
+	c.todoSave = true
+	s.clusterBroadcastPong(false)
+	s.clusterResetManualFailover()
+}
+
+// clusterSendFailoverAuthIfNeeded votes for the replica requesting the failover of its
+// master, if the master is failing, and it doesn't vote in this epoch or for another
+// replica of the master recently, and the slots claimed don't have a newer config.
+// It must be called with s.mu held.
+func (s *Server) clusterSendFailoverAuthIfNeeded(n *clusterNode, msg *clusterMsg) {
+	c := s.cluster
+	myself := c.myself
+	if myself.is(nodeReplica) || myself.numSlots == 0 {
+		return
+	}
+	if msg.currentEpoch < c.currentEpoch {
+		fmt.Printf("Failover auth denied to %s: reqEpoch (%d) < curEpoch(%d)\n", n.id, msg.currentEpoch, c.currentEpoch)
+		return
+	}
+	if c.lastVoteEpoch == c.currentEpoch {
+		fmt.Printf("Failover auth denied to %s: already voted for epoch %d\n", n.id, c.currentEpoch)
+		return
+	}
+	forceAck := msg.mflags&clusterMsgFlagForceAck != 0
+	master := n.master
+	if n.is(nodeMaster) || master == nil || (!master.is(nodeFail) && !forceAck) {
+		fmt.Printf("Failover auth denied to %s: its master is up\n", n.id)
+		return
+	}
+	if wait := c.nodeTimeout * 2; time.Since(master.votedTime) < wait {
+		fmt.Printf("Failover auth denied to %s: can't vote about this master before %d milliseconds\n",
+			n.id, (wait - time.Since(master.votedTime)).Milliseconds())
+		return
+	}
+	for slot := 0; slot < clusterSlots; slot++ {
+		if msg.slots[slot/8]&(1<<(slot%8)) == 0 {
+			continue
+		}
+		if owner := c.slots[slot]; owner != nil && owner.configEpoch > msg.configEpoch {
+			fmt.Printf("Failover auth denied to %s: slot %d epoch (%d) > reqEpoch (%d)\n", n.id, slot, owner.configEpoch, msg.configEpoch)
+			return
+		}
+	}
+
+	c.lastVoteEpoch = c.currentEpoch
+	master.votedTime = time.Now()
+	c.todoSave = true
+	if n.link != nil {
+		n.link.WriteRawBytes(s.clusterBuildMsg(clusterMsgFailoverAuthAck).encode())
+	}
+	fmt.Printf("Failover auth granted to %s for epoch %d\n", n.id, c.currentEpoch)
+}
+
+// clusterHandleManualFailover lets the manual failover start once this replica
+// catches up with the offset of its paused master.
+// It must be called with s.mu held.
+func (s *Server) clusterHandleManualFailover() {
+	c := s.cluster
+	if c.mfEnd.IsZero() || c.mfCanStart || c.mfMasterOffset == -1 {
+		return
+	}
+	if c.mfMasterOffset == s.replOffset {
+		c.mfCanStart = true
+		fmt.Println("All master replication stream processed, manual failover can start.")
+	}
+}
+
+// clusterManualFailoverCheckTimeout must be called with s.mu held.
+func (s *Server) clusterManualFailoverCheckTimeout() {
+	c := s.cluster
+	if !c.mfEnd.IsZero() && time.Now().After(c.mfEnd) {
+		fmt.Println("Manual failover timed out.")
+		s.clusterResetManualFailover()
+	}
+}
+
+// clusterResetManualFailover ends the manual failover, the master resumes the writes.
+// It must be called with s.mu held.
+func (s *Server) clusterResetManualFailover() {
+	c := s.cluster
+	if c.mfPause != nil && s.failoverJob == c.mfPause {
+		s.endFailover()
+	}
+	c.mfPause = nil
+	c.mfEnd = time.Time{}
+	c.mfReplica = nil
+	c.mfMasterOffset = -1
+	c.mfCanStart = false
+}
+
+// clusterSetMaster makes this node a replica of the master.
+// It must be called with s.mu held.
+func (s *Server) clusterSetMaster(n *clusterNode) {
+	c := s.cluster
+	myself := c.myself
+	if myself.is(nodeMaster) {
+		c.delNodeSlots(myself)
+		for slot := 0; slot < clusterSlots; slot++ {
+			c.migratingTo[slot] = nil
+			c.importingFrom[slot] = nil
+		}
+		myself.flags &^= nodeMaster
+		myself.flags |= nodeReplica
+	}
+	if myself.master != nil {
+		myself.master.removeReplica(myself)
+	}
+	myself.master = n
+	n.addReplica(myself)
+	if n.ip != "" {
+		s.becomeReplica(nodeAddr(n, nil))
+	}
+	s.clusterResetManualFailover()
+	c.todoSave = true
+	c.todoUpdateState = true
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+type cmdFlag int
+
+const (
+	// the command may modify the dataset, it's propagated to the aof and the replicas.
+	flagWrite cmdFlag = 1 << iota
+	// the command only reads the dataset.
+	flagReadOnly
+	flagAdmin
+	// the handler locks s.mu by itself, e.g. it blocks.
+	flagNoLock
+	// the command is allowed while the replica has stale data,
+	// see replica-serve-stale-data.
+	flagStale
+	// the command isn't a write command, but it's propagated to the replicas, e.g. PUBLISH.
+	flagMayReplicate
+	// the command is served like after ASKING, e.g. RESTORE-ASKING.
+	flagAsking
+)
+
+// commandSpec describes a command, like `struct redisCommand`.
+type commandSpec struct {
+	name string
+	proc func(s *Server, conn *Conn, cmd Command) error
+	// the number of arguments including the command name,
+	// -N means at least N.
+	arity int
+	flags cmdFlag
+	// the positions of the keys: firstKey, firstKey+step, ..., lastKey.
+	// lastKey -1 means the last argument. firstKey 0 means no keys.
+	firstKey int
+	lastKey  int
+	step     int
+	// getKeys finds the keys of the commands whose keys can't be described by positions.
+	getKeys func(cmd Command) []int
+}
+
+var commandTable = map[string]*commandSpec{}
+
+func init() {
+	specs := []*commandSpec{
+		{name: proto.CmdPing, proc: (*Server).ping, arity: -1, flags: flagStale},
+		{name: proto.CmdEcho, proc: (*Server).echo, arity: 2},
+		{name: proto.CmdAuth, proc: (*Server).auth, arity: -2, flags: flagStale},
+		{name: proto.CmdHello, proc: (*Server).hello, arity: -1, flags: flagStale},
+		{name: proto.CmdInfo, proc: (*Server).info, arity: -1, flags: flagStale},
+		{name: proto.CmdConfig, proc: (*Server).config, arity: -2, flags: flagAdmin | flagStale},
+		{name: proto.CmdClient, proc: (*Server).client, arity: -2, flags: flagStale},
+		{name: proto.CmdKeys, proc: (*Server).keys, arity: 2, flags: flagReadOnly},
+		{name: proto.CmdType, proc: (*Server).dataType, arity: 2, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdSet, proc: (*Server).set, arity: -3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdGet, proc: (*Server).get, arity: 2, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdDel, proc: (*Server).del, arity: -2, flags: flagWrite, firstKey: 1, lastKey: -1, step: 1},
+		{name: proto.CmdExpire, proc: (*Server).expire, arity: 3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdPExpire, proc: (*Server).expire, arity: 3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdExpireAt, proc: (*Server).expire, arity: 3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdPExpireAt, proc: (*Server).expire, arity: 3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdTTL, proc: (*Server).ttl, arity: 2, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdPTTL, proc: (*Server).ttl, arity: 2, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXAdd, proc: (*Server).xadd, arity: -5, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXRange, proc: (*Server).xrange, arity: -4, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXRevRange, proc: (*Server).xrange, arity: -4, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXLen, proc: (*Server).xlen, arity: 2, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXDel, proc: (*Server).xdel, arity: -3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXTrim, proc: (*Server).xtrim, arity: -4, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXSetID, proc: (*Server).xsetid, arity: -3, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXRead, proc: (*Server).xread, arity: -4, flags: flagReadOnly | flagNoLock, getKeys: xreadKeys},
+		{name: proto.CmdDump, proc: (*Server).dump, arity: 2, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdRestore, proc: (*Server).restore, arity: -4, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdRestoreAsking, proc: (*Server).restore, arity: -4, flags: flagWrite | flagAsking, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdMigrate, proc: (*Server).migrate, arity: -6, flags: flagWrite, getKeys: migrateKeys},
+		{name: proto.CmdXGroup, proc: (*Server).xgroup, arity: -2, flags: flagWrite, firstKey: 2, lastKey: 2, step: 1},
+		{name: proto.CmdXReadGroup, proc: (*Server).xreadgroup, arity: -7, flags: flagWrite | flagNoLock, getKeys: xreadgroupKeys},
+		{name: proto.CmdXAck, proc: (*Server).xack, arity: -4, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXPending, proc: (*Server).xpending, arity: -3, flags: flagReadOnly, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXClaim, proc: (*Server).xclaim, arity: -6, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXAutoClaim, proc: (*Server).xautoclaim, arity: -6, flags: flagWrite, firstKey: 1, lastKey: 1, step: 1},
+		{name: proto.CmdXInfo, proc: (*Server).xinfo, arity: -2, flags: flagReadOnly, firstKey: 2, lastKey: 2, step: 1},
+		{name: proto.CmdReplConf, proc: (*Server).replconf, arity: -1, flags: flagAdmin | flagStale},
+		{name: proto.CmdWait, proc: (*Server).wait, arity: 3, flags: flagNoLock},
+		{name: proto.CmdWaitAof, proc: (*Server).waitaof, arity: 4, flags: flagNoLock},
+		{name: proto.CmdBgRewriteAof, proc: (*Server).bgrewriteaof, arity: 1, flags: flagAdmin | flagNoLock},
+		{name: proto.CmdReplicaOf, proc: (*Server).replicaof, arity: 3, flags: flagAdmin | flagStale},
+		{name: proto.CmdFailover, proc: (*Server).failover, arity: -1, flags: flagAdmin},
+		{name: proto.CmdSlaveOf, proc: (*Server).replicaof, arity: 3, flags: flagAdmin | flagStale},
+		{name: proto.CmdSubscribe, proc: (*Server).subscribe, arity: -2, flags: flagStale},
+		{name: proto.CmdUnsubscribe, proc: (*Server).unsubscribe, arity: -1, flags: flagStale},
+		{name: proto.CmdPublish, proc: (*Server).publish, arity: 3, flags: flagStale | flagMayReplicate},
+		{name: proto.CmdCluster, proc: (*Server).clusterCommand, arity: -2, flags: flagStale},
+		{name: proto.CmdAsking, proc: (*Server).asking, arity: 1},
+		{name: proto.CmdReadOnly, proc: (*Server).readonly, arity: 1},
+		{name: proto.CmdReadWrite, proc: (*Server).readwrite, arity: 1},
+	}
+	for _, spec := range specs {
+		commandTable[spec.name] = spec
+	}
+}
+
+func (spec *commandSpec) isWrite() bool {
+	return spec.flags&flagWrite != 0
+}
+
+// keys returns the positions of the keys in cmd.
+func (spec *commandSpec) keys(cmd Command) []int {
+	if spec.getKeys != nil {
+		return spec.getKeys(cmd)
+	}
+	if spec.firstKey == 0 {
+		return nil
+	}
+	last := spec.lastKey
+	if last < 0 {
+		last = len(cmd.Args()) + last
+	}
+	pos := []int{}
+	for i := spec.firstKey; i <= last && i < len(cmd.Args()); i += spec.step {
+		pos = append(pos, i)
+	}
+	return pos
+}
+
+// xreadKeys finds the keys of `XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]`.
+func xreadKeys(cmd Command) []int {
+	return streamsKeys(cmd, 1)
+}
+
+// streamsKeys finds the keys after STREAMS, which is searched from the argument at from.
+func streamsKeys(cmd Command, from int) []int {
+	args := cmd.Args()
+	for i := from; i < len(args); i++ {
+		if strings.EqualFold(string(args[i]), proto.OptionStreams) {
+			n := (len(args) - i - 1) / 2
+			pos := make([]int, n)
+			for j := range pos {
+				pos[j] = i + 1 + j
+			}
+			return pos
+		}
+	}
+	return nil
+}
+
+// execute looks up the command and calls its handler.
+func (s *Server) execute(conn *Conn, cmd Command) error {
+	spec, msg := lookupCommand(cmd)
+	if spec == nil {
+		return conn.WriteError(msg)
+	}
+	// any command is allowed in the subscribed state in RESP3, the messages are push messages.
+	if conn.resp < proto.Resp3 && conn.subscribed() && !pubsubAllowed(spec.name) {
+		return conn.WriteError(pubsubErrorMsg(cmd))
+	}
+
+	// ASKING only affects the next command.
+	defer func() {
+		if spec.name != proto.CmdAsking {
+			conn.asking = false
+		}
+	}()
+
+	s.mu.Lock()
+	conn.commandRead(spec, cmd)
+	for done := s.pausedUntil(conn, spec, cmd); done != nil; done = s.pausedUntil(conn, spec, cmd) {
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+	}
+	code, msg := "", ""
+	if s.cluster != nil && !conn.fromMaster && !s.loading {
+		code, msg = s.getNodeByQuery(conn, spec, cmd)
+	}
+	if code == "" {
+		code, msg = s.rejectOnReplica(conn, spec)
+	}
+	if code == "" {
+		code, msg = s.rejectOnMaster(conn, spec)
+	}
+	if code != "" {
+		s.mu.Unlock()
+		return conn.WriteErrorCode(code, msg)
+	}
+	if spec.flags&flagNoLock != 0 {
+		s.mu.Unlock()
+		err := spec.proc(s, conn, cmd)
+		s.mu.Lock()
+		s.trackingRememberKeys(conn, spec, cmd)
+		s.mu.Unlock()
+		return err
+	}
+	defer s.mu.Unlock()
+	return s.call(conn, spec, cmd)
+}
+
+// lookupCommand returns the spec of the command, or the error message if the command
+// is unknown or the number of arguments is wrong.
+func lookupCommand(cmd Command) (*commandSpec, string) {
+	spec, ok := commandTable[cmd.Name()]
+	if !ok {
+		return nil, fmt.Sprintf("unknown command '%s', with args beginning with: %s", cmd.At(0), argsPreview(cmd))
+	}
+	n := len(cmd.Args())
+	if (spec.arity > 0 && n != spec.arity) || n < -spec.arity {
+		return nil, fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(spec.name))
+	}
+	return spec, ""
+}
+
+// call calls the handler of the command.
+// A write command changing the dataset is propagated after the handler returns,
+// the handler rewrites the arguments with cmd.SetArgs if the command isn't
+// deterministic, e.g. `XADD key *` is propagated with the generated id,
+// or it's propagated as other commands, see alsoPropagate.
+// It must be called with s.mu held.
+func (s *Server) call(conn *Conn, spec *commandSpec, cmd Command) error {
+	dirty := s.dirty
+	err := spec.proc(s, conn, cmd)
+	if len(s.alsoPropagated) > 0 {
+		s.propagateAlso(conn)
+	} else if spec.isWrite() && s.dirty != dirty {
+		s.propagate(cmd)
+		// WAIT and WAITAOF of the client wait for this offset.
+		conn.woff = s.replOffset
+	}
+	if spec.isWrite() && s.dirty != dirty {
+		s.signalKeysAsReady(spec, cmd)
+		s.trackingInvalidateKeys(conn, spec, cmd)
+	}
+	s.trackingRememberKeys(conn, spec, cmd)
+	return err
+}
+
+// alsoPropagate adds a command propagated instead of the command being executed,
+// e.g. XREADGROUP is propagated as an XCLAIM for every entry delivered.
+// It must be called with s.mu held.
+func (s *Server) alsoPropagate(args ...string) {
+	b := make([][]byte, len(args))
+	for i, arg := range args {
+		b[i] = []byte(arg)
+	}
+	s.alsoPropagated = append(s.alsoPropagated, &command{args: b})
+}
+
+// propagateAlso propagates the commands added by alsoPropagate, the handler with
+// flagNoLock calls it by itself.
+// It must be called with s.mu held.
+func (s *Server) propagateAlso(conn *Conn) {
+	for _, cmd := range s.alsoPropagated {
+		s.propagate(cmd)
+	}
+	s.alsoPropagated = nil
+	conn.woff = s.replOffset
+}
+
+// rejectOnReplica returns the error code and message if a replica doesn't
+// accept the command from the client.
+// It must be called with s.mu held.
+func (s *Server) rejectOnReplica(conn *Conn, spec *commandSpec) (string, string) {
+	if s.role != roleReplica || conn.fromMaster || s.loading {
+		return "", ""
+	}
+	if !s.replicaServeStaleData && s.replState != replConnected && spec.flags&flagStale == 0 {
+		return "MASTERDOWN", "Link with MASTER is down and replica-serve-stale-data is set to 'no'."
+	}
+	if s.replicaReadOnly && spec.isWrite() {
+		return "READONLY", "You can't write against a read only replica."
+	}
+	return "", ""
+}
+
+// rejectOnMaster returns the error code and message if a master doesn't accept
+// the write command because there are not enough good replicas, see min-replicas-to-write.
+// It must be called with s.mu held.
+func (s *Server) rejectOnMaster(conn *Conn, spec *commandSpec) (string, string) {
+	if s.role != roleMaster || s.loading || !spec.isWrite() || conn.fromMaster {
+		return "", ""
+	}
+	if s.minReplicasToWrite > 0 && s.minReplicasMaxLag > 0 && s.goodReplicas() < s.minReplicasToWrite {
+		return "NOREPLICAS", "Not enough good replicas to write."
+	}
+	return "", ""
+}
+
+func argsPreview(cmd Command) string {
+	preview := []string{}
+	for _, arg := range cmd.Args()[1:] {
+		preview = append(preview, fmt.Sprintf("'%s'", arg))
+	}
+	return strings.Join(preview, " ")
+}
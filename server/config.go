@@ -2,14 +2,74 @@ package server
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+
+	"github.com/fukua95/gedis/aof"
 )
 
 const (
-	port       string = "port"
-	replicaof  string = "replicaof"
-	dbdir      string = "dir"
-	dbfilename string = "dbfilename"
+	port             string = "port"
+	replicaof        string = "replicaof"
+	dbdir            string = "dir"
+	dbfilename       string = "dbfilename"
+	appendonly       string = "appendonly"
+	appendfilename   string = "appendfilename"
+	appenddirname    string = "appenddirname"
+	appendfsync      string = "appendfsync"
+	aofLoadTruncated string = "aof-load-truncated"
+	aofRdbPreamble   string = "aof-use-rdb-preamble"
+	replBacklogSize  string = "repl-backlog-size"
+	replBacklogTTL   string = "repl-backlog-ttl"
+	replTimeout      string = "repl-timeout"
+	replPingPeriod   string = "repl-ping-replica-period"
+	slaveof          string = "slaveof"
+	masteruser       string = "masteruser"
+	masterauth       string = "masterauth"
+	requirepass      string = "requirepass"
+
+	replicaReadOnly       string = "replica-read-only"
+	slaveReadOnly         string = "slave-read-only"
+	replicaServeStaleData string = "replica-serve-stale-data"
+	slaveServeStaleData   string = "slave-serve-stale-data"
+
+	replDisklessSync      string = "repl-diskless-sync"
+	replDisklessSyncDelay string = "repl-diskless-sync-delay"
+	replDisklessLoad      string = "repl-diskless-load"
+
+	minReplicasToWrite string = "min-replicas-to-write"
+	minSlavesToWrite   string = "min-slaves-to-write"
+	minReplicasMaxLag  string = "min-replicas-max-lag"
+	minSlavesMaxLag    string = "min-slaves-max-lag"
+
+	replicaPriority string = "replica-priority"
+	slavePriority   string = "slave-priority"
+	sentinel        string = "sentinel"
+
+	clusterEnabled             string = "cluster-enabled"
+	clusterRequireFullCoverage string = "cluster-require-full-coverage"
+	clusterConfigFile          string = "cluster-config-file"
+	clusterNodeTimeout         string = "cluster-node-timeout"
+	clusterPort                string = "cluster-port"
+	clusterReplicaValidity     string = "cluster-replica-validity-factor"
+	clusterSlaveValidity       string = "cluster-slave-validity-factor"
+
+	protoMaxBulkLen        string = "proto-max-bulk-len"
+	clientQueryBufferLimit string = "client-query-buffer-limit"
+)
+
+// the min of proto-max-bulk-len and client-query-buffer-limit.
+const minProtoLimit = 1 << 20
+
+// the values of repl-diskless-load.
+const (
+	// the replica saves the rdb file to disk, and then loads it.
+	disklessLoadDisabled = "disabled"
+	// the replica loads the rdb file from the socket, serving the old dataset meanwhile.
+	disklessLoadSwapdb = "swapdb"
+	// the replica loads the rdb file from the socket only if its dataset is empty.
+	disklessLoadOnEmptyDB = "on-empty-db"
 )
 
 type Config struct {
@@ -20,21 +80,188 @@ type Config struct {
 	masterAddr string
 	dir        string
 	dbfilename string
+
+	appendonly       bool
+	appendfilename   string
+	appenddirname    string
+	appendfsync      string
+	aofLoadTruncated bool
+	aofRdbPreamble   bool
+
+	replBacklogSize int
+	replBacklogTTL  int
+	replTimeout     int
+	replPingPeriod  int
+	masterUser      string
+	masterAuth      string
+	requirepass     string
+
+	replicaReadOnly       bool
+	replicaServeStaleData bool
+
+	replDisklessSync      bool
+	replDisklessSyncDelay int
+	replDisklessLoad      string
+
+	minReplicasToWrite int
+	minReplicasMaxLag  int
+
+	// a sentinel promotes the replica with the lowest priority, 0 means never.
+	replicaPriority int
+
+	clusterEnabled             bool
+	clusterRequireFullCoverage bool
+	// the cluster config is saved to the file in dir, it's not meant to be edited.
+	clusterConfigFile string
+	// in milliseconds, a node not replying for this long is failing.
+	clusterNodeTimeout int
+	// the port of the cluster bus, 0 means port + 10000.
+	clusterPort int
+	// a replica doesn't failover if it's disconnected from the master for more than
+	// node-timeout * factor, 0 means it always tries.
+	clusterReplicaValidityFactor int
+
+	// the max length of an argument of a command, and the max size of a command.
+	protoMaxBulkLen   int
+	clientMaxQueryBuf int
+
+	// run as a sentinel, see NewSentinel.
+	sentinel         bool
+	sentinelMonitors []sentinelMonitorConf
 }
 
 func NewConfig(args []string) *Config {
 	conf := new(Config)
+	conf.appendfilename = "appendonly.aof"
+	conf.appenddirname = "appendonlydir"
+	conf.appendfsync = aof.FsyncEverySec
+	conf.aofLoadTruncated = true
+	conf.aofRdbPreamble = true
+	conf.replBacklogSize = 1 << 20
+	conf.replBacklogTTL = 3600
+	conf.replTimeout = 60
+	conf.replPingPeriod = 10
+	conf.replicaReadOnly = true
+	conf.replicaServeStaleData = true
+	conf.replDisklessSync = true
+	conf.replDisklessSyncDelay = 5
+	conf.replDisklessLoad = disklessLoadDisabled
+	conf.minReplicasMaxLag = 10
+	conf.replicaPriority = 100
+	conf.clusterRequireFullCoverage = true
+	conf.clusterConfigFile = "nodes.conf"
+	conf.clusterNodeTimeout = 15000
+	conf.clusterReplicaValidityFactor = 10
+	conf.protoMaxBulkLen = 512 << 20
+	conf.clientMaxQueryBuf = 1 << 30
+
 	for i := 1; i < len(args); i++ {
-		arg := strings.ToLower(args[i])
-		if strings.HasSuffix(arg, port) && i+1 < len(args) {
+		name := strings.TrimLeft(strings.ToLower(args[i]), "-")
+		switch {
+		case name == port && i+1 < len(args):
 			conf.port = strings.ToLower(args[i+1])
-		} else if strings.HasSuffix(arg, replicaof) && i+2 < len(args) {
+		case (name == replicaof || name == slaveof) && i+2 < len(args):
 			conf.role = roleReplica
-			conf.masterAddr = fmt.Sprintf("%s:%s", strings.ToLower(args[i+1]), strings.ToLower(args[i+2]))
-		} else if strings.HasSuffix(arg, dbdir) && i+1 < len(args) {
+			conf.masterAddr = net.JoinHostPort(strings.ToLower(args[i+1]), strings.ToLower(args[i+2]))
+		case name == dbdir && i+1 < len(args):
 			conf.dir = args[i+1]
-		} else if strings.HasSuffix(arg, dbfilename) && i+1 < len(args) {
+		case name == dbfilename && i+1 < len(args):
 			conf.dbfilename = args[i+1]
+		case name == appendonly && i+1 < len(args):
+			conf.appendonly = isYes(args[i+1])
+		case name == appendfilename && i+1 < len(args):
+			conf.appendfilename = args[i+1]
+		case name == appenddirname && i+1 < len(args):
+			conf.appenddirname = args[i+1]
+		case name == appendfsync && i+1 < len(args):
+			conf.appendfsync = strings.ToLower(args[i+1])
+		case name == aofLoadTruncated && i+1 < len(args):
+			conf.aofLoadTruncated = isYes(args[i+1])
+		case name == aofRdbPreamble && i+1 < len(args):
+			conf.aofRdbPreamble = isYes(args[i+1])
+		case name == replBacklogSize && i+1 < len(args):
+			if v, err := parseMemory(args[i+1]); err == nil && v > 0 {
+				conf.replBacklogSize = v
+			}
+		case name == replBacklogTTL && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v >= 0 {
+				conf.replBacklogTTL = v
+			}
+		case name == replTimeout && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v > 0 {
+				conf.replTimeout = v
+			}
+		case name == replPingPeriod && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v > 0 {
+				conf.replPingPeriod = v
+			}
+		case name == masteruser && i+1 < len(args):
+			conf.masterUser = args[i+1]
+		case name == masterauth && i+1 < len(args):
+			conf.masterAuth = args[i+1]
+		case name == requirepass && i+1 < len(args):
+			conf.requirepass = args[i+1]
+		case (name == replicaReadOnly || name == slaveReadOnly) && i+1 < len(args):
+			conf.replicaReadOnly = isYes(args[i+1])
+		case (name == replicaServeStaleData || name == slaveServeStaleData) && i+1 < len(args):
+			conf.replicaServeStaleData = isYes(args[i+1])
+		case name == replDisklessSync && i+1 < len(args):
+			conf.replDisklessSync = isYes(args[i+1])
+		case name == replDisklessSyncDelay && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v >= 0 {
+				conf.replDisklessSyncDelay = v
+			}
+		case (name == minReplicasToWrite || name == minSlavesToWrite) && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v >= 0 {
+				conf.minReplicasToWrite = v
+			}
+		case (name == minReplicasMaxLag || name == minSlavesMaxLag) && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v >= 0 {
+				conf.minReplicasMaxLag = v
+			}
+		case (name == replicaPriority || name == slavePriority) && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v >= 0 {
+				conf.replicaPriority = v
+			}
+		case name == clusterEnabled && i+1 < len(args):
+			conf.clusterEnabled = isYes(args[i+1])
+		case name == clusterRequireFullCoverage && i+1 < len(args):
+			conf.clusterRequireFullCoverage = isYes(args[i+1])
+		case name == clusterConfigFile && i+1 < len(args):
+			conf.clusterConfigFile = args[i+1]
+		case name == clusterNodeTimeout && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v > 0 {
+				conf.clusterNodeTimeout = v
+			}
+		case name == clusterPort && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v >= 0 && v < 65536 {
+				conf.clusterPort = v
+			}
+		case (name == clusterReplicaValidity || name == clusterSlaveValidity) && i+1 < len(args):
+			if v, err := strconv.Atoi(args[i+1]); err == nil && v >= 0 {
+				conf.clusterReplicaValidityFactor = v
+			}
+		case name == protoMaxBulkLen && i+1 < len(args):
+			if v, err := parseMemory(args[i+1]); err == nil && v >= minProtoLimit {
+				conf.protoMaxBulkLen = v
+			}
+		case name == clientQueryBufferLimit && i+1 < len(args):
+			if v, err := parseMemory(args[i+1]); err == nil && v >= minProtoLimit {
+				conf.clientMaxQueryBuf = v
+			}
+		case name == sentinel:
+			conf.sentinel = true
+			// `--sentinel monitor <name> ...` like a line of sentinel.conf.
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i += 1 + conf.parseSentinelOption(strings.ToLower(args[i+1]), args[i+2:])
+			}
+		case strings.HasPrefix(name, sentinel+"-"):
+			i += conf.parseSentinelOption(strings.TrimPrefix(name, sentinel+"-"), args[i+1:])
+		case name == replDisklessLoad && i+1 < len(args):
+			switch v := strings.ToLower(args[i+1]); v {
+			case disklessLoadDisabled, disklessLoadSwapdb, disklessLoadOnEmptyDB:
+				conf.replDisklessLoad = v
+			}
 		}
 	}
 
@@ -43,6 +270,9 @@ func NewConfig(args []string) *Config {
 	}
 	if conf.port == "" {
 		conf.port = "6379"
+		if conf.sentinel {
+			conf.port = "26379"
+		}
 	}
 	conf.addr = fmt.Sprintf("0.0.0.0:%s", conf.port)
 	if conf.masterAddr == "" {
@@ -50,3 +280,37 @@ func NewConfig(args []string) *Config {
 	}
 	return conf
 }
+
+// parseMemory parses a memory size like redis, e.g. 1024, 1kb, 1mb, 1gb.
+func parseMemory(v string) (int, error) {
+	v = strings.ToLower(v)
+	units := []struct {
+		suffix string
+		mul    int
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1}}
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(v, u.suffix))
+			return n * u.mul, err
+		}
+	}
+	return strconv.Atoi(v)
+}
+
+func isYes(v string) bool {
+	return strings.EqualFold(v, "yes")
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
+
+func boolToInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
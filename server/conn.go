@@ -1,8 +1,12 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/fukua95/gedis/proto"
@@ -12,13 +16,88 @@ type Conn struct {
 	netConn net.Conn
 	r       *proto.Reader
 	w       *proto.Writer
+	wmu     sync.Mutex
+
+	authenticated bool
+	// the fake client executing the commands from the master.
+	fromMaster bool
+	// the replication offset after the last write command of the client.
+	woff int
+
+	// set by a replica with REPLCONF.
+	replListeningPort string
+	replCapaPsync2    bool
+	// not nil if the connection is a replica after PSYNC.
+	replica *replica
+
+	// the next command is served if the slot is importing, see ASKING.
+	asking bool
+	// a replica serves the reads of the client in a cluster, see READONLY.
+	readOnly bool
+
+	// the channels subscribed, see SUBSCRIBE.
+	channels map[string]struct{}
+
+	// the metadata of the client, see CLIENT LIST, they're protected by s.mu.
+	id      int64
+	name    string
+	libName string
+	libVer  string
+	ctime   time.Time
+	// the last command executed, and when it's executed.
+	lastCmd         string
+	lastInteraction time.Time
+	// the unparsed bytes of the query buffer and the size of the arguments
+	// when the last command is read.
+	qbuf    int
+	argvMem int
+	noEvict bool
+	// blocked by XREAD or XREADGROUP.
+	blocked bool
+	// the connection is closed after the reply of the current command, see CLIENT KILL.
+	closeAfterReply bool
+	// the version of the protocol, 3 if push messages can be sent.
+	resp int
+	// nil if CLIENT TRACKING is off.
+	tracking *clientTracking
+
+	// the replies are discarded, see CLIENT REPLY, they're protected by wmu.
+	replyOff      bool
+	replySkip     bool
+	replySkipNext bool
+
+	// the push messages waiting to be written, see QueuePush, they're protected by pmu.
+	pmu sync.Mutex
+	// the version of the protocol the messages are built in, it changes with resp.
+	pushResp int
+	pushes   []byte
+	// a goroutine is writing the push messages.
+	pushing bool
+	// the client is closed for exceeding pushBufferLimit, or its connection is broken.
+	pushBroken bool
 }
 
+// the max size of the push messages not written yet, the client is closed if it can't
+// read them fast enough, like the pubsub class of client-output-buffer-limit of redis.
+const pushBufferLimit = 32 << 20
+
 func NewConn(conn net.Conn) *Conn {
 	return &Conn{
-		netConn: conn,
-		r:       proto.NewReader(conn),
-		w:       proto.NewWriter(conn),
+		netConn:  conn,
+		r:        proto.NewReader(conn),
+		w:        proto.NewWriter(conn),
+		resp:     proto.Resp2,
+		pushResp: proto.Resp2,
+	}
+}
+
+// newFakeConn returns a Conn discarding all replies, it executes commands
+// not sent by a client, e.g. commands loaded from the aof file.
+func newFakeConn() *Conn {
+	return &Conn{
+		w:        proto.NewWriter(io.Discard),
+		resp:     proto.Resp2,
+		pushResp: proto.Resp2,
 	}
 }
 
@@ -30,8 +109,33 @@ func (conn *Conn) ResetReadDeadline() {
 	conn.netConn.SetDeadline(time.Time{})
 }
 
+// watchClose returns a channel closed if the client disconnects or is killed while the
+// goroutine serving it doesn't read, e.g. it's blocked by XREAD, and stop to stop watching,
+// stop must be called before reading the client again.
+// The bytes of the next command arriving meanwhile are left in the reader.
+func (conn *Conn) watchClose() (closed <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	if conn.netConn == nil {
+		return ch, func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := conn.r.Peek(); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(ch)
+		}
+	}()
+	return ch, func() {
+		// wake up the goroutine peeking, the writes aren't affected.
+		conn.netConn.SetReadDeadline(time.Now())
+		<-done
+		conn.netConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// ReadCommand reads a command in the multibulk or the inline format.
 func (conn *Conn) ReadCommand() (Command, error) {
-	args, err := conn.r.ReadSlice()
+	args, err := conn.r.ReadCommand()
 	if err != nil {
 		return nil, err
 	}
@@ -39,13 +143,30 @@ func (conn *Conn) ReadCommand() (Command, error) {
 	return cmd, nil
 }
 
+// ReadCommandRaw reads a command, and also returns the raw bytes of it.
+func (conn *Conn) ReadCommandRaw() (Command, []byte, error) {
+	args, raw, err := conn.r.ReadSliceRaw()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &command{args: args}, raw, nil
+}
+
 // golang 目前不支持 struct's method type.
 func (conn *Conn) ReadStatusReply() (string, error) {
 	v, err := conn.r.ReadReply()
 	if err != nil {
 		return "", err
 	}
-	return v.(string), nil
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("redis: unexpected reply %.100v, expecting a status reply", v)
+}
+
+// ReadReply reads a reply of any type, an error reply is returned as proto.RedisError.
+func (conn *Conn) ReadReply() (interface{}, error) {
+	return conn.r.ReadReply()
 }
 
 func (conn *Conn) ReadSliceReply() ([][]byte, error) {
@@ -57,6 +178,10 @@ func (conn *Conn) ReadRdb() ([]byte, error) {
 	return s, err
 }
 
+func (conn *Conn) RdbReader() (io.Reader, error) {
+	return conn.r.RdbReader()
+}
+
 func (conn *Conn) WriteCommand(cmd Command) error {
 	strs := make([]string, len(cmd.Args()))
 	for i := 0; i < len(cmd.Args()); i++ {
@@ -65,29 +190,143 @@ func (conn *Conn) WriteCommand(cmd Command) error {
 	return conn.WriteSlice(strs)
 }
 
-func (conn *Conn) WriteStatus(b string) error {
-	if err := conn.w.WriteStatus(b); err != nil {
+// setProtocol sets the version of the protocol of the client, see HELLO.
+func (conn *Conn) setProtocol(resp int) {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	conn.resp = resp
+	conn.w.SetProtocol(resp)
+	conn.pmu.Lock()
+	conn.pushResp = resp
+	conn.pmu.Unlock()
+}
+
+// mapHeader, setHeader, pushHeader, nullBulk and nullArray build a reply in the protocol
+// of the client, see proto.MapHeader.
+func (conn *Conn) mapHeader(l int) []byte {
+	return proto.MapHeader(l, conn.resp)
+}
+
+func (conn *Conn) setHeader(l int) []byte {
+	return proto.SetHeader(l, conn.resp)
+}
+
+func (conn *Conn) pushHeader(l int) []byte {
+	return proto.PushHeader(l, conn.resp)
+}
+
+func (conn *Conn) nullBulk() []byte {
+	return proto.NullBulk(conn.resp)
+}
+
+func (conn *Conn) nullArray() []byte {
+	return proto.NullArray(conn.resp)
+}
+
+// QueuePush queues a message not replying to a command of the client, e.g. a message
+// published to a channel, fn builds it in the protocol of the client. The message is written
+// by another goroutine, so a client not reading doesn't block the sender holding the locks.
+// It's written even if the replies are discarded by CLIENT REPLY.
+func (conn *Conn) QueuePush(fn func(resp int) []byte) {
+	conn.pmu.Lock()
+	defer conn.pmu.Unlock()
+	if conn.pushBroken {
+		return
+	}
+	conn.pushes = append(conn.pushes, fn(conn.pushResp)...)
+	if len(conn.pushes) > pushBufferLimit {
+		fmt.Printf("client %v closed for overcoming of output buffer limits\n", conn.netConn.RemoteAddr())
+		conn.pushBroken, conn.pushes = true, nil
+		// the goroutine reading the client fails and cleans up the client.
+		conn.netConn.Close()
+		return
+	}
+	if !conn.pushing {
+		conn.pushing = true
+		go conn.writePushes()
+	}
+}
+
+// writePushes writes the queued push messages until there is none.
+func (conn *Conn) writePushes() {
+	for {
+		conn.pmu.Lock()
+		b := conn.pushes
+		conn.pushes = nil
+		if len(b) == 0 || conn.pushBroken {
+			conn.pushing = false
+			conn.pmu.Unlock()
+			return
+		}
+		conn.pmu.Unlock()
+
+		conn.wmu.Lock()
+		err := conn.w.WriteRawBytes(b)
+		if err == nil {
+			err = conn.w.Flush()
+		}
+		conn.wmu.Unlock()
+		if err != nil {
+			conn.pmu.Lock()
+			conn.pushBroken, conn.pushes = true, nil
+			conn.pmu.Unlock()
+		}
+	}
+}
+
+// write writes with fn and flushes.
+// The writes are serialized, because the messages to a subscriber are written
+// by the goroutines of the publishers.
+func (conn *Conn) write(fn func(w *proto.Writer) error) error {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	if conn.replyOff || conn.replySkip {
+		return nil
+	}
+	if err := fn(conn.w); err != nil {
 		return err
 	}
 	return conn.w.Flush()
 }
 
+func (conn *Conn) WriteStatus(b string) error {
+	return conn.write(func(w *proto.Writer) error { return w.WriteStatus(b) })
+}
+
 func (conn *Conn) WriteStatusOK() error {
 	return conn.WriteStatus("OK")
 }
 
 func (conn *Conn) WriteString(s string) error {
-	if err := conn.w.WriteBytes([]byte(s)); err != nil {
-		return err
-	}
-	return conn.w.Flush()
+	return conn.write(func(w *proto.Writer) error { return w.WriteBytes([]byte(s)) })
 }
 
 func (conn *Conn) WriteNilBulkString() error {
-	if err := conn.w.WriteNilBulkString(); err != nil {
-		return err
-	}
-	return conn.w.Flush()
+	return conn.write(func(w *proto.Writer) error { return w.WriteNilBulkString() })
+}
+
+func (conn *Conn) WriteNilArray() error {
+	return conn.write(func(w *proto.Writer) error { return w.WriteNilArray() })
+}
+
+// WriteStringMap writes the pairs of the keys and the values as a map.
+func (conn *Conn) WriteStringMap(kvs []string) error {
+	return conn.write(func(w *proto.Writer) error {
+		if err := w.WriteMapHeader(len(kvs) / 2); err != nil {
+			return err
+		}
+		for _, s := range kvs {
+			if err := w.WriteBytes([]byte(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteVerbatim writes a text for humans, e.g. INFO, as a verbatim string.
+func (conn *Conn) WriteVerbatim(s string) error {
+	return conn.write(func(w *proto.Writer) error { return w.WriteVerbatim("txt", s) })
 }
 
 func (conn *Conn) WriteSlice(a []string) error {
@@ -95,31 +334,24 @@ func (conn *Conn) WriteSlice(a []string) error {
 	for i := 0; i < len(a); i++ {
 		b[i] = []byte(a[i])
 	}
-	if err := conn.w.WriteSlice(b); err != nil {
-		return err
-	}
-	return conn.w.Flush()
+	return conn.write(func(w *proto.Writer) error { return w.WriteSlice(b) })
 }
 
 func (conn *Conn) WriteRdb(content []byte) error {
-	if err := conn.w.WriteRdb(content); err != nil {
-		return err
-	}
-	return conn.w.Flush()
+	return conn.write(func(w *proto.Writer) error { return w.WriteRdb(content) })
 }
 
 func (conn *Conn) WriteInt(v int) error {
-	if err := conn.w.WriteInt(v); err != nil {
-		return err
-	}
-	return conn.w.Flush()
+	return conn.write(func(w *proto.Writer) error { return w.WriteInt(v) })
 }
 
 func (conn *Conn) WriteError(e string) error {
-	if err := conn.w.WriteError(e); err != nil {
-		return err
-	}
-	return conn.w.Flush()
+	return conn.write(func(w *proto.Writer) error { return w.WriteError(e) })
+}
+
+// WriteErrorCode writes an error with a specific code instead of `ERR`, e.g. `-NOAUTH <e>`.
+func (conn *Conn) WriteErrorCode(code string, e string) error {
+	return conn.write(func(w *proto.Writer) error { return w.WriteRawBytes(proto.ErrorCode(code, e)) })
 }
 
 func (conn *Conn) WriteErrorInvalidCmd() error {
@@ -127,20 +359,17 @@ func (conn *Conn) WriteErrorInvalidCmd() error {
 }
 
 func (conn *Conn) WriteRawBytes(b []byte) error {
-	if err := conn.w.WriteRawBytes(b); err != nil {
-		return err
-	}
-	return conn.Flush()
+	return conn.write(func(w *proto.Writer) error { return w.WriteRawBytes(b) })
 }
 
 func (conn *Conn) Flush() error {
-	return conn.w.Flush()
+	return conn.write(func(w *proto.Writer) error { return nil })
 }
 
+// Close closes the connection without taking wmu, it may be called with s.mu held while
+// another goroutine is blocked writing to a stalled peer, e.g. a replica, the write fails then.
+// The replies are flushed as they're written, so nothing is lost.
 func (conn *Conn) Close() error {
-	if err := conn.w.Flush(); err != nil {
-		return err
-	}
 	fmt.Printf("closing connection: %v->%v\n", conn.netConn.LocalAddr(), conn.netConn.RemoteAddr())
 	return conn.netConn.Close()
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/rdb"
+	"github.com/fukua95/gedis/storage"
+	"github.com/fukua95/gedis/util"
+)
+
+// replicasWriter writes to the sockets of the replicas of a diskless sync,
+// a replica failing is skipped, the others continue.
+type replicasWriter struct {
+	replicas []*replica
+	failed   map[*replica]error
+}
+
+func (w *replicasWriter) Write(p []byte) (int, error) {
+	for _, r := range w.replicas {
+		if w.failed[r] != nil {
+			continue
+		}
+		if err := r.conn.WriteRawBytes(p); err != nil {
+			w.failed[r] = err
+		}
+	}
+	if len(w.failed) == len(w.replicas) {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+// sendRdbDiskless streams the snapshot to the sockets of the replicas of the job without
+// touching the disk. The size isn't known in advance, so the rdb file is sent as
+// `$EOF:<mark>\r\n<rdb><mark>`, the replica reads until the random mark.
+func (s *Server) sendRdbDiskless(job *rdbJob, snapshot *storage.Store) {
+	w := &replicasWriter{replicas: job.replicas, failed: make(map[*replica]error)}
+	bw := bufio.NewWriterSize(w, 64*1024)
+	mark := util.RandomAlphanumericString(proto.RdbEOFMarkLen)
+	_, err := bw.Write(proto.RdbEOFHeader(mark))
+	if err == nil {
+		err = rdb.Save(bw, snapshot, nil)
+	}
+	if err == nil {
+		_, err = bw.WriteString(mark)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finishRdbJob(job)
+
+	if err != nil {
+		fmt.Println("master streams rdb snapshot error: ", err.Error())
+	}
+	sent := 0
+	for _, r := range job.replicas {
+		if err != nil || w.failed[r] != nil {
+			s.dropReplica(r)
+			continue
+		}
+		s.startStreaming(r, nil)
+		sent++
+	}
+	fmt.Printf("master streamed rdb snapshot to %d replicas without disk\n", sent)
+}
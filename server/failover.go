@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+type failoverState string
+
+// the states of a failover, shown as master_failover_state in INFO.
+const (
+	failoverNone        failoverState = "no-failover"
+	failoverWaitForSync failoverState = "waiting-for-sync"
+	failoverInProgress  failoverState = "failover-in-progress"
+)
+
+// pendingFailover is a FAILOVER in progress, all fields are protected by Server.mu.
+type pendingFailover struct {
+	state failoverState
+	// the replica to promote, any replica catching up if host is empty.
+	host string
+	port string
+	// promote the target replica even if it doesn't catch up before the timeout.
+	force bool
+	// zero means no timeout.
+	deadline time.Time
+	// closed when the failover ends, the writes paused meanwhile continue.
+	done chan struct{}
+}
+
+// failover handles `FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT ms]`.
+// The master pauses writes, waits for a replica to catch up with its offset, and then
+// becomes a replica of it. It connects to the replica with `PSYNC <replid> <offset> FAILOVER`,
+// which makes the replica a master.
+func (s *Server) failover(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	f := &pendingFailover{state: failoverWaitForSync}
+	abort := false
+	timeoutMS := 0
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case proto.OptionTo:
+			if i+2 >= len(args) || f.host != "" {
+				return conn.WriteError("syntax error")
+			}
+			f.host, f.port = string(args[i+1]), string(args[i+2])
+			if _, err := strconv.Atoi(f.port); err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			i += 2
+		case proto.OptionForce:
+			f.force = true
+		case proto.OptionAbort:
+			abort = true
+		case proto.OptionTimeout:
+			if i+1 >= len(args) || timeoutMS != 0 {
+				return conn.WriteError("syntax error")
+			}
+			v, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			if v <= 0 {
+				return conn.WriteError("FAILOVER timeout must be greater than 0")
+			}
+			timeoutMS = v
+			i++
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+
+	if abort {
+		if len(args) != 2 {
+			return conn.WriteError("syntax error")
+		}
+		if s.failoverJob == nil {
+			return conn.WriteError("No failover in progress.")
+		}
+		s.abortFailover("Failover manually aborted")
+		return conn.WriteStatusOK()
+	}
+
+	if f.force && (f.host == "" || timeoutMS == 0) {
+		return conn.WriteError("FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+	if s.role == roleReplica {
+		return conn.WriteError("FAILOVER is not valid when server is a replica.")
+	}
+	if s.replicas.Len() == 0 {
+		return conn.WriteError("FAILOVER requires connected replicas.")
+	}
+	if s.failoverJob != nil {
+		return conn.WriteError("FAILOVER already in progress.")
+	}
+	if f.host != "" {
+		var target *replica
+		for _, r := range s.replicas.Clone() {
+			if f.isTarget(r) {
+				target = r
+				break
+			}
+		}
+		if target == nil {
+			return conn.WriteError("FAILOVER target HOST and PORT is not a replica.")
+		}
+		if target.state != replicaOnline {
+			return conn.WriteError("FAILOVER target replica is not online.")
+		}
+	}
+
+	if timeoutMS > 0 {
+		f.deadline = time.Now().Add(time.Duration(timeoutMS) * time.Millisecond)
+	}
+	f.done = make(chan struct{})
+	s.failoverJob = f
+	fmt.Println("FAILOVER requested, pausing writes and waiting for a replica to catch up")
+	go s.runFailover(f)
+	return conn.WriteStatusOK()
+}
+
+// isTarget reports whether r is the replica at host:port.
+func (f *pendingFailover) isTarget(r *replica) bool {
+	if f.port != r.conn.replListeningPort {
+		return false
+	}
+	ip := replicaIP(r)
+	if f.host == ip {
+		return true
+	}
+	addrs, err := net.LookupHost(f.host)
+	return err == nil && slices.Contains(addrs, ip)
+}
+
+func replicaIP(r *replica) string {
+	ip, _, _ := net.SplitHostPort(r.conn.netConn.RemoteAddr().String())
+	return ip
+}
+
+// runFailover waits for a replica to catch up with the offset of the master,
+// and then starts the failover to it.
+func (s *Server) runFailover(f *pendingFailover) {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.failoverJob == f && f.state == failoverWaitForSync {
+		// the writes are paused, and neither PING nor GETACK is sent meanwhile,
+		// so the replicas catch up with the offset by their periodic acks.
+		for _, r := range s.replicas.Clone() {
+			if r.state == replicaOnline && r.ackOffset == s.replOffset && (f.host == "" || f.isTarget(r)) {
+				s.startFailover(f, net.JoinHostPort(replicaIP(r), r.conn.replListeningPort))
+				return
+			}
+		}
+		if !f.deadline.IsZero() && time.Now().After(f.deadline) {
+			if f.force {
+				s.startFailover(f, net.JoinHostPort(f.host, f.port))
+				return
+			}
+			s.abortFailover("Replica never caught up before timeout")
+			return
+		}
+
+		notify := s.ackNotify
+		s.mu.Unlock()
+		select {
+		case <-notify:
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+	}
+}
+
+// startFailover makes the master a replica of the target, the replica link sends
+// `PSYNC ... FAILOVER` to promote the target.
+// It must be called with s.mu held.
+func (s *Server) startFailover(f *pendingFailover, addr string) {
+	fmt.Printf("failover target %s is synced, failing over\n", addr)
+	f.state = failoverInProgress
+	s.becomeReplica(addr)
+}
+
+// endFailover resumes the paused writes.
+// It must be called with s.mu held.
+func (s *Server) endFailover() {
+	if s.failoverJob == nil {
+		return
+	}
+	close(s.failoverJob.done)
+	s.failoverJob = nil
+}
+
+// abortFailover must be called with s.mu held.
+func (s *Server) abortFailover(reason string) {
+	if s.failoverJob == nil {
+		return
+	}
+	fmt.Printf("FAILOVER aborted: %s\n", reason)
+	if s.failoverJob.state == failoverInProgress {
+		// the target may not be promoted, this server is the master again.
+		s.becomeMaster()
+	}
+	s.endFailover()
+}
+
+func (s *Server) failoverState() failoverState {
+	if s.failoverJob == nil {
+		return failoverNone
+	}
+	return s.failoverJob.state
+}
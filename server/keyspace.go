@@ -0,0 +1,85 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+// del handles `DEL key [key ...]`.
+func (s *Server) del(conn *Conn, cmd Command) error {
+	n := 0
+	for _, key := range cmd.Args()[1:] {
+		if s.store.Del(string(key)) {
+			n++
+		}
+	}
+	if n > 0 {
+		s.dirty++
+	}
+	return conn.WriteInt(n)
+}
+
+// expire handles EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, only strings can expire.
+// It's propagated as `PEXPIREAT key unix-time-milliseconds`, which doesn't depend on the time,
+// or as `DEL key` if the time is in the past.
+func (s *Server) expire(conn *Conn, cmd Command) error {
+	key := string(cmd.At(1))
+	v, err := strconv.ParseInt(string(cmd.At(2)), 10, 64)
+	if err != nil {
+		return conn.WriteError("value is not an integer or out of range")
+	}
+	now := time.Now().UnixMilli()
+	var at int64
+	switch cmd.Name() {
+	case proto.CmdExpire:
+		at = now + v*1000
+	case proto.CmdPExpire:
+		at = now + v
+	case proto.CmdExpireAt:
+		at = v * 1000
+	case proto.CmdPExpireAt:
+		at = v
+	}
+
+	if _, ok := s.store.Expire(key); !ok {
+		if s.store.HasStream(key) {
+			return conn.WriteError("expire is only supported for strings")
+		}
+		return conn.WriteInt(0)
+	}
+
+	s.dirty++
+	if at <= now {
+		s.store.Del(key)
+		cmd.SetArgs([][]byte{[]byte(proto.CmdDel), []byte(key)})
+		return conn.WriteInt(1)
+	}
+	s.store.SetExpire(key, at)
+	cmd.SetArgs([][]byte{[]byte(proto.CmdPExpireAt), []byte(key), []byte(strconv.FormatInt(at, 10))})
+	return conn.WriteInt(1)
+}
+
+// ttl handles TTL and PTTL, it replies -2 if the key doesn't exist, -1 if the key has no expiration.
+func (s *Server) ttl(conn *Conn, cmd Command) error {
+	key := string(cmd.At(1))
+	at, ok := s.store.Expire(key)
+	if !ok {
+		if s.store.HasStream(key) {
+			return conn.WriteInt(-1)
+		}
+		return conn.WriteInt(-2)
+	}
+	if at == 0 {
+		return conn.WriteInt(-1)
+	}
+	ms := at - time.Now().UnixMilli()
+	if ms < 0 {
+		ms = 0
+	}
+	if cmd.Name() == proto.CmdTTL {
+		return conn.WriteInt(int((ms + 500) / 1000))
+	}
+	return conn.WriteInt(int(ms))
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/storage"
+)
+
+type replState int
+
+// the state of the link of a replica to its master.
+const (
+	// not a replica.
+	replNone replState = iota
+	// must (re)connect to the master.
+	replConnect
+	replConnecting
+	// PING, AUTH and REPLCONF in progress.
+	replHandshake
+	// receiving the rdb snapshot from the master.
+	replTransfer
+	// receiving the replication stream.
+	replConnected
+)
+
+const (
+	replMinBackoff = 100 * time.Millisecond
+	replMaxBackoff = 5 * time.Second
+)
+
+// replicaof handles `REPLICAOF host port` and `REPLICAOF NO ONE`.
+func (s *Server) replicaof(conn *Conn, cmd Command) error {
+	host, port := string(cmd.At(1)), string(cmd.At(2))
+	if s.cluster != nil {
+		return conn.WriteError("REPLICAOF not allowed in cluster mode.")
+	}
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if s.role == roleReplica {
+			s.becomeMaster()
+			fmt.Println("MASTER MODE enabled (user request)")
+		}
+		return conn.WriteStatusOK()
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return conn.WriteError("Invalid master port")
+	}
+	addr := net.JoinHostPort(host, port)
+	if s.role == roleReplica && s.masterAddr == addr {
+		return conn.WriteStatus("OK Already connected to specified master")
+	}
+	s.becomeReplica(addr)
+	fmt.Printf("REPLICAOF %s enabled (user request)\n", addr)
+	return conn.WriteStatusOK()
+}
+
+// becomeReplica makes the server a replica of the master at addr.
+// It must be called with s.mu held.
+func (s *Server) becomeReplica(addr string) {
+	if s.role == roleMaster {
+		// the replicas need to resync with the new history.
+		s.dropAllReplicas()
+		// the history of this server may be continued by the new master, e.g. it was
+		// a replica of this server, so keep the backlog to try a partial resynchronization.
+		if s.backlog == nil {
+			s.backlog = newBacklog(s.replBacklogSize, s.replOffset+1)
+		}
+	}
+	s.closeMasterLink()
+	s.role = roleReplica
+	s.masterAddr = addr
+	s.masterGen++
+	s.replState = replConnect
+	s.masterDownSince = time.Now()
+	go s.replicateMaster(s.masterGen, addr)
+}
+
+// becomeMaster turns a replica into a master.
+// It must be called with s.mu held.
+func (s *Server) becomeMaster() {
+	s.closeMasterLink()
+	s.role = roleMaster
+	s.masterAddr = ""
+	s.masterGen++
+	s.replState = replNone
+	s.masterDownSince = time.Time{}
+	s.shiftReplicationID()
+	// the replicas of this replica resync to learn the new id,
+	// the old id is the secondary one so they can partially resync.
+	s.dropAllReplicas()
+	if s.backlog == nil {
+		s.backlog = newBacklog(s.replBacklogSize, s.replOffset+1)
+	}
+}
+
+// closeMasterLink must be called with s.mu held.
+func (s *Server) closeMasterLink() {
+	if s.master != nil {
+		s.master.Close()
+		s.master = nil
+	}
+}
+
+// replicateMaster connects to the master and replicates it, and reconnects with
+// a backoff when the link is broken, until the server is not a replica of the master.
+// gen identifies the master, it changes whenever the master changes.
+func (s *Server) replicateMaster(gen int, addr string) {
+	backoff := replMinBackoff
+	for {
+		s.mu.Lock()
+		if gen != s.masterGen {
+			s.mu.Unlock()
+			return
+		}
+		s.replState = replConnecting
+		s.mu.Unlock()
+
+		synced, err := s.connectToMaster(gen, addr)
+		if err != nil {
+			fmt.Printf("replica link with master %s error: %s\n", addr, err.Error())
+		}
+		if synced {
+			backoff = replMinBackoff
+		}
+
+		s.mu.Lock()
+		if gen != s.masterGen {
+			s.mu.Unlock()
+			return
+		}
+		if !synced && s.failoverState() == failoverInProgress {
+			s.abortFailover("Failover target rejected psync request")
+			s.mu.Unlock()
+			return
+		}
+		s.closeMasterLink()
+		s.replState = replConnect
+		if s.masterDownSince.IsZero() {
+			s.masterDownSince = time.Now()
+		}
+		s.mu.Unlock()
+
+		fmt.Printf("replica reconnecting to master %s in %v\n", addr, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, replMaxBackoff)
+	}
+}
+
+// connectToMaster runs the link with the master until it's broken.
+// synced reports whether the replica was synchronized with the master.
+func (s *Server) connectToMaster(gen int, addr string) (synced bool, err error) {
+	timeout := time.Duration(s.replTimeout) * time.Second
+	c, err := net.DialTimeout(s.network, addr, timeout)
+	if err != nil {
+		return false, err
+	}
+	conn := NewConn(c)
+
+	s.mu.Lock()
+	if gen != s.masterGen {
+		s.mu.Unlock()
+		conn.Close()
+		return false, nil
+	}
+	s.master = conn
+	s.replState = replHandshake
+	s.masterLastIO = time.Now()
+	s.mu.Unlock()
+	fmt.Printf("replica connected to master %s\n", addr)
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if err = s.handshake(conn); err != nil {
+		return false, fmt.Errorf("handshake: %w", err)
+	}
+
+	s.mu.Lock()
+	s.replState = replTransfer
+	s.mu.Unlock()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if err = s.syncWithMaster(conn, gen); err != nil {
+		return false, fmt.Errorf("synchronization: %w", err)
+	}
+	conn.ResetReadDeadline()
+
+	s.mu.Lock()
+	if gen != s.masterGen {
+		s.mu.Unlock()
+		return true, nil
+	}
+	s.replState = replConnected
+	s.masterDownSince = time.Time{}
+	s.masterLastIO = time.Now()
+	if s.failoverState() == failoverInProgress {
+		fmt.Printf("failover target %s is now master\n", addr)
+		s.endFailover()
+	}
+	s.mu.Unlock()
+	fmt.Println("MASTER <-> REPLICA sync: master link is up")
+
+	return true, s.readReplicationStream(conn)
+}
+
+// readReplicationStream applies the commands from the master.
+// The replica keeps the exact stream in its backlog and forwards it to its own replicas,
+// so they have the same replication id and offsets as the master, and can partially
+// resync with this replica once it is promoted.
+func (s *Server) readReplicationStream(conn *Conn) error {
+	// the commands are executed like the commands of a client, but the replies are discarded.
+	client := newFakeConn()
+	client.fromMaster = true
+	// the master is listed by CLIENT LIST, and CLIENT KILL closes the link.
+	client.netConn = conn.netConn
+	s.mu.Lock()
+	s.linkClient(client)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.unlinkClient(client)
+		s.mu.Unlock()
+	}()
+	for {
+		cmd, raw, err := conn.ReadCommandRaw()
+		if err != nil {
+			return err
+		}
+
+		// the command is applied and fed to the stream at the same time, so a snapshot
+		// for a full resynchronization of the replicas is at the right offset.
+		s.mu.Lock()
+		s.masterLastIO = time.Now()
+		// master -> replica, replica 只回复 REPLCONF GETACK, 其余 cmd 不回复.
+		if cmd.Name() == proto.CmdReplConf && len(cmd.Args()) == 3 && strings.EqualFold(string(cmd.At(1)), proto.OptionGetAck) {
+			if err := s.sendAck(conn); err != nil {
+				fmt.Println("replica reply GETACK error: ", err.Error())
+			}
+		} else if spec, msg := lookupCommand(cmd); spec == nil || spec.flags&flagNoLock != 0 {
+			fmt.Printf("replica can't execute command from master: %s %s\n", cmd.Name(), msg)
+		} else {
+			client.commandRead(spec, cmd)
+			if err := s.call(client, spec, cmd); err != nil {
+				fmt.Println("replica execute command from master error: ", err.Error())
+			}
+		}
+		s.feedReplicationStream(raw)
+		s.mu.Unlock()
+	}
+}
+
+// sendAck sends `REPLCONF ACK <offset> FACK <aofoffset>` to the master,
+// aofoffset is the offset fsynced to the aof, or -1 if the aof is disabled.
+// It must be called with s.mu held, which serializes the writes to the master.
+func (s *Server) sendAck(conn *Conn) error {
+	aofOffset := -1
+	if s.aof != nil {
+		aofOffset = s.aof.FsyncedOffset()
+	}
+	reply := []string{proto.CmdReplConf, proto.OptionAck, strconv.Itoa(s.replOffset), proto.OptionFAck, strconv.Itoa(aofOffset)}
+	return conn.WriteSlice(reply)
+}
+
+func (s *Server) handshake(conn *Conn) error {
+	if s.masterAuth != "" {
+		args := [][]byte{[]byte(proto.CmdAuth), []byte(s.masterAuth)}
+		if s.masterUser != "" {
+			args = [][]byte{[]byte(proto.CmdAuth), []byte(s.masterUser), []byte(s.masterAuth)}
+		}
+		if err := s.WriteCmdAndCheckReply(conn, &command{args: args}, "ok"); err != nil {
+			return fmt.Errorf("AUTH: %w", err)
+		}
+	}
+
+	cmd := &command{args: [][]byte{[]byte(proto.CmdPing)}}
+	if err := s.WriteCmdAndCheckReply(conn, cmd, "pong"); err != nil {
+		return err
+	}
+
+	cmd = &command{
+		args: [][]byte{
+			[]byte(proto.CmdReplConf),
+			[]byte(proto.OptionReplLPort),
+			[]byte(s.port),
+		},
+	}
+	if err := s.WriteCmdAndCheckReply(conn, cmd, "ok"); err != nil {
+		return err
+	}
+
+	cmd = &command{
+		args: [][]byte{
+			[]byte(proto.CmdReplConf),
+			[]byte(proto.OptionReplCapa),
+			[]byte(proto.CapaPsync2),
+		},
+	}
+	if err := s.WriteCmdAndCheckReply(conn, cmd, "ok"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// syncWithMaster sends `PSYNC <replid> <offset>` with the replication id and offset
+// of the last master to continue from, or `PSYNC ? -1` if there is no history
+// and the replica needs to be full resynchronized.
+func (s *Server) syncWithMaster(conn *Conn, gen int) error {
+	s.mu.Lock()
+	replID, offset := "?", "-1"
+	if s.backlog != nil {
+		replID, offset = s.replID, strconv.Itoa(s.replOffset+1)
+	}
+	failover := s.failoverState() == failoverInProgress
+	s.mu.Unlock()
+
+	fmt.Printf("replica trying a partial resynchronization (request %s:%s)\n", replID, offset)
+	cmd := &command{args: [][]byte{[]byte(proto.CmdPsync), []byte(replID), []byte(offset)}}
+	if failover {
+		// the master asks the replica to become the master, see FAILOVER.
+		cmd.args = append(cmd.args, []byte(proto.OptionFailover))
+	}
+	if err := conn.WriteCommand(cmd); err != nil {
+		return err
+	}
+	replyStr, err := conn.ReadStatusReply()
+	if err != nil {
+		return err
+	}
+	reply := strings.Split(replyStr, " ")
+
+	switch reply[0] {
+	case proto.ReplyContinue:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(reply) > 1 && reply[1] != s.replID {
+			// the master was promoted and has a new id, the old one is still valid
+			// for the history up to now.
+			s.replID2 = s.replID
+			s.secondReplOffset = s.replOffset + 1
+			s.replID = reply[1]
+			fmt.Printf("master replication id changed to %s\n", s.replID)
+			// the replicas of this replica resync to learn the new id.
+			s.dropAllReplicas()
+		}
+		fmt.Println("successful partial resynchronization with master")
+		return nil
+	case proto.ReplyFullResync:
+		if len(reply) != 3 {
+			return proto.ErrInvalidReply
+		}
+		return s.fullResyncFromMaster(conn, gen, reply[1], reply[2])
+	}
+	return proto.ErrInvalidReply
+}
+
+func (s *Server) fullResyncFromMaster(conn *Conn, gen int, replID string, offsetStr string) error {
+	offset, err := strconv.Atoi(offsetStr)
+	if err != nil {
+		return proto.ErrInvalidReply
+	}
+
+	rd, err := conn.RdbReader()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	strs, streams := s.store.Len()
+	s.mu.Unlock()
+
+	// the rdb file is loaded into a new store, which replaces the old dataset,
+	// so the old dataset is served meanwhile.
+	var store *storage.Store
+	if s.replDisklessLoad == disklessLoadSwapdb || (s.replDisklessLoad == disklessLoadOnEmptyDB && strs+streams == 0) {
+		fmt.Println("replica loading rdb file from the socket")
+		store, err = loadRdbStore(rd)
+		if err == nil {
+			// the rest of the payload, e.g. the eof mark.
+			_, err = io.Copy(io.Discard, rd)
+		}
+	} else {
+		store, err = s.receiveRdbFile(rd)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if gen != s.masterGen {
+		s.mu.Unlock()
+		return nil
+	}
+	// the history of the replicas of this replica is not continued by the new dataset.
+	s.dropAllReplicas()
+	s.store = store
+	s.replID = replID
+	s.replOffset = offset
+	s.clearReplicationID2()
+	s.backlog = newBacklog(s.replBacklogSize, offset+1)
+	s.mu.Unlock()
+	fmt.Println("replica finishes loading rdb file")
+
+	// the aof has the old dataset, rebuild it from the new one.
+	if s.aof != nil {
+		if err := s.rewriteAof(); err != nil {
+			fmt.Println("replica rewrites aof error: ", err.Error())
+		}
+	}
+	return nil
+}
+
+// receiveRdbFile saves the rdb file from the master to disk, and then loads it.
+func (s *Server) receiveRdbFile(rd io.Reader) (*storage.Store, error) {
+	tmp := filepath.Join(s.dir, fmt.Sprintf("temp-%d-%d.rdb", os.Getpid(), time.Now().UnixNano()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, rd)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	path := s.rdbPath()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	fmt.Println("replica finishes receiving rdb file")
+
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return loadRdbStore(f)
+}
+
+// masterLinkCron sends the offset to the master every second, and breaks the link
+// if nothing is received from the master for repl-timeout.
+// It must be called with s.mu held.
+func (s *Server) masterLinkCron() {
+	if s.role != roleReplica || s.master == nil {
+		return
+	}
+	if time.Since(s.masterLastIO) > time.Duration(s.replTimeout)*time.Second {
+		fmt.Println("MASTER timeout: no data nor PING received...")
+		s.closeMasterLink()
+		return
+	}
+	if s.replState == replConnected {
+		if err := s.sendAck(s.master); err != nil {
+			fmt.Println("replica sends ACK error: ", err.Error())
+		}
+	}
+}
+
+func (s *Server) WriteCmdAndCheckReply(conn *Conn, cmd Command, reply string) error {
+	err := conn.WriteCommand(cmd)
+	if err != nil {
+		return err
+	}
+	v, err := conn.ReadStatusReply()
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(v, reply) {
+		return proto.ErrInvalidReply
+	}
+	return nil
+}
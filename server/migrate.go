@@ -0,0 +1,400 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/rdb"
+)
+
+const (
+	// the cached connections to the targets of MIGRATE are closed if not used for a while.
+	migrateConnTTL       = 10 * time.Second
+	migrateConnCacheSize = 64
+)
+
+// migrateConn is a cached connection to the target of MIGRATE.
+type migrateConn struct {
+	conn *Conn
+	// the db selected, a new connection uses db 0.
+	db      int
+	lastUse time.Time
+}
+
+// dump handles `DUMP key`, it replies the serialized value, see rdb.Dump.
+func (s *Server) dump(conn *Conn, cmd Command) error {
+	e, ok := s.dumpEntry(string(cmd.At(1)))
+	if !ok {
+		return conn.WriteNilBulkString()
+	}
+	return conn.WriteString(string(rdb.Dump(e)))
+}
+
+// dumpEntry returns the value of the key as an rdb.Entry.
+// It must be called with s.mu held.
+func (s *Server) dumpEntry(key string) (rdb.Entry, bool) {
+	if v, ok := s.store.Get(key); ok {
+		ex, _ := s.store.Expire(key)
+		return rdb.Entry{K: key, V: v, Ex: ex}, true
+	}
+	if stream, ok := s.store.Stream(key); ok {
+		return rdb.Entry{K: key, Stream: stream}, true
+	}
+	return rdb.Entry{}, false
+}
+
+// restore handles RESTORE and RESTORE-ASKING,
+// `RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]`.
+// IDLETIME and FREQ are checked but ignored, there is no eviction.
+// It's propagated with the absolute ttl, or as `DEL key` if the key is expired already.
+func (s *Server) restore(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	key := string(args[1])
+	replace, absTTL := false, false
+	for i := 4; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case proto.OptionReplace:
+			replace = true
+		case proto.OptionAbsTTL:
+			absTTL = true
+		case proto.OptionIdleTime:
+			if i+1 >= len(args) {
+				return conn.WriteError("syntax error")
+			}
+			i++
+			if v, err := strconv.ParseInt(string(args[i]), 10, 64); err != nil || v < 0 {
+				return conn.WriteError("Invalid IDLETIME value, must be >= 0")
+			}
+		case proto.OptionFreq:
+			if i+1 >= len(args) {
+				return conn.WriteError("syntax error")
+			}
+			i++
+			if v, err := strconv.Atoi(string(args[i])); err != nil || v < 0 || v > 255 {
+				return conn.WriteError("Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+	ttl, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return conn.WriteError("value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return conn.WriteError("Invalid TTL value, must be >= 0")
+	}
+	if !replace && s.store.Exists(key) {
+		return conn.WriteErrorCode("BUSYKEY", "Target key name already exists.")
+	}
+
+	e, err := rdb.Restore(args[3])
+	if errors.Is(err, rdb.ErrBadPayload) {
+		return conn.WriteError(err.Error())
+	}
+	if err != nil {
+		return conn.WriteError("Bad data format")
+	}
+	if e.Stream != nil && ttl > 0 {
+		return conn.WriteError("expire is only supported for strings")
+	}
+
+	now := time.Now().UnixMilli()
+	at := ttl
+	if ttl > 0 && !absTTL {
+		at += now
+	}
+	deleted := replace && s.store.Del(key)
+	if at > 0 && at <= now {
+		// the key is expired already.
+		if deleted {
+			s.dirty++
+			cmd.SetArgs([][]byte{[]byte(proto.CmdDel), []byte(key)})
+		}
+		return conn.WriteStatusOK()
+	}
+	e.K, e.Ex = key, at
+	putRdbEntry(s.store, e)
+	s.dirty++
+	if ttl > 0 && !absTTL {
+		newArgs := append([][]byte{}, args...)
+		newArgs[2] = []byte(strconv.FormatInt(at, 10))
+		cmd.SetArgs(append(newArgs, []byte(proto.OptionAbsTTL)))
+	}
+	return conn.WriteStatusOK()
+}
+
+// migrate handles
+// `MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password | AUTH2 username password] [KEYS key [key ...]]`.
+// The keys are sent to the target with RESTORE, RESTORE-ASKING in a cluster, and deleted
+// here unless COPY is given. Like redis, it blocks the server until the target replies.
+// It's propagated as `DEL key [key ...]` of the keys moved.
+func (s *Server) migrate(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	copyKeys, replace := false, false
+	user, pass := "", ""
+	first, num := 3, 1
+	for i := 6; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case proto.OptionCopy:
+			copyKeys = true
+		case proto.OptionReplace:
+			replace = true
+		case proto.OptionAuth:
+			if i+1 >= len(args) {
+				return conn.WriteError("syntax error")
+			}
+			pass = string(args[i+1])
+			i++
+		case proto.OptionAuth2:
+			if i+2 >= len(args) {
+				return conn.WriteError("syntax error")
+			}
+			user, pass = string(args[i+1]), string(args[i+2])
+			i += 2
+		case proto.OptionKeys:
+			if len(args[3]) != 0 {
+				return conn.WriteError("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			first, num = i+1, len(args)-i-1
+			i = len(args)
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+	db, err1 := strconv.Atoi(string(args[4]))
+	timeout, err2 := strconv.Atoi(string(args[5]))
+	if err1 != nil || err2 != nil {
+		return conn.WriteError("value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	// the keys not existing are skipped.
+	now := time.Now().UnixMilli()
+	keys := []string{}
+	entries := []rdb.Entry{}
+	for _, key := range args[first : first+num] {
+		e, ok := s.dumpEntry(string(key))
+		if !ok || (e.Ex > 0 && e.Ex <= now) {
+			continue
+		}
+		keys = append(keys, string(key))
+		entries = append(entries, e)
+	}
+	if len(keys) == 0 {
+		return conn.WriteStatus("NOKEY")
+	}
+
+	restoreCmd := proto.CmdRestore
+	if s.cluster != nil {
+		restoreCmd = proto.CmdRestoreAsking
+	}
+	addr := net.JoinHostPort(string(args[1]), string(args[2]))
+	for retry := true; ; retry = false {
+		mc, cached, err := s.getMigrateConn(addr, time.Duration(timeout)*time.Millisecond)
+		if err != nil {
+			return conn.WriteErrorCode("IOERR", "error or timeout connecting to the client")
+		}
+
+		// AUTH and SELECT are pipelined with the RESTOREs.
+		b := []byte{}
+		if pass != "" {
+			auth := []string{proto.CmdAuth, pass}
+			if user != "" {
+				auth = []string{proto.CmdAuth, user, pass}
+			}
+			b = append(b, encodeArgs(auth...)...)
+		}
+		selectDB := db != mc.db
+		if selectDB {
+			b = append(b, encodeArgs(proto.CmdSelect, strconv.Itoa(db))...)
+		}
+		for _, e := range entries {
+			ttl := int64(0)
+			if e.Ex > 0 {
+				ttl = max(e.Ex-now, 1)
+			}
+			restore := []string{restoreCmd, e.K, strconv.FormatInt(ttl, 10), string(rdb.Dump(e))}
+			if replace {
+				restore = append(restore, proto.OptionReplace)
+			}
+			b = append(b, encodeArgs(restore...)...)
+		}
+
+		mc.conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+		if err := mc.conn.WriteRawBytes(b); err != nil {
+			s.closeMigrateConn(addr)
+			// the cached connection may be closed by the target, try again with a new one.
+			if cached && retry && !isTimeout(err) {
+				continue
+			}
+			return conn.WriteErrorCode("IOERR", "error or timeout writing to target instance")
+		}
+
+		// readReply reads a reply, the connection is closed on an I/O error.
+		// The first reply of a cached connection is retried with a new connection,
+		// since the target may close the connection meanwhile.
+		replies, again := 0, false
+		readReply := func() error {
+			_, err := mc.conn.ReadReply()
+			replies++
+			if err != nil && !isRedisError(err) {
+				s.closeMigrateConn(addr)
+				again = replies == 1 && cached && retry && !isTimeout(err)
+			}
+			return err
+		}
+		var targetErr error
+		if pass != "" {
+			err := readReply()
+			if again {
+				continue
+			}
+			if err != nil && !isRedisError(err) {
+				return conn.WriteErrorCode("IOERR", "error or timeout reading to target instance")
+			}
+			targetErr = err
+		}
+		if selectDB {
+			err := readReply()
+			if again {
+				continue
+			}
+			if err != nil && !isRedisError(err) {
+				return conn.WriteErrorCode("IOERR", "error or timeout reading to target instance")
+			}
+			if err != nil {
+				targetErr = cmp.Or(targetErr, err)
+			} else {
+				mc.db = db
+			}
+		}
+
+		moved := []string{}
+		for i := range entries {
+			err := readReply()
+			if again {
+				break
+			}
+			if err != nil && !isRedisError(err) {
+				// the keys restored so far are still deleted below.
+				targetErr = err
+				break
+			}
+			if err != nil {
+				targetErr = cmp.Or(targetErr, err)
+				continue
+			}
+			if !copyKeys {
+				s.store.Del(keys[i])
+				moved = append(moved, keys[i])
+			}
+		}
+		if again {
+			continue
+		}
+		mc.conn.SetReadDeadline(time.Time{})
+
+		if len(moved) > 0 {
+			s.dirty++
+			delArgs := [][]byte{[]byte(proto.CmdDel)}
+			for _, key := range moved {
+				delArgs = append(delArgs, []byte(key))
+			}
+			cmd.SetArgs(delArgs)
+		}
+		if targetErr != nil {
+			if !isRedisError(targetErr) {
+				return conn.WriteErrorCode("IOERR", "error or timeout reading to target instance")
+			}
+			return conn.WriteError(fmt.Sprintf("Target instance replied with error: %s", targetErr.Error()))
+		}
+		return conn.WriteStatusOK()
+	}
+}
+
+// getMigrateConn returns the cached connection to addr, or connects to it.
+// cached reports whether the connection was cached.
+// It must be called with s.mu held.
+func (s *Server) getMigrateConn(addr string, timeout time.Duration) (mc *migrateConn, cached bool, err error) {
+	if mc, ok := s.migrateConns[addr]; ok {
+		mc.lastUse = time.Now()
+		return mc, true, nil
+	}
+	// a random connection is closed if there are too many.
+	if len(s.migrateConns) >= migrateConnCacheSize {
+		n := rand.Intn(len(s.migrateConns))
+		for a := range s.migrateConns {
+			if n == 0 {
+				s.closeMigrateConn(a)
+				break
+			}
+			n--
+		}
+	}
+	c, err := net.DialTimeout(s.network, addr, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	mc = &migrateConn{conn: NewConn(c), lastUse: time.Now()}
+	s.migrateConns[addr] = mc
+	return mc, false, nil
+}
+
+// closeMigrateConn must be called with s.mu held.
+func (s *Server) closeMigrateConn(addr string) {
+	if mc, ok := s.migrateConns[addr]; ok {
+		mc.conn.Close()
+		delete(s.migrateConns, addr)
+	}
+}
+
+// closeIdleMigrateConns closes the connections not used for migrateConnTTL.
+// It must be called with s.mu held.
+func (s *Server) closeIdleMigrateConns() {
+	for addr, mc := range s.migrateConns {
+		if time.Since(mc.lastUse) > migrateConnTTL {
+			s.closeMigrateConn(addr)
+		}
+	}
+}
+
+// migrateKeys finds the keys of MIGRATE, the key argument, or the keys after KEYS.
+func migrateKeys(cmd Command) []int {
+	args := cmd.Args()
+	if len(args[3]) != 0 {
+		return []int{3}
+	}
+	for i := 6; i < len(args); i++ {
+		if strings.EqualFold(string(args[i]), proto.OptionKeys) {
+			pos := []int{}
+			for j := i + 1; j < len(args); j++ {
+				pos = append(pos, j)
+			}
+			return pos
+		}
+	}
+	return nil
+}
+
+func encodeArgs(args ...string) []byte {
+	b := proto.ArrayHeader(len(args))
+	for _, arg := range args {
+		b = append(b, proto.String(arg)...)
+	}
+	return b
+}
+
+func isTimeout(err error) bool {
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
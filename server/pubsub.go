@@ -0,0 +1,175 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+const (
+	pubsubSubscribe   = "subscribe"
+	pubsubUnsubscribe = "unsubscribe"
+	pubsubMessage     = "message"
+)
+
+// pubsub delivers the messages published to a channel to the subscribers of the channel.
+// The messages are not stored, a client subscribing later doesn't receive them.
+type pubsub struct {
+	mu       sync.Mutex
+	channels map[string]map[*Conn]struct{}
+}
+
+func newPubsub() *pubsub {
+	return &pubsub{channels: map[string]map[*Conn]struct{}{}}
+}
+
+// subscribed reports whether the client is in the subscribed state, where only
+// SUBSCRIBE, UNSUBSCRIBE and PING are allowed.
+func (conn *Conn) subscribed() bool {
+	return len(conn.channels) > 0
+}
+
+// isSubscribed reports whether the client is in the subscribed state, for the clients
+// other than the client itself.
+func (ps *pubsub) isSubscribed(conn *Conn) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return conn.subscribed()
+}
+
+// subscribe handles `SUBSCRIBE channel [channel ...]`.
+func (ps *pubsub) subscribe(conn *Conn, channels [][]byte) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if conn.channels == nil {
+		conn.channels = map[string]struct{}{}
+	}
+	reply := []byte{}
+	for _, b := range channels {
+		ch := string(b)
+		if _, ok := conn.channels[ch]; !ok {
+			conn.channels[ch] = struct{}{}
+			if ps.channels[ch] == nil {
+				ps.channels[ch] = map[*Conn]struct{}{}
+			}
+			ps.channels[ch][conn] = struct{}{}
+		}
+		reply = append(reply, pubsubReply(conn, pubsubSubscribe, ch, len(conn.channels))...)
+	}
+	// the replies are written before any message, a publisher needs ps.mu.
+	return conn.WriteRawBytes(reply)
+}
+
+// unsubscribe handles `UNSUBSCRIBE [channel [channel ...]]`, all the channels if none is given.
+func (ps *pubsub) unsubscribe(conn *Conn, channels [][]byte) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(channels) == 0 {
+		for ch := range conn.channels {
+			channels = append(channels, []byte(ch))
+		}
+	}
+	if len(channels) == 0 {
+		return conn.WriteRawBytes(pubsubReply(conn, pubsubUnsubscribe, "", 0))
+	}
+	reply := []byte{}
+	for _, b := range channels {
+		ch := string(b)
+		ps.remove(conn, ch)
+		reply = append(reply, pubsubReply(conn, pubsubUnsubscribe, ch, len(conn.channels))...)
+	}
+	return conn.WriteRawBytes(reply)
+}
+
+// unsubscribeAll is called when the client is closed.
+func (ps *pubsub) unsubscribeAll(conn *Conn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for ch := range conn.channels {
+		ps.remove(conn, ch)
+	}
+}
+
+// remove must be called with ps.mu held.
+func (ps *pubsub) remove(conn *Conn, ch string) {
+	delete(conn.channels, ch)
+	if subs, ok := ps.channels[ch]; ok {
+		delete(subs, conn)
+		if len(subs) == 0 {
+			delete(ps.channels, ch)
+		}
+	}
+}
+
+// publish sends the message to the subscribers of the channel,
+// and returns the number of the subscribers.
+func (ps *pubsub) publish(ch string, msg []byte) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subs := ps.channels[ch]
+	if len(subs) == 0 {
+		return 0
+	}
+	// the message is built once for each version of the protocol.
+	msgs := map[int][]byte{}
+	build := func(resp int) []byte {
+		if b, ok := msgs[resp]; ok {
+			return b
+		}
+		b := proto.PushHeader(3, resp)
+		b = append(b, proto.String(pubsubMessage)...)
+		b = append(b, proto.String(ch)...)
+		b = append(b, proto.String(string(msg))...)
+		msgs[resp] = b
+		return b
+	}
+	for conn := range subs {
+		conn.QueuePush(build)
+	}
+	return len(subs)
+}
+
+// pubsubReply is the reply of SUBSCRIBE and UNSUBSCRIBE, a push message in RESP3.
+func pubsubReply(conn *Conn, kind string, ch string, count int) []byte {
+	b := conn.pushHeader(3)
+	b = append(b, proto.String(kind)...)
+	if ch == "" && kind == pubsubUnsubscribe {
+		b = append(b, conn.nullBulk()...)
+	} else {
+		b = append(b, proto.String(ch)...)
+	}
+	return append(b, proto.Integer(count)...)
+}
+
+// pubsubAllowed reports whether the command is allowed in the subscribed state.
+func pubsubAllowed(name string) bool {
+	switch name {
+	case proto.CmdSubscribe, proto.CmdUnsubscribe, proto.CmdPing:
+		return true
+	}
+	return false
+}
+
+func pubsubErrorMsg(cmd Command) string {
+	return "Can't execute '" + strings.ToLower(cmd.Name()) + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"
+}
+
+func (s *Server) subscribe(conn *Conn, cmd Command) error {
+	return s.pubsub.subscribe(conn, cmd.Args()[1:])
+}
+
+func (s *Server) unsubscribe(conn *Conn, cmd Command) error {
+	return s.pubsub.unsubscribe(conn, cmd.Args()[1:])
+}
+
+// publish handles `PUBLISH channel message`.
+// The message is also propagated to the replicas, but not to the aof file,
+// so the subscribers of the replicas receive it too.
+func (s *Server) publish(conn *Conn, cmd Command) error {
+	n := s.pubsub.publish(string(cmd.At(1)), cmd.At(2))
+	if s.role == roleMaster && !s.loading {
+		s.feedReplicationStream(encodeCommand(cmd))
+	}
+	return conn.WriteInt(n)
+}
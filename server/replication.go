@@ -0,0 +1,566 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/storage"
+	"github.com/fukua95/gedis/util"
+)
+
+type replicaState int
+
+// the state of a replica on the master.
+const (
+	// waiting for the rdb snapshot to start, see repl-diskless-sync-delay.
+	replicaWaitBgsaveStart replicaState = iota
+	// waiting for the rdb snapshot, the propagated commands are buffered.
+	replicaWaitBgsave
+	// the rdb snapshot is produced, the replication stream is sent to it.
+	replicaOnline
+	replicaClosed
+)
+
+// replica is a replica connected to the master.
+// All fields are protected by Server.mu.
+type replica struct {
+	conn  *Conn
+	state replicaState
+	// the commands propagated while waiting for the snapshot.
+	buf []byte
+	// the replication stream waiting to be written by streamToReplica.
+	pending [][]byte
+	wake    chan struct{}
+
+	// the offset acknowledged by REPLCONF ACK.
+	ackOffset int
+	// the offset fsynced to the aof of the replica, acknowledged by REPLCONF ACK FACK.
+	ackAofOffset int
+	ackTime      time.Time
+}
+
+func (st replicaState) String() string {
+	switch st {
+	case replicaWaitBgsaveStart, replicaWaitBgsave:
+		return "wait_bgsave"
+	case replicaOnline:
+		return "online"
+	}
+	return "closed"
+}
+
+// lag returns the seconds since the last REPLCONF ACK.
+func (r *replica) lag() int {
+	if r.state != replicaOnline {
+		return 0
+	}
+	return int(time.Since(r.ackTime).Seconds())
+}
+
+// feed queues b of the replication stream to the replica.
+func (r *replica) feed(b []byte) {
+	switch r.state {
+	case replicaWaitBgsave:
+		r.buf = append(r.buf, b...)
+	case replicaOnline:
+		r.pending = append(r.pending, b)
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// rdbJob is a rdb snapshot being produced for a full resynchronization,
+// replicas requesting a full resynchronization meanwhile share it.
+type rdbJob struct {
+	// the snapshot is taken, the job is waiting for more replicas before.
+	started bool
+	// the replication offset the snapshot is taken at.
+	offset   int
+	replicas []*replica
+}
+
+func encodeCommand(cmd Command) []byte {
+	b := proto.ArrayHeader(len(cmd.Args()))
+	for _, arg := range cmd.Args() {
+		b = append(b, proto.String(string(arg))...)
+	}
+	return b
+}
+
+func (s *Server) replconf(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToLower(string(args[i])) {
+		case proto.OptionReplLPort:
+			conn.replListeningPort = string(args[i+1])
+		case proto.OptionReplCapa:
+			if strings.EqualFold(string(args[i+1]), proto.CapaPsync2) {
+				conn.replCapaPsync2 = true
+			}
+		}
+	}
+	return conn.WriteStatusOK()
+}
+
+// psync handles `PSYNC <replid> <offset>` from a replica, which wants the replication
+// stream from offset on.
+// If the history of replid is still in the backlog, it replies `+CONTINUE` and sends
+// the stream from the backlog, otherwise it starts a full resynchronization.
+func (s *Server) psync(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	failover := len(args) == 4 && strings.EqualFold(string(args[3]), proto.OptionFailover)
+	if len(args) != 3 && !failover {
+		return conn.WriteErrorInvalidCmd()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the master of this replica is failing over to it, see FAILOVER.
+	if failover {
+		if s.role != roleReplica {
+			return conn.WriteError("PSYNC FAILOVER can't be sent to a master.")
+		}
+		if string(args[1]) != s.replID {
+			return conn.WriteError("PSYNC FAILOVER replid must match my replid.")
+		}
+		fmt.Println("promoting myself to master after PSYNC FAILOVER request")
+		s.becomeMaster()
+	}
+	// a replica serves its own replicas with the stream of its master,
+	// it can't while it's not connected to the master.
+	if s.role == roleReplica && s.replState != replConnected {
+		return conn.WriteErrorCode("NOMASTERLINK", "Can't SYNC while not connected with my master")
+	}
+	if s.tryPartialResync(conn, string(args[1]), string(args[2])) {
+		return nil
+	}
+	return s.fullResync(conn)
+}
+
+// tryPartialResync must be called with s.mu held.
+func (s *Server) tryPartialResync(conn *Conn, replID string, offsetStr string) bool {
+	offset, err := strconv.Atoi(offsetStr)
+	if err != nil || s.backlog == nil {
+		return false
+	}
+	// the secondary id is the id of the old master of this server before it was promoted,
+	// its history is valid until the offset of the promotion.
+	if replID != s.replID && (replID != s.replID2 || offset > s.secondReplOffset) {
+		fmt.Printf("partial resynchronization not accepted: replication id mismatch, replica asked for %s, master has %s and %s\n",
+			replID, s.replID, s.replID2)
+		return false
+	}
+	if !s.backlog.contains(offset) {
+		fmt.Printf("unable to partial resync with replica: lack of backlog, replica request was %d, backlog is [%d, %d]\n",
+			offset, s.backlog.offset, s.backlog.offset+s.backlog.histlen)
+		return false
+	}
+
+	status := proto.ReplyContinue
+	if conn.replCapaPsync2 {
+		status = fmt.Sprintf("%s %s", proto.ReplyContinue, s.replID)
+	}
+	if err := conn.WriteStatus(status); err != nil {
+		return false
+	}
+
+	r := &replica{conn: conn, state: replicaOnline, wake: make(chan struct{}, 1), ackTime: time.Now()}
+	r.pending = [][]byte{s.backlog.readFrom(offset)}
+	conn.replica = r
+	s.replicas.Append(r)
+	go s.streamToReplica(r)
+	fmt.Printf("partial resynchronization request accepted, sending %d bytes of backlog starting from offset %d\n",
+		len(r.pending[0]), offset)
+	return true
+}
+
+// fullResync replies `+FULLRESYNC <replid> <offset>`, and sends a rdb snapshot of the
+// dataset at offset, followed by the commands propagated after the snapshot.
+// It must be called with s.mu held.
+func (s *Server) fullResync(conn *Conn) error {
+	if s.backlog == nil {
+		s.backlog = newBacklog(s.replBacklogSize, s.replOffset+1)
+	}
+
+	r := &replica{conn: conn, state: replicaWaitBgsaveStart, wake: make(chan struct{}, 1)}
+	s.replicas.Append(r)
+	conn.replica = r
+
+	job := s.rdbJob
+	switch {
+	case job != nil && !job.started:
+		// the job is waiting for more replicas.
+		job.replicas = append(job.replicas, r)
+		return nil
+	case job != nil && !s.replDisklessSync && s.backlog.contains(job.offset+1):
+		// the replica shares the rdb file in progress, so it also needs the commands
+		// propagated since the snapshot, which are still in the backlog.
+		// A diskless transfer can't be shared, it's already streamed to the sockets.
+		r.state = replicaWaitBgsave
+		r.buf = s.backlog.readFrom(job.offset + 1)
+		job.replicas = append(job.replicas, r)
+		return conn.WriteStatus(s.fullResyncStatus(job.offset))
+	}
+
+	job = &rdbJob{replicas: []*replica{r}}
+	s.rdbJob = job
+	if s.replDisklessSync && s.replDisklessSyncDelay > 0 {
+		// wait for more replicas to arrive, so they share the transfer.
+		fmt.Printf("starting diskless sync in %d seconds\n", s.replDisklessSyncDelay)
+		time.AfterFunc(time.Duration(s.replDisklessSyncDelay)*time.Second, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.startRdbJob(job)
+		})
+		return nil
+	}
+	s.startRdbJob(job)
+	return nil
+}
+
+func (s *Server) fullResyncStatus(offset int) string {
+	return fmt.Sprintf("%s %s %s", proto.ReplyFullResync, s.replID, strconv.Itoa(offset))
+}
+
+// startRdbJob takes the snapshot of the job, replies `+FULLRESYNC` to the replicas of the
+// job, and sends the snapshot to them in the background.
+// It must be called with s.mu held.
+func (s *Server) startRdbJob(job *rdbJob) {
+	job.started = true
+	job.offset = s.replOffset
+	replicas := []*replica{}
+	for _, r := range job.replicas {
+		// dropped while waiting for the job to start.
+		if r.state == replicaClosed {
+			continue
+		}
+		if err := r.conn.WriteStatus(s.fullResyncStatus(job.offset)); err != nil {
+			s.dropReplica(r)
+			continue
+		}
+		r.state = replicaWaitBgsave
+		replicas = append(replicas, r)
+	}
+	job.replicas = replicas
+	if len(replicas) == 0 {
+		s.finishRdbJob(job)
+		return
+	}
+
+	if s.replDisklessSync {
+		go s.sendRdbDiskless(job, s.store.Snapshot())
+	} else {
+		go s.produceRdb(job, s.store.Snapshot())
+	}
+}
+
+// finishRdbJob must be called with s.mu held.
+func (s *Server) finishRdbJob(job *rdbJob) {
+	if s.rdbJob == job {
+		s.rdbJob = nil
+	}
+}
+
+// shiftReplicationID makes the current replication id the secondary one, and switches to
+// a new id. A promoted replica calls it, so the replicas of the old master can still
+// partially resync with it up to the current offset.
+// It must be called with s.mu held.
+func (s *Server) shiftReplicationID() {
+	s.replID2 = s.replID
+	s.secondReplOffset = s.replOffset + 1
+	s.replID = util.RandomAlphanumericString(40)
+	fmt.Printf("setting secondary replication id to %s, valid up to offset %d, new replication id is %s\n",
+		s.replID2, s.secondReplOffset, s.replID)
+}
+
+func (s *Server) clearReplicationID2() {
+	s.replID2 = strings.Repeat("0", 40)
+	s.secondReplOffset = -1
+}
+
+// replicaAck handles the commands sent by a replica on its replication link,
+// which are only `REPLCONF ACK <offset> [FACK <aofoffset>]`.
+func (s *Server) replicaAck(r *replica, cmd Command) {
+	if cmd.Name() != proto.CmdReplConf || len(cmd.Args()) < 3 ||
+		!strings.EqualFold(string(cmd.At(1)), proto.OptionAck) {
+		return
+	}
+	offset, err := util.Atoi(cmd.At(2))
+	if err != nil {
+		return
+	}
+	aofOffset := -1
+	if len(cmd.Args()) == 5 && strings.EqualFold(string(cmd.At(3)), proto.OptionFAck) {
+		aofOffset, _ = util.Atoi(cmd.At(4))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if offset > r.ackOffset {
+		r.ackOffset = offset
+	}
+	if aofOffset > r.ackAofOffset {
+		r.ackAofOffset = aofOffset
+	}
+	r.ackTime = time.Now()
+	r.conn.lastInteraction = r.ackTime
+	s.notifyAck()
+}
+
+// replicationCron runs the periodic jobs of replication.
+func (s *Server) replicationCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for tick := 0; ; tick++ {
+		<-ticker.C
+		s.mu.Lock()
+		s.masterLinkCron()
+		if s.role == roleMaster {
+			// the PING would move the offset the replicas catch up with during a failover.
+			if s.replPingPeriod > 0 && tick%s.replPingPeriod == 0 && s.replicas.Len() > 0 && s.failoverJob == nil {
+				// the PING goes through the stream, so the replicas know the master is alive.
+				s.feedReplicationStream(encodeCommand(&command{args: [][]byte{[]byte(proto.CmdPing)}}))
+			}
+		}
+		s.dropTimedOutReplicas()
+		s.freeBacklogIfUnused()
+		s.closeIdleMigrateConns()
+		s.mu.Unlock()
+	}
+}
+
+// dropTimedOutReplicas drops the replicas that haven't acknowledged for repl-timeout.
+// It must be called with s.mu held.
+func (s *Server) dropTimedOutReplicas() {
+	timeout := time.Duration(s.replTimeout) * time.Second
+	for _, r := range s.replicas.Clone() {
+		if r.state == replicaOnline && time.Since(r.ackTime) > timeout {
+			fmt.Printf("disconnecting timedout replica: %v\n", r.conn.netConn.RemoteAddr())
+			s.dropReplica(r)
+		}
+	}
+}
+
+// infoReplication returns the replication section of INFO.
+// It must be called with s.mu held.
+func (s *Server) infoReplication() string {
+	lines := []string{"# Replication", fmt.Sprintf("role:%s", s.role)}
+	if s.role == roleReplica {
+		host, port, _ := net.SplitHostPort(s.masterAddr)
+		linkStatus := "down"
+		if s.replState == replConnected {
+			linkStatus = "up"
+		}
+		lastIO := -1
+		if s.master != nil {
+			lastIO = int(time.Since(s.masterLastIO).Seconds())
+		}
+		syncInProgress := 0
+		if s.replState == replTransfer {
+			syncInProgress = 1
+		}
+		lines = append(lines,
+			fmt.Sprintf("master_host:%s", host),
+			fmt.Sprintf("master_port:%s", port),
+			fmt.Sprintf("master_link_status:%s", linkStatus),
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", syncInProgress),
+			fmt.Sprintf("slave_read_repl_offset:%d", s.replOffset),
+			fmt.Sprintf("slave_repl_offset:%d", s.replOffset),
+			fmt.Sprintf("slave_priority:%d", s.replicaPriority),
+			fmt.Sprintf("slave_read_only:%d", boolToInt(s.replicaReadOnly)),
+			"replica_announced:1",
+		)
+		if linkStatus == "down" {
+			lines = append(lines, fmt.Sprintf("master_link_down_since_seconds:%d", int(time.Since(s.masterDownSince).Seconds())))
+		}
+	}
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", s.replicas.Len()))
+	if s.minReplicasToWrite > 0 && s.minReplicasMaxLag > 0 {
+		lines = append(lines, fmt.Sprintf("min_slaves_good_slaves:%d", s.goodReplicas()))
+	}
+	for i, r := range s.replicas.Clone() {
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d",
+			i, replicaIP(r), r.conn.replListeningPort, r.state, r.ackOffset, r.lag()))
+	}
+	lines = append(lines,
+		fmt.Sprintf("master_failover_state:%s", s.failoverState()),
+		fmt.Sprintf("master_replid:%s", s.replID),
+		fmt.Sprintf("master_replid2:%s", s.replID2),
+		fmt.Sprintf("master_repl_offset:%d", s.replOffset),
+		fmt.Sprintf("second_repl_offset:%d", s.secondReplOffset),
+	)
+	if s.backlog != nil {
+		lines = append(lines,
+			"repl_backlog_active:1",
+			fmt.Sprintf("repl_backlog_size:%d", s.backlog.size()),
+			fmt.Sprintf("repl_backlog_first_byte_offset:%d", s.backlog.offset),
+			fmt.Sprintf("repl_backlog_histlen:%d", s.backlog.histlen),
+		)
+	} else {
+		lines = append(lines, "repl_backlog_active:0")
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// freeBacklogIfUnused frees the backlog of a master which has had no replicas for
+// repl-backlog-ttl. A new replication id is used since then, because the
+// history can't be continued anymore.
+func (s *Server) freeBacklogIfUnused() {
+	if s.role != roleMaster || s.backlog == nil || s.replBacklogTTL == 0 {
+		return
+	}
+	if s.replicas.Len() > 0 {
+		s.noReplicasSince = time.Time{}
+		return
+	}
+	if s.noReplicasSince.IsZero() {
+		s.noReplicasSince = time.Now()
+		return
+	}
+	if time.Since(s.noReplicasSince) > time.Duration(s.replBacklogTTL)*time.Second {
+		s.backlog = nil
+		s.replID = util.RandomAlphanumericString(40)
+		s.clearReplicationID2()
+		fmt.Printf("replication backlog freed after %d seconds without connected replicas\n", s.replBacklogTTL)
+	}
+}
+
+// produceRdb saves the snapshot to the rdb file, and sends the file to the replicas of
+// the job, and then starts to stream to them.
+func (s *Server) produceRdb(job *rdbJob, snapshot *storage.Store) {
+	var payload []byte
+	path, err := s.saveRdbFile(snapshot)
+	if err == nil {
+		var b []byte
+		if b, err = os.ReadFile(path); err == nil {
+			payload = proto.RdbContent(b)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finishRdbJob(job)
+
+	if err != nil {
+		fmt.Println("master generates rdb snapshot error: ", err.Error())
+		for _, r := range job.replicas {
+			s.dropReplica(r)
+		}
+		return
+	}
+	fmt.Printf("master saved rdb snapshot of %d bytes on disk for %d replicas\n", len(payload), len(job.replicas))
+
+	// the rdb and the buffered commands are queued before any command propagated later.
+	for _, r := range job.replicas {
+		s.startStreaming(r, payload)
+	}
+}
+
+// startStreaming queues b before the commands buffered while waiting for the snapshot,
+// and starts to stream to the replica.
+// It must be called with s.mu held.
+func (s *Server) startStreaming(r *replica, b []byte) {
+	// dropped while waiting for the snapshot.
+	if r.state == replicaClosed {
+		return
+	}
+	r.pending = append([][]byte{b, r.buf}, r.pending...)
+	r.buf = nil
+	r.state = replicaOnline
+	r.ackTime = time.Now()
+	go s.streamToReplica(r)
+}
+
+// streamToReplica writes the replication stream queued by propagate to the replica.
+func (s *Server) streamToReplica(r *replica) {
+	for {
+		s.mu.Lock()
+		pending := r.pending
+		r.pending = nil
+		s.mu.Unlock()
+
+		for _, b := range pending {
+			if err := r.conn.WriteRawBytes(b); err != nil {
+				fmt.Println("master writes to replica error: ", err.Error())
+				s.mu.Lock()
+				s.dropReplica(r)
+				s.mu.Unlock()
+				return
+			}
+		}
+		if _, ok := <-r.wake; !ok {
+			return
+		}
+	}
+}
+
+// dropReplica must be called with s.mu held.
+func (s *Server) dropReplica(r *replica) {
+	if r.state == replicaClosed {
+		return
+	}
+	if r.state == replicaOnline {
+		close(r.wake)
+	}
+	r.state = replicaClosed
+	s.replicas.DeleteFunc(func(v *replica) bool { return v == r })
+	r.conn.Close()
+}
+
+// goodReplicas returns the number of online replicas with a lag <= min-replicas-max-lag.
+// It must be called with s.mu held.
+func (s *Server) goodReplicas() int {
+	n := 0
+	for _, r := range s.replicas.Clone() {
+		if r.state == replicaOnline && r.lag() <= s.minReplicasMaxLag {
+			n++
+		}
+	}
+	return n
+}
+
+// dropAllReplicas must be called with s.mu held.
+func (s *Server) dropAllReplicas() {
+	for _, r := range s.replicas.Clone() {
+		s.dropReplica(r)
+	}
+}
+
+// propagate feeds a write command to the aof file and to the replicas.
+// It must be called with s.mu held, so the order of the commands is the execution order.
+func (s *Server) propagate(cmd Command) {
+	if s.loading {
+		return
+	}
+	if s.aof != nil {
+		if err := s.aof.Feed(cmd.Args()); err != nil {
+			fmt.Println("write aof error: ", err.Error())
+		}
+	}
+	if s.role == roleMaster {
+		s.feedReplicationStream(encodeCommand(cmd))
+	}
+}
+
+// feedReplicationStream must be called with s.mu held.
+func (s *Server) feedReplicationStream(b []byte) {
+	s.replOffset += len(b)
+	if s.aof != nil {
+		s.aof.SetOffset(s.replOffset)
+	}
+	if s.backlog != nil {
+		s.backlog.feed(b)
+	}
+	for _, r := range s.replicas.Clone() {
+		r.feed(b)
+	}
+}
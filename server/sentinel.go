@@ -0,0 +1,464 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/util"
+)
+
+const (
+	sentinelHelloChannel = "__sentinel__:hello"
+
+	sentinelDefaultDownAfter       = 30 * time.Second
+	sentinelDefaultFailoverTimeout = 3 * time.Minute
+	sentinelDefaultParallelSyncs   = 1
+)
+
+// the options of a monitored master, `sentinel <option> <master-name> <value>`.
+const (
+	sentinelMonitor         = "monitor"
+	sentinelDownAfter       = "down-after-milliseconds"
+	sentinelFailoverTimeout = "failover-timeout"
+	sentinelParallelSyncs   = "parallel-syncs"
+	sentinelAuthPass        = "auth-pass"
+	sentinelQuorum          = "quorum"
+)
+
+type sentinelMonitorConf struct {
+	name            string
+	host            string
+	port            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	parallelSyncs   int
+	authPass        string
+}
+
+// parseSentinelOption parses `--sentinel-<opt> <args>`, or `--sentinel <opt> <args>` like the
+// sentinel.conf of redis, and returns the number of the arguments consumed.
+func (conf *Config) parseSentinelOption(opt string, args []string) int {
+	if opt == sentinelMonitor {
+		if len(args) < 4 {
+			return 0
+		}
+		quorum, err := strconv.Atoi(args[3])
+		if err != nil || quorum <= 0 {
+			fmt.Printf("sentinel monitor %s: invalid quorum %s\n", args[0], args[3])
+			return 4
+		}
+		conf.sentinelMonitors = append(conf.sentinelMonitors, sentinelMonitorConf{
+			name:            args[0],
+			host:            args[1],
+			port:            args[2],
+			quorum:          quorum,
+			downAfter:       sentinelDefaultDownAfter,
+			failoverTimeout: sentinelDefaultFailoverTimeout,
+			parallelSyncs:   sentinelDefaultParallelSyncs,
+		})
+		return 4
+	}
+	if len(args) < 2 {
+		return 0
+	}
+	// the master must be monitored before its options.
+	var m *sentinelMonitorConf
+	for i := range conf.sentinelMonitors {
+		if conf.sentinelMonitors[i].name == args[0] {
+			m = &conf.sentinelMonitors[i]
+		}
+	}
+	if m == nil {
+		fmt.Printf("sentinel %s: no such master %s\n", opt, args[0])
+		return 2
+	}
+	if msg := m.set(opt, args[1]); msg != "" {
+		fmt.Printf("sentinel %s %s: %s\n", opt, args[0], msg)
+	}
+	return 2
+}
+
+// set sets an option of the master, and returns the error message if the option is invalid.
+func (m *sentinelMonitorConf) set(opt string, v string) string {
+	if opt == sentinelAuthPass {
+		m.authPass = v
+		return ""
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return "Invalid argument '" + v + "' for SENTINEL SET '" + opt + "'"
+	}
+	switch opt {
+	case sentinelDownAfter:
+		m.downAfter = time.Duration(n) * time.Millisecond
+	case sentinelFailoverTimeout:
+		m.failoverTimeout = time.Duration(n) * time.Millisecond
+	case sentinelParallelSyncs:
+		m.parallelSyncs = n
+	case sentinelQuorum:
+		m.quorum = n
+	default:
+		return "Invalid argument '" + opt + "' to SENTINEL SET"
+	}
+	return ""
+}
+
+// SentinelMode reports whether the server runs as a sentinel.
+func (conf *Config) SentinelMode() bool {
+	return conf.sentinel
+}
+
+// Sentinel monitors masters and their replicas, and promotes a replica if a master is down,
+// like redis sentinel.
+//
+// A sentinel pings the instances to find out if they are subjectively down (SDOWN), and
+// asks the other sentinels monitoring the same master whether the master is objectively
+// down (ODOWN), i.e. at least quorum sentinels think it's down. The sentinels discover
+// each other with the hello messages published to the masters and the replicas. One of
+// them is elected to failover the master, it promotes the best replica, and the others
+// learn the new master from its hello messages with a greater config epoch.
+type Sentinel struct {
+	network string
+	port    string
+	addr    string
+
+	myID      string
+	startTime time.Time
+	pubsub    *pubsub
+
+	mu sync.Mutex
+	// the epoch of the last election, it only increases.
+	currentEpoch int
+	masters      map[string]*sentinelInstance
+}
+
+func NewSentinel(conf *Config) *Sentinel {
+	st := &Sentinel{
+		network:   conf.network,
+		port:      conf.port,
+		addr:      conf.addr,
+		myID:      util.RandomHexString(40),
+		startTime: time.Now(),
+		pubsub:    newPubsub(),
+		masters:   map[string]*sentinelInstance{},
+	}
+	for _, m := range conf.sentinelMonitors {
+		st.monitorMaster(m)
+	}
+	go st.cron()
+	return st
+}
+
+func (st *Sentinel) ListenAndServe() error {
+	l, err := net.Listen(st.network, st.addr)
+	if err != nil {
+		fmt.Println("listen error: ", err.Error())
+		return err
+	}
+	defer l.Close()
+
+	fmt.Printf("Sentinel ID is %s, start to accept requests\n", st.myID)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("accept error: ", err.Error())
+			return err
+		}
+		go st.handleConn(conn)
+	}
+}
+
+func (st *Sentinel) handleConn(c net.Conn) {
+	conn := NewConn(c)
+	defer func() {
+		st.pubsub.unsubscribeAll(conn)
+		conn.Close()
+	}()
+
+	for {
+		cmd, err := conn.ReadCommand()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			fmt.Printf("sentinel error reading from conn: %q\n", err.Error())
+			return
+		}
+		if err := st.execute(conn, cmd); err != nil {
+			fmt.Println("Error handle command: ", err.Error())
+			return
+		}
+	}
+}
+
+type sentinelCommandSpec struct {
+	proc  func(st *Sentinel, conn *Conn, cmd Command) error
+	arity int
+}
+
+// the commands of a sentinel, it doesn't have a dataset.
+var sentinelCommandTable = map[string]*sentinelCommandSpec{
+	proto.CmdPing:        {proc: (*Sentinel).ping, arity: -1},
+	proto.CmdInfo:        {proc: (*Sentinel).info, arity: -1},
+	proto.CmdSentinel:    {proc: (*Sentinel).sentinel, arity: -2},
+	proto.CmdSubscribe:   {proc: (*Sentinel).subscribe, arity: -2},
+	proto.CmdUnsubscribe: {proc: (*Sentinel).unsubscribe, arity: -1},
+	proto.CmdPublish:     {proc: (*Sentinel).publish, arity: 3},
+}
+
+func (st *Sentinel) execute(conn *Conn, cmd Command) error {
+	spec, ok := sentinelCommandTable[cmd.Name()]
+	if !ok {
+		return conn.WriteError(fmt.Sprintf("unknown command '%s', with args beginning with: %s", cmd.At(0), argsPreview(cmd)))
+	}
+	n := len(cmd.Args())
+	if (spec.arity > 0 && n != spec.arity) || n < -spec.arity {
+		return conn.WriteError(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd.Name())))
+	}
+	if conn.subscribed() && !pubsubAllowed(cmd.Name()) {
+		return conn.WriteError(pubsubErrorMsg(cmd))
+	}
+	return spec.proc(st, conn, cmd)
+}
+
+func (st *Sentinel) ping(conn *Conn, cmd Command) error {
+	if conn.subscribed() {
+		return conn.WriteSlice([]string{"pong", ""})
+	}
+	return conn.WriteStatus("PONG")
+}
+
+func (st *Sentinel) subscribe(conn *Conn, cmd Command) error {
+	return st.pubsub.subscribe(conn, cmd.Args()[1:])
+}
+
+func (st *Sentinel) unsubscribe(conn *Conn, cmd Command) error {
+	return st.pubsub.unsubscribe(conn, cmd.Args()[1:])
+}
+
+// publish handles `PUBLISH channel message`, the other sentinels publish their
+// hello messages to this sentinel directly too.
+func (st *Sentinel) publish(conn *Conn, cmd Command) error {
+	ch := string(cmd.At(1))
+	if ch != sentinelHelloChannel {
+		return conn.WriteError("Only HELLO messages are accepted by Sentinel instances.")
+	}
+	st.mu.Lock()
+	st.processHello(string(cmd.At(2)))
+	st.mu.Unlock()
+	return conn.WriteInt(st.pubsub.publish(ch, cmd.At(2)))
+}
+
+func (st *Sentinel) info(conn *Conn, cmd Command) error {
+	section := "default"
+	if len(cmd.Args()) > 1 {
+		section = strings.ToLower(string(cmd.At(1)))
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	info := []string{}
+	if section == "default" || section == "all" || section == proto.OptionInfoServer {
+		info = append(info, strings.Join([]string{
+			"# Server",
+			fmt.Sprintf("redis_version:%s", version),
+			"redis_mode:sentinel",
+			fmt.Sprintf("process_id:%d", os.Getpid()),
+			fmt.Sprintf("run_id:%s", st.myID),
+			fmt.Sprintf("tcp_port:%s", st.port),
+			fmt.Sprintf("uptime_in_seconds:%d", int(time.Since(st.startTime).Seconds())),
+		}, "\r\n")+"\r\n")
+	}
+	if section == "default" || section == "all" || section == "sentinel" {
+		lines := []string{
+			"# Sentinel",
+			fmt.Sprintf("sentinel_masters:%d", len(st.masters)),
+			"sentinel_tilt:0",
+			"sentinel_running_scripts:0",
+			"sentinel_scripts_queue_length:0",
+		}
+		i := 0
+		for _, m := range st.sortedMasters() {
+			status := "ok"
+			if m.odown() {
+				status = "odown"
+			} else if m.sdown() {
+				status = "sdown"
+			}
+			lines = append(lines, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+				i, m.name, status, m.addr(), len(m.replicas), len(m.sentinels)+1))
+			i++
+		}
+		info = append(info, strings.Join(lines, "\r\n")+"\r\n")
+	}
+	return conn.WriteString(strings.Join(info, "\r\n"))
+}
+
+// sentinel handles the SENTINEL subcommands.
+func (st *Sentinel) sentinel(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	sub := strings.ToLower(string(args[1]))
+	arity := map[string]int{
+		"get-master-addr-by-name": 3,
+		"masters":                 2,
+		"master":                  3,
+		"replicas":                3,
+		"slaves":                  3,
+		"sentinels":               3,
+		"is-master-down-by-addr":  6,
+		"monitor":                 6,
+		"remove":                  3,
+		"set":                     -5,
+		"failover":                3,
+		"myid":                    2,
+	}
+	n, ok := arity[sub]
+	if !ok {
+		return conn.WriteError(fmt.Sprintf("Unknown subcommand or wrong number of arguments for '%s'. Try SENTINEL HELP.", args[1]))
+	}
+	if (n > 0 && len(args) != n) || len(args) < -n {
+		return conn.WriteError(fmt.Sprintf("Unknown subcommand or wrong number of arguments for '%s'. Try SENTINEL HELP.", args[1]))
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch sub {
+	case "myid":
+		return conn.WriteString(st.myID)
+	case "masters":
+		b := proto.ArrayHeader(len(st.masters))
+		for _, m := range st.sortedMasters() {
+			b = append(b, proto.Array(m.fields(st))...)
+		}
+		return conn.WriteRawBytes(b)
+	case "is-master-down-by-addr":
+		return st.isMasterDownByAddr(conn, args)
+	case "monitor":
+		return st.monitorCommand(conn, args)
+	}
+
+	m, ok := st.masters[string(args[2])]
+	if !ok {
+		if sub == "get-master-addr-by-name" {
+			return conn.WriteRawBytes([]byte("*-1\r\n"))
+		}
+		return conn.WriteError("No such master with that name")
+	}
+	switch sub {
+	case "get-master-addr-by-name":
+		host, port := st.currentMasterAddr(m)
+		return conn.WriteSlice([]string{host, port})
+	case "master":
+		return conn.WriteSlice(m.fields(st))
+	case "replicas", "slaves", "sentinels":
+		instances := m.sortedReplicas()
+		if sub == "sentinels" {
+			instances = m.sortedSentinels()
+		}
+		b := proto.ArrayHeader(len(instances))
+		for _, ri := range instances {
+			b = append(b, proto.Array(ri.fields(st))...)
+		}
+		return conn.WriteRawBytes(b)
+	case "remove":
+		st.event("-monitor", m.describe())
+		st.removeMaster(m)
+		return conn.WriteStatusOK()
+	case "set":
+		if len(args)%2 != 1 {
+			return conn.WriteError("wrong number of arguments for 'sentinel|set' command")
+		}
+		conf := m.conf()
+		for i := 3; i < len(args); i += 2 {
+			if msg := conf.set(strings.ToLower(string(args[i])), string(args[i+1])); msg != "" {
+				return conn.WriteError(msg)
+			}
+		}
+		m.applyConf(conf)
+		return conn.WriteStatusOK()
+	case "failover":
+		if m.failoverState != sentinelFailoverNone {
+			return conn.WriteErrorCode("INPROG", "Failover already in progress")
+		}
+		if st.selectReplica(m) == nil {
+			return conn.WriteErrorCode("NOGOODSLAVE", "No suitable replica to promote")
+		}
+		fmt.Printf("Executing user requested FAILOVER of '%s'\n", m.name)
+		st.startFailover(m)
+		m.forceFailover = true
+		return conn.WriteStatusOK()
+	}
+	return nil
+}
+
+// monitorCommand handles `SENTINEL MONITOR <name> <ip> <port> <quorum>`.
+// It must be called with st.mu held.
+func (st *Sentinel) monitorCommand(conn *Conn, args [][]byte) error {
+	name := string(args[2])
+	if _, ok := st.masters[name]; ok {
+		return conn.WriteError("Duplicated master name")
+	}
+	quorum, err := strconv.Atoi(string(args[5]))
+	if err != nil || quorum <= 0 {
+		return conn.WriteError("Quorum must be 1 or greater.")
+	}
+	port, err := strconv.Atoi(string(args[4]))
+	if err != nil || port <= 0 || port > 65535 {
+		return conn.WriteError("Invalid port number")
+	}
+	m := st.monitorMaster(sentinelMonitorConf{
+		name:            name,
+		host:            string(args[3]),
+		port:            string(args[4]),
+		quorum:          quorum,
+		downAfter:       sentinelDefaultDownAfter,
+		failoverTimeout: sentinelDefaultFailoverTimeout,
+		parallelSyncs:   sentinelDefaultParallelSyncs,
+	})
+	st.event("+monitor", m.describe()+fmt.Sprintf(" quorum %d", quorum))
+	return conn.WriteStatusOK()
+}
+
+// isMasterDownByAddr handles `SENTINEL IS-MASTER-DOWN-BY-ADDR <ip> <port> <current-epoch> <runid>`.
+// A sentinel asks whether the master is down, and also asks for the vote if runid isn't `*`.
+// The reply is `[<down-state>, <leader-runid>, <leader-epoch>]`.
+// It must be called with st.mu held.
+func (st *Sentinel) isMasterDownByAddr(conn *Conn, args [][]byte) error {
+	epoch, err := strconv.Atoi(string(args[4]))
+	if err != nil {
+		return conn.WriteError("value is not an integer or out of range")
+	}
+	runID := string(args[5])
+	var m *sentinelInstance
+	for _, master := range st.masters {
+		if master.host == string(args[2]) && master.port == string(args[3]) {
+			m = master
+		}
+	}
+	down := m != nil && m.sdown()
+	leader, leaderEpoch := "*", 0
+	if m != nil && runID != "*" {
+		leader, leaderEpoch = st.voteLeader(m, epoch, runID)
+	}
+	b := proto.ArrayHeader(3)
+	b = append(b, proto.Integer(boolToInt(down))...)
+	b = append(b, proto.String(leader)...)
+	b = append(b, proto.Integer(leaderEpoch)...)
+	return conn.WriteRawBytes(b)
+}
+
+// event logs the event, and publishes it to the channel of the same name, e.g. `+switch-master`.
+func (st *Sentinel) event(typ string, msg string) {
+	fmt.Printf("%s %s\n", typ, msg)
+	st.pubsub.publish(typ, []byte(msg))
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+// failoverStep is the state of the failover of a master run by a sentinel.
+type failoverStep int
+
+const (
+	sentinelFailoverNone failoverStep = iota
+	// waiting to be elected as the leader.
+	sentinelFailoverWaitStart
+	sentinelFailoverSelectReplica
+	sentinelFailoverSendReplicaOfNoOne
+	sentinelFailoverWaitPromotion
+	// reconfiguring the other replicas to replicate the promoted one.
+	sentinelFailoverReconfReplicas
+	sentinelFailoverUpdateConfig
+)
+
+func (f failoverStep) String() string {
+	return [...]string{"none", "wait_start", "select_slave", "send_slaveof_noone",
+		"wait_promotion", "reconf_slaves", "update_config"}[f]
+}
+
+// reconfState is the state of the reconfiguration of a replica in a failover.
+type reconfState int
+
+const (
+	reconfNone reconfState = iota
+	// REPLICAOF is sent.
+	reconfSent
+	// the replica replicates the promoted replica.
+	reconfInProgress
+	// the replica is in sync with the promoted replica.
+	reconfDone
+)
+
+// voteLeader votes for the sentinel requesting the vote to failover the master in the epoch,
+// a sentinel votes once per epoch, and returns the leader voted for and its epoch.
+// It must be called with st.mu held.
+func (st *Sentinel) voteLeader(m *sentinelInstance, epoch int, runID string) (string, int) {
+	if epoch > st.currentEpoch {
+		st.currentEpoch = epoch
+		st.event("+new-epoch", strconv.Itoa(epoch))
+	}
+	if m.leaderEpoch < epoch && st.currentEpoch <= epoch {
+		m.leader = runID
+		m.leaderEpoch = st.currentEpoch
+		st.event("+vote-for-leader", fmt.Sprintf("%s %d", runID, m.leaderEpoch))
+		// another sentinel is trying to failover the master, delays our own attempt.
+		if runID != st.myID {
+			m.failoverStartTime = time.Now().Add(randomFailoverDelay())
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// getLeader returns the leader of the epoch, which has the votes of the majority of the
+// sentinels and at least quorum votes, or "" if there is no leader yet.
+// This sentinel votes for the sentinel with the most votes, or for itself.
+// It must be called with st.mu held.
+func (st *Sentinel) getLeader(m *sentinelInstance, epoch int) string {
+	votes := map[string]int{}
+	for _, peer := range m.sentinels {
+		if peer.leader != "" && peer.leaderEpoch == st.currentEpoch {
+			votes[peer.leader]++
+		}
+	}
+	winner := mostVoted(votes)
+	if winner == "" {
+		winner = st.myID
+	}
+	if leader, leaderEpoch := st.voteLeader(m, epoch, winner); leader != "" && leaderEpoch == epoch {
+		votes[leader]++
+	}
+	winner = mostVoted(votes)
+	voters := len(m.sentinels) + 1
+	if votes[winner] < voters/2+1 || votes[winner] < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+func mostVoted(votes map[string]int) string {
+	winner, most := "", 0
+	for id, n := range votes {
+		if n > most || (n == most && id < winner) {
+			winner, most = id, n
+		}
+	}
+	return winner
+}
+
+// randomFailoverDelay spreads the failover attempts of the sentinels, so one of them
+// is likely to be elected.
+func randomFailoverDelay() time.Duration {
+	return time.Duration(rand.Intn(1000)) * time.Millisecond
+}
+
+// startFailoverIfNeeded starts a failover of the master if it's ODOWN, and there is no
+// failover of it in progress or attempted recently.
+// It must be called with st.mu held.
+func (st *Sentinel) startFailoverIfNeeded(m *sentinelInstance) bool {
+	if !m.odown() || m.failoverState != sentinelFailoverNone {
+		return false
+	}
+	if time.Since(m.failoverStartTime) < 2*m.failoverTimeout {
+		return false
+	}
+	st.startFailover(m)
+	return true
+}
+
+// startFailover must be called with st.mu held.
+func (st *Sentinel) startFailover(m *sentinelInstance) {
+	st.currentEpoch++
+	m.failoverEpoch = st.currentEpoch
+	m.failoverState = sentinelFailoverWaitStart
+	m.failoverStateChangeTime = time.Now()
+	m.failoverStartTime = time.Now().Add(randomFailoverDelay())
+	st.event("+new-epoch", strconv.Itoa(st.currentEpoch))
+	st.event("+try-failover", m.describe())
+}
+
+// failoverStateMachine runs the failover of the master step by step.
+// It must be called with st.mu held.
+func (st *Sentinel) failoverStateMachine(m *sentinelInstance) {
+	now := time.Now()
+	elapsed := now.Sub(m.failoverStateChangeTime)
+	switch m.failoverState {
+	case sentinelFailoverWaitStart:
+		leader := st.getLeader(m, m.failoverEpoch)
+		if leader != st.myID && !m.forceFailover {
+			if now.Sub(m.failoverStartTime) > m.failoverTimeout {
+				st.event("-failover-abort-not-elected", m.describe())
+				st.abortFailover(m)
+			}
+			return
+		}
+		st.event("+elected-leader", m.describe())
+		st.setFailoverState(m, sentinelFailoverSelectReplica)
+		st.event("+failover-state-select-slave", m.describe())
+
+	case sentinelFailoverSelectReplica:
+		r := st.selectReplica(m)
+		if r == nil {
+			st.event("-failover-abort-no-good-slave", m.describe())
+			st.abortFailover(m)
+			return
+		}
+		m.promoted = r
+		st.event("+selected-slave", r.describe())
+		st.setFailoverState(m, sentinelFailoverSendReplicaOfNoOne)
+		st.event("+failover-state-send-slaveof-noone", r.describe())
+
+	case sentinelFailoverSendReplicaOfNoOne:
+		r := m.promoted
+		if !r.connected() {
+			if elapsed > m.failoverTimeout {
+				st.event("-failover-abort-slave-timeout", m.describe())
+				st.abortFailover(m)
+			}
+			return
+		}
+		st.sendCommand(r.addr(), m.authPass, proto.CmdReplicaOf, "NO", "ONE")
+		st.setFailoverState(m, sentinelFailoverWaitPromotion)
+		st.event("+failover-state-wait-promotion", r.describe())
+
+	case sentinelFailoverWaitPromotion:
+		// refreshReplicaRole moves on once the replica reports the master role.
+		if elapsed > m.failoverTimeout {
+			st.event("-failover-abort-slave-timeout", m.describe())
+			st.abortFailover(m)
+		}
+
+	case sentinelFailoverReconfReplicas:
+		st.reconfReplicas(m)
+
+	case sentinelFailoverUpdateConfig:
+		st.switchMaster(m, m.promoted.host, m.promoted.port)
+	}
+}
+
+// setFailoverState must be called with st.mu held.
+func (st *Sentinel) setFailoverState(m *sentinelInstance, step failoverStep) {
+	m.failoverState = step
+	m.failoverStateChangeTime = time.Now()
+}
+
+// abortFailover must be called with st.mu held.
+func (st *Sentinel) abortFailover(m *sentinelInstance) {
+	m.failoverState = sentinelFailoverNone
+	m.failoverStateChangeTime = time.Now()
+	m.forceFailover = false
+	m.promoted = nil
+	for _, ri := range m.replicas {
+		ri.reconfState = reconfNone
+	}
+}
+
+// selectReplica selects the replica to promote: it must be up, have fresh INFO, a
+// non zero priority, and not be disconnected from the master for too long. The one with
+// the lowest priority, then the greatest replication offset, then the smallest run id wins.
+// It must be called with st.mu held.
+func (st *Sentinel) selectReplica(m *sentinelInstance) *sentinelInstance {
+	now := time.Now()
+	infoValidity := 3 * sentinelInfoPeriod
+	if m.sdown() {
+		infoValidity = 5 * sentinelFastInfoPeriod
+	}
+	maxLinkDown := 10 * m.downAfter
+	if m.sdown() {
+		maxLinkDown += now.Sub(m.sdownSince)
+	}
+
+	var best *sentinelInstance
+	for _, ri := range m.sortedReplicas() {
+		if ri.sdown() || !ri.connected() || ri.replPriority == 0 ||
+			now.Sub(ri.lastAvail) > 5*sentinelPingPeriod ||
+			now.Sub(ri.infoRefresh) > infoValidity ||
+			ri.masterLinkDownTime > maxLinkDown {
+			continue
+		}
+		if best == nil || betterReplica(ri, best) {
+			best = ri
+		}
+	}
+	return best
+}
+
+func betterReplica(a, b *sentinelInstance) bool {
+	if a.replPriority != b.replPriority {
+		return a.replPriority < b.replPriority
+	}
+	if a.replOffset != b.replOffset {
+		return a.replOffset > b.replOffset
+	}
+	// a replica without run id is the last choice.
+	if a.runID == "" || b.runID == "" {
+		return b.runID == ""
+	}
+	return a.runID < b.runID
+}
+
+// reconfReplicas sends REPLICAOF <promoted> to the other replicas, at most parallel-syncs
+// of them are syncing at the same time. The failover ends once all the replicas are
+// reconfigured, or on the failover timeout.
+// It must be called with st.mu held.
+func (st *Sentinel) reconfReplicas(m *sentinelInstance) {
+	now := time.Now()
+	timeout := now.Sub(m.failoverStateChangeTime) > m.failoverTimeout
+	inProgress := 0
+	for _, ri := range m.replicas {
+		if ri.reconfState == reconfSent || ri.reconfState == reconfInProgress {
+			inProgress++
+		}
+	}
+	done := true
+	for _, ri := range m.sortedReplicas() {
+		if ri == m.promoted || ri.reconfState == reconfDone {
+			continue
+		}
+		if ri.reconfState != reconfNone && now.Sub(ri.reconfSentTime) > m.failoverTimeout {
+			st.event("-slave-reconf-sent-timeout", ri.describe())
+			ri.reconfState = reconfDone
+			continue
+		}
+		// a replica down is reconfigured once it's up again, see refreshReplicaRole.
+		if ri.sdown() {
+			continue
+		}
+		done = false
+		if ri.reconfState == reconfNone && (inProgress < m.parallelSyncs || timeout) {
+			st.sendCommand(ri.addr(), m.authPass, proto.CmdReplicaOf, m.promoted.host, m.promoted.port)
+			ri.reconfState = reconfSent
+			ri.reconfSentTime = now
+			inProgress++
+			st.event("+slave-reconf-sent", ri.describe())
+		}
+	}
+	if done || timeout {
+		if timeout {
+			st.event("+failover-end-for-timeout", m.describe())
+		}
+		st.event("+failover-end", m.describe())
+		st.setFailoverState(m, sentinelFailoverUpdateConfig)
+	}
+}
@@ -0,0 +1,921 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+const (
+	sentinelTickInterval   = 100 * time.Millisecond
+	sentinelPingPeriod     = time.Second
+	sentinelInfoPeriod     = 10 * time.Second
+	sentinelFastInfoPeriod = time.Second
+	sentinelHelloPeriod    = 2 * time.Second
+	sentinelAskPeriod      = time.Second
+	sentinelConnectTimeout = time.Second
+	// the reply of a sentinel about the master state is valid for this long.
+	sentinelAskValidity = 5 * sentinelAskPeriod
+)
+
+type instanceKind int
+
+const (
+	kindMaster instanceKind = iota
+	kindReplica
+	kindSentinel
+)
+
+func (k instanceKind) String() string {
+	switch k {
+	case kindMaster:
+		return "master"
+	case kindReplica:
+		return "slave"
+	}
+	return "sentinel"
+}
+
+// sentinelInstance is a master, a replica or another sentinel monitored by the sentinel,
+// like `sentinelRedisInstance`. A replica and a sentinel belong to a master.
+// The fields are protected by Sentinel.mu.
+type sentinelInstance struct {
+	kind instanceKind
+	// the master name, or ip:port of a replica or a sentinel.
+	name   string
+	host   string
+	port   string
+	runID  string
+	master *sentinelInstance
+
+	// increased to stop the goroutines of the links, see resetLinks.
+	gen        int
+	cmdConn    *Conn
+	pubsubConn *Conn
+	// the last time the instance replied to PING correctly.
+	lastAvail   time.Time
+	lastPing    time.Time
+	lastPong    time.Time
+	lastHello   time.Time
+	helloSent   time.Time
+	infoRefresh time.Time
+	sdownSince  time.Time
+
+	roleReported     role
+	roleReportedTime time.Time
+
+	// the replication state reported by INFO of a replica.
+	replMasterHost     string
+	replMasterPort     string
+	replMasterLinkUp   bool
+	masterLinkDownTime time.Duration
+	replConfChangeTime time.Time
+	replOffset         int
+	replPriority       int
+	reconfState        reconfState
+	reconfSentTime     time.Time
+
+	// for a sentinel, whether it thinks the master is down, see `SENTINEL IS-MASTER-DOWN-BY-ADDR`.
+	masterDown          bool
+	masterDownReplyTime time.Time
+	lastAsk             time.Time
+	// for a sentinel, the leader it voted for; for a master, the leader this sentinel voted for.
+	leader      string
+	leaderEpoch int
+
+	// for a master.
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	parallelSyncs   int
+	authPass        string
+	configEpoch     int
+	replicas        map[string]*sentinelInstance
+	// the other sentinels by run id.
+	sentinels  map[string]*sentinelInstance
+	odownSince time.Time
+
+	failoverState           failoverStep
+	failoverEpoch           int
+	failoverStartTime       time.Time
+	failoverStateChangeTime time.Time
+	forceFailover           bool
+	promoted                *sentinelInstance
+}
+
+func newSentinelInstance(kind instanceKind, name string, host string, port string, master *sentinelInstance) *sentinelInstance {
+	now := time.Now()
+	return &sentinelInstance{
+		kind:               kind,
+		name:               name,
+		host:               host,
+		port:               port,
+		master:             master,
+		lastAvail:          now,
+		roleReportedTime:   now,
+		replConfChangeTime: now,
+		replPriority:       100,
+	}
+}
+
+func (ri *sentinelInstance) addr() string {
+	return net.JoinHostPort(ri.host, ri.port)
+}
+
+// describe describes the instance in the events:
+// `<type> <name> <ip> <port> [@ <master-name> <master-ip> <master-port>]`.
+func (ri *sentinelInstance) describe() string {
+	desc := fmt.Sprintf("%s %s %s %s", ri.kind, ri.name, ri.host, ri.port)
+	if ri.master != nil {
+		desc += fmt.Sprintf(" @ %s %s %s", ri.master.name, ri.master.host, ri.master.port)
+	}
+	return desc
+}
+
+func (ri *sentinelInstance) sdown() bool {
+	return !ri.sdownSince.IsZero()
+}
+
+func (ri *sentinelInstance) odown() bool {
+	return !ri.odownSince.IsZero()
+}
+
+func (ri *sentinelInstance) connected() bool {
+	return ri.cmdConn != nil
+}
+
+// downAfter returns down-after-milliseconds of the master of the instance.
+func (ri *sentinelInstance) downAfterPeriod() time.Duration {
+	if ri.master != nil {
+		return ri.master.downAfter
+	}
+	return ri.downAfter
+}
+
+func (ri *sentinelInstance) conf() sentinelMonitorConf {
+	return sentinelMonitorConf{
+		name:            ri.name,
+		host:            ri.host,
+		port:            ri.port,
+		quorum:          ri.quorum,
+		downAfter:       ri.downAfter,
+		failoverTimeout: ri.failoverTimeout,
+		parallelSyncs:   ri.parallelSyncs,
+		authPass:        ri.authPass,
+	}
+}
+
+func (ri *sentinelInstance) applyConf(conf sentinelMonitorConf) {
+	ri.quorum = conf.quorum
+	ri.downAfter = conf.downAfter
+	ri.failoverTimeout = conf.failoverTimeout
+	ri.parallelSyncs = conf.parallelSyncs
+	ri.authPass = conf.authPass
+}
+
+func (ri *sentinelInstance) flags() string {
+	flags := []string{ri.kind.String()}
+	if ri.sdown() {
+		flags = append(flags, "s_down")
+	}
+	if ri.odown() {
+		flags = append(flags, "o_down")
+	}
+	if !ri.connected() {
+		flags = append(flags, "disconnected")
+	}
+	if ri.masterDown {
+		flags = append(flags, "master_down")
+	}
+	if ri.failoverState != sentinelFailoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	if ri.master != nil && ri.master.promoted == ri {
+		flags = append(flags, "promoted")
+	}
+	return strings.Join(flags, ",")
+}
+
+// fields returns the state of the instance replied by SENTINEL MASTER, REPLICAS and SENTINELS.
+func (ri *sentinelInstance) fields(st *Sentinel) []string {
+	ms := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(time.Since(t).Milliseconds(), 10)
+	}
+	f := []string{
+		"name", ri.name,
+		"ip", ri.host,
+		"port", ri.port,
+		"runid", ri.runID,
+		"flags", ri.flags(),
+		"last-ping-sent", ms(ri.lastPing),
+		"last-ok-ping-reply", ms(ri.lastAvail),
+		"last-ping-reply", ms(ri.lastPong),
+		"down-after-milliseconds", strconv.FormatInt(ri.downAfterPeriod().Milliseconds(), 10),
+	}
+	if ri.sdown() {
+		f = append(f, "s-down-time", ms(ri.sdownSince))
+	}
+	switch ri.kind {
+	case kindMaster:
+		if ri.odown() {
+			f = append(f, "o-down-time", ms(ri.odownSince))
+		}
+		f = append(f,
+			"info-refresh", ms(ri.infoRefresh),
+			"role-reported", string(ri.roleReported),
+			"role-reported-time", ms(ri.roleReportedTime),
+			"config-epoch", strconv.Itoa(ri.configEpoch),
+			"num-slaves", strconv.Itoa(len(ri.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(ri.sentinels)),
+			"quorum", strconv.Itoa(ri.quorum),
+			"failover-timeout", strconv.FormatInt(ri.failoverTimeout.Milliseconds(), 10),
+			"parallel-syncs", strconv.Itoa(ri.parallelSyncs),
+		)
+		if ri.failoverState != sentinelFailoverNone {
+			f = append(f, "failover-state", ri.failoverState.String())
+		}
+	case kindReplica:
+		linkStatus := "err"
+		if ri.replMasterLinkUp {
+			linkStatus = "ok"
+		}
+		f = append(f,
+			"info-refresh", ms(ri.infoRefresh),
+			"role-reported", string(ri.roleReported),
+			"role-reported-time", ms(ri.roleReportedTime),
+			"master-link-down-time", strconv.FormatInt(ri.masterLinkDownTime.Milliseconds(), 10),
+			"master-link-status", linkStatus,
+			"master-host", ri.replMasterHost,
+			"master-port", ri.replMasterPort,
+			"slave-priority", strconv.Itoa(ri.replPriority),
+			"slave-repl-offset", strconv.Itoa(ri.replOffset),
+		)
+	case kindSentinel:
+		leader := ri.leader
+		if leader == "" {
+			leader = "*"
+		}
+		f = append(f,
+			"last-hello-message", ms(ri.lastHello),
+			"voted-leader", leader,
+			"voted-leader-epoch", strconv.Itoa(ri.leaderEpoch),
+		)
+	}
+	return f
+}
+
+func (st *Sentinel) sortedMasters() []*sentinelInstance {
+	return sortedInstances(st.masters)
+}
+
+func (ri *sentinelInstance) sortedReplicas() []*sentinelInstance {
+	return sortedInstances(ri.replicas)
+}
+
+func (ri *sentinelInstance) sortedSentinels() []*sentinelInstance {
+	return sortedInstances(ri.sentinels)
+}
+
+func sortedInstances(m map[string]*sentinelInstance) []*sentinelInstance {
+	res := make([]*sentinelInstance, 0, len(m))
+	for _, ri := range m {
+		res = append(res, ri)
+	}
+	slices.SortFunc(res, func(a, b *sentinelInstance) int { return strings.Compare(a.name, b.name) })
+	return res
+}
+
+// monitorMaster starts to monitor a master.
+// It must be called with st.mu held, or before the sentinel is started.
+func (st *Sentinel) monitorMaster(conf sentinelMonitorConf) *sentinelInstance {
+	m := newSentinelInstance(kindMaster, conf.name, conf.host, conf.port, nil)
+	m.applyConf(conf)
+	m.replicas = map[string]*sentinelInstance{}
+	m.sentinels = map[string]*sentinelInstance{}
+	st.masters[m.name] = m
+	st.startLinks(m)
+	return m
+}
+
+// removeMaster must be called with st.mu held.
+func (st *Sentinel) removeMaster(m *sentinelInstance) {
+	for _, ri := range m.replicas {
+		st.resetLinks(ri)
+	}
+	for _, ri := range m.sentinels {
+		st.resetLinks(ri)
+	}
+	st.resetLinks(m)
+	delete(st.masters, m.name)
+}
+
+// addReplica must be called with st.mu held.
+func (st *Sentinel) addReplica(m *sentinelInstance, host string, port string) *sentinelInstance {
+	addr := net.JoinHostPort(host, port)
+	if ri, ok := m.replicas[addr]; ok {
+		return ri
+	}
+	ri := newSentinelInstance(kindReplica, addr, host, port, m)
+	m.replicas[addr] = ri
+	st.startLinks(ri)
+	return ri
+}
+
+// startLinks starts the goroutines of the links to the instance.
+// A sentinel subscribes to the hello channel of the masters and the replicas.
+// It must be called with st.mu held.
+func (st *Sentinel) startLinks(ri *sentinelInstance) {
+	go st.monitorInstance(ri, ri.gen)
+	if ri.kind != kindSentinel {
+		go st.subscribeHello(ri, ri.gen)
+	}
+}
+
+// resetLinks stops the goroutines of the links, closing the connections stops their waiting.
+// It must be called with st.mu held.
+func (st *Sentinel) resetLinks(ri *sentinelInstance) {
+	ri.gen++
+	if ri.cmdConn != nil {
+		ri.cmdConn.Close()
+		ri.cmdConn = nil
+	}
+	if ri.pubsubConn != nil {
+		ri.pubsubConn.Close()
+		ri.pubsubConn = nil
+	}
+}
+
+// dial connects to the instance, and authenticates with the auth-pass of the master.
+func (st *Sentinel) dial(addr string, authPass string, timeout time.Duration) (*Conn, error) {
+	c, err := net.DialTimeout("tcp", addr, sentinelConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := NewConn(c)
+	if authPass != "" {
+		if _, err := request(conn, timeout, proto.CmdAuth, authPass); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// request sends a command and reads the reply, an error reply is returned as proto.RedisError.
+func request(conn *Conn, timeout time.Duration, args ...string) (interface{}, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.ResetReadDeadline()
+	if err := conn.WriteSlice(args); err != nil {
+		return nil, err
+	}
+	return conn.ReadReply()
+}
+
+// sendCommand sends a command to the instance with a new connection, e.g. to reconfigure it.
+func (st *Sentinel) sendCommand(addr string, authPass string, args ...string) {
+	go func() {
+		conn, err := st.dial(addr, authPass, sentinelConnectTimeout)
+		if err != nil {
+			fmt.Printf("sentinel connects to %s error: %s\n", addr, err.Error())
+			return
+		}
+		defer conn.Close()
+		if _, err := request(conn, sentinelConnectTimeout, args...); err != nil {
+			fmt.Printf("sentinel sends %s to %s error: %s\n", strings.Join(args, " "), addr, err.Error())
+		}
+	}()
+}
+
+// monitorInstance keeps the command link to the instance, and sends the periodic commands:
+// PING, INFO, the hello message, and asks the other sentinels about the master.
+func (st *Sentinel) monitorInstance(ri *sentinelInstance, gen int) {
+	for {
+		st.mu.Lock()
+		if ri.gen != gen {
+			st.mu.Unlock()
+			return
+		}
+		conn := ri.cmdConn
+		addr, timeout := ri.addr(), max(ri.downAfterPeriod(), sentinelConnectTimeout)
+		authPass := ""
+		if ri.kind != kindSentinel {
+			authPass = ri.masterOf().authPass
+		}
+		st.mu.Unlock()
+
+		if conn == nil {
+			c, err := st.dial(addr, authPass, timeout)
+			st.mu.Lock()
+			if ri.gen != gen {
+				st.mu.Unlock()
+				if c != nil {
+					c.Close()
+				}
+				return
+			}
+			ri.cmdConn = c
+			st.mu.Unlock()
+			if err != nil {
+				time.Sleep(sentinelPingPeriod)
+				continue
+			}
+			conn = c
+		}
+
+		if err := st.sendPeriodicCommands(ri, conn, timeout); err != nil {
+			st.mu.Lock()
+			if ri.cmdConn == conn {
+				ri.cmdConn = nil
+				conn.Close()
+			}
+			st.mu.Unlock()
+			continue
+		}
+		time.Sleep(sentinelTickInterval)
+	}
+}
+
+func (ri *sentinelInstance) masterOf() *sentinelInstance {
+	if ri.master != nil {
+		return ri.master
+	}
+	return ri
+}
+
+// sendPeriodicCommands sends the commands which are due, an error breaks the link.
+func (st *Sentinel) sendPeriodicCommands(ri *sentinelInstance, conn *Conn, timeout time.Duration) error {
+	st.mu.Lock()
+	now := time.Now()
+	m := ri.masterOf()
+	infoPeriod := sentinelInfoPeriod
+	// the replicas are watched closely during a failover.
+	if ri.kind == kindReplica && (m.odown() || m.failoverState != sentinelFailoverNone) {
+		infoPeriod = sentinelFastInfoPeriod
+	}
+	ping := now.Sub(ri.lastPing) >= min(sentinelPingPeriod, ri.downAfterPeriod())
+	info := ri.kind != kindSentinel && now.Sub(ri.infoRefresh) >= infoPeriod
+	hello := now.Sub(ri.helloSent) >= sentinelHelloPeriod
+	ask := ri.kind == kindSentinel && m.sdown() && now.Sub(ri.lastAsk) >= sentinelAskPeriod
+	var helloMsg string
+	if hello {
+		helloMsg = st.helloMessage(m, conn)
+		ri.helloSent = now
+	}
+	var askArgs []string
+	if ask {
+		ri.lastAsk = now
+		runID := "*"
+		if m.failoverState != sentinelFailoverNone {
+			runID = st.myID
+		}
+		askArgs = []string{proto.CmdSentinel, "is-master-down-by-addr", m.host, m.port, strconv.Itoa(st.currentEpoch), runID}
+	}
+	st.mu.Unlock()
+
+	if ping {
+		st.mu.Lock()
+		ri.lastPing = now
+		st.mu.Unlock()
+		v, err := request(conn, timeout, proto.CmdPing)
+		if err != nil && !isRedisError(err) {
+			return err
+		}
+		st.mu.Lock()
+		ri.lastPong = time.Now()
+		// a busy instance is still available.
+		if s, ok := v.(string); ok && strings.EqualFold(s, "PONG") || isAvailableError(err) {
+			ri.lastAvail = ri.lastPong
+		}
+		st.mu.Unlock()
+	}
+	if info {
+		v, err := request(conn, timeout, proto.CmdInfo)
+		if err != nil && !isRedisError(err) {
+			return err
+		}
+		if s, ok := v.(string); ok {
+			st.mu.Lock()
+			st.refreshInfo(ri, s)
+			st.mu.Unlock()
+		}
+	}
+	if hello {
+		if _, err := request(conn, timeout, proto.CmdPublish, sentinelHelloChannel, helloMsg); err != nil && !isRedisError(err) {
+			return err
+		}
+	}
+	if ask {
+		v, err := request(conn, timeout, askArgs...)
+		if err != nil && !isRedisError(err) {
+			return err
+		}
+		if r, ok := v.([]interface{}); ok && len(r) == 3 {
+			down, _ := r[0].(int64)
+			leader, _ := r[1].(string)
+			epoch, _ := r[2].(int64)
+			st.mu.Lock()
+			ri.masterDown = down == 1
+			ri.masterDownReplyTime = time.Now()
+			if leader != "" && leader != "*" {
+				ri.leader = leader
+				ri.leaderEpoch = int(epoch)
+			}
+			st.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func isRedisError(err error) bool {
+	var e proto.RedisError
+	return errors.As(err, &e)
+}
+
+// isAvailableError reports whether the error reply means the instance is available, but busy.
+func isAvailableError(err error) bool {
+	var e proto.RedisError
+	if !errors.As(err, &e) {
+		return false
+	}
+	return strings.HasPrefix(string(e), "LOADING") || strings.HasPrefix(string(e), "MASTERDOWN")
+}
+
+// helloMessage returns the hello message published to the instances:
+// `<ip>,<port>,<runid>,<current-epoch>,<master-name>,<master-ip>,<master-port>,<master-config-epoch>`.
+// The ip is the local address of the link, the address the others connect to.
+// It must be called with st.mu held.
+func (st *Sentinel) helloMessage(m *sentinelInstance, conn *Conn) string {
+	ip, _, _ := net.SplitHostPort(conn.netConn.LocalAddr().String())
+	host, port := st.currentMasterAddr(m)
+	return fmt.Sprintf("%s,%s,%s,%d,%s,%s,%s,%d", ip, st.port, st.myID, st.currentEpoch, m.name, host, port, m.configEpoch)
+}
+
+// subscribeHello subscribes to the hello channel of a master or a replica,
+// to discover the other sentinels and their configurations.
+func (st *Sentinel) subscribeHello(ri *sentinelInstance, gen int) {
+	for {
+		st.mu.Lock()
+		if ri.gen != gen {
+			st.mu.Unlock()
+			return
+		}
+		addr, authPass := ri.addr(), ri.masterOf().authPass
+		st.mu.Unlock()
+
+		conn, err := st.dial(addr, authPass, sentinelConnectTimeout)
+		st.mu.Lock()
+		if ri.gen != gen {
+			st.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		ri.pubsubConn = conn
+		st.mu.Unlock()
+		if err != nil {
+			time.Sleep(sentinelPingPeriod)
+			continue
+		}
+
+		err = conn.WriteSlice([]string{proto.CmdSubscribe, sentinelHelloChannel})
+		for err == nil {
+			// this sentinel publishes a hello message every 2 seconds, so the link is broken
+			// if nothing is received for a while.
+			conn.SetReadDeadline(time.Now().Add(5 * sentinelHelloPeriod))
+			var v interface{}
+			if v, err = conn.ReadReply(); err != nil {
+				break
+			}
+			msg, ok := v.([]interface{})
+			if !ok || len(msg) != 3 || msg[0] != pubsubMessage {
+				continue
+			}
+			if hello, ok := msg[2].(string); ok {
+				st.mu.Lock()
+				st.processHello(hello)
+				st.mu.Unlock()
+			}
+		}
+
+		st.mu.Lock()
+		if ri.pubsubConn == conn {
+			ri.pubsubConn = nil
+			conn.Close()
+		}
+		st.mu.Unlock()
+	}
+}
+
+// processHello updates the sentinels of the master and the configuration of the master
+// with a hello message, see helloMessage.
+// It must be called with st.mu held.
+func (st *Sentinel) processHello(hello string) {
+	parts := strings.Split(hello, ",")
+	if len(parts) != 8 {
+		return
+	}
+	ip, port, runID, mname, mip, mport := parts[0], parts[1], parts[2], parts[4], parts[5], parts[6]
+	epoch, err1 := strconv.Atoi(parts[3])
+	configEpoch, err2 := strconv.Atoi(parts[7])
+	if err1 != nil || err2 != nil || runID == st.myID {
+		return
+	}
+	m, ok := st.masters[mname]
+	if !ok {
+		return
+	}
+
+	peer, ok := m.sentinels[runID]
+	if !ok {
+		// a sentinel restarted with a new run id at the same address.
+		for id, p := range m.sentinels {
+			if p.host == ip && p.port == port {
+				st.resetLinks(p)
+				delete(m.sentinels, id)
+			}
+		}
+		peer = newSentinelInstance(kindSentinel, net.JoinHostPort(ip, port), ip, port, m)
+		peer.runID = runID
+		m.sentinels[runID] = peer
+		st.startLinks(peer)
+		st.event("+sentinel", peer.describe())
+	} else if peer.host != ip || peer.port != port {
+		st.resetLinks(peer)
+		peer.name, peer.host, peer.port = net.JoinHostPort(ip, port), ip, port
+		st.startLinks(peer)
+	}
+	peer.lastHello = time.Now()
+
+	if epoch > st.currentEpoch {
+		st.currentEpoch = epoch
+		st.event("+new-epoch", strconv.Itoa(epoch))
+	}
+	// the sentinel which did the failover of the master announces the new master.
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if m.host != mip || m.port != mport {
+			st.event("+config-update-from", peer.describe())
+			st.switchMaster(m, mip, mport)
+		}
+	}
+}
+
+// refreshInfo updates the instance with the reply of INFO.
+// It must be called with st.mu held.
+func (st *Sentinel) refreshInfo(ri *sentinelInstance, info string) {
+	m := ri.masterOf()
+	now := time.Now()
+	fields := map[string]string{}
+	for _, line := range strings.Split(info, "\r\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			fields[k] = v
+		}
+	}
+	ri.infoRefresh = now
+	if id := fields["run_id"]; id != "" {
+		if ri.runID != "" && ri.runID != id {
+			st.event("+reboot", ri.describe())
+		}
+		ri.runID = id
+	}
+
+	r := role(fields["role"])
+	if r != roleMaster && r != roleReplica {
+		return
+	}
+	if r != ri.roleReported {
+		ri.roleReported = r
+		ri.roleReportedTime = now
+	}
+
+	// discovers the replicas of the master.
+	if ri.kind == kindMaster && r == roleMaster {
+		for i := 0; ; i++ {
+			line, ok := fields[fmt.Sprintf("slave%d", i)]
+			if !ok {
+				break
+			}
+			kv := map[string]string{}
+			for _, f := range strings.Split(line, ",") {
+				if k, v, ok := strings.Cut(f, "="); ok {
+					kv[k] = v
+				}
+			}
+			if kv["ip"] == "" || kv["port"] == "" {
+				continue
+			}
+			if _, ok := m.replicas[net.JoinHostPort(kv["ip"], kv["port"])]; !ok {
+				st.event("+slave", st.addReplica(m, kv["ip"], kv["port"]).describe())
+			}
+		}
+	}
+
+	if r == roleReplica {
+		host, port := fields["master_host"], fields["master_port"]
+		if host != ri.replMasterHost || port != ri.replMasterPort {
+			ri.replMasterHost, ri.replMasterPort = host, port
+			ri.replConfChangeTime = now
+		}
+		ri.replMasterLinkUp = fields["master_link_status"] == "up"
+		ri.masterLinkDownTime = 0
+		if v, err := strconv.Atoi(fields["master_link_down_since_seconds"]); err == nil {
+			ri.masterLinkDownTime = time.Duration(v) * time.Second
+		}
+		if v, err := strconv.Atoi(fields["slave_priority"]); err == nil {
+			ri.replPriority = v
+		}
+		if v, err := strconv.Atoi(fields["slave_repl_offset"]); err == nil {
+			ri.replOffset = v
+		}
+	}
+
+	if ri.kind != kindReplica {
+		return
+	}
+	st.refreshReplicaRole(ri, r)
+}
+
+// refreshReplicaRole acts on the role reported by a replica: it's promoted in a failover,
+// or it's reconfigured to replicate the right master.
+// It must be called with st.mu held.
+func (st *Sentinel) refreshReplicaRole(ri *sentinelInstance, r role) {
+	m := ri.master
+	now := time.Now()
+	// wait for the new configurations a while after a change.
+	wait := 4 * sentinelHelloPeriod
+
+	if r == roleMaster {
+		if m.failoverState == sentinelFailoverWaitPromotion && m.promoted == ri {
+			m.configEpoch = m.failoverEpoch
+			m.failoverState = sentinelFailoverReconfReplicas
+			m.failoverStateChangeTime = now
+			st.event("+promoted-slave", ri.describe())
+			st.event("+failover-state-reconf-slaves", m.describe())
+			// announces the new configuration right now.
+			for _, other := range m.replicas {
+				other.helloSent = time.Time{}
+			}
+			m.helloSent = time.Time{}
+			return
+		}
+		if m.failoverState == sentinelFailoverNone && m.promoted != ri && st.masterLooksSane(m) &&
+			now.Sub(ri.roleReportedTime) > wait && !ri.sdown() {
+			st.event("+convert-to-slave", ri.describe())
+			st.sendCommand(ri.addr(), m.authPass, proto.CmdReplicaOf, m.host, m.port)
+		}
+		return
+	}
+
+	// a replica of a wrong master.
+	if ri.replMasterHost != m.host || ri.replMasterPort != m.port {
+		if m.failoverState == sentinelFailoverNone && st.masterLooksSane(m) && now.Sub(ri.replConfChangeTime) > wait {
+			st.event("+fix-slave-config", ri.describe())
+			st.sendCommand(ri.addr(), m.authPass, proto.CmdReplicaOf, m.host, m.port)
+			ri.replConfChangeTime = now
+		}
+	}
+
+	// the progress of the reconfiguration in a failover.
+	if m.failoverState == sentinelFailoverReconfReplicas && m.promoted != nil &&
+		ri.replMasterHost == m.promoted.host && ri.replMasterPort == m.promoted.port {
+		if ri.reconfState == reconfSent {
+			ri.reconfState = reconfInProgress
+			st.event("+slave-reconf-inprog", ri.describe())
+		}
+		if ri.reconfState == reconfInProgress && ri.replMasterLinkUp {
+			ri.reconfState = reconfDone
+			st.event("+slave-reconf-done", ri.describe())
+		}
+	}
+}
+
+// masterLooksSane reports whether the master is up and reports the master role recently.
+func (st *Sentinel) masterLooksSane(m *sentinelInstance) bool {
+	return !m.sdown() && m.roleReported == roleMaster && time.Since(m.infoRefresh) < 2*sentinelInfoPeriod
+}
+
+// cron checks the state of the instances, and runs the failovers.
+func (st *Sentinel) cron() {
+	ticker := time.NewTicker(sentinelTickInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		st.mu.Lock()
+		for _, m := range st.sortedMasters() {
+			st.checkSubjectivelyDown(m)
+			for _, ri := range m.replicas {
+				st.checkSubjectivelyDown(ri)
+			}
+			for _, ri := range m.sentinels {
+				st.checkSubjectivelyDown(ri)
+			}
+			st.checkObjectivelyDown(m)
+			if st.startFailoverIfNeeded(m) {
+				// asks for the votes right now.
+				for _, peer := range m.sentinels {
+					peer.lastAsk = time.Time{}
+				}
+			}
+			st.failoverStateMachine(m)
+		}
+		st.mu.Unlock()
+	}
+}
+
+// checkSubjectivelyDown marks the instance SDOWN if it doesn't reply to PING correctly
+// for down-after-milliseconds, or if a master reports the replica role for a while.
+// It must be called with st.mu held.
+func (st *Sentinel) checkSubjectivelyDown(ri *sentinelInstance) {
+	now := time.Now()
+	downAfter := ri.downAfterPeriod()
+	down := now.Sub(ri.lastAvail) > downAfter ||
+		(ri.kind == kindMaster && ri.roleReported == roleReplica &&
+			now.Sub(ri.roleReportedTime) > downAfter+2*sentinelInfoPeriod)
+	if down && !ri.sdown() {
+		ri.sdownSince = now
+		st.event("+sdown", ri.describe())
+	} else if !down && ri.sdown() {
+		ri.sdownSince = time.Time{}
+		st.event("-sdown", ri.describe())
+	}
+}
+
+// checkObjectivelyDown marks the master ODOWN if at least quorum sentinels, including
+// this one, think it's down.
+// It must be called with st.mu held.
+func (st *Sentinel) checkObjectivelyDown(m *sentinelInstance) {
+	votes := 0
+	if m.sdown() {
+		votes = 1
+		for _, peer := range m.sentinels {
+			if peer.masterDown && time.Since(peer.masterDownReplyTime) < sentinelAskValidity {
+				votes++
+			}
+		}
+	}
+	if votes >= m.quorum && votes > 0 {
+		if !m.odown() {
+			m.odownSince = time.Now()
+			st.event("+odown", m.describe()+fmt.Sprintf(" #quorum %d/%d", votes, m.quorum))
+		}
+	} else if m.odown() {
+		m.odownSince = time.Time{}
+		st.event("-odown", m.describe())
+	}
+}
+
+// currentMasterAddr returns the address of the master, which is the promoted replica
+// once it's promoted in a failover.
+func (st *Sentinel) currentMasterAddr(m *sentinelInstance) (string, string) {
+	if m.promoted != nil && m.failoverState >= sentinelFailoverReconfReplicas {
+		return m.promoted.host, m.promoted.port
+	}
+	return m.host, m.port
+}
+
+// switchMaster changes the address of the master after a failover, the old master and
+// the other replicas are the replicas of the new master.
+// It must be called with st.mu held.
+func (st *Sentinel) switchMaster(m *sentinelInstance, host string, port string) {
+	oldHost, oldPort := m.host, m.port
+	addrs := [][2]string{}
+	for _, ri := range m.replicas {
+		if ri.host != host || ri.port != port {
+			addrs = append(addrs, [2]string{ri.host, ri.port})
+		}
+		st.resetLinks(ri)
+	}
+	if oldHost != host || oldPort != port {
+		addrs = append(addrs, [2]string{oldHost, oldPort})
+	}
+
+	st.resetLinks(m)
+	now := time.Now()
+	m.host, m.port = host, port
+	m.runID = ""
+	m.replicas = map[string]*sentinelInstance{}
+	m.lastAvail, m.lastPing, m.lastPong, m.infoRefresh = now, time.Time{}, time.Time{}, time.Time{}
+	m.roleReported, m.roleReportedTime = "", now
+	m.sdownSince, m.odownSince = time.Time{}, time.Time{}
+	m.failoverState = sentinelFailoverNone
+	m.forceFailover = false
+	m.promoted = nil
+	for _, peer := range m.sentinels {
+		peer.masterDown = false
+		peer.leader, peer.leaderEpoch = "", 0
+	}
+	for _, a := range addrs {
+		st.addReplica(m, a[0], a[1])
+	}
+	st.startLinks(m)
+	st.event("+switch-master", fmt.Sprintf("%s %s %s %s %s", m.name, oldHost, oldPort, host, port))
+}
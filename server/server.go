@@ -6,17 +6,22 @@ import (
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/fukua95/gedis/aof"
 	"github.com/fukua95/gedis/proto"
 	"github.com/fukua95/gedis/rdb"
 	"github.com/fukua95/gedis/storage"
 	"github.com/fukua95/gedis/util"
 )
 
+// the version reported by INFO, the features implemented are those of redis 7.
+const version = "7.2.0"
+
 type role string
 
 const (
@@ -32,44 +37,171 @@ type Server struct {
 	dir        string
 	dbfilename string
 
+	aof        *aof.AOF
+	appendonly bool
+	aofConf    aof.Config
+	// the server is loading the dataset, commands are not propagated.
+	loading bool
+	// the number of changes to the dataset, a write command changing it is propagated.
+	dirty int
+	// the commands propagated instead of the command being executed, see alsoPropagate.
+	alsoPropagated []Command
+
+	// the random id of the server, changes on every restart.
+	runID     string
+	startTime time.Time
+
+	pubsub *pubsub
+	// nil if cluster-enabled is no.
+	cluster *clusterState
+	// the cached connections to the targets of MIGRATE, by host:port.
+	migrateConns map[string]*migrateConn
+
 	role       role
 	replID     string
 	replOffset int
+	// the replication id of the old master, valid up to secondReplOffset.
+	replID2          string
+	secondReplOffset int
+	backlog          *backlog
+	replBacklogSize  int
+	replBacklogTTL   int
+	noReplicasSince  time.Time
 
 	// sync write cmd to store and propagate to replicas.
 	mu sync.Mutex
+	// the clients blocked on the keys by XREAD and XREADGROUP, see keysWaiter.
+	blockingKeys map[string]map[chan struct{}]struct{}
+	// the connected clients by ID, see CLIENT LIST.
+	clients      map[int64]*Conn
+	nextClientID int64
+	// the pause by CLIENT PAUSE, nil if none.
+	clientsPause *clientsPause
+	// the IDs of the clients tracking the keys they read, and of the clients with BCAST
+	// tracking the prefixes, see CLIENT TRACKING.
+	trackingTable    map[string]map[int64]struct{}
+	trackingPrefixes map[string]map[int64]struct{}
 
 	// for master
-	replicas *storage.SyncSlice[*Conn]
-	propCh   chan Command
+	replicas *storage.SyncSlice[*replica]
+	// closed and replaced when a replica acknowledges, see notifyAck.
+	ackNotify chan struct{}
+	// the FAILOVER in progress, nil if none.
+	failoverJob *pendingFailover
+	// the full resynchronization in progress.
+	rdbJob *rdbJob
+
+	replTimeout    int
+	replPingPeriod int
+	requirepass    string
+
+	replicaReadOnly       bool
+	replicaServeStaleData bool
+
+	replDisklessSync      bool
+	replDisklessSyncDelay int
+	replDisklessLoad      string
+
+	// writes are refused if less than minReplicasToWrite replicas have a lag <= minReplicasMaxLag.
+	minReplicasToWrite int
+	minReplicasMaxLag  int
+
+	replicaPriority int
+
+	// the limits of the commands of the clients, see proto.Limits.
+	protoMaxBulkLen   int
+	clientMaxQueryBuf int
 
 	// for replica
-	masterAddr string
+	masterAddr      string
+	masterUser      string
+	masterAuth      string
+	replState       replState
+	master          *Conn
+	masterLastIO    time.Time
+	masterDownSince time.Time
+	// changes whenever the master changes, stops replicating the old master.
+	masterGen int
 }
 
 func NewServer(conf *Config) *Server {
 	s := &Server{
-		network:    conf.network,
-		port:       conf.port,
-		addr:       conf.addr,
-		store:      storage.NewStore(),
-		dir:        conf.dir,
-		dbfilename: conf.dbfilename,
-		role:       conf.role,
-	}
-
-	s.loadRdb()
-
-	if s.role == roleMaster {
-		s.replID = util.RandomAlphanumericString(40)
-		s.replOffset = 0
-		s.propCh = make(chan Command, 10)
-		s.replicas = new(storage.SyncSlice[*Conn])
-		go s.asMaster()
+		network:      conf.network,
+		port:         conf.port,
+		addr:         conf.addr,
+		store:        storage.NewStore(),
+		pubsub:       newPubsub(),
+		migrateConns: map[string]*migrateConn{},
+		runID:        util.RandomHexString(40),
+		startTime:    time.Now(),
+		dir:          conf.dir,
+		dbfilename:   conf.dbfilename,
+		role:         conf.role,
+
+		replBacklogSize: conf.replBacklogSize,
+		replBacklogTTL:  conf.replBacklogTTL,
+		replTimeout:     conf.replTimeout,
+		replPingPeriod:  conf.replPingPeriod,
+		requirepass:     conf.requirepass,
+
+		replicaReadOnly:       conf.replicaReadOnly,
+		replicaServeStaleData: conf.replicaServeStaleData,
+		replDisklessSync:      conf.replDisklessSync,
+		replDisklessSyncDelay: conf.replDisklessSyncDelay,
+		replDisklessLoad:      conf.replDisklessLoad,
+		minReplicasToWrite:    conf.minReplicasToWrite,
+		minReplicasMaxLag:     conf.minReplicasMaxLag,
+		replicaPriority:       conf.replicaPriority,
+		protoMaxBulkLen:       conf.protoMaxBulkLen,
+		clientMaxQueryBuf:     conf.clientMaxQueryBuf,
+		masterUser:            conf.masterUser,
+		masterAuth:            conf.masterAuth,
+
+		appendonly: conf.appendonly,
+		aofConf: aof.Config{
+			Dir:            conf.dir,
+			DirName:        conf.appenddirname,
+			FileName:       conf.appendfilename,
+			Fsync:          conf.appendfsync,
+			UseRdbPreamble: conf.aofRdbPreamble,
+			LoadTruncated:  conf.aofLoadTruncated,
+		},
+	}
+
+	// the aof file is more complete than the rdb file, so it takes precedence.
+	if s.appendonly {
+		s.loadAndOpenAof()
 	} else {
-		s.masterAddr = conf.masterAddr
-		go s.asReplica()
+		s.loadRdb()
 	}
+
+	s.replID = util.RandomAlphanumericString(40)
+	s.replOffset = 0
+	s.clearReplicationID2()
+	if conf.clusterEnabled {
+		s.cluster = newClusterState(conf)
+		if err := s.loadClusterConfig(); err != nil {
+			fmt.Println("load cluster config error: ", err.Error())
+			os.Exit(1)
+		}
+	}
+	s.replicas = new(storage.SyncSlice[*replica])
+	s.ackNotify = make(chan struct{})
+	s.blockingKeys = map[string]map[chan struct{}]struct{}{}
+	s.clients = map[int64]*Conn{}
+	s.trackingTable = map[string]map[int64]struct{}{}
+	s.trackingPrefixes = map[string]map[int64]struct{}{}
+	if s.role == roleReplica {
+		s.becomeReplica(conf.masterAddr)
+	}
+	if s.cluster != nil {
+		// a replica in nodes.conf replicates its master again.
+		if m := s.cluster.myself.master; m != nil && m.ip != "" {
+			s.becomeReplica(nodeAddr(m, nil))
+		}
+		go s.clusterCron()
+	}
+	go s.replicationCron()
 	return s
 }
 
@@ -84,18 +216,102 @@ func (s *Server) loadRdb() {
 		fmt.Printf("read file %s error %s\n", db, err.Error())
 		return
 	}
+	defer f.Close()
 
-	// kvCh := make(chan rdb.Entry, 100)
-	kvCh := make(chan rdb.Entry, 100)
-	rdb := rdb.NewRdb(f)
-	go rdb.Read(kvCh)
+	err = rdb.NewRdb(f).Load(func(e rdb.Entry) error {
+		putRdbEntry(s.store, e)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("load rdb file %s error %s\n", db, err.Error())
+		return
+	}
+	fmt.Println("server successfully loaded rdb")
+}
 
-	for kv := range kvCh {
-		s.store.Put(kv.K, kv.V, int64(kv.Ex))
+// rdbPath returns the path of the rdb file, `dump.rdb` in the working directory by default.
+func (s *Server) rdbPath() string {
+	name := s.dbfilename
+	if name == "" {
+		name = "dump.rdb"
 	}
+	return filepath.Join(s.dir, name)
+}
 
-	f.Close()
-	fmt.Println("server successfully loaded rdb")
+// saveRdbFile saves the snapshot to the rdb file.
+// It writes a temp file first, so the rdb file is always complete.
+func (s *Server) saveRdbFile(snapshot *storage.Store) (string, error) {
+	path := s.rdbPath()
+	tmp := filepath.Join(s.dir, fmt.Sprintf("temp-%d-%d.rdb", os.Getpid(), time.Now().UnixNano()))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	err = rdb.Save(f, snapshot, nil)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// loadRdbStore loads a rdb file into a new store.
+func loadRdbStore(rd io.Reader) (*storage.Store, error) {
+	store := storage.NewStore()
+	err := rdb.NewRdb(rd).Load(func(e rdb.Entry) error {
+		putRdbEntry(store, e)
+		return nil
+	})
+	return store, err
+}
+
+func putRdbEntry(store *storage.Store, e rdb.Entry) {
+	if e.Stream != nil {
+		store.PutStream(e.K, e.Stream)
+	} else {
+		store.Put(e.K, e.V, e.Ex)
+	}
+}
+
+func (s *Server) loadAndOpenAof() {
+	a, err := aof.New(s.aofConf)
+	if err != nil {
+		fmt.Println("aof config error: ", err.Error())
+		os.Exit(1)
+	}
+
+	s.loading = true
+	conn := newFakeConn()
+	err = a.Load(aof.Loader{
+		Command: func(args [][]byte) error {
+			return s.execute(conn, &command{args: args})
+		},
+		Entry: func(e rdb.Entry) error {
+			putRdbEntry(s.store, e)
+			return nil
+		},
+	})
+	s.loading = false
+	if err != nil {
+		fmt.Println("load aof error: ", err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("server successfully loaded aof")
+
+	if err := a.Open(); err != nil {
+		fmt.Println("open aof error: ", err.Error())
+		os.Exit(1)
+	}
+	s.aof = a
 }
 
 func (s *Server) ListenAndServe() error {
@@ -106,6 +322,16 @@ func (s *Server) ListenAndServe() error {
 	}
 	defer l.Close()
 
+	if s.cluster != nil {
+		bus, err := net.Listen(s.network, fmt.Sprintf("0.0.0.0:%d", s.cluster.myself.cport))
+		if err != nil {
+			fmt.Println("cluster bus listen error: ", err.Error())
+			return err
+		}
+		defer bus.Close()
+		go s.serveClusterBus(bus)
+	}
+
 	fmt.Println("Server start to accept requests")
 
 	for {
@@ -120,214 +346,303 @@ func (s *Server) ListenAndServe() error {
 
 func (s *Server) handleConn(c net.Conn) {
 	conn := NewConn(c)
-	isReplica := false
+	s.mu.Lock()
+	s.linkClient(conn)
+	s.mu.Unlock()
 	defer func() {
-		if !isReplica {
+		s.mu.Lock()
+		s.unlinkClient(conn)
+		s.mu.Unlock()
+		if conn.replica != nil {
+			s.mu.Lock()
+			s.dropReplica(conn.replica)
+			s.mu.Unlock()
+		} else {
+			s.pubsub.unsubscribeAll(conn)
 			conn.Close()
 		}
 	}()
 
 	for {
+		conn.r.SetLimits(s.queryLimits(conn))
 		cmd, err := conn.ReadCommand()
 		if err == io.EOF {
 			return
 		}
+		var protoErr proto.ProtocolError
+		if errors.As(err, &protoErr) {
+			// like redis, the client is closed after the error reply.
+			fmt.Printf("Protocol error (%s) from client: %v\n", string(protoErr), conn.netConn.RemoteAddr())
+			conn.WriteError(protoErr.Error())
+			return
+		}
+		if err == proto.ErrQueryBufferLimit {
+			fmt.Printf("closing client that reached max query buffer length: %v\n", conn.netConn.RemoteAddr())
+			return
+		}
 		if err != nil {
 			fmt.Printf("role=%s Error reading from conn: %q\n", s.role, err.Error())
 			return
 		}
 
-		switch cmd.Name() {
-		case proto.CmdEcho:
-			err = conn.WriteString(string(cmd.At(1)))
-		case proto.CmdPing:
-			err = conn.WriteString("PONG")
-		case proto.CmdSet:
-			err = s.set(conn, cmd)
-			if err != nil {
-				conn.WriteErrorInvalidCmd()
-			}
-			conn.WriteStatusOK()
-		case proto.CmdGet:
-			err = s.get(conn, cmd)
-		case proto.CmdInfo:
-			err = s.info(conn, cmd)
-		case proto.CmdReplConf:
-			err = s.replconf(conn, cmd)
-		case proto.CmdPsync:
+		if conn.replica != nil {
+			s.replicaAck(conn.replica, cmd)
+			continue
+		}
+		conn.beforeCommand()
+		// HELLO authenticates the client with its AUTH option.
+		if s.requirepass != "" && !conn.authenticated && cmd.Name() != proto.CmdAuth && cmd.Name() != proto.CmdHello {
+			err = conn.WriteErrorCode("NOAUTH", "Authentication required.")
+		} else if cmd.Name() == proto.CmdPsync {
 			err = s.psync(conn, cmd)
-			isReplica = true
-		case proto.CmdWait:
-			err = s.wait(conn, cmd)
-		case proto.CmdConfig:
-			err = s.config(conn, cmd)
-		case proto.CmdKeys:
-			err = s.keys(conn, cmd)
-		case proto.CmdType:
-			err = s.dataType(conn, cmd)
-		case proto.CmdXAdd:
-			err = s.xadd(conn, cmd)
-		case proto.CmdXRange:
-			err = s.xrange(conn, cmd)
-		case proto.CmdXRead:
-			err = s.xread(conn, cmd)
+		} else {
+			err = s.execute(conn, cmd)
 		}
+		conn.afterCommand()
 		if err != nil {
 			fmt.Println("Error handle command: ", err.Error())
 			return
 		}
-		if isReplica {
-			break
+		s.mu.Lock()
+		closeAfterReply := conn.closeAfterReply
+		s.mu.Unlock()
+		if closeAfterReply {
+			return
 		}
 	}
 }
 
-func (s *Server) set(_ *Conn, cmd Command) error {
-	args := cmd.Args()
-	if len(args) < 3 {
-		return errors.New("invalid command")
-	}
-	px, hasPx := cmd.SearchOption(proto.OptionSetEx)
-	ex := 0
-	var err error
-	if hasPx {
-		if ex, err = util.Atoi(px); err != nil {
-			return err
+func (s *Server) ping(conn *Conn, cmd Command) error {
+	if conn.resp < proto.Resp3 && conn.subscribed() {
+		msg := ""
+		if len(cmd.Args()) > 1 {
+			msg = string(cmd.At(1))
 		}
-		ex += int(time.Now().UnixMilli())
+		return conn.WriteSlice([]string{"pong", msg})
 	}
+	return conn.WriteString("PONG")
+}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.store.Put(string(args[1]), string(args[2]), int64(ex))
-	s.propagate(cmd)
-
-	return nil
+func (s *Server) echo(conn *Conn, cmd Command) error {
+	return conn.WriteString(string(cmd.At(1)))
 }
 
-func (s *Server) get(conn *Conn, cmd Command) error {
+// set handles `SET key value [NX | XX] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]`.
+// It's propagated as `SET key value [PXAT unix-time-milliseconds]`, which doesn't depend on the time.
+func (s *Server) set(conn *Conn, cmd Command) error {
 	args := cmd.Args()
-	if len(args) < 2 {
-		return conn.WriteErrorInvalidCmd()
+	key, val := string(args[1]), string(args[2])
+	var ex int64
+	nx, xx, keepTTL, hasEx := false, false, false, false
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		switch opt {
+		case proto.OptionSetNX:
+			nx = true
+		case proto.OptionSetXX:
+			xx = true
+		case proto.OptionSetKeepTTL:
+			keepTTL = true
+		case proto.OptionSetExSec, proto.OptionSetEx, proto.OptionSetExAtSec, proto.OptionSetExAt:
+			if hasEx || i+1 >= len(args) {
+				return conn.WriteError("syntax error")
+			}
+			hasEx = true
+			i++
+			v, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			if v <= 0 {
+				return conn.WriteError("invalid expire time in 'set' command")
+			}
+			switch opt {
+			case proto.OptionSetExSec:
+				ex = time.Now().UnixMilli() + v*1000
+			case proto.OptionSetEx:
+				ex = time.Now().UnixMilli() + v
+			case proto.OptionSetExAtSec:
+				ex = v * 1000
+			case proto.OptionSetExAt:
+				ex = v
+			}
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+	if (nx && xx) || (keepTTL && hasEx) {
+		return conn.WriteError("syntax error")
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	val, ok := s.store.Get(string(args[1]))
-	if !ok {
+	old, exists := s.store.Expire(key)
+	if !exists {
+		exists = s.store.HasStream(key)
+	}
+	if (nx && exists) || (xx && !exists) {
 		return conn.WriteNilBulkString()
 	}
-	return conn.WriteString(string(val))
-}
-
-func (s *Server) info(conn *Conn, _ Command) error {
-	info := fmt.Sprintf("role:%s", s.role)
-	if s.role == roleMaster {
-		info = fmt.Sprintf("%s\nmaster_replid:%s\nmaster_repl_offset:%s",
-			info, s.replID, util.Itoa(s.replOffset))
+	if keepTTL {
+		ex = old
 	}
-	return conn.WriteString(info)
-}
 
-func (s *Server) replconf(conn *Conn, _ Command) error {
+	s.store.Put(key, val, ex)
+	s.dirty++
+	propagated := [][]byte{args[0], args[1], args[2]}
+	if ex > 0 {
+		propagated = append(propagated, []byte(proto.OptionSetExAt), []byte(strconv.FormatInt(ex, 10)))
+	}
+	cmd.SetArgs(propagated)
 	return conn.WriteStatusOK()
 }
 
-func (s *Server) psync(conn *Conn, cmd Command) error {
-	if len(cmd.Args()) != 3 {
-		panic("psync cmd is invalid")
-	}
-	// replicaReplID := cmd.At(1)
-	// offset := cmd.At(2)
-	// psync repl_id, offset 表示 replica 希望 master(repl_id = repl_id) 从 offset 开始继续同步.
-	// repl_id = ? 表示 replica 第一次连接到这个 master, 不知道 master's repl_id.
-	// repl_id != ? 时, 检查 master's repl_id = repl_id.
-	// offset = -1, 表示从头开始同步: 发送 rdb file + 后续同步.
-	// 这里是 `psync ? -1`, 所以先忽略相关逻辑.
-	status := fmt.Sprintf("%s %s %s", proto.ReplyFullResync, s.replID, strconv.Itoa(int(s.replOffset)))
-	if err := conn.WriteStatus(status); err != nil {
-		return err
-	}
-	// send a rdb file.
-	if err := conn.WriteRdb([]byte(rdb.EmptyRdb())); err != nil {
-		return err
+func (s *Server) get(conn *Conn, cmd Command) error {
+	val, ok := s.store.Get(string(cmd.At(1)))
+	if !ok {
+		return conn.WriteNilBulkString()
 	}
-	fmt.Println("master finishes sending rdb file")
-
-	s.replicas.Append(conn)
-	return nil
+	return conn.WriteString(string(val))
 }
 
-// `wait` waits until:
-// - the expected number of replicas complete sync with master,
-// - or timeout expires.
-// `wait` should return the number of replicas that sync with master, even if the timeout expires.
-func (s *Server) wait(conn *Conn, cmd Command) error {
-	if len(cmd.Args()) != 3 {
-		return proto.ErrInvalidCommand
+func (s *Server) info(conn *Conn, cmd Command) error {
+	section := "default"
+	if len(cmd.Args()) > 1 {
+		section = strings.ToLower(string(cmd.At(1)))
 	}
-	threshold, _ := util.Atoi(cmd.At(1))
-	timeoutMS, _ := util.Atoi(cmd.At(2))
-
-	if s.replOffset == 0 {
-		return conn.WriteInt(s.replicas.Len())
+	sections := []struct {
+		name string
+		fn   func() string
+	}{
+		{proto.OptionInfoServer, s.infoServer},
+		{proto.OptionInfoRep, s.infoReplication},
+		{proto.OptionInfoCluster, s.infoCluster},
 	}
 
-	if threshold <= 0 || timeoutMS <= 0 {
-		return conn.WriteInt(0)
+	info := []string{}
+	for _, sec := range sections {
+		if section == "default" || section == "all" || section == "everything" || section == sec.name {
+			info = append(info, sec.fn())
+		}
 	}
+	return conn.WriteVerbatim(strings.Join(info, "\r\n"))
+}
 
-	replicas := s.replicas.Clone()
-	isSync := make(chan int, len(replicas)+1)
-	syncCount := 0
-	getAckCmd := &command{args: [][]byte{[]byte(proto.CmdReplConf), []byte(proto.OptionGetAck), []byte("*")}}
-	timeout := time.Now().Add(time.Duration(timeoutMS) * time.Millisecond)
-
-	for _, replica := range replicas {
-		go func(conn *Conn, isSync chan<- int, offset int, cmd *command, timeout time.Time) {
-			isSync <- func() int {
-				defer conn.ResetReadDeadline()
-
-				err := conn.WriteCommand(cmd)
-				if err != nil {
-					fmt.Println("master send getack error: ", err.Error())
-					return 0
-				}
-				conn.SetReadDeadline(timeout)
-				reply, err := conn.ReadSliceReply()
-				if err != nil {
-					fmt.Println("master getack reply error: ", err.Error())
-					return 0
-				}
-
-				if len(reply) != 3 || string(reply[0]) != proto.CmdReplConf || string(reply[1]) != proto.OptionAck {
-					fmt.Println("master getack reply error: invalid reply")
-					return 0
-				}
-
-				replicaOffset, _ := util.Atoi(reply[2])
-				if replicaOffset < offset {
-					fmt.Printf("master offset=%v, replica offset=%v\n", offset, replicaOffset)
-					return 0
-				}
+func (s *Server) infoServer() string {
+	lines := []string{
+		"# Server",
+		fmt.Sprintf("redis_version:%s", version),
+		"redis_mode:standalone",
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		fmt.Sprintf("run_id:%s", s.runID),
+		fmt.Sprintf("tcp_port:%s", s.port),
+		fmt.Sprintf("uptime_in_seconds:%d", int(time.Since(s.startTime).Seconds())),
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
 
-				fmt.Println("master getack from one replica successfully, offset=", offset)
-				return 1
-			}()
-		}(replica, isSync, s.replOffset, getAckCmd, timeout)
+// auth handles `AUTH [username] password`, only the default user exists.
+func (s *Server) auth(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	if len(args) > 3 {
+		return conn.WriteError("syntax error")
 	}
-
-	for i := 0; i < len(replicas); i++ {
-		syncCount += <-isSync
+	if s.requirepass == "" {
+		return conn.WriteError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	user, pass := "default", string(args[len(args)-1])
+	if len(args) == 3 {
+		user = string(args[1])
 	}
+	if user != "default" || pass != s.requirepass {
+		return conn.WriteErrorCode("WRONGPASS", "invalid username-password pair or user is disabled.")
+	}
+	conn.authenticated = true
+	return conn.WriteStatusOK()
+}
 
-	fmt.Println("master getack count=", syncCount)
+// hello handles `HELLO [protover [AUTH username password] [SETNAME clientname]]`, it switches
+// the client to the version of the protocol, and replies the information of the server.
+func (s *Server) hello(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	resp := conn.resp
+	if len(args) > 1 {
+		v, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return conn.WriteError("Protocol version is not an integer or out of range")
+		}
+		if v < proto.Resp2 || v > proto.Resp3 {
+			return conn.WriteErrorCode("NOPROTO", "unsupported protocol version")
+		}
+		resp = int(v)
+	}
+	name, setName := "", false
+	for i := 2; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == proto.OptionAuth && left >= 2:
+			// only the default user exists, any password is accepted without requirepass.
+			user, pass := string(args[i+1]), string(args[i+2])
+			if user != "default" || (s.requirepass != "" && pass != s.requirepass) {
+				return conn.WriteErrorCode("WRONGPASS", "invalid username-password pair or user is disabled.")
+			}
+			conn.authenticated = true
+			i += 2
+		case opt == proto.OptionSetName && left >= 1:
+			name, setName = string(args[i+1]), true
+			i++
+		default:
+			return conn.WriteError(fmt.Sprintf("Syntax error in HELLO option '%s'", args[i]))
+		}
+	}
+	if s.requirepass != "" && !conn.authenticated {
+		return conn.WriteErrorCode("NOAUTH", "HELLO must be called with the client already authenticated, "+
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client "+
+			"and select the RESP protocol version at the same time")
+	}
+	if setName {
+		if !validClientString(name) {
+			return conn.WriteError("Client names cannot contain spaces, newlines or special characters.")
+		}
+		conn.name = name
+	}
+	conn.setProtocol(resp)
+
+	mode, role := "standalone", "master"
+	if s.cluster != nil {
+		mode = "cluster"
+	}
+	if s.role == roleReplica {
+		role = "replica"
+	}
+	b := conn.mapHeader(7)
+	b = append(b, proto.String("server")...)
+	b = append(b, proto.String("redis")...)
+	b = append(b, proto.String("version")...)
+	b = append(b, proto.String(version)...)
+	b = append(b, proto.String("proto")...)
+	b = append(b, proto.Integer(resp)...)
+	b = append(b, proto.String("id")...)
+	b = append(b, proto.Integer(int(conn.id))...)
+	b = append(b, proto.String("mode")...)
+	b = append(b, proto.String(mode)...)
+	b = append(b, proto.String("role")...)
+	b = append(b, proto.String(role)...)
+	b = append(b, proto.String("modules")...)
+	b = append(b, proto.ArrayHeader(0)...)
+	return conn.WriteRawBytes(b)
+}
 
-	s.replOffset += getAckCmd.RespLen()
+// the max number of the arguments of a command, like redis.
+const maxMultiBulkLen = 1024 * 1024
 
-	return conn.WriteInt(syncCount)
+// queryLimits returns the limits of the next command of the client, the commands
+// from the master aren't limited by them.
+func (s *Server) queryLimits(conn *Conn) proto.Limits {
+	return proto.Limits{
+		MaxBulkLen:      int64(s.protoMaxBulkLen),
+		MaxMultiBulkLen: maxMultiBulkLen,
+		MaxQueryBuf:     int64(s.clientMaxQueryBuf),
+		Unauthenticated: s.requirepass != "" && !conn.authenticated,
+	}
 }
 
 func (s *Server) config(conn *Conn, cmd Command) error {
@@ -337,13 +652,41 @@ func (s *Server) config(conn *Conn, cmd Command) error {
 		reply = []string{proto.OptionDir, s.dir}
 	case proto.OptionDBFile:
 		reply = []string{proto.OptionDBFile, s.dbfilename}
-	}
-	return conn.WriteSlice(reply)
+	case proto.OptionAppendOnly:
+		reply = []string{proto.OptionAppendOnly, yesNo(s.appendonly)}
+	case proto.OptionAppendFsync:
+		reply = []string{proto.OptionAppendFsync, s.aofConf.Fsync}
+	case replicaReadOnly:
+		reply = []string{replicaReadOnly, yesNo(s.replicaReadOnly)}
+	case replicaServeStaleData:
+		reply = []string{replicaServeStaleData, yesNo(s.replicaServeStaleData)}
+	case replDisklessSync:
+		reply = []string{replDisklessSync, yesNo(s.replDisklessSync)}
+	case replDisklessSyncDelay:
+		reply = []string{replDisklessSyncDelay, strconv.Itoa(s.replDisklessSyncDelay)}
+	case replDisklessLoad:
+		reply = []string{replDisklessLoad, s.replDisklessLoad}
+	case minReplicasToWrite:
+		reply = []string{minReplicasToWrite, strconv.Itoa(s.minReplicasToWrite)}
+	case minReplicasMaxLag:
+		reply = []string{minReplicasMaxLag, strconv.Itoa(s.minReplicasMaxLag)}
+	case clusterEnabled:
+		reply = []string{clusterEnabled, yesNo(s.cluster != nil)}
+	case clusterNodeTimeout:
+		if s.cluster != nil {
+			reply = []string{clusterNodeTimeout, strconv.FormatInt(s.cluster.nodeTimeout.Milliseconds(), 10)}
+		}
+	case replicaPriority:
+		reply = []string{replicaPriority, strconv.Itoa(s.replicaPriority)}
+	case protoMaxBulkLen:
+		reply = []string{protoMaxBulkLen, strconv.Itoa(s.protoMaxBulkLen)}
+	case clientQueryBufferLimit:
+		reply = []string{clientQueryBufferLimit, strconv.Itoa(s.clientMaxQueryBuf)}
+	}
+	return conn.WriteStringMap(reply)
 }
 
 func (s *Server) keys(conn *Conn, _ Command) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
 	keys := s.store.Scan()
 	reply := make([]string, len(keys))
 	for i, k := range keys {
@@ -353,261 +696,270 @@ func (s *Server) keys(conn *Conn, _ Command) error {
 }
 
 func (s *Server) dataType(conn *Conn, cmd Command) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
 	vt := s.store.ValueType(string(cmd.At(1)))
 	return conn.WriteStatus(vt)
 }
 
+// xadd handles `XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] id|* field value [field value ...]`.
 func (s *Server) xadd(conn *Conn, cmd Command) error {
-	key := string(cmd.At(1))
-	idStr := string(cmd.At(2))
-	pairs := make([]string, len(cmd.Args())-3)
+	args := cmd.Args()
+	key := string(args[1])
+	opts, errMsg := parseStreamAddTrimArgs(args, true)
+	if errMsg != "" {
+		return conn.WriteError(errMsg)
+	}
+	if n := len(args) - opts.idPos - 1; n < 2 || n%2 != 0 {
+		return conn.WriteError("wrong number of arguments for 'xadd' command")
+	}
+	idStr := string(args[opts.idPos])
+	pairs := make([]string, len(args)-opts.idPos-1)
 
 	fmt.Printf("xadd: key=%s, id=%s", key, idStr)
-	for i := 3; i < len(cmd.Args()); i++ {
-		arg := string(cmd.At(i))
-		pairs[i-3] = arg
+	for i := range pairs {
+		pairs[i] = string(args[opts.idPos+1+i])
 	}
 
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	if stream == nil && opts.noMkStream {
+		return conn.WriteNilBulkString()
+	}
 	id, err := s.store.AddStream(key, idStr, pairs)
 	if err != nil {
 		return conn.WriteError(err.Error())
 	}
+	s.dirty++
+	// propagate the generated id, so replaying the command adds the same entry.
+	prop := [][]byte{args[0], args[1]}
+	if opts.trim.Strategy != 0 {
+		stream, _ = s.store.Stream(key)
+		stream.Trim(opts.trim)
+		prop = append(prop, exactTrimArgs(stream)...)
+	}
+	prop = append(prop, []byte(id))
+	cmd.SetArgs(append(prop, args[opts.idPos+1:]...))
+
 	fmt.Printf("xadd a stream key=%s, id=%s\n", key, id)
 	return conn.WriteString(id)
 }
 
+// xrange handles `XRANGE key start end [COUNT count]` and `XREVRANGE key end start [COUNT count]`,
+// `(` before an ID excludes it from the range.
 func (s *Server) xrange(conn *Conn, cmd Command) error {
-	key := string(cmd.At(1))
-	start := string(cmd.At(2))
-	if start == "-" {
-		start = storage.MinID.String()
-	}
-	end := string(cmd.At(3))
-	if end == "+" {
-		end = storage.MaxID.String()
+	args := cmd.Args()
+	startArg, endArg := args[2], args[3]
+	rev := strings.EqualFold(string(args[0]), proto.CmdXRevRange)
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, errMsg := parseIntervalID(startArg, false)
+	if errMsg != "" {
+		return conn.WriteError(errMsg)
+	}
+	end, errMsg := parseIntervalID(endArg, true)
+	if errMsg != "" {
+		return conn.WriteError(errMsg)
+	}
+	count := -1
+	for i := 4; i < len(args); i++ {
+		if !strings.EqualFold(string(args[i]), proto.OptionCount) || i+1 == len(args) {
+			return conn.WriteError("syntax error")
+		}
+		v, err := strconv.Atoi(string(args[i+1]))
+		if err != nil {
+			return conn.WriteError("value is not an integer or out of range")
+		}
+		count = max(v, 0)
+		i++
 	}
-	entries := s.store.GetStream(key, start, end)
 
+	stream, ok := s.lookupStream(conn, string(args[1]))
+	if !ok {
+		return nil
+	}
+	if stream == nil {
+		return conn.WriteRawBytes(proto.ArrayHeader(0))
+	}
+	if count == 0 {
+		return conn.WriteNilArray()
+	}
+	entries := stream.Range(start, end, count, rev)
 	return conn.WriteRawBytes(s.StreamEntriesToResp(entries))
 }
 
+// xread handles `XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]`,
+// `$` reads the entries added after the command, `+` reads the last entry.
+// With BLOCK, the client is blocked on the keys until an entry is added.
 func (s *Server) xread(conn *Conn, cmd Command) error {
-	fmt.Println("xread: cmd=", cmd.Args())
-	keysPos, blockMS := 2, -1
-	if string(cmd.At(1)) == proto.OptionBlock {
-		blockMS, _ = util.Atoi(cmd.At(2))
-		keysPos = 4
-	}
-
-	keyL := (len(cmd.Args()) - keysPos) / 2
-	fmt.Printf("keys pos = %v, key len = %v, block = %vMS\n", keysPos, keyL, blockMS)
-
-	keys := make([]string, keyL)
-	starts := make([]string, keyL)
-	for i := 0; i < keyL; i++ {
-		keys[i] = string(cmd.At(i + keysPos))
-		starts[i] = string(cmd.At(i + keysPos + keyL))
-	}
-
-	for i, key := range keys {
-		key, start := key, starts[i]
-		fmt.Printf("key=%s, start=%s\n", key, start)
-		if start == proto.OptionStreamIDNewest {
-			starts[i] = s.store.StreamNewestID(key)
+	args := cmd.Args()
+	count, blockMS := 0, -1
+	i := 1
+	for ; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		if opt == proto.OptionStreams {
+			break
 		}
-	}
-
-	xreadData := func() ([]byte, bool) {
-		hasData := false
-		b := proto.ArrayHeader(len(keys))
-		for i, key := range keys {
-			key, start := string(key), string(starts[i])
-
-			entries := s.store.GetStream(key, start, storage.MaxID.String())
-			if len(entries) > 0 && entries[0].ID.String() == start {
-				entries = entries[1:]
+		switch {
+		case opt == proto.OptionCount && i+1 < len(args):
+			v, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
 			}
-			if len(entries) > 0 {
-				hasData = true
+			count = max(v, 0)
+			i++
+		case opt == proto.OptionBlock && i+1 < len(args):
+			v, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return conn.WriteError("timeout is not an integer or out of range")
 			}
-
-			b = append(b, []byte("*2\r\n")...)
-			b = append(b, proto.String(key)...)
-			b = append(b, s.StreamEntriesToResp(entries)...)
-		}
-		return b, hasData
-	}
-
-	var reply []byte
-	hasData := false
-
-	if blockMS == -1 {
-		reply, hasData = xreadData()
-	} else if blockMS > 0 {
-		time.Sleep(time.Millisecond * time.Duration(blockMS))
-		reply, hasData = xreadData()
-	} else {
-		for !hasData {
-			reply, hasData = xreadData()
-			if !hasData {
-				time.Sleep(time.Millisecond * 10)
+			if v < 0 {
+				return conn.WriteError("timeout is negative")
 			}
+			blockMS = v
+			i++
+		default:
+			return conn.WriteError("syntax error")
 		}
 	}
-
-	if !hasData {
-		reply = proto.NilString()
-	}
-
-	return conn.WriteRawBytes(reply)
-}
-
-func (s *Server) propagate(cmd Command) {
-	if s.role == roleMaster {
-		s.propCh <- cmd
-		s.replOffset += cmd.RespLen()
-	}
-}
-
-func (s *Server) asMaster() {
-	for cmd := range s.propCh {
-		replicas := s.replicas.Clone()
-		for _, replica := range replicas {
-			replica.WriteCommand(cmd)
+	rest := len(args) - i - 1
+	if i == len(args) || rest == 0 || rest%2 != 0 {
+		return conn.WriteError("Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+	}
+	n := rest / 2
+	keys := make([]string, n)
+	ids := make([]storage.ID, n)
+	for j := range keys {
+		keys[j] = string(args[i+1+j])
+		idStr := string(args[i+1+n+j])
+		if idStr == proto.OptionStreamIDNewest || idStr == proto.OptionStreamIDLast {
+			continue
 		}
-	}
-}
-
-func (s *Server) asReplica() {
-	c, err := net.Dial(s.network, s.masterAddr)
-	if err != nil {
-		fmt.Println("replica connect to master error: ", err.Error())
-		return
+		id, err := storage.ParseID(idStr, 0)
+		if err != nil {
+			return conn.WriteError(errInvalidID)
+		}
+		ids[j] = id
 	}
 
-	conn := NewConn(c)
-	defer conn.Close()
-
-	if err = s.handshake(conn); err != nil {
-		fmt.Println("replica handshake with master error: ", err.Error())
-		return
+	s.mu.Lock()
+	for j, key := range keys {
+		idStr := string(args[i+1+n+j])
+		if idStr != proto.OptionStreamIDNewest && idStr != proto.OptionStreamIDLast {
+			continue
+		}
+		stream, ok := s.lookupStream(conn, key)
+		if !ok {
+			s.mu.Unlock()
+			return nil
+		}
+		if stream == nil {
+			continue
+		}
+		if idStr == proto.OptionStreamIDNewest {
+			ids[j] = stream.LastID
+		} else if last := stream.LastEntry(); last != nil {
+			// XDEL doesn't lower the last ID, the last live entry is after the ID before it.
+			ids[j], _ = last.ID.Prev()
+		} else {
+			// no entry, wait for the next one like `$`.
+			ids[j] = stream.LastID
+		}
 	}
+	s.mu.Unlock()
 
-	if err = s.requestFullResync(conn); err != nil {
-		fmt.Println("replica full resynchronization error: ", err.Error())
-		return
+	var w *keysWaiter
+	if blockMS >= 0 {
+		w = s.newKeysWaiter(conn, keys, blockMS)
+		defer w.stop()
 	}
-
 	for {
-		cmd, err := conn.ReadCommand()
-		if err != nil {
-			fmt.Println("Error reading from master: ", err.Error())
-			break
+		s.mu.Lock()
+		reply, done := s.xreadServe(conn, keys, ids, count)
+		if reply == nil && !done && w != nil {
+			w.block()
 		}
-		// master -> replica, replica 只回复 REPLCONF, 其余 cmd 不回复.
-		switch cmd.Name() {
-		case proto.CmdSet:
-			s.set(conn, cmd)
-		case proto.CmdReplConf:
-			if len(cmd.Args()) != 3 || string(cmd.At(1)) != proto.OptionGetAck {
-				fmt.Println("Error reading from master: invalid REPLCONF command")
-				conn.WriteErrorInvalidCmd()
-				return
-			}
-			fmt.Println("replica receives GETACK command from master")
-			reply := []string{proto.CmdReplConf, "ACK", strconv.Itoa(s.replOffset)}
-			if err := conn.WriteSlice(reply); err != nil {
-				fmt.Println("replica reply GETACK error: ", err.Error())
-			} else {
-				fmt.Println("replica reply GETACK successfully")
-			}
+		s.mu.Unlock()
+		if done {
+			return nil
+		}
+		if reply != nil {
+			return conn.WriteRawBytes(reply)
+		}
+		if w == nil || !w.wait() {
+			return conn.WriteNilArray()
 		}
-		s.replOffset += cmd.RespLen()
 	}
 }
 
-func (s *Server) handshake(conn *Conn) error {
-	cmd := &command{args: [][]byte{[]byte(proto.CmdPing)}}
-	if err := s.WriteCmdAndCheckReply(conn, cmd, "pong"); err != nil {
-		return err
-	}
-
-	cmd = &command{
-		args: [][]byte{
-			[]byte(proto.CmdReplConf),
-			[]byte(proto.OptionReplLPort),
-			[]byte(s.port),
-		},
-	}
-	if err := s.WriteCmdAndCheckReply(conn, cmd, "ok"); err != nil {
-		return err
+// xreadServe reads the entries after the IDs, it returns nil if there is nothing
+// to reply, or done if the error reply is written.
+// It must be called with s.mu held.
+func (s *Server) xreadServe(conn *Conn, keys []string, ids []storage.ID, count int) (reply []byte, done bool) {
+	n := 0
+	b := []byte{}
+	for i, key := range keys {
+		stream, ok := s.lookupStream(conn, key)
+		if !ok {
+			return nil, true
+		}
+		if stream == nil {
+			continue
+		}
+		entries := stream.After(ids[i], count)
+		if len(entries) == 0 {
+			continue
+		}
+		// a map of the keys and the entries in RESP3, an array of the pairs in RESP2.
+		if conn.resp < proto.Resp3 {
+			b = append(b, proto.ArrayHeader(2)...)
+		}
+		b = append(b, proto.String(key)...)
+		b = append(b, streamEntriesToResp(entries)...)
+		n++
 	}
-
-	cmd = &command{
-		args: [][]byte{
-			[]byte(proto.CmdReplConf),
-			[]byte(proto.OptionReplCapa),
-			[]byte("psync2"),
-		},
+	if n == 0 {
+		return nil, false
 	}
-	if err := s.WriteCmdAndCheckReply(conn, cmd, "ok"); err != nil {
-		return err
+	if conn.resp >= proto.Resp3 {
+		return append(conn.mapHeader(n), b...), false
 	}
-	return nil
+	return append(proto.ArrayHeader(n), b...), false
 }
 
-func (s *Server) requestFullResync(conn *Conn) error {
-	// replica sens a `PSYNC ? -1` to tell the master that it doesn't have any data,
-	// and needs to be full resynchronized.
-	cmd := &command{args: [][]byte{[]byte(proto.CmdPsync), []byte("?"), []byte("-1")}}
-	if err := conn.WriteCommand(cmd); err != nil {
-		return err
-	}
-	replyStr, err := conn.ReadStatusReply()
-	if err != nil {
-		return err
-	}
-	reply := strings.Split(replyStr, " ")
-	if len(reply) != 3 || reply[0] != proto.ReplyFullResync {
-		return proto.ErrInvalidReply
+func (s *Server) bgrewriteaof(conn *Conn, _ Command) error {
+	if s.aof == nil {
+		return conn.WriteError("Background append only file rewriting is only possible when appendonly is yes")
 	}
-	s.replID = reply[1]
-	s.replOffset, _ = strconv.Atoi(reply[2])
 
-	// read the rdb file from the master, and apply the rdb file.
-	_, err = conn.ReadRdb()
-	fmt.Println("replica finishes receiving rdb file")
-	return err
+	if err := s.rewriteAof(); err != nil {
+		return conn.WriteError(err.Error())
+	}
+	return conn.WriteStatus("Background append only file rewriting started")
 }
 
-func (s *Server) WriteCmdAndCheckReply(conn *Conn, cmd Command, reply string) error {
-	err := conn.WriteCommand(cmd)
-	if err != nil {
-		return err
-	}
-	v, err := conn.ReadStatusReply()
-	if err != nil {
+// rewriteAof starts a background aof rewrite.
+func (s *Server) rewriteAof() error {
+	// the snapshot and the switch to a new incremental file must be at the same point.
+	s.mu.Lock()
+	if err := s.aof.StartRewrite(); err != nil {
+		s.mu.Unlock()
 		return err
 	}
-	if !strings.EqualFold(v, reply) {
-		return proto.ErrInvalidReply
-	}
+	snapshot := s.store.Snapshot()
+	s.mu.Unlock()
+
+	go func() {
+		if err := s.aof.Rewrite(snapshot); err != nil {
+			fmt.Println("background aof rewrite error: ", err.Error())
+			return
+		}
+		fmt.Println("background aof rewrite terminated with success")
+	}()
 	return nil
 }
 
 func (s *Server) StreamEntriesToResp(entries []*storage.Entry) []byte {
-	b := proto.ArrayHeader(len(entries))
-	for _, e := range entries {
-		b = append(b, []byte("*2\r\n")...)
-		b = append(b, proto.String(e.ID.String())...)
-		pairs := []string{}
-		for _, kv := range e.KVs {
-			pairs = append(pairs, kv.K)
-			pairs = append(pairs, kv.V)
-		}
-		b = append(b, proto.Array(pairs)...)
-	}
-	return b
+	return streamEntriesToResp(entries)
 }
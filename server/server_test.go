@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+// testClient is a client connected to the server through a pipe.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *proto.Reader
+}
+
+func newTestServer(t *testing.T) *Server {
+	return NewServer(NewConfig([]string{"gedis", "--dir", t.TempDir()}))
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	c, sc := net.Pipe()
+	go s.handleConn(sc)
+	t.Cleanup(func() { c.Close() })
+	return &testClient{t: t, conn: c, r: proto.NewReader(c)}
+}
+
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Write(proto.Array(args)); err != nil {
+		c.t.Fatalf("%q error: %v", args, err)
+	}
+}
+
+func (c *testClient) reply() interface{} {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	v, err := c.r.ReadReply()
+	if err != nil {
+		c.t.Fatalf("reading the reply error: %v", err)
+	}
+	return v
+}
+
+func (c *testClient) do(args ...string) interface{} {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func TestXReadLastEntry(t *testing.T) {
+	c := newTestClient(t, newTestServer(t))
+	c.do("XADD", "s", "1-1", "f", "a")
+	c.do("XADD", "s", "1-2", "f", "b")
+	want := []interface{}{[]interface{}{"s", []interface{}{[]interface{}{"1-2", []interface{}{"f", "b"}}}}}
+	if got := c.do("XREAD", "STREAMS", "s", "+"); !reflect.DeepEqual(got, want) {
+		t.Errorf("XREAD + = %#v, want %#v", got, want)
+	}
+
+	// the last ID is still 1-2 after deleting the tail entry.
+	c.do("XDEL", "s", "1-2")
+	want = []interface{}{[]interface{}{"s", []interface{}{[]interface{}{"1-1", []interface{}{"f", "a"}}}}}
+	if got := c.do("XREAD", "STREAMS", "s", "+"); !reflect.DeepEqual(got, want) {
+		t.Errorf("XREAD + after XDEL = %#v, want %#v", got, want)
+	}
+	if got := c.do("XREAD", "BLOCK", "0", "STREAMS", "s", "+"); !reflect.DeepEqual(got, want) {
+		t.Errorf("XREAD BLOCK 0 + after XDEL = %#v, want %#v", got, want)
+	}
+
+	// without a live entry, + waits for the next entry like $.
+	c.do("XDEL", "s", "1-1")
+	if got := c.do("XREAD", "STREAMS", "s", "+"); got != nil {
+		t.Errorf("XREAD + of an empty stream = %#v, want nil", got)
+	}
+	if got := c.do("XREAD", "BLOCK", "10", "STREAMS", "s", "+"); got != nil {
+		t.Errorf("XREAD BLOCK + of an empty stream = %#v, want nil", got)
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/storage"
+)
+
+// the default LIMIT of the approximate trimming, 100 times stream-node-max-entries of redis.
+const streamTrimDefaultLimit = 100 * 100
+
+// streamAddTrimArgs are the options of XADD and XTRIM.
+type streamAddTrimArgs struct {
+	trim       storage.TrimArgs
+	noMkStream bool
+	// the index of the ID of XADD.
+	idPos int
+}
+
+// parseStreamAddTrimArgs parses `[NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]]`
+// from args[2:], NOMKSTREAM is only for XADD, and the first unknown argument is the ID of XADD.
+// It returns the error reply if the options are invalid.
+func parseStreamAddTrimArgs(args [][]byte, xadd bool) (*streamAddTrimArgs, string) {
+	opts := &streamAddTrimArgs{}
+	limitGiven := false
+	i := 2
+loop:
+	for ; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToLower(string(args[i])); {
+		case xadd && opt == proto.OptionNoMkStream:
+			opts.noMkStream = true
+		case (opt == proto.OptionMaxLen || opt == proto.OptionMinID) && left >= 1:
+			strategy := storage.TrimMaxLen
+			if opt == proto.OptionMinID {
+				strategy = storage.TrimMinID
+			}
+			if opts.trim.Strategy != 0 && opts.trim.Strategy != strategy {
+				return nil, "syntax error, MAXLEN and MINID options at the same time are not compatible"
+			}
+			opts.trim.Strategy = strategy
+			if next := string(args[i+1]); (next == "~" || next == "=") && left >= 2 {
+				opts.trim.Approx = next == "~"
+				i++
+			}
+			i++
+			if strategy == storage.TrimMaxLen {
+				n, err := strconv.ParseInt(string(args[i]), 10, 64)
+				if err != nil {
+					return nil, "value is not an integer or out of range"
+				}
+				if n < 0 {
+					return nil, "The MAXLEN argument must be >= 0."
+				}
+				opts.trim.MaxLen = n
+			} else {
+				id, err := storage.ParseID(string(args[i]), 0)
+				if err != nil {
+					return nil, errInvalidID
+				}
+				opts.trim.MinID = id
+			}
+		case opt == proto.OptionLimit && left >= 1:
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, "value is not an integer or out of range"
+			}
+			if n < 0 {
+				return nil, "The LIMIT argument must be >= 0."
+			}
+			opts.trim.Limit = n
+			limitGiven = true
+			i++
+		case xadd:
+			break loop
+		default:
+			return nil, "syntax error"
+		}
+	}
+	opts.idPos = i
+
+	if limitGiven && !opts.trim.Approx {
+		return nil, "syntax error, LIMIT cannot be used without the special ~ option"
+	}
+	if opts.trim.Approx && !limitGiven {
+		opts.trim.Limit = streamTrimDefaultLimit
+	}
+	return opts, ""
+}
+
+// exactTrimArgs returns the trimming options deleting the same entries as trimming the stream
+// did, the result depends on the LIMIT of the approximate trimming, so it's propagated exactly.
+func exactTrimArgs(stream *storage.Stream) [][]byte {
+	return [][]byte{[]byte(proto.OptionMaxLen), []byte("="), []byte(strconv.Itoa(stream.Len()))}
+}
+
+// xtrim handles `XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]`.
+func (s *Server) xtrim(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	key := string(args[1])
+	opts, errMsg := parseStreamAddTrimArgs(args, false)
+	if errMsg != "" {
+		return conn.WriteError(errMsg)
+	}
+	if opts.trim.Strategy == 0 {
+		return conn.WriteError("syntax error, XTRIM must be called with a trimming strategy")
+	}
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	if stream == nil {
+		return conn.WriteInt(0)
+	}
+	n := stream.Trim(opts.trim)
+	if n > 0 {
+		s.dirty++
+		cmd.SetArgs(append([][]byte{args[0], args[1]}, exactTrimArgs(stream)...))
+	}
+	return conn.WriteInt(int(n))
+}
+
+func (s *Server) xlen(conn *Conn, cmd Command) error {
+	stream, ok := s.lookupStream(conn, string(cmd.At(1)))
+	if !ok {
+		return nil
+	}
+	if stream == nil {
+		return conn.WriteInt(0)
+	}
+	return conn.WriteInt(stream.Len())
+}
+
+// xdel handles `XDEL key id [id ...]`, it replies the number of the entries deleted.
+func (s *Server) xdel(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	ids := make([]storage.ID, len(args)-2)
+	for i, arg := range args[2:] {
+		id, err := storage.ParseID(string(arg), 0)
+		if err != nil {
+			return conn.WriteError(errInvalidID)
+		}
+		ids[i] = id
+	}
+	stream, ok := s.lookupStream(conn, string(args[1]))
+	if !ok {
+		return nil
+	}
+	if stream == nil {
+		return conn.WriteInt(0)
+	}
+	deleted := 0
+	for _, id := range ids {
+		if stream.Delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.dirty++
+	}
+	return conn.WriteInt(deleted)
+}
+
+// xsetid handles `XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id]`.
+func (s *Server) xsetid(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	key := string(args[1])
+	id, err := storage.ParseID(string(args[2]), 0)
+	if err != nil {
+		return conn.WriteError(errInvalidID)
+	}
+	entriesAdded := int64(-1)
+	var maxDeletedID storage.ID
+	for i := 3; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == proto.OptionEntriesAdded && left >= 1:
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			if n < 0 {
+				return conn.WriteError("entries_added must be positive")
+			}
+			entriesAdded = n
+			i++
+		case opt == proto.OptionMaxDeletedID && left >= 1:
+			if maxDeletedID, err = storage.ParseID(string(args[i+1]), 0); err != nil {
+				return conn.WriteError(errInvalidID)
+			}
+			if storage.CompareID(id, maxDeletedID) < 0 {
+				return conn.WriteError("The ID specified in XSETID is smaller than the provided max_deleted_entry_id")
+			}
+			i++
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	if stream == nil {
+		return conn.WriteError("no such key")
+	}
+	if entriesAdded != -1 && int64(stream.Len()) > entriesAdded {
+		return conn.WriteError("The entries_added specified in XSETID is smaller than the target stream length")
+	}
+	if stream.Len() > 0 && storage.CompareID(id, stream.LastEntry().ID) < 0 {
+		return conn.WriteError("The ID specified in XSETID is smaller than the target stream top item")
+	}
+	stream.LastID = id
+	if entriesAdded != -1 {
+		stream.EntriesAdded = entriesAdded
+	}
+	if maxDeletedID != (storage.ID{}) {
+		stream.MaxDeletedID = maxDeletedID
+	}
+	s.dirty++
+	return conn.WriteStatusOK()
+}
@@ -0,0 +1,1028 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+	"github.com/fukua95/gedis/storage"
+)
+
+const (
+	errWrongType     = "Operation against a key holding the wrong kind of value"
+	errInvalidID     = "Invalid stream ID specified as stream command argument"
+	errXGroupNoKey   = "The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+	errXReadGroupDol = "The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set."
+)
+
+// lookupStream returns the stream of the key, the error reply is written if the key
+// holds a string.
+// It must be called with s.mu held.
+func (s *Server) lookupStream(conn *Conn, key string) (*storage.Stream, bool) {
+	if _, ok := s.store.Expire(key); ok {
+		conn.WriteErrorCode("WRONGTYPE", errWrongType)
+		return nil, false
+	}
+	stream, _ := s.store.Stream(key)
+	return stream, true
+}
+
+// parseRangeID parses the start or the end of a range of IDs, `-` and `+` are
+// the smallest and the greatest IDs, `<ms>` is `<ms>-0` as a start, `<ms>-<max seq>` as an end.
+func parseRangeID(arg []byte, isEnd bool) (storage.ID, bool) {
+	switch string(arg) {
+	case "-":
+		return storage.NewID(0, 0), true
+	case "+":
+		return storage.MaxID, true
+	}
+	seq := int64(0)
+	if isEnd {
+		seq = math.MaxInt64
+	}
+	id, err := storage.ParseID(string(arg), seq)
+	return id, err == nil
+}
+
+// parseIntervalID is parseRangeID supporting `(` before an ID to exclude it from the range,
+// it returns the error reply if the ID is invalid.
+func parseIntervalID(arg []byte, isEnd bool) (storage.ID, string) {
+	exclude := len(arg) > 1 && arg[0] == '('
+	if exclude {
+		arg = arg[1:]
+	}
+	id, ok := parseRangeID(arg, isEnd)
+	if !ok {
+		return id, errInvalidID
+	}
+	if exclude && isEnd {
+		if id, ok = id.Prev(); !ok {
+			return id, "invalid end ID for the interval"
+		}
+	} else if exclude {
+		if id, ok = id.Next(); !ok {
+			return id, "invalid start ID for the interval"
+		}
+	}
+	return id, ""
+}
+
+// xgroup handles `XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD entries-read]`,
+// `XGROUP SETID key group id|$ [ENTRIESREAD entries-read]`,
+// `XGROUP DESTROY key group`, `XGROUP CREATECONSUMER key group consumer`
+// and `XGROUP DELCONSUMER key group consumer`.
+// `$` is propagated as the last ID of the stream.
+func (s *Server) xgroup(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	sub := strings.ToLower(string(args[1]))
+	arity := map[string]int{
+		"create":         -5,
+		"setid":          -5,
+		"destroy":        4,
+		"createconsumer": 5,
+		"delconsumer":    5,
+	}
+	n, ok := arity[sub]
+	if !ok || (n > 0 && len(args) != n) || len(args) < -n {
+		return conn.WriteError(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%s'. Try XGROUP HELP.", args[1]))
+	}
+	key, name := string(args[2]), string(args[3])
+	mkstream := false
+	entriesRead := int64(storage.InvalidEntriesRead)
+	for i := 5; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == proto.OptionMkStream && sub == "create":
+			mkstream = true
+		case opt == proto.OptionEntriesRead && i+1 < len(args):
+			v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			if v < 0 && v != storage.InvalidEntriesRead {
+				return conn.WriteError("value for ENTRIESREAD must be positive or -1")
+			}
+			entriesRead = v
+			i++
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	if stream == nil && !mkstream {
+		return conn.WriteError(errXGroupNoKey)
+	}
+
+	var g *storage.ConsumerGroup
+	if stream != nil {
+		g = stream.Group(name)
+	}
+	if g == nil && sub != "create" && sub != "destroy" {
+		return conn.WriteErrorCode("NOGROUP", fmt.Sprintf("No such consumer group '%s' for key name '%s'", name, key))
+	}
+	now := time.Now().UnixMilli()
+
+	switch sub {
+	case "create", "setid":
+		var id storage.ID
+		if string(args[4]) == proto.OptionStreamIDNewest {
+			if stream != nil {
+				id = stream.LastID
+			}
+		} else {
+			var err error
+			if id, err = storage.ParseID(string(args[4]), 0); err != nil {
+				return conn.WriteError(errInvalidID)
+			}
+		}
+		if sub == "create" {
+			if g != nil {
+				return conn.WriteErrorCode("BUSYGROUP", "Consumer Group name already exists")
+			}
+			if stream == nil {
+				stream = storage.NewStream()
+				s.store.PutStream(key, stream)
+			}
+			stream.CreateGroup(name, id, entriesRead)
+		} else {
+			g.LastID = id
+			g.EntriesRead = entriesRead
+		}
+		s.dirty++
+		newArgs := append([][]byte{}, args...)
+		newArgs[4] = []byte(id.String())
+		cmd.SetArgs(newArgs)
+		return conn.WriteStatusOK()
+	case "destroy":
+		if g == nil {
+			return conn.WriteInt(0)
+		}
+		stream.DestroyGroup(name)
+		s.dirty++
+		return conn.WriteInt(1)
+	case "createconsumer":
+		if g.CreateConsumer(string(args[4]), now) == nil {
+			return conn.WriteInt(0)
+		}
+		s.dirty++
+		return conn.WriteInt(1)
+	case "delconsumer":
+		pending := g.DeleteConsumer(string(args[4]))
+		if pending < 0 {
+			return conn.WriteInt(0)
+		}
+		s.dirty++
+		return conn.WriteInt(pending)
+	}
+	return nil
+}
+
+// xack handles `XACK key group id [id ...]`, it replies the number of the entries acknowledged.
+func (s *Server) xack(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	ids := make([]storage.ID, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		id, err := storage.ParseID(string(arg), 0)
+		if err != nil {
+			return conn.WriteError(errInvalidID)
+		}
+		ids = append(ids, id)
+	}
+	stream, ok := s.lookupStream(conn, string(args[1]))
+	if !ok {
+		return nil
+	}
+	var g *storage.ConsumerGroup
+	if stream != nil {
+		g = stream.Group(string(args[2]))
+	}
+	if g == nil {
+		return conn.WriteInt(0)
+	}
+	n := 0
+	for _, id := range ids {
+		if g.Ack(id) {
+			n++
+		}
+	}
+	if n > 0 {
+		s.dirty++
+	}
+	return conn.WriteInt(n)
+}
+
+// xpending handles `XPENDING key group [[IDLE min-idle-time] start end count [consumer]]`.
+// It replies the summary of the pending entries without the range:
+// the number of the entries, the smallest and greatest IDs, and the number of the entries
+// of every consumer; or the pending entries in the range: the ID, the consumer,
+// the milliseconds since the last delivery and the number of the deliveries.
+func (s *Server) xpending(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	key, name := string(args[1]), string(args[2])
+	extended := len(args) > 3
+	minIdle := int64(0)
+	var start, end storage.ID
+	count := 0
+	consumerName := ""
+	if extended {
+		i := 3
+		if strings.EqualFold(string(args[i]), proto.OptionIdle) {
+			if len(args) < 8 {
+				return conn.WriteError("syntax error")
+			}
+			v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			minIdle = v
+			i += 2
+		}
+		if len(args)-i < 3 || len(args)-i > 4 {
+			return conn.WriteError("syntax error")
+		}
+		var errMsg string
+		if start, errMsg = parseIntervalID(args[i], false); errMsg != "" {
+			return conn.WriteError(errMsg)
+		}
+		if end, errMsg = parseIntervalID(args[i+1], true); errMsg != "" {
+			return conn.WriteError(errMsg)
+		}
+		v, err := strconv.Atoi(string(args[i+2]))
+		if err != nil {
+			return conn.WriteError("value is not an integer or out of range")
+		}
+		count = max(v, 0)
+		if len(args)-i == 4 {
+			consumerName = string(args[i+3])
+		}
+	}
+
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	var g *storage.ConsumerGroup
+	if stream != nil {
+		g = stream.Group(name)
+	}
+	if g == nil {
+		return conn.WriteErrorCode("NOGROUP", fmt.Sprintf("No such key '%s' or consumer group '%s'", key, name))
+	}
+
+	if !extended {
+		if g.PEL.Len() == 0 {
+			b := proto.ArrayHeader(4)
+			b = append(b, proto.Integer(0)...)
+			b = append(b, conn.nullBulk()...)
+			b = append(b, conn.nullBulk()...)
+			return conn.WriteRawBytes(append(b, conn.nullArray()...))
+		}
+		first, last := g.PEL.First(), g.PEL.Last()
+		b := proto.ArrayHeader(4)
+		b = append(b, proto.Integer(g.PEL.Len())...)
+		b = append(b, proto.String(first.String())...)
+		b = append(b, proto.String(last.String())...)
+		consumers := []string{}
+		for _, cname := range g.ConsumerNames() {
+			if g.Consumer(cname).PEL.Len() > 0 {
+				consumers = append(consumers, cname)
+			}
+		}
+		b = append(b, proto.ArrayHeader(len(consumers))...)
+		for _, cname := range consumers {
+			b = append(b, proto.Array([]string{cname, strconv.Itoa(g.Consumer(cname).PEL.Len())})...)
+		}
+		return conn.WriteRawBytes(b)
+	}
+
+	pel := g.PEL
+	if consumerName != "" {
+		c := g.Consumer(consumerName)
+		if c == nil {
+			return conn.WriteRawBytes(proto.ArrayHeader(0))
+		}
+		pel = c.PEL
+	}
+	now := time.Now().UnixMilli()
+	n := 0
+	b := []byte{}
+	pel.Range(start, end, func(pe *storage.PendingEntry) bool {
+		if n >= count {
+			return false
+		}
+		idle := now - pe.DeliveryTime
+		if idle < minIdle {
+			return true
+		}
+		b = append(b, proto.ArrayHeader(4)...)
+		b = append(b, proto.String(pe.ID.String())...)
+		b = append(b, proto.String(pe.Consumer.Name)...)
+		b = append(b, proto.Integer(int(idle))...)
+		b = append(b, proto.Integer(int(pe.DeliveryCount))...)
+		n++
+		return true
+	})
+	return conn.WriteRawBytes(append(proto.ArrayHeader(n), b...))
+}
+
+// xclaim handles `XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+// [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]`, the pending entries idle for
+// min-idle-time at least are moved to the consumer.
+// It's propagated as an XCLAIM with the delivery time and count of every entry claimed.
+func (s *Server) xclaim(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	key, name := string(args[1]), string(args[2])
+	minIdle, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return conn.WriteError("Invalid min-idle-time argument for XCLAIM")
+	}
+	ids := []storage.ID{}
+	i := 5
+	for ; i < len(args); i++ {
+		id, err := storage.ParseID(string(args[i]), 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime, retryCount := int64(-1), int64(-1)
+	force, justID := false, false
+	var lastID *storage.ID
+	for ; i < len(args); i++ {
+		more := i+1 < len(args)
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == proto.OptionForce:
+			force = true
+		case opt == proto.OptionJustID:
+			justID = true
+		case opt == proto.OptionIdle && more:
+			v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return conn.WriteError("Invalid IDLE option argument for XCLAIM")
+			}
+			deliveryTime = now - v
+			i++
+		case opt == proto.OptionTime && more:
+			v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return conn.WriteError("Invalid TIME option argument for XCLAIM")
+			}
+			deliveryTime = v
+			i++
+		case opt == proto.OptionRetryCount && more:
+			v, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || v < 0 {
+				return conn.WriteError("Invalid RETRYCOUNT option argument for XCLAIM")
+			}
+			retryCount = v
+			i++
+		case opt == proto.OptionLastID && more:
+			id, err := storage.ParseID(string(args[i+1]), 0)
+			if err != nil {
+				return conn.WriteError(errInvalidID)
+			}
+			lastID = &id
+			i++
+		default:
+			return conn.WriteError(fmt.Sprintf("Unrecognized XCLAIM option '%s'", args[i]))
+		}
+	}
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	var g *storage.ConsumerGroup
+	if stream != nil {
+		g = stream.Group(name)
+	}
+	if g == nil {
+		return conn.WriteErrorCode("NOGROUP", fmt.Sprintf("No such key '%s' or consumer group '%s'", key, name))
+	}
+	if lastID != nil && storage.CompareID(*lastID, g.LastID) > 0 {
+		g.LastID = *lastID
+		s.dirty++
+		s.propagateGroupID(key, g)
+	}
+
+	c := s.lookupOrCreateConsumer(key, g, string(args[3]), now)
+	n := 0
+	b := []byte{}
+	for _, id := range ids {
+		pe := g.PEL.Get(id)
+		entry := stream.Lookup(id)
+		if pe == nil && force && entry != nil {
+			// a new pending entry is delivered once.
+			pe = g.Deliver(id, c, now, true)
+		}
+		if pe == nil || (minIdle > 0 && now-pe.DeliveryTime < minIdle) {
+			continue
+		}
+		if entry == nil {
+			// the entry is deleted, it's removed from the pending entries lists.
+			g.Ack(id)
+			s.propagateXClaim(key, g, c, pe)
+			s.dirty++
+			continue
+		}
+		g.Deliver(id, c, deliveryTime, false)
+		if retryCount >= 0 {
+			pe.DeliveryCount = retryCount
+		} else if !justID {
+			pe.DeliveryCount++
+		}
+		c.ActiveTime = now
+		if justID {
+			b = append(b, proto.String(id.String())...)
+		} else {
+			b = append(b, streamEntryToResp(entry)...)
+		}
+		n++
+		s.propagateXClaim(key, g, c, pe)
+		s.dirty++
+	}
+	return conn.WriteRawBytes(append(proto.ArrayHeader(n), b...))
+}
+
+// xautoclaim handles `XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]`,
+// it claims at most count pending entries idle for min-idle-time at least, from start.
+// It replies the ID to start the next call with, 0-0 if the scan is done, the entries
+// claimed and the IDs of the entries deleted, which are removed from the pending entries list.
+func (s *Server) xautoclaim(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	key, name := string(args[1]), string(args[2])
+	minIdle, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return conn.WriteError("Invalid min-idle-time argument for XAUTOCLAIM")
+	}
+	start, ok := parseRangeID(args[5], false)
+	if !ok {
+		return conn.WriteError(errInvalidID)
+	}
+	count, justID := 100, false
+	for i := 6; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == proto.OptionCount && i+1 < len(args):
+			v, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || v < 1 || v > math.MaxInt32/10 {
+				return conn.WriteError("COUNT must be > 0")
+			}
+			count = v
+			i++
+		case opt == proto.OptionJustID:
+			justID = true
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	var g *storage.ConsumerGroup
+	if stream != nil {
+		g = stream.Group(name)
+	}
+	if g == nil {
+		return conn.WriteErrorCode("NOGROUP", fmt.Sprintf("No such key '%s' or consumer group '%s'", key, name))
+	}
+
+	now := time.Now().UnixMilli()
+	c := s.lookupOrCreateConsumer(key, g, string(args[3]), now)
+	// the entries scanned are limited, not to block the server for long.
+	attempts := count * 10
+	cursor := storage.NewID(0, 0)
+	pending := []*storage.PendingEntry{}
+	g.PEL.Range(start, storage.MaxID, func(pe *storage.PendingEntry) bool {
+		if attempts == 0 || count == 0 {
+			cursor = pe.ID
+			return false
+		}
+		attempts--
+		if minIdle > 0 && now-pe.DeliveryTime < minIdle {
+			return true
+		}
+		pending = append(pending, pe)
+		if stream.Lookup(pe.ID) != nil {
+			count--
+		}
+		return true
+	})
+
+	claimed, deleted := []byte{}, []string{}
+	n := 0
+	for _, pe := range pending {
+		entry := stream.Lookup(pe.ID)
+		if entry == nil {
+			g.Ack(pe.ID)
+			deleted = append(deleted, pe.ID.String())
+		} else {
+			g.Deliver(pe.ID, c, now, !justID)
+			c.ActiveTime = now
+			if justID {
+				claimed = append(claimed, proto.String(pe.ID.String())...)
+			} else {
+				claimed = append(claimed, streamEntryToResp(entry)...)
+			}
+			n++
+		}
+		s.propagateXClaim(key, g, c, pe)
+		s.dirty++
+	}
+
+	b := proto.ArrayHeader(3)
+	b = append(b, proto.String(cursor.String())...)
+	b = append(b, proto.ArrayHeader(n)...)
+	b = append(b, claimed...)
+	b = append(b, proto.Array(deleted)...)
+	return conn.WriteRawBytes(b)
+}
+
+// lookupOrCreateConsumer returns the consumer of the group, it's created if it doesn't exist.
+// It must be called with s.mu held.
+func (s *Server) lookupOrCreateConsumer(key string, g *storage.ConsumerGroup, name string, now int64) *storage.Consumer {
+	c := g.Consumer(name)
+	if c == nil {
+		c = g.CreateConsumer(name, now)
+		s.dirty++
+		s.alsoPropagate(proto.CmdXGroup, "CREATECONSUMER", key, g.Name, name)
+	}
+	c.SeenTime = now
+	return c
+}
+
+// propagateXClaim propagates the state of the pending entry as
+// `XCLAIM key group consumer 0 id TIME ms RETRYCOUNT count FORCE JUSTID LASTID id`.
+// The entry is removed from the pending entries lists by the XCLAIM if it's deleted.
+// It must be called with s.mu held.
+func (s *Server) propagateXClaim(key string, g *storage.ConsumerGroup, c *storage.Consumer, pe *storage.PendingEntry) {
+	s.alsoPropagate(proto.CmdXClaim, key, g.Name, c.Name, "0", pe.ID.String(),
+		"TIME", strconv.FormatInt(pe.DeliveryTime, 10), "RETRYCOUNT", strconv.FormatInt(pe.DeliveryCount, 10),
+		"FORCE", "JUSTID", "LASTID", g.LastID.String())
+}
+
+// propagateGroupID propagates the last ID and the entries read of the group as
+// `XGROUP SETID key group id ENTRIESREAD entries-read`.
+// It must be called with s.mu held.
+func (s *Server) propagateGroupID(key string, g *storage.ConsumerGroup) {
+	s.alsoPropagate(proto.CmdXGroup, "SETID", key, g.Name, g.LastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(g.EntriesRead, 10))
+}
+
+// xreadGroupRequest is a parsed XREADGROUP.
+type xreadGroupRequest struct {
+	group    string
+	consumer string
+	count    int
+	// -1 if not blocking.
+	blockMS int
+	noAck   bool
+	keys    []string
+	// nil for `>`.
+	ids []*storage.ID
+}
+
+// xreadgroup handles `XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK]
+// STREAMS key [key ...] id [id ...]`: `>` reads the entries never delivered to the group,
+// and other IDs read the pending entries of the consumer after them.
+// It's propagated as an XCLAIM for every entry delivered, or as XGROUP SETID with NOACK.
+func (s *Server) xreadgroup(conn *Conn, cmd Command) error {
+	req, msg := parseXReadGroup(cmd)
+	if msg != "" {
+		return conn.WriteError(msg)
+	}
+	// it only blocks if all the IDs are `>`.
+	history := false
+	for _, id := range req.ids {
+		history = history || id != nil
+	}
+	var w *keysWaiter
+	if req.blockMS >= 0 && !history {
+		w = s.newKeysWaiter(conn, req.keys, req.blockMS)
+		defer w.stop()
+	}
+	for {
+		s.mu.Lock()
+		reply, done := s.xreadgroupServe(conn, req)
+		if len(s.alsoPropagated) > 0 {
+			s.propagateAlso(conn)
+		}
+		if reply == nil && !done && w != nil {
+			w.block()
+		}
+		s.mu.Unlock()
+		if done {
+			return nil
+		}
+		if reply != nil {
+			return conn.WriteRawBytes(reply)
+		}
+		if w == nil || !w.wait() {
+			return conn.WriteNilArray()
+		}
+	}
+}
+
+// parseXReadGroup returns the parsed request, or the error message.
+func parseXReadGroup(cmd Command) (*xreadGroupRequest, string) {
+	args := cmd.Args()
+	if !strings.EqualFold(string(args[1]), proto.OptionGroup) {
+		return nil, "syntax error"
+	}
+	req := &xreadGroupRequest{group: string(args[2]), consumer: string(args[3]), blockMS: -1}
+	i := 4
+	for ; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		if opt == proto.OptionStreams {
+			break
+		}
+		switch {
+		case opt == proto.OptionCount && i+1 < len(args):
+			v, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, "value is not an integer or out of range"
+			}
+			req.count = max(v, 0)
+			i++
+		case opt == proto.OptionBlock && i+1 < len(args):
+			v, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, "timeout is not an integer or out of range"
+			}
+			if v < 0 {
+				return nil, "timeout is negative"
+			}
+			req.blockMS = v
+			i++
+		case opt == proto.OptionNoAck:
+			req.noAck = true
+		default:
+			return nil, "syntax error"
+		}
+	}
+	rest := len(args) - i - 1
+	if i == len(args) || rest == 0 || rest%2 != 0 {
+		return nil, "Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified."
+	}
+	n := rest / 2
+	for j := 0; j < n; j++ {
+		req.keys = append(req.keys, string(args[i+1+j]))
+		idStr := string(args[i+1+n+j])
+		switch idStr {
+		case proto.OptionStreamIDNew:
+			req.ids = append(req.ids, nil)
+		case proto.OptionStreamIDNewest:
+			return nil, errXReadGroupDol
+		default:
+			id, err := storage.ParseID(idStr, 0)
+			if err != nil {
+				return nil, errInvalidID
+			}
+			req.ids = append(req.ids, &id)
+		}
+	}
+	return req, ""
+}
+
+// xreadgroupServe reads the entries of the request, it returns nil if there is nothing
+// to reply, or done if the error reply is written.
+// It must be called with s.mu held.
+func (s *Server) xreadgroupServe(conn *Conn, req *xreadGroupRequest) (reply []byte, done bool) {
+	now := time.Now().UnixMilli()
+	type groupOf struct {
+		stream *storage.Stream
+		group  *storage.ConsumerGroup
+	}
+	groups := make([]groupOf, len(req.keys))
+	for i, key := range req.keys {
+		stream, ok := s.lookupStream(conn, key)
+		if !ok {
+			return nil, true
+		}
+		var g *storage.ConsumerGroup
+		if stream != nil {
+			g = stream.Group(req.group)
+		}
+		if g == nil {
+			conn.WriteErrorCode("NOGROUP", fmt.Sprintf("No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, req.group))
+			return nil, true
+		}
+		groups[i] = groupOf{stream, g}
+	}
+
+	n := 0
+	b := []byte{}
+	for i, key := range req.keys {
+		stream, g := groups[i].stream, groups[i].group
+		c := s.lookupOrCreateConsumer(key, g, req.consumer, now)
+		entries := []byte{}
+		num := 0
+		if req.ids[i] == nil {
+			for _, e := range stream.After(g.LastID, req.count) {
+				stream.Advance(g, e.ID)
+				if !req.noAck {
+					pe := g.Deliver(e.ID, c, now, true)
+					s.propagateXClaim(key, g, c, pe)
+				}
+				entries = append(entries, streamEntryToResp(e)...)
+				num++
+			}
+			if num == 0 {
+				continue
+			}
+			s.dirty++
+			s.propagateGroupID(key, g)
+		} else {
+			// the history of the consumer, the entries deleted are replied with nil.
+			start, ok := req.ids[i].Next()
+			if ok {
+				c.PEL.Range(start, storage.MaxID, func(pe *storage.PendingEntry) bool {
+					if req.count > 0 && num >= req.count {
+						return false
+					}
+					if e := stream.Lookup(pe.ID); e != nil {
+						entries = append(entries, streamEntryToResp(e)...)
+					} else {
+						entries = append(entries, proto.ArrayHeader(2)...)
+						entries = append(entries, proto.String(pe.ID.String())...)
+						entries = append(entries, conn.nullArray()...)
+					}
+					pe.DeliveryTime = now
+					pe.DeliveryCount++
+					s.propagateXClaim(key, g, c, pe)
+					num++
+					return true
+				})
+			}
+			if num > 0 {
+				s.dirty++
+			}
+		}
+		if num > 0 {
+			c.ActiveTime = now
+		}
+		// a map of the keys and the entries in RESP3, like XREAD.
+		if conn.resp < proto.Resp3 {
+			b = append(b, proto.ArrayHeader(2)...)
+		}
+		b = append(b, proto.String(key)...)
+		b = append(b, proto.ArrayHeader(num)...)
+		b = append(b, entries...)
+		n++
+	}
+	if n == 0 {
+		return nil, false
+	}
+	if conn.resp >= proto.Resp3 {
+		return append(conn.mapHeader(n), b...), false
+	}
+	return append(proto.ArrayHeader(n), b...), false
+}
+
+// xinfo handles `XINFO STREAM key [FULL [COUNT count]]`, `XINFO GROUPS key`
+// and `XINFO CONSUMERS key group`.
+func (s *Server) xinfo(conn *Conn, cmd Command) error {
+	args := cmd.Args()
+	sub := strings.ToLower(string(args[1]))
+	arity := map[string]int{
+		"stream":    -3,
+		"groups":    3,
+		"consumers": 4,
+	}
+	n, ok := arity[sub]
+	if !ok || (n > 0 && len(args) != n) || len(args) < -n {
+		return conn.WriteError(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%s'. Try XINFO HELP.", args[1]))
+	}
+	key := string(args[2])
+	stream, ok := s.lookupStream(conn, key)
+	if !ok {
+		return nil
+	}
+	if stream == nil {
+		return conn.WriteError("no such key")
+	}
+	now := time.Now().UnixMilli()
+
+	switch sub {
+	case "stream":
+		full, count := false, 10
+		if len(args) > 3 {
+			full = strings.EqualFold(string(args[3]), proto.OptionFull)
+			if !full || (len(args) != 4 && len(args) != 6) {
+				return conn.WriteError("syntax error")
+			}
+			if len(args) == 6 {
+				v, err := strconv.Atoi(string(args[5]))
+				if !strings.EqualFold(string(args[4]), proto.OptionCount) || err != nil {
+					return conn.WriteError("syntax error")
+				}
+				count = max(v, 0)
+			}
+		}
+		return conn.WriteRawBytes(xinfoStream(stream, full, count, conn.resp))
+	case "groups":
+		names := stream.GroupNames()
+		b := proto.ArrayHeader(len(names))
+		for _, name := range names {
+			g := stream.Group(name)
+			b = append(b, conn.mapHeader(6)...)
+			b = append(b, proto.String("name")...)
+			b = append(b, proto.String(name)...)
+			b = append(b, proto.String("consumers")...)
+			b = append(b, proto.Integer(len(g.Consumers))...)
+			b = append(b, proto.String("pending")...)
+			b = append(b, proto.Integer(g.PEL.Len())...)
+			b = append(b, proto.String("last-delivered-id")...)
+			b = append(b, proto.String(g.LastID.String())...)
+			b = append(b, xinfoGroupLag(stream, g, conn.resp)...)
+		}
+		return conn.WriteRawBytes(b)
+	case "consumers":
+		g := stream.Group(string(args[3]))
+		if g == nil {
+			return conn.WriteErrorCode("NOGROUP", fmt.Sprintf("No such consumer group '%s' for key name '%s'", args[3], key))
+		}
+		names := g.ConsumerNames()
+		b := proto.ArrayHeader(len(names))
+		for _, name := range names {
+			c := g.Consumer(name)
+			inactive := int64(-1)
+			if c.ActiveTime >= 0 {
+				inactive = now - c.ActiveTime
+			}
+			b = append(b, conn.mapHeader(4)...)
+			b = append(b, proto.String("name")...)
+			b = append(b, proto.String(name)...)
+			b = append(b, proto.String("pending")...)
+			b = append(b, proto.Integer(c.PEL.Len())...)
+			b = append(b, proto.String("idle")...)
+			b = append(b, proto.Integer(int(now-c.SeenTime))...)
+			b = append(b, proto.String("inactive")...)
+			b = append(b, proto.Integer(int(inactive))...)
+		}
+		return conn.WriteRawBytes(b)
+	}
+	return nil
+}
+
+// xinfoGroupLag returns the entries-read and lag fields of the group, they're null if unknown.
+func xinfoGroupLag(stream *storage.Stream, g *storage.ConsumerGroup, resp int) []byte {
+	b := proto.String("entries-read")
+	if g.EntriesRead != storage.InvalidEntriesRead {
+		b = append(b, proto.Integer(int(g.EntriesRead))...)
+	} else {
+		b = append(b, proto.NullBulk(resp)...)
+	}
+	b = append(b, proto.String("lag")...)
+	if lag, ok := stream.Lag(g); ok {
+		return append(b, proto.Integer(int(lag))...)
+	}
+	return append(b, proto.NullBulk(resp)...)
+}
+
+// xinfoStream returns the reply of XINFO STREAM, FULL replies the entries, the groups,
+// the consumers and their pending entries, count limits the entries of every list, 0 means no limit.
+// The stream, the groups and the consumers are maps in RESP3.
+func xinfoStream(stream *storage.Stream, full bool, count int, resp int) []byte {
+	entryOrNil := func(e *storage.Entry) []byte {
+		if e == nil {
+			return proto.NullBulk(resp)
+		}
+		return streamEntryToResp(e)
+	}
+	if !full {
+		b := proto.MapHeader(10, resp)
+		b = append(b, proto.String("length")...)
+		b = append(b, proto.Integer(stream.Len())...)
+		b = append(b, xinfoStreamIDs(stream)...)
+		b = append(b, proto.String("groups")...)
+		b = append(b, proto.Integer(len(stream.Groups))...)
+		b = append(b, proto.String("first-entry")...)
+		b = append(b, entryOrNil(stream.First())...)
+		b = append(b, proto.String("last-entry")...)
+		return append(b, entryOrNil(stream.LastEntry())...)
+	}
+
+	limit := func(n int) int {
+		if count > 0 {
+			return min(n, count)
+		}
+		return n
+	}
+	b := proto.MapHeader(9, resp)
+	b = append(b, proto.String("length")...)
+	b = append(b, proto.Integer(stream.Len())...)
+	b = append(b, xinfoStreamIDs(stream)...)
+	b = append(b, proto.String("entries")...)
+	b = append(b, streamEntriesToResp(stream.Range(storage.NewID(0, 0), storage.MaxID, count, false))...)
+	b = append(b, proto.String("groups")...)
+	names := stream.GroupNames()
+	b = append(b, proto.ArrayHeader(len(names))...)
+	for _, name := range names {
+		g := stream.Group(name)
+		b = append(b, proto.MapHeader(7, resp)...)
+		b = append(b, proto.String("name")...)
+		b = append(b, proto.String(name)...)
+		b = append(b, proto.String("last-delivered-id")...)
+		b = append(b, proto.String(g.LastID.String())...)
+		b = append(b, xinfoGroupLag(stream, g, resp)...)
+		b = append(b, proto.String("pel-count")...)
+		b = append(b, proto.Integer(g.PEL.Len())...)
+		b = append(b, proto.String("pending")...)
+		n := limit(g.PEL.Len())
+		b = append(b, proto.ArrayHeader(n)...)
+		g.PEL.Range(storage.NewID(0, 0), storage.MaxID, func(pe *storage.PendingEntry) bool {
+			if n == 0 {
+				return false
+			}
+			n--
+			b = append(b, proto.ArrayHeader(4)...)
+			b = append(b, proto.String(pe.ID.String())...)
+			b = append(b, proto.String(pe.Consumer.Name)...)
+			b = append(b, proto.Integer(int(pe.DeliveryTime))...)
+			b = append(b, proto.Integer(int(pe.DeliveryCount))...)
+			return true
+		})
+		b = append(b, proto.String("consumers")...)
+		cnames := g.ConsumerNames()
+		b = append(b, proto.ArrayHeader(len(cnames))...)
+		for _, cname := range cnames {
+			c := g.Consumer(cname)
+			b = append(b, proto.MapHeader(5, resp)...)
+			b = append(b, proto.String("name")...)
+			b = append(b, proto.String(cname)...)
+			b = append(b, proto.String("seen-time")...)
+			b = append(b, proto.Integer(int(c.SeenTime))...)
+			b = append(b, proto.String("active-time")...)
+			b = append(b, proto.Integer(int(c.ActiveTime))...)
+			b = append(b, proto.String("pel-count")...)
+			b = append(b, proto.Integer(c.PEL.Len())...)
+			b = append(b, proto.String("pending")...)
+			n := limit(c.PEL.Len())
+			b = append(b, proto.ArrayHeader(n)...)
+			c.PEL.Range(storage.NewID(0, 0), storage.MaxID, func(pe *storage.PendingEntry) bool {
+				if n == 0 {
+					return false
+				}
+				n--
+				b = append(b, proto.ArrayHeader(3)...)
+				b = append(b, proto.String(pe.ID.String())...)
+				b = append(b, proto.Integer(int(pe.DeliveryTime))...)
+				b = append(b, proto.Integer(int(pe.DeliveryCount))...)
+				return true
+			})
+		}
+	}
+	return b
+}
+
+// xinfoStreamIDs returns the radix tree, the last ID, the counters and the first ID fields of XINFO STREAM.
+func xinfoStreamIDs(stream *storage.Stream) []byte {
+	keys, nodes := stream.RaxSize()
+	b := proto.String("radix-tree-keys")
+	b = append(b, proto.Integer(keys)...)
+	b = append(b, proto.String("radix-tree-nodes")...)
+	b = append(b, proto.Integer(nodes)...)
+	b = append(b, proto.String("last-generated-id")...)
+	b = append(b, proto.String(stream.LastID.String())...)
+	b = append(b, proto.String("max-deleted-entry-id")...)
+	b = append(b, proto.String(stream.MaxDeletedID.String())...)
+	b = append(b, proto.String("entries-added")...)
+	b = append(b, proto.Integer(int(stream.EntriesAdded))...)
+	b = append(b, proto.String("recorded-first-entry-id")...)
+	return append(b, proto.String(stream.FirstID.String())...)
+}
+
+// xreadgroupKeys finds the keys of XREADGROUP, the group and the consumer may be named STREAMS.
+func xreadgroupKeys(cmd Command) []int {
+	return streamsKeys(cmd, 4)
+}
+
+func streamEntryToResp(e *storage.Entry) []byte {
+	b := proto.ArrayHeader(2)
+	b = append(b, proto.String(e.ID.String())...)
+	pairs := []string{}
+	for _, kv := range e.KVs {
+		pairs = append(pairs, kv.K, kv.V)
+	}
+	return append(b, proto.Array(pairs)...)
+}
+
+func streamEntriesToResp(entries []*storage.Entry) []byte {
+	b := proto.ArrayHeader(len(entries))
+	for _, e := range entries {
+		b = append(b, streamEntryToResp(e)...)
+	}
+	return b
+}
@@ -0,0 +1,332 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+// the channel of the invalidation messages to a client in RESP2, which is subscribed to it
+// and redirected to by a client tracking the keys.
+const trackingChannel = "__redis__:invalidate"
+
+// clientTracking is the state of CLIENT TRACKING of a client, like the client side caching
+// of redis, it's protected by s.mu.
+// The server remembers the keys read by the client, and sends an invalidation message
+// when one of them is written, then it forgets the key until the client reads it again.
+type clientTracking struct {
+	// the ID of the client receiving the invalidation messages, 0 if it's the client itself.
+	redirect       int64
+	brokenRedirect bool
+	// the client is notified of all the keys written with the prefixes, instead of
+	// the keys it reads.
+	bcast    bool
+	prefixes []string
+	// with OPTIN only the keys read after CLIENT CACHING YES are tracked, with OPTOUT
+	// the keys read after CLIENT CACHING NO are not, caching is set by CLIENT CACHING.
+	optin   bool
+	optout  bool
+	caching bool
+	// the keys written by the client itself are not invalidated.
+	noloop bool
+}
+
+// clientTrackingCmd handles `CLIENT TRACKING ON|OFF [REDIRECT client-id] [PREFIX prefix [PREFIX prefix ...]]
+// [BCAST] [OPTIN] [OPTOUT] [NOLOOP]`.
+func (s *Server) clientTrackingCmd(conn *Conn, args [][]byte) error {
+	opts := &clientTracking{}
+	prefixes := []string{}
+	for i := 3; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == proto.OptionRedirect && left >= 1:
+			if opts.redirect != 0 {
+				return conn.WriteError("A client can only redirect to a single other client")
+			}
+			id, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return conn.WriteError("value is not an integer or out of range")
+			}
+			if id != 0 && s.clients[id] == nil {
+				return conn.WriteError("The client ID you want redirect to does not exist")
+			}
+			opts.redirect = id
+			i++
+		case opt == proto.OptionPrefix && left >= 1:
+			prefixes = append(prefixes, string(args[i+1]))
+			i++
+		case opt == proto.OptionBCast:
+			opts.bcast = true
+		case opt == proto.OptionOptIn:
+			opts.optin = true
+		case opt == proto.OptionOptOut:
+			opts.optout = true
+		case opt == proto.OptionNoLoop:
+			opts.noloop = true
+		default:
+			return conn.WriteError("syntax error")
+		}
+	}
+
+	switch strings.ToLower(string(args[2])) {
+	case proto.OptionOn:
+		old := conn.tracking
+		switch {
+		case !opts.bcast && len(prefixes) > 0:
+			return conn.WriteError("PREFIX option requires BCAST mode to be enabled")
+		case old != nil && old.bcast != opts.bcast:
+			return conn.WriteError("You can't switch BCAST mode on/off before disabling tracking for this client, " +
+				"and then re-enabling it with a different mode.")
+		case opts.bcast && (opts.optin || opts.optout):
+			return conn.WriteError("OPTIN and OPTOUT are not compatible with BCAST")
+		case opts.optin && opts.optout:
+			return conn.WriteError("You can't use both OPTIN and OPTOUT")
+		case old != nil && ((opts.optin && old.optout) || (opts.optout && old.optin)):
+			return conn.WriteError("You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, " +
+				"and then re-enabling it with a different mode.")
+		}
+		if opts.bcast {
+			if msg := checkPrefixCollisions(old, prefixes); msg != "" {
+				return conn.WriteError(msg)
+			}
+		}
+		s.enableTracking(conn, opts, prefixes)
+	case proto.OptionOff:
+		s.disableTracking(conn)
+	default:
+		return conn.WriteError("syntax error")
+	}
+	return conn.WriteStatusOK()
+}
+
+// checkPrefixCollisions returns the error message if a prefix is a prefix of another one
+// of the client, the key would be notified twice.
+func checkPrefixCollisions(old *clientTracking, prefixes []string) string {
+	for i, p := range prefixes {
+		if old != nil {
+			for _, o := range old.prefixes {
+				if strings.HasPrefix(p, o) || strings.HasPrefix(o, p) {
+					return fmt.Sprintf("Prefix '%s' overlaps with an existing prefix '%s'. "+
+						"Prefixes for a single client must not overlap.", p, o)
+				}
+			}
+		}
+		for _, q := range prefixes[i+1:] {
+			if strings.HasPrefix(p, q) || strings.HasPrefix(q, p) {
+				return fmt.Sprintf("Prefix '%s' overlaps with another provided prefix '%s'. "+
+					"Prefixes for a single client must not overlap.", p, q)
+			}
+		}
+	}
+	return ""
+}
+
+// enableTracking turns on the tracking of the client, or changes its options, the prefixes
+// are added to the prefixes of the client, BCAST without a prefix notifies all the keys.
+// It must be called with s.mu held.
+func (s *Server) enableTracking(conn *Conn, opts *clientTracking, prefixes []string) {
+	if old := conn.tracking; old != nil {
+		opts.prefixes = old.prefixes
+	}
+	if opts.bcast && len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	for _, p := range prefixes {
+		if s.trackingPrefixes[p] == nil {
+			s.trackingPrefixes[p] = map[int64]struct{}{}
+		}
+		s.trackingPrefixes[p][conn.id] = struct{}{}
+		opts.prefixes = append(opts.prefixes, p)
+	}
+	conn.tracking = opts
+}
+
+// disableTracking turns off the tracking of the client, the keys it read are forgotten lazily.
+// It must be called with s.mu held.
+func (s *Server) disableTracking(conn *Conn) {
+	t := conn.tracking
+	if t == nil {
+		return
+	}
+	for _, p := range t.prefixes {
+		if ids, ok := s.trackingPrefixes[p]; ok {
+			delete(ids, conn.id)
+			if len(ids) == 0 {
+				delete(s.trackingPrefixes, p)
+			}
+		}
+	}
+	conn.tracking = nil
+}
+
+// clientCaching handles `CLIENT CACHING YES|NO`.
+func (s *Server) clientCaching(conn *Conn, args [][]byte) error {
+	t := conn.tracking
+	if t == nil || (!t.optin && !t.optout) {
+		return conn.WriteError("CLIENT CACHING can be called only when the client is in tracking mode " +
+			"with OPTIN or OPTOUT mode enabled")
+	}
+	switch strings.ToLower(string(args[2])) {
+	case proto.OptionYes:
+		if !t.optin {
+			return conn.WriteError("CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+		}
+	case proto.OptionNo:
+		if !t.optout {
+			return conn.WriteError("CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+		}
+	default:
+		return conn.WriteError("syntax error")
+	}
+	t.caching = true
+	return conn.WriteStatusOK()
+}
+
+// clientTrackingInfo handles `CLIENT TRACKINGINFO`, it replies the flags, the client redirected to,
+// -1 if the tracking is off, and the prefixes.
+func (s *Server) clientTrackingInfo(conn *Conn) error {
+	flags := []string{"off"}
+	redirect := -1
+	prefixes := []string{}
+	if t := conn.tracking; t != nil {
+		flags = []string{"on"}
+		if t.bcast {
+			flags = append(flags, "bcast")
+		}
+		if t.optin {
+			flags = append(flags, "optin")
+			if t.caching {
+				flags = append(flags, "caching-yes")
+			}
+		}
+		if t.optout {
+			flags = append(flags, "optout")
+			if t.caching {
+				flags = append(flags, "caching-no")
+			}
+		}
+		if t.noloop {
+			flags = append(flags, "noloop")
+		}
+		if t.brokenRedirect {
+			flags = append(flags, "broken_redirect")
+		}
+		redirect = int(t.redirect)
+		prefixes = t.prefixes
+	}
+	b := conn.mapHeader(3)
+	b = append(b, proto.String("flags")...)
+	b = append(b, conn.setHeader(len(flags))...)
+	for _, f := range flags {
+		b = append(b, proto.String(f)...)
+	}
+	b = append(b, proto.String("redirect")...)
+	b = append(b, proto.Integer(redirect)...)
+	b = append(b, proto.String("prefixes")...)
+	b = append(b, proto.Array(prefixes)...)
+	return conn.WriteRawBytes(b)
+}
+
+// trackingRememberKeys remembers the keys read by the command of the client.
+// It must be called with s.mu held.
+func (s *Server) trackingRememberKeys(conn *Conn, spec *commandSpec, cmd Command) {
+	t := conn.tracking
+	if t == nil {
+		return
+	}
+	caching := t.caching
+	// CLIENT CACHING only affects the next command.
+	if spec.name != proto.CmdClient {
+		t.caching = false
+	}
+	if t.bcast || spec.flags&flagReadOnly == 0 || (t.optin && !caching) || (t.optout && caching) {
+		return
+	}
+	for _, i := range spec.keys(cmd) {
+		key := string(cmd.At(i))
+		if s.trackingTable[key] == nil {
+			s.trackingTable[key] = map[int64]struct{}{}
+		}
+		s.trackingTable[key][conn.id] = struct{}{}
+	}
+}
+
+// trackingInvalidateKeys notifies the clients tracking the keys written by the command of the client.
+// It must be called with s.mu held.
+func (s *Server) trackingInvalidateKeys(conn *Conn, spec *commandSpec, cmd Command) {
+	if len(s.trackingTable) == 0 && len(s.trackingPrefixes) == 0 {
+		return
+	}
+	for _, i := range spec.keys(cmd) {
+		s.trackingInvalidateKey(conn, string(cmd.At(i)))
+	}
+}
+
+// trackingInvalidateKey notifies the clients tracking the key, the clients with BCAST are
+// notified if the key has one of their prefixes, the others are notified once after
+// reading the key, and not again until they read it again.
+// It must be called with s.mu held.
+func (s *Server) trackingInvalidateKey(conn *Conn, key string) {
+	for prefix, ids := range s.trackingPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for id := range ids {
+			if c := s.clients[id]; c != nil && !(c == conn && c.tracking.noloop) {
+				s.sendTrackingMessage(c, key)
+			}
+		}
+	}
+
+	ids, ok := s.trackingTable[key]
+	if !ok {
+		return
+	}
+	delete(s.trackingTable, key)
+	for id := range ids {
+		c := s.clients[id]
+		// the client may be closed, or turn off the tracking, or switch to BCAST after reading the key.
+		if c == nil || c.tracking == nil || c.tracking.bcast || (c == conn && c.tracking.noloop) {
+			continue
+		}
+		s.sendTrackingMessage(c, key)
+	}
+}
+
+// sendTrackingMessage sends the invalidation of the key to the client, or to the client it
+// redirects to. It's a push message in RESP3, and a message of the channel __redis__:invalidate
+// to a client in RESP2 subscribed to it, a client in RESP2 can't receive it without redirecting.
+// It must be called with s.mu held.
+func (s *Server) sendTrackingMessage(c *Conn, key string) {
+	target := c
+	if id := c.tracking.redirect; id != 0 {
+		if target = s.clients[id]; target == nil {
+			c.tracking.brokenRedirect = true
+			if c.resp >= proto.Resp3 {
+				c.QueuePush(func(resp int) []byte {
+					b := proto.PushHeader(2, resp)
+					b = append(b, proto.String("tracking-redir-broken")...)
+					return append(b, proto.Integer(int(id))...)
+				})
+			}
+			return
+		}
+	}
+
+	var b []byte
+	switch {
+	case target.resp >= proto.Resp3:
+		b = append(proto.PushHeader(2, target.resp), proto.String("invalidate")...)
+	case target != c && s.pubsub.isSubscribed(target):
+		b = append(proto.ArrayHeader(3), proto.String(pubsubMessage)...)
+		b = append(b, proto.String(trackingChannel)...)
+	default:
+		return
+	}
+	b = append(b, proto.Array([]string{key})...)
+	// the message is written by another goroutine, a client not reading doesn't block
+	// the server, and the protocol of the client can't be changed by HELLO with s.mu held.
+	target.QueuePush(func(int) []byte { return b })
+}
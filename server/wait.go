@@ -0,0 +1,145 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/fukua95/gedis/proto"
+)
+
+// waitPollInterval is how often the local aof is checked by WAITAOF,
+// the replicas notify their acks.
+const waitPollInterval = 100 * time.Millisecond
+
+// wait handles `WAIT numreplicas timeout`.
+// It blocks until numreplicas replicas acknowledge the last write of the client,
+// or the timeout in ms expires, 0 means forever. It replies the number of replicas
+// acknowledging the write, even if the timeout expires.
+func (s *Server) wait(conn *Conn, cmd Command) error {
+	numReplicas, err1 := strconv.Atoi(string(cmd.At(1)))
+	timeoutMS, err2 := strconv.Atoi(string(cmd.At(2)))
+	if err1 != nil || err2 != nil {
+		return conn.WriteError("value is not an integer or out of range")
+	}
+	if timeoutMS < 0 {
+		return conn.WriteError("timeout is negative")
+	}
+
+	s.mu.Lock()
+	if s.role == roleReplica {
+		s.mu.Unlock()
+		return conn.WriteError("WAIT cannot be used with replica instances. Please also note that since Redis 4.0 if a replica is configured to be writable (which is not the default) writes to replicas are just local and are not propagated.")
+	}
+	s.mu.Unlock()
+
+	offset := conn.woff
+	acked := func() int {
+		n := 0
+		for _, r := range s.replicas.Clone() {
+			if r.ackOffset >= offset {
+				n++
+			}
+		}
+		return n
+	}
+	s.blockForAcks(timeoutMS, func() bool { return acked() >= numReplicas })
+
+	s.mu.Lock()
+	n := acked()
+	s.mu.Unlock()
+	return conn.WriteInt(n)
+}
+
+// waitaof handles `WAITAOF numlocal numreplicas timeout`.
+// It blocks until the last write of the client is fsynced to the local aof if numlocal
+// is 1, and to the aof of numreplicas replicas, or the timeout in ms expires, 0 means
+// forever. It replies the number of local aofs (0 or 1) and replicas fsyncing the write.
+func (s *Server) waitaof(conn *Conn, cmd Command) error {
+	numLocal, err1 := strconv.Atoi(string(cmd.At(1)))
+	numReplicas, err2 := strconv.Atoi(string(cmd.At(2)))
+	timeoutMS, err3 := strconv.Atoi(string(cmd.At(3)))
+	if err1 != nil || err2 != nil || err3 != nil {
+		return conn.WriteError("value is not an integer or out of range")
+	}
+	if timeoutMS < 0 {
+		return conn.WriteError("timeout is negative")
+	}
+
+	s.mu.Lock()
+	if s.role == roleReplica {
+		s.mu.Unlock()
+		return conn.WriteError("WAITAOF cannot be used with replica instances. Please also note that writes to replicas are just local and are not propagated.")
+	}
+	if numLocal > 0 && s.aof == nil {
+		s.mu.Unlock()
+		return conn.WriteError("WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+	s.mu.Unlock()
+
+	offset := conn.woff
+	acked := func() (int, int) {
+		local := 0
+		if s.aof != nil && s.aof.FsyncedOffset() >= offset {
+			local = 1
+		}
+		n := 0
+		for _, r := range s.replicas.Clone() {
+			if r.ackAofOffset >= offset {
+				n++
+			}
+		}
+		return local, n
+	}
+	s.blockForAcks(timeoutMS, func() bool {
+		local, n := acked()
+		return local >= numLocal && n >= numReplicas
+	})
+
+	s.mu.Lock()
+	local, n := acked()
+	s.mu.Unlock()
+	return conn.WriteRawBytes(append(proto.ArrayHeader(2), append(proto.Integer(local), proto.Integer(n)...)...))
+}
+
+// blockForAcks blocks until done returns true or the timeout in ms expires, 0 means forever.
+// done is called with s.mu held. If it's not done, the replicas are asked to acknowledge
+// with `REPLCONF GETACK *` instead of waiting for their periodic acks.
+func (s *Server) blockForAcks(timeoutMS int, done func() bool) {
+	var timeout <-chan time.Time
+	if timeoutMS > 0 {
+		timer := time.NewTimer(time.Duration(timeoutMS) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	askedAck := false
+	for !done() {
+		// the replication stream is paused during a failover.
+		if !askedAck && s.role == roleMaster && s.replicas.Len() > 0 && s.failoverJob == nil {
+			getAck := &command{args: [][]byte{[]byte(proto.CmdReplConf), []byte(proto.OptionGetAck), []byte("*")}}
+			s.feedReplicationStream(encodeCommand(getAck))
+			askedAck = true
+		}
+		notify := s.ackNotify
+		s.mu.Unlock()
+		select {
+		case <-notify:
+		case <-ticker.C:
+		case <-timeout:
+			s.mu.Lock()
+			return
+		}
+		s.mu.Lock()
+	}
+}
+
+// notifyAck wakes up the clients blocked by WAIT and WAITAOF.
+// It must be called with s.mu held.
+func (s *Server) notifyAck() {
+	close(s.ackNotify)
+	s.ackNotify = make(chan struct{})
+}
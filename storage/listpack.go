@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// the limits of a stream node, like stream-node-max-entries and stream-node-max-bytes of redis.
+const (
+	streamNodeMaxEntries = 100
+	streamNodeMaxBytes   = 4096
+)
+
+// the flags of an entry in a listpack.
+const (
+	lpEntryDeleted    = 1 << 0
+	lpEntrySameFields = 1 << 1
+)
+
+// listpack is a stream node, the entries are delta-encoded against the master entry,
+// which is the first entry added, like the listpack of a stream node of redis:
+// [<flags> <ms delta> <seq delta> [<fields len> [<field>]...] [<value>]...]...
+// the fields are omitted if they're the same as the master fields, the deleted entries
+// are only flagged, the node is removed when all of them are deleted.
+type listpack struct {
+	master ID
+	fields []string
+	// the last entry added, it may be deleted.
+	last    ID
+	buf     []byte
+	count   int
+	deleted int
+}
+
+func newListpack(e *Entry) *listpack {
+	lp := &listpack{master: e.ID, fields: make([]string, len(e.KVs))}
+	for i, kv := range e.KVs {
+		lp.fields[i] = kv.K
+	}
+	lp.append(e)
+	return lp
+}
+
+// full returns whether the node can't hold more entries.
+func (lp *listpack) full() bool {
+	return lp.count+lp.deleted >= streamNodeMaxEntries || len(lp.buf) >= streamNodeMaxBytes
+}
+
+func (lp *listpack) append(e *Entry) {
+	flags := byte(0)
+	if lp.sameFields(e) {
+		flags |= lpEntrySameFields
+	}
+	lp.buf = append(lp.buf, flags)
+	lp.buf = binary.AppendUvarint(lp.buf, uint64(e.ID.timestamp-lp.master.timestamp))
+	lp.buf = binary.AppendVarint(lp.buf, e.ID.seq-lp.master.seq)
+	if flags&lpEntrySameFields == 0 {
+		lp.buf = binary.AppendUvarint(lp.buf, uint64(len(e.KVs)))
+		for _, kv := range e.KVs {
+			lp.buf = appendLpString(lp.buf, kv.K)
+		}
+	}
+	for _, kv := range e.KVs {
+		lp.buf = appendLpString(lp.buf, kv.V)
+	}
+	lp.last = e.ID
+	lp.count++
+}
+
+func (lp *listpack) sameFields(e *Entry) bool {
+	if len(e.KVs) != len(lp.fields) {
+		return false
+	}
+	for i, kv := range e.KVs {
+		if kv.K != lp.fields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// decode decodes the entry at off, it returns the entry, whether it's deleted,
+// and the offset of the next entry.
+func (lp *listpack) decode(off int) (*Entry, bool, int) {
+	flags := lp.buf[off]
+	off++
+	msDelta, n := binary.Uvarint(lp.buf[off:])
+	off += n
+	seqDelta, n := binary.Varint(lp.buf[off:])
+	off += n
+	e := &Entry{ID: ID{timestamp: lp.master.timestamp + int64(msDelta), seq: lp.master.seq + seqDelta}}
+	if flags&lpEntrySameFields != 0 {
+		e.KVs = make([]KV, len(lp.fields))
+		for i, f := range lp.fields {
+			e.KVs[i].K = f
+		}
+	} else {
+		l, n := binary.Uvarint(lp.buf[off:])
+		off += n
+		e.KVs = make([]KV, l)
+		for i := range e.KVs {
+			e.KVs[i].K, off = lp.string(off)
+		}
+	}
+	for i := range e.KVs {
+		e.KVs[i].V, off = lp.string(off)
+	}
+	return e, flags&lpEntryDeleted != 0, off
+}
+
+// markDeleted flags the entry at off deleted.
+func (lp *listpack) markDeleted(off int) {
+	lp.buf[off] |= lpEntryDeleted
+	lp.count--
+	lp.deleted++
+}
+
+// each calls fn with the live entries and their offsets in order, until fn returns false.
+func (lp *listpack) each(fn func(e *Entry, off int) bool) {
+	for off := 0; off < len(lp.buf); {
+		e, deleted, next := lp.decode(off)
+		if !deleted && !fn(e, off) {
+			return
+		}
+		off = next
+	}
+}
+
+// entries returns the live entries in order.
+func (lp *listpack) entries() []*Entry {
+	res := make([]*Entry, 0, lp.count)
+	lp.each(func(e *Entry, _ int) bool {
+		res = append(res, e)
+		return true
+	})
+	return res
+}
+
+func (lp *listpack) clone() *listpack {
+	c := *lp
+	c.buf = slices.Clone(lp.buf)
+	return &c
+}
+
+func (lp *listpack) string(off int) (string, int) {
+	l, n := binary.Uvarint(lp.buf[off:])
+	off += n
+	return string(lp.buf[off : off+int(l)]), off + int(l)
+}
+
+func appendLpString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
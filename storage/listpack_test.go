@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func entry(ms int64, seq int64, kvs ...string) *Entry {
+	e := &Entry{ID: NewID(ms, seq), KVs: []KV{}}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		e.KVs = append(e.KVs, KV{K: kvs[i], V: kvs[i+1]})
+	}
+	return e
+}
+
+func entriesString(entries []*Entry) string {
+	s := ""
+	for _, e := range entries {
+		s += fmt.Sprintf("%v %v ", e.ID.String(), e.KVs)
+	}
+	return s
+}
+
+func TestListpackEncoding(t *testing.T) {
+	entries := []*Entry{
+		entry(1000, 5, "name", "a", "age", "1"),
+		// the seq delta against the master is negative.
+		entry(1001, 0, "name", "b", "age", "2"),
+		entry(1001, 1, "other", "x"),
+		entry(1000000, 7, "name", "", "age", ""),
+		entry(1000000, 8),
+	}
+	lp := newListpack(entries[0])
+	for _, e := range entries[1:] {
+		lp.append(e)
+	}
+	if got := lp.entries(); !reflect.DeepEqual(got, entries) {
+		t.Fatalf("entries() = %v, want %v", entriesString(got), entriesString(entries))
+	}
+	if lp.master != entries[0].ID || lp.last != entries[len(entries)-1].ID || lp.count != len(entries) {
+		t.Errorf("master, last, count = %v, %v, %d", lp.master, lp.last, lp.count)
+	}
+
+	// the fields are omitted only if they're the master fields.
+	wantSame := []bool{true, true, false, true, false}
+	i := 0
+	for off := 0; off < len(lp.buf); i++ {
+		if same := lp.buf[off]&lpEntrySameFields != 0; same != wantSame[i] {
+			t.Errorf("the entry %d has the same fields flag %v, want %v", i, same, wantSame[i])
+		}
+		_, _, off = lp.decode(off)
+	}
+	if i != len(entries) {
+		t.Errorf("decoded %d entries, want %d", i, len(entries))
+	}
+}
+
+func TestListpackDeleted(t *testing.T) {
+	lp := newListpack(entry(1, 0, "f", "v0"))
+	for i := 1; i < 4; i++ {
+		lp.append(entry(1, int64(i), "f", fmt.Sprint("v", i)))
+	}
+	offs := []int{}
+	lp.each(func(e *Entry, off int) bool {
+		offs = append(offs, off)
+		return true
+	})
+	lp.markDeleted(offs[0])
+	lp.markDeleted(offs[2])
+	if lp.count != 2 || lp.deleted != 2 {
+		t.Errorf("count, deleted = %d, %d, want 2, 2", lp.count, lp.deleted)
+	}
+	want := []*Entry{entry(1, 1, "f", "v1"), entry(1, 3, "f", "v3")}
+	if got := lp.entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("entries() = %v, want %v", entriesString(got), entriesString(want))
+	}
+	// the deleted entries are still decoded with the flag.
+	if e, deleted, _ := lp.decode(offs[2]); !deleted || e.ID != NewID(1, 2) {
+		t.Errorf("decode() = %v, %v, want 1-2 deleted", e.ID, deleted)
+	}
+
+	c := lp.clone()
+	c.markDeleted(offs[1])
+	if len(lp.entries()) != 2 || len(c.entries()) != 1 {
+		t.Errorf("the clone shares the buffer")
+	}
+}
+
+func TestListpackFull(t *testing.T) {
+	lp := newListpack(entry(1, 0, "f", "v"))
+	for i := 1; i < streamNodeMaxEntries; i++ {
+		if lp.full() {
+			t.Fatalf("full() = true with %d entries", i)
+		}
+		lp.append(entry(1, int64(i), "f", "v"))
+	}
+	if !lp.full() {
+		t.Errorf("full() = false with %d entries", streamNodeMaxEntries)
+	}
+
+	// a node is full with the deleted entries too.
+	lp = newListpack(entry(1, 0, "f", "v"))
+	for i := 1; i < streamNodeMaxEntries; i++ {
+		lp.append(entry(1, int64(i), "f", "v"))
+		lp.markDeleted(0)
+	}
+	if !lp.full() {
+		t.Errorf("full() = false with %d deleted entries", lp.deleted)
+	}
+
+	lp = newListpack(entry(1, 0, "f", string(make([]byte, streamNodeMaxBytes))))
+	if !lp.full() {
+		t.Errorf("full() = false with %d bytes", len(lp.buf))
+	}
+}
+
+// TestStreamNodes checks the stream over several nodes, the entries are split into
+// the nodes by the limits, and the nodes are removed when all the entries are deleted.
+func TestStreamNodes(t *testing.T) {
+	s := NewStream()
+	n := streamNodeMaxEntries*2 + 10
+	for i := 0; i < n; i++ {
+		s.Add(entry(int64(i/10), int64(i%10), "f", fmt.Sprint(i)))
+	}
+	if keys, _ := s.RaxSize(); keys != 3 || s.Len() != n {
+		t.Fatalf("RaxSize() = %d, Len() = %d, want 3, %d", keys, s.Len(), n)
+	}
+	if e := s.Lookup(NewID(15, 3)); e == nil || e.KVs[0].V != "153" {
+		t.Errorf("Lookup(15-3) = %v", e)
+	}
+	got := s.Range(NewID(9, 8), NewID(10, 1), 0, false)
+	if len(got) != 4 || got[0].ID != NewID(9, 8) || got[3].ID != NewID(10, 1) {
+		t.Errorf("Range(9-8, 10-1) across the nodes = %v", entriesString(got))
+	}
+	got = s.Range(MinID, MaxID, 3, true)
+	if len(got) != 3 || got[0].ID != s.LastID {
+		t.Errorf("reversed Range() = %v", entriesString(got))
+	}
+
+	// delete all the entries of the second node.
+	for i := streamNodeMaxEntries; i < streamNodeMaxEntries*2; i++ {
+		if !s.Delete(NewID(int64(i/10), int64(i%10))) {
+			t.Fatalf("Delete(%d) = false", i)
+		}
+	}
+	if keys, _ := s.RaxSize(); keys != 2 || s.Len() != n-streamNodeMaxEntries {
+		t.Errorf("RaxSize() = %d, Len() = %d after deleting a node", keys, s.Len())
+	}
+	if s.Delete(NewID(10, 0)) {
+		t.Errorf("Delete of a deleted entry = true")
+	}
+	got = s.Range(NewID(9, 9), NewID(20, 0), 0, false)
+	if len(got) != 2 || got[0].ID != NewID(9, 9) || got[1].ID != NewID(20, 0) {
+		t.Errorf("Range() over the deleted node = %v", entriesString(got))
+	}
+
+	// the exact trimming deletes the first node and a part of the last one.
+	if d := s.Trim(TrimArgs{Strategy: TrimMaxLen, MaxLen: 5}); d != int64(n-streamNodeMaxEntries-5) {
+		t.Errorf("Trim() = %d", d)
+	}
+	if keys, _ := s.RaxSize(); keys != 1 || s.Len() != 5 || s.FirstID != NewID(20, 5) {
+		t.Errorf("RaxSize() = %d, Len() = %d, FirstID = %v after trimming", keys, s.Len(), s.FirstID)
+	}
+}
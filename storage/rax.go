@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Rax is a radix tree with compressed edges, keys are ordered lexicographically like `rax` of redis.
+type Rax[T interface{}] struct {
+	root  *raxNode[T]
+	size  int
+	nodes int
+}
+
+type raxNode[T interface{}] struct {
+	// the edge from the parent, the key of the node is the prefixes from the root.
+	prefix []byte
+	// ordered by the first byte of the prefixes, which are different.
+	children []*raxNode[T]
+	isKey    bool
+	value    T
+}
+
+func NewRax[T interface{}]() *Rax[T] {
+	return &Rax[T]{root: &raxNode[T]{}, nodes: 1}
+}
+
+// Len returns the number of the keys.
+func (t *Rax[T]) Len() int {
+	return t.size
+}
+
+// Nodes returns the number of the nodes.
+func (t *Rax[T]) Nodes() int {
+	return t.nodes
+}
+
+// child returns the index of the child whose prefix starts with b, or where it should be inserted.
+func (n *raxNode[T]) child(b byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].prefix[0] >= b })
+	return i, i < len(n.children) && n.children[i].prefix[0] == b
+}
+
+// Insert sets the value of the key, it returns false if the key exists and the value is replaced.
+func (t *Rax[T]) Insert(key []byte, v T) bool {
+	n := t.root
+	for {
+		if len(key) == 0 {
+			added := !n.isKey
+			n.isKey, n.value = true, v
+			if added {
+				t.size++
+			}
+			return added
+		}
+		i, ok := n.child(key[0])
+		if !ok {
+			leaf := &raxNode[T]{prefix: bytes.Clone(key), isKey: true, value: v}
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = leaf
+			t.size++
+			t.nodes++
+			return true
+		}
+		c := n.children[i]
+		l := commonPrefixLen(c.prefix, key)
+		if l < len(c.prefix) {
+			// split the edge.
+			mid := &raxNode[T]{prefix: c.prefix[:l:l], children: []*raxNode[T]{c}}
+			c.prefix = c.prefix[l:]
+			n.children[i] = mid
+			t.nodes++
+			c = mid
+		}
+		n, key = c, key[l:]
+	}
+}
+
+// Find returns the value of the key.
+func (t *Rax[T]) Find(key []byte) (T, bool) {
+	n := t.root
+	for len(key) > 0 {
+		i, ok := n.child(key[0])
+		if !ok || !bytes.HasPrefix(key, n.children[i].prefix) {
+			var zero T
+			return zero, false
+		}
+		n = n.children[i]
+		key = key[len(n.prefix):]
+	}
+	return n.value, n.isKey
+}
+
+// Remove removes the key, it returns false if the key doesn't exist.
+func (t *Rax[T]) Remove(key []byte) bool {
+	path := []*raxNode[T]{t.root}
+	n := t.root
+	for len(key) > 0 {
+		i, ok := n.child(key[0])
+		if !ok || !bytes.HasPrefix(key, n.children[i].prefix) {
+			return false
+		}
+		n = n.children[i]
+		key = key[len(n.prefix):]
+		path = append(path, n)
+	}
+	if !n.isKey {
+		return false
+	}
+	var zero T
+	n.isKey, n.value = false, zero
+	t.size--
+
+	// remove the empty leaves, and merge the node with its only child.
+	for i := len(path) - 1; i > 0 && len(n.children) == 0 && !n.isKey; i-- {
+		parent := path[i-1]
+		j, _ := parent.child(n.prefix[0])
+		parent.children = append(parent.children[:j], parent.children[j+1:]...)
+		t.nodes--
+		n = parent
+	}
+	if n != t.root && !n.isKey && len(n.children) == 1 {
+		c := n.children[0]
+		prefix := make([]byte, 0, len(n.prefix)+len(c.prefix))
+		n.prefix = append(append(prefix, n.prefix...), c.prefix...)
+		n.children, n.isKey, n.value = c.children, c.isKey, c.value
+		t.nodes--
+	}
+	return true
+}
+
+// Ceil returns the smallest key >= key, or > key if strict.
+func (t *Rax[T]) Ceil(key []byte, strict bool) ([]byte, T, bool) {
+	return t.root.ceil(nil, key, strict)
+}
+
+// Floor returns the greatest key <= key, or < key if strict.
+func (t *Rax[T]) Floor(key []byte, strict bool) ([]byte, T, bool) {
+	return t.root.floor(nil, key, strict)
+}
+
+// First and Last return the smallest and the greatest keys.
+func (t *Rax[T]) First() ([]byte, T, bool) {
+	return t.root.min(nil)
+}
+
+func (t *Rax[T]) Last() ([]byte, T, bool) {
+	return t.root.max(nil)
+}
+
+// ceil searches the subtree of n, whose key is path, key is the rest of the key to search.
+func (n *raxNode[T]) ceil(path []byte, key []byte, strict bool) ([]byte, T, bool) {
+	if len(key) == 0 {
+		if n.isKey && !strict {
+			return path, n.value, true
+		}
+		// the keys of the children are greater.
+		if len(n.children) > 0 {
+			c := n.children[0]
+			return c.min(append(path, c.prefix...))
+		}
+		var zero T
+		return nil, zero, false
+	}
+	for _, c := range n.children {
+		l := commonPrefixLen(c.prefix, key)
+		switch {
+		case l == len(c.prefix):
+			if k, v, ok := c.ceil(append(path, c.prefix...), key[l:], strict); ok {
+				return k, v, true
+			}
+		case l == len(key) || c.prefix[l] > key[l]:
+			return c.min(append(path, c.prefix...))
+		}
+	}
+	var zero T
+	return nil, zero, false
+}
+
+func (n *raxNode[T]) floor(path []byte, key []byte, strict bool) ([]byte, T, bool) {
+	if len(key) == 0 {
+		if n.isKey && !strict {
+			return path, n.value, true
+		}
+		var zero T
+		return nil, zero, false
+	}
+	for i := len(n.children) - 1; i >= 0; i-- {
+		c := n.children[i]
+		l := commonPrefixLen(c.prefix, key)
+		switch {
+		case l == len(c.prefix):
+			if k, v, ok := c.floor(append(path, c.prefix...), key[l:], strict); ok {
+				return k, v, true
+			}
+		case l < len(key) && c.prefix[l] < key[l]:
+			return c.max(append(path, c.prefix...))
+		}
+	}
+	// the key of n is a prefix of the key, so it's smaller.
+	if n.isKey {
+		return path, n.value, true
+	}
+	var zero T
+	return nil, zero, false
+}
+
+func (n *raxNode[T]) min(path []byte) ([]byte, T, bool) {
+	for !n.isKey {
+		if len(n.children) == 0 {
+			var zero T
+			return nil, zero, false
+		}
+		n = n.children[0]
+		path = append(path, n.prefix...)
+	}
+	return path, n.value, true
+}
+
+func (n *raxNode[T]) max(path []byte) ([]byte, T, bool) {
+	for len(n.children) > 0 {
+		n = n.children[len(n.children)-1]
+		path = append(path, n.prefix...)
+	}
+	if !n.isKey {
+		var zero T
+		return nil, zero, false
+	}
+	return path, n.value, true
+}
+
+func commonPrefixLen(a []byte, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestRaxInsertFind(t *testing.T) {
+	keys := []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", "r", ""}
+	rax := NewRax[int]()
+	for i, k := range keys {
+		if !rax.Insert([]byte(k), i) {
+			t.Errorf("Insert(%q) = false, want true", k)
+		}
+	}
+	if rax.Len() != len(keys) {
+		t.Errorf("Len() = %d, want %d", rax.Len(), len(keys))
+	}
+	for i, k := range keys {
+		if v, ok := rax.Find([]byte(k)); !ok || v != i {
+			t.Errorf("Find(%q) = %d, %v, want %d, true", k, v, ok, i)
+		}
+	}
+	// the prefixes of the edges and the keys going through a leaf are not keys.
+	for _, k := range []string{"rom", "roman", "rub", "rubicons", "x"} {
+		if _, ok := rax.Find([]byte(k)); ok {
+			t.Errorf("Find(%q) = true, want false", k)
+		}
+	}
+
+	if rax.Insert([]byte("ruber"), 100) {
+		t.Errorf("Insert of an existing key = true, want false")
+	}
+	if v, _ := rax.Find([]byte("ruber")); v != 100 || rax.Len() != len(keys) {
+		t.Errorf("replaced value = %d, Len() = %d, want 100, %d", v, rax.Len(), len(keys))
+	}
+}
+
+func TestRaxRemove(t *testing.T) {
+	keys := []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus", "r"}
+	rax := NewRax[int]()
+	for i, k := range keys {
+		rax.Insert([]byte(k), i)
+	}
+	if rax.Remove([]byte("rom")) || rax.Remove([]byte("romanes")) {
+		t.Errorf("Remove of a missing key = true, want false")
+	}
+	for i, k := range keys {
+		if !rax.Remove([]byte(k)) {
+			t.Errorf("Remove(%q) = false, want true", k)
+		}
+		if rax.Remove([]byte(k)) {
+			t.Errorf("Remove(%q) twice = true, want false", k)
+		}
+		if rax.Len() != len(keys)-i-1 {
+			t.Errorf("Len() = %d after removing %q, want %d", rax.Len(), k, len(keys)-i-1)
+		}
+		// the other keys survive the merges of the nodes.
+		for j, o := range keys[i+1:] {
+			if v, ok := rax.Find([]byte(o)); !ok || v != i+1+j {
+				t.Errorf("Find(%q) = %d, %v after removing %q", o, v, ok, k)
+			}
+		}
+	}
+	if rax.Nodes() != 1 {
+		t.Errorf("Nodes() = %d of an empty tree, want 1", rax.Nodes())
+	}
+	if _, _, ok := rax.First(); ok {
+		t.Errorf("First() of an empty tree = true, want false")
+	}
+}
+
+func TestRaxNodes(t *testing.T) {
+	rax := NewRax[int]()
+	rax.Insert([]byte("abcd"), 1)
+	// root -> "abcd".
+	if rax.Nodes() != 2 {
+		t.Errorf("Nodes() = %d, want 2", rax.Nodes())
+	}
+	// root -> "ab" -> "cd", "xy".
+	rax.Insert([]byte("abxy"), 2)
+	if rax.Nodes() != 4 {
+		t.Errorf("Nodes() = %d after splitting, want 4", rax.Nodes())
+	}
+	// "ab" is merged with "cd".
+	rax.Remove([]byte("abxy"))
+	if rax.Nodes() != 2 {
+		t.Errorf("Nodes() = %d after merging, want 2", rax.Nodes())
+	}
+	if v, ok := rax.Find([]byte("abcd")); !ok || v != 1 {
+		t.Errorf("Find(abcd) = %d, %v after merging", v, ok)
+	}
+}
+
+// TestRaxSeek compares the seeks with a sorted slice, the keys are from a small
+// alphabet so they share many prefixes.
+func TestRaxSeek(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randKey := func() string {
+		b := make([]byte, rnd.Intn(6))
+		for i := range b {
+			b[i] = "abc"[rnd.Intn(3)]
+		}
+		return string(b)
+	}
+
+	rax := NewRax[string]()
+	set := map[string]bool{}
+	for i := 0; i < 300; i++ {
+		k := randKey()
+		rax.Insert([]byte(k), k)
+		set[k] = true
+	}
+	for i := 0; i < 100; i++ {
+		k := randKey()
+		rax.Remove([]byte(k))
+		delete(set, k)
+	}
+	sorted := make([]string, 0, len(set))
+	for k := range set {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	if rax.Len() != len(sorted) {
+		t.Fatalf("Len() = %d, want %d", rax.Len(), len(sorted))
+	}
+
+	check := func(name string, key string, gotKey []byte, v string, ok bool, i int) {
+		t.Helper()
+		if i < 0 || i >= len(sorted) {
+			if ok {
+				t.Errorf("%s(%q) = %q, want none", name, key, gotKey)
+			}
+			return
+		}
+		if !ok || string(gotKey) != sorted[i] || v != sorted[i] {
+			t.Errorf("%s(%q) = %q, %q, %v, want %q", name, key, gotKey, v, ok, sorted[i])
+		}
+	}
+	k, v, ok := rax.First()
+	check("First", "", k, v, ok, 0)
+	k, v, ok = rax.Last()
+	check("Last", "", k, v, ok, len(sorted)-1)
+	for i := 0; i < 200; i++ {
+		key := randKey()
+		ge := sort.SearchStrings(sorted, key)
+		gt := ge
+		if gt < len(sorted) && sorted[gt] == key {
+			gt++
+		}
+		k, v, ok := rax.Ceil([]byte(key), false)
+		check("Ceil", key, k, v, ok, ge)
+		k, v, ok = rax.Ceil([]byte(key), true)
+		check("Ceil strict", key, k, v, ok, gt)
+		k, v, ok = rax.Floor([]byte(key), false)
+		check("Floor", key, k, v, ok, gt-1)
+		k, v, ok = rax.Floor([]byte(key), true)
+		check("Floor strict", key, k, v, ok, ge-1)
+	}
+
+	// iterating with the strict Ceil visits the keys in order.
+	i := 0
+	for k, _, ok := rax.First(); ok; k, _, ok = rax.Ceil(k, true) {
+		if i >= len(sorted) {
+			t.Fatalf("the iteration visits more than %d keys", len(sorted))
+		}
+		if string(k) != sorted[i] {
+			t.Fatalf("the key %d of the iteration = %q, want %q", i, k, sorted[i])
+		}
+		i++
+	}
+	if i != len(sorted) {
+		t.Errorf("the iteration visits %d keys, want %d", i, len(sorted))
+	}
+}
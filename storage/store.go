@@ -61,6 +61,45 @@ func (s *Store) Get(key string) (string, bool) {
 	return v.v, true
 }
 
+// Del deletes the key, it returns false if the key doesn't exist.
+func (s *Store) Del(key string) bool {
+	k := Key(key)
+	if v, ok := s.m[k]; ok {
+		delete(s.m, k)
+		return !s.HasExpired(v)
+	}
+
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	if _, ok := s.streams[k]; ok {
+		delete(s.streams, k)
+		return true
+	}
+	return false
+}
+
+// Expire returns the expiration of the string key in unix ms, 0 means no expiration.
+func (s *Store) Expire(key string) (int64, bool) {
+	k := Key(key)
+	v, ok := s.m[k]
+	if !ok || s.HasExpired(v) {
+		return 0, false
+	}
+	return int64(v.ex), true
+}
+
+// SetExpire sets the expiration of the string key in unix ms.
+func (s *Store) SetExpire(key string, ex int64) bool {
+	k := Key(key)
+	v, ok := s.m[k]
+	if !ok || s.HasExpired(v) {
+		return false
+	}
+	v.ex = time.Duration(ex)
+	s.m[k] = v
+	return true
+}
+
 func (s *Store) Scan() []Key {
 	res := []Key{}
 	del := []Key{}
@@ -99,38 +138,31 @@ func (s *Store) AddStream(key string, idStr string, pairs []string) (string, err
 	defer s.streamsLock.Unlock()
 
 	if _, has := s.streams[Key(key)]; !has {
-		s.streams[Key(key)] = &Stream{}
+		s.streams[Key(key)] = NewStream()
 	}
 	s.streams[Key(key)].Add(entry)
 	return id.String(), nil
 }
 
-// [start, end]
-func (s *Store) GetStream(key string, start string, end string) []*Entry {
+func (s *Store) PutStream(key string, stream *Stream) {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	s.streams[Key(key)] = stream
+}
+
+// Stream returns the stream of the key.
+func (s *Store) Stream(key string) (*Stream, bool) {
 	s.streamsLock.RLock()
 	defer s.streamsLock.RUnlock()
-
 	stream, has := s.streams[Key(key)]
-	if !has {
-		return nil
-	}
-	startID, _ := DecodeID(start)
-	endID, _ := DecodeID(end)
-	return stream.Get(startID, endID)
+	return stream, has
 }
 
-func (s *Store) StreamNewestID(key string) string {
+func (s *Store) HasStream(key string) bool {
 	s.streamsLock.RLock()
 	defer s.streamsLock.RUnlock()
-
-	stream, has := s.streams[Key(key)]
-	var id ID
-	if !has {
-		id = ID{timestamp: 0, seq: 0}
-	} else {
-		id = stream.LastEntry().ID
-	}
-	return id.String()
+	_, has := s.streams[Key(key)]
+	return has
 }
 
 func (s *Store) ValueType(key string) string {
@@ -156,7 +188,7 @@ func (s *Store) generateID(key string, idStr string) (ID, error) {
 	}
 
 	if stream, has := s.streams[Key(key)]; has {
-		lastID := stream.LastEntry().ID
+		lastID := stream.LastID
 		if LessThan(id, lastID) || Equal(id, lastID) {
 			return id, proto.ErrStreamIDInvalid
 		}
@@ -178,3 +210,76 @@ func (s *Store) generateID(key string, idStr string) (ID, error) {
 	}
 	return id, nil
 }
+
+// Snapshot returns a point-in-time copy of the store.
+// Stream entries are immutable, so they are shared with the copy.
+func (s *Store) Snapshot() *Store {
+	snap := NewStore()
+	for k, v := range s.m {
+		if !s.HasExpired(v) {
+			snap.m[k] = v
+		}
+	}
+
+	s.streamsLock.RLock()
+	defer s.streamsLock.RUnlock()
+	for k, stream := range s.streams {
+		snap.streams[k] = stream.Clone()
+	}
+	return snap
+}
+
+// Len returns the number of strings and streams.
+func (s *Store) Len() (int, int) {
+	s.streamsLock.RLock()
+	defer s.streamsLock.RUnlock()
+	return len(s.m), len(s.streams)
+}
+
+func (s *Store) ExpiresLen() int {
+	n := 0
+	for _, v := range s.m {
+		if v.ex > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Store) ForEachString(fn func(key string, val string, ex int64)) {
+	for k, v := range s.m {
+		if !s.HasExpired(v) {
+			fn(string(k), v.v, int64(v.ex))
+		}
+	}
+}
+
+func (s *Store) ForEachStream(fn func(key string, stream *Stream)) {
+	s.streamsLock.RLock()
+	defer s.streamsLock.RUnlock()
+	for k, stream := range s.streams {
+		fn(string(k), stream)
+	}
+}
+
+// Exists reports whether the key exists, whatever its type.
+func (s *Store) Exists(key string) bool {
+	if _, ok := s.Expire(key); ok {
+		return true
+	}
+	return s.HasStream(key)
+}
+
+// ForEachKey calls fn with every key, whatever its type.
+func (s *Store) ForEachKey(fn func(key string)) {
+	for k, v := range s.m {
+		if !s.HasExpired(v) {
+			fn(string(k))
+		}
+	}
+	s.streamsLock.RLock()
+	defer s.streamsLock.RUnlock()
+	for k := range s.streams {
+		fn(string(k))
+	}
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
@@ -19,6 +21,18 @@ var (
 	anyID = ID{timestamp: -1, seq: -1}
 )
 
+func NewID(ms int64, seq int64) ID {
+	return ID{timestamp: ms, seq: seq}
+}
+
+func (id ID) Ms() int64 {
+	return id.timestamp
+}
+
+func (id ID) Seq() int64 {
+	return id.seq
+}
+
 func DecodeID(idStr string) (ID, error) {
 	if idStr == "*" {
 		return anyID, nil
@@ -59,6 +73,57 @@ func GreaterThan(l ID, r ID) bool {
 	return l.timestamp > r.timestamp || (l.timestamp == r.timestamp && l.seq > r.seq)
 }
 
+// CompareID returns -1, 0 or 1 if l is smaller than, equal to or greater than r.
+func CompareID(l ID, r ID) int {
+	switch {
+	case l.timestamp < r.timestamp || (l.timestamp == r.timestamp && l.seq < r.seq):
+		return -1
+	case l == r:
+		return 0
+	}
+	return 1
+}
+
+// ParseID parses an ID like `<ms>-<seq>` or `<ms>`, missingSeq is the seq of the latter.
+func ParseID(s string, missingSeq int64) (ID, error) {
+	msStr, seqStr, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msStr, 10, 63)
+	if err != nil {
+		return ID{}, errors.New("invalid stream id")
+	}
+	seq := missingSeq
+	if hasSeq {
+		v, err := strconv.ParseUint(seqStr, 10, 63)
+		if err != nil {
+			return ID{}, errors.New("invalid stream id")
+		}
+		seq = int64(v)
+	}
+	return ID{timestamp: int64(ms), seq: seq}, nil
+}
+
+// Next returns the smallest ID greater than id, false if id is the greatest.
+func (id ID) Next() (ID, bool) {
+	switch {
+	case id.seq < math.MaxInt64:
+		return ID{timestamp: id.timestamp, seq: id.seq + 1}, true
+	case id.timestamp < math.MaxInt64:
+		return ID{timestamp: id.timestamp + 1}, true
+	}
+	return id, false
+}
+
+// Prev returns the greatest ID smaller than id, false if id is 0-0.
+func (id ID) Prev() (ID, bool) {
+	switch {
+	case id.seq > 0:
+		return ID{timestamp: id.timestamp, seq: id.seq - 1}, true
+	case id.timestamp > 0:
+		return ID{timestamp: id.timestamp - 1, seq: math.MaxInt64}, true
+	}
+	return id, false
+}
+
 func (id *ID) String() string {
 	return fmt.Sprintf("%s-%s", strconv.FormatInt(id.timestamp, 10), strconv.FormatInt(id.seq, 10))
 }
@@ -73,28 +138,272 @@ type Entry struct {
 	KVs []KV
 }
 
+// Stream is the entries in listpacks indexed by a radix tree, the keys are the master IDs
+// in big endian, so the entries in a range are found by seeking the tree, like `stream` of redis.
 type Stream struct {
-	Entries []*Entry
+	rax    *Rax[*listpack]
+	length int
+	// the ID of the last entry added, the stream may be empty, see XGROUP CREATE MKSTREAM.
+	LastID ID
+	// the consumer groups by name.
+	Groups map[string]*ConsumerGroup
+	// the ID of the first entry, 0-0 if the stream is empty.
+	FirstID ID
+	// the greatest ID deleted by XDEL.
+	MaxDeletedID ID
+	// the number of the entries ever added, including the deleted ones.
+	EntriesAdded int64
 }
 
+func NewStream() *Stream {
+	return &Stream{rax: NewRax[*listpack]()}
+}
+
+// raxKey returns the key of the radix tree, the IDs are not negative, so the big endian
+// order is the order of the IDs.
+func (id ID) raxKey() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(id.timestamp))
+	binary.BigEndian.PutUint64(b[8:], uint64(id.seq))
+	return b
+}
+
+// Add appends the entry, its ID must be greater than the last ID.
 func (s *Stream) Add(e *Entry) {
-	s.Entries = append(s.Entries, e)
+	if s.length == 0 {
+		s.FirstID = e.ID
+	}
+	if _, lp, ok := s.rax.Last(); ok && !lp.full() {
+		lp.append(e)
+	} else {
+		s.rax.Insert(e.ID.raxKey(), newListpack(e))
+	}
+	s.length++
+	s.LastID = e.ID
+	s.EntriesAdded++
 }
 
-func (s *Stream) Get(start ID, end ID) []*Entry {
-	res := []*Entry{}
-	for _, e := range s.Entries {
-		if LessThan(e.ID, start) {
+func (s *Stream) Len() int {
+	return s.length
+}
+
+// RaxSize returns the number of the keys and the nodes of the radix tree, see XINFO STREAM.
+func (s *Stream) RaxSize() (int, int) {
+	return s.rax.Len(), s.rax.Nodes()
+}
+
+// Delete deletes the entry of the ID, like XDEL, it returns false if the entry doesn't exist.
+func (s *Stream) Delete(id ID) bool {
+	key, lp, ok := s.rax.Floor(id.raxKey(), false)
+	if !ok || CompareID(id, lp.last) > 0 {
+		return false
+	}
+	found := false
+	lp.each(func(e *Entry, off int) bool {
+		if e.ID == id {
+			lp.markDeleted(off)
+			found = true
+		}
+		return CompareID(e.ID, id) < 0
+	})
+	if !found {
+		return false
+	}
+	if lp.count == 0 {
+		s.rax.Remove(key)
+	}
+	s.length--
+	if CompareID(id, s.MaxDeletedID) > 0 {
+		s.MaxDeletedID = id
+	}
+	if id == s.FirstID {
+		s.updateFirstID()
+	}
+	return true
+}
+
+// trim strategies.
+const (
+	TrimMaxLen = iota + 1
+	TrimMinID
+)
+
+// TrimArgs are the trimming options of XADD and XTRIM, like `streamAddTrimArgs` of redis.
+type TrimArgs struct {
+	Strategy int
+	MaxLen   int64
+	MinID    ID
+	// the approximate trimming `~` only removes the whole nodes, and at most Limit entries
+	// are deleted, 0 means no limit.
+	Approx bool
+	Limit  int64
+}
+
+// Trim deletes the oldest entries by the strategy, it returns the number of the entries deleted.
+func (s *Stream) Trim(args TrimArgs) int64 {
+	trimmed := func(id ID, left int) bool {
+		if args.Strategy == TrimMaxLen {
+			return int64(left) > args.MaxLen
+		}
+		return CompareID(id, args.MinID) < 0
+	}
+	var deleted int64
+	for s.length > 0 {
+		key, lp, _ := s.rax.First()
+		// remove the whole node if all the entries should be deleted.
+		if trimmed(lp.last, s.length-lp.count+1) {
+			if args.Approx && args.Limit > 0 && deleted+int64(lp.count) > args.Limit {
+				break
+			}
+			s.rax.Remove(key)
+			s.length -= lp.count
+			deleted += int64(lp.count)
 			continue
 		}
-		if GreaterThan(e.ID, end) {
+		if args.Approx {
 			break
 		}
-		res = append(res, e)
+		lp.each(func(e *Entry, off int) bool {
+			if !trimmed(e.ID, s.length) {
+				return false
+			}
+			lp.markDeleted(off)
+			s.length--
+			deleted++
+			return true
+		})
+		if lp.count == 0 {
+			s.rax.Remove(key)
+		}
+		break
+	}
+	if deleted > 0 {
+		s.updateFirstID()
+	}
+	return deleted
+}
+
+func (s *Stream) updateFirstID() {
+	s.FirstID = ID{}
+	if e := s.First(); e != nil {
+		s.FirstID = e.ID
 	}
-	return res
+}
+
+// First and LastEntry return the first and the last entries, nil if the stream is empty.
+func (s *Stream) First() *Entry {
+	var first *Entry
+	s.ForEach(ID{}, MaxID, false, func(e *Entry) bool {
+		first = e
+		return false
+	})
+	return first
 }
 
 func (s *Stream) LastEntry() *Entry {
-	return s.Entries[len(s.Entries)-1]
+	var last *Entry
+	s.ForEach(ID{}, MaxID, true, func(e *Entry) bool {
+		last = e
+		return false
+	})
+	return last
+}
+
+// ForEach calls fn with the entries in [start, end] in order, from end to start if rev,
+// until fn returns false.
+func (s *Stream) ForEach(start ID, end ID, rev bool, fn func(e *Entry) bool) {
+	if CompareID(start, end) > 0 {
+		return
+	}
+	if rev {
+		// the node containing end is the last one whose master ID <= end.
+		key, lp, ok := s.rax.Floor(end.raxKey(), false)
+		for ok {
+			entries := lp.entries()
+			for i := len(entries) - 1; i >= 0; i-- {
+				e := entries[i]
+				if CompareID(e.ID, start) < 0 {
+					return
+				}
+				if CompareID(e.ID, end) <= 0 && !fn(e) {
+					return
+				}
+			}
+			key, lp, ok = s.rax.Floor(key, true)
+		}
+		return
+	}
+
+	key, lp, ok := s.rax.Floor(start.raxKey(), false)
+	if !ok || CompareID(lp.last, start) < 0 {
+		key, lp, ok = s.rax.Ceil(start.raxKey(), true)
+	}
+	for ok {
+		stop := false
+		lp.each(func(e *Entry, _ int) bool {
+			if CompareID(e.ID, start) < 0 {
+				return true
+			}
+			if CompareID(e.ID, end) > 0 || !fn(e) {
+				stop = true
+			}
+			return !stop
+		})
+		if stop {
+			return
+		}
+		key, lp, ok = s.rax.Ceil(key, true)
+	}
+}
+
+// Lookup returns the entry of the ID, nil if it doesn't exist.
+func (s *Stream) Lookup(id ID) *Entry {
+	var res *Entry
+	s.ForEach(id, id, false, func(e *Entry) bool {
+		res = e
+		return false
+	})
+	return res
+}
+
+// After returns at most count entries greater than id, all of them if count <= 0.
+func (s *Stream) After(id ID, count int) []*Entry {
+	next, ok := id.Next()
+	if !ok {
+		return nil
+	}
+	return s.Range(next, MaxID, count, false)
+}
+
+// Clone returns a deep copy of the stream.
+func (s *Stream) Clone() *Stream {
+	c := &Stream{
+		rax:          NewRax[*listpack](),
+		length:       s.length,
+		LastID:       s.LastID,
+		FirstID:      s.FirstID,
+		MaxDeletedID: s.MaxDeletedID,
+		EntriesAdded: s.EntriesAdded,
+	}
+	for key, lp, ok := s.rax.First(); ok; key, lp, ok = s.rax.Ceil(key, true) {
+		c.rax.Insert(bytes.Clone(key), lp.clone())
+	}
+	for name, g := range s.Groups {
+		if c.Groups == nil {
+			c.Groups = map[string]*ConsumerGroup{}
+		}
+		c.Groups[name] = g.clone()
+	}
+	return c
+}
+
+// Range returns at most count entries in [start, end], from end to start if rev,
+// all of them if count <= 0.
+func (s *Stream) Range(start ID, end ID, count int, rev bool) []*Entry {
+	res := []*Entry{}
+	s.ForEach(start, end, rev, func(e *Entry) bool {
+		res = append(res, e)
+		return count <= 0 || len(res) < count
+	})
+	return res
 }
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"sort"
+)
+
+// ConsumerGroup is a consumer group of a stream, like `streamCG` of redis.
+type ConsumerGroup struct {
+	Name string
+	// the last ID delivered to the consumers, XREADGROUP with `>` reads the entries after it.
+	LastID ID
+	// the number of the entries read by the group, the logical position of LastID
+	// in the stream, InvalidEntriesRead if it's unknown, see Stream.Lag.
+	EntriesRead int64
+	// the entries delivered but not acknowledged yet, of all the consumers.
+	PEL       *PendingList
+	Consumers map[string]*Consumer
+}
+
+// Consumer is a consumer of a consumer group, like `streamConsumer` of redis.
+type Consumer struct {
+	Name string
+	// the last time the consumer is seen, and the last time it reads or claims
+	// entries successfully, -1 if never, in unix milliseconds.
+	SeenTime   int64
+	ActiveTime int64
+	// the pending entries of the consumer, they're in the PEL of the group too.
+	PEL *PendingList
+}
+
+// PendingEntry is an entry delivered to a consumer but not acknowledged, like `streamNACK`.
+type PendingEntry struct {
+	ID       ID
+	Consumer *Consumer
+	// the last time the entry is delivered, in unix milliseconds.
+	DeliveryTime  int64
+	DeliveryCount int64
+}
+
+// PendingList is a pending entries list ordered by ID.
+type PendingList struct {
+	ids []ID
+	m   map[ID]*PendingEntry
+}
+
+func NewPendingList() *PendingList {
+	return &PendingList{m: map[ID]*PendingEntry{}}
+}
+
+func (l *PendingList) Len() int {
+	return len(l.ids)
+}
+
+func (l *PendingList) Get(id ID) *PendingEntry {
+	return l.m[id]
+}
+
+// Add adds the entry, it returns false if the ID is in the list already.
+func (l *PendingList) Add(pe *PendingEntry) bool {
+	if _, ok := l.m[pe.ID]; ok {
+		return false
+	}
+	l.m[pe.ID] = pe
+	// the IDs delivered are mostly increasing.
+	i := len(l.ids)
+	if i > 0 && CompareID(l.ids[i-1], pe.ID) > 0 {
+		i = l.search(pe.ID)
+	}
+	l.ids = append(l.ids, ID{})
+	copy(l.ids[i+1:], l.ids[i:])
+	l.ids[i] = pe.ID
+	return true
+}
+
+func (l *PendingList) Remove(id ID) bool {
+	if _, ok := l.m[id]; !ok {
+		return false
+	}
+	delete(l.m, id)
+	i := l.search(id)
+	l.ids = append(l.ids[:i], l.ids[i+1:]...)
+	return true
+}
+
+// Range calls fn with the entries in [start, end] in order, until fn returns false.
+func (l *PendingList) Range(start ID, end ID, fn func(pe *PendingEntry) bool) {
+	for i := l.search(start); i < len(l.ids) && CompareID(l.ids[i], end) <= 0; i++ {
+		if !fn(l.m[l.ids[i]]) {
+			return
+		}
+	}
+}
+
+// First and Last return the smallest and the greatest IDs, the list must not be empty.
+func (l *PendingList) First() ID {
+	return l.ids[0]
+}
+
+func (l *PendingList) Last() ID {
+	return l.ids[len(l.ids)-1]
+}
+
+// search returns the index of the first ID >= id.
+func (l *PendingList) search(id ID) int {
+	return sort.Search(len(l.ids), func(i int) bool { return CompareID(l.ids[i], id) >= 0 })
+}
+
+// InvalidEntriesRead is the entries read by a group if it's unknown, like SCG_INVALID_ENTRIES_READ.
+const InvalidEntriesRead = -1
+
+// Group returns the consumer group, nil if it doesn't exist.
+func (s *Stream) Group(name string) *ConsumerGroup {
+	return s.Groups[name]
+}
+
+// CreateGroup creates a consumer group delivering the entries after lastID, entriesRead
+// is the number of the entries up to lastID, it returns nil if the group exists.
+func (s *Stream) CreateGroup(name string, lastID ID, entriesRead int64) *ConsumerGroup {
+	if _, ok := s.Groups[name]; ok {
+		return nil
+	}
+	if s.Groups == nil {
+		s.Groups = map[string]*ConsumerGroup{}
+	}
+	g := &ConsumerGroup{Name: name, LastID: lastID, EntriesRead: entriesRead, PEL: NewPendingList(), Consumers: map[string]*Consumer{}}
+	s.Groups[name] = g
+	return g
+}
+
+// Advance moves the last ID of the group to the entry delivered by XREADGROUP, and counts
+// the entries read, like streamReplyWithRange of redis.
+func (s *Stream) Advance(g *ConsumerGroup, id ID) {
+	if CompareID(id, g.LastID) <= 0 {
+		return
+	}
+	if g.EntriesRead != InvalidEntriesRead && !s.hasTombstonesAfter(id) {
+		// no entry after id is deleted, so the counter is still valid.
+		g.EntriesRead++
+	} else if s.EntriesAdded > 0 {
+		g.EntriesRead = s.estimateEntriesRead(id)
+	}
+	g.LastID = id
+}
+
+// Lag returns the number of the entries not read by the group yet, false if it can't
+// be determined, like streamGetLag of redis.
+func (s *Stream) Lag(g *ConsumerGroup) (int64, bool) {
+	if s.EntriesAdded == 0 {
+		return 0, true
+	}
+	if g.EntriesRead != InvalidEntriesRead && !s.hasTombstonesAfter(g.LastID) {
+		return s.EntriesAdded - g.EntriesRead, true
+	}
+	if read := s.estimateEntriesRead(g.LastID); read != InvalidEntriesRead {
+		return s.EntriesAdded - read, true
+	}
+	return 0, false
+}
+
+// hasTombstonesAfter reports whether an entry >= id may be deleted, like streamRangeHasTombstones.
+func (s *Stream) hasTombstonesAfter(id ID) bool {
+	if s.length == 0 || s.MaxDeletedID == (ID{}) {
+		return false
+	}
+	return CompareID(id, s.MaxDeletedID) <= 0
+}
+
+// estimateEntriesRead returns the logical position of id in the stream, the number of
+// the entries ever added up to id, InvalidEntriesRead if it's unknown because of the deleted
+// entries, like streamEstimateDistanceFromFirstEverEntry of redis.
+func (s *Stream) estimateEntriesRead(id ID) int64 {
+	if s.EntriesAdded == 0 {
+		return 0
+	}
+	cmpLast := CompareID(id, s.LastID)
+	if s.length == 0 && cmpLast <= 0 {
+		return s.EntriesAdded
+	}
+	if cmpLast == 0 {
+		return s.EntriesAdded
+	} else if cmpLast > 0 {
+		return InvalidEntriesRead
+	}
+	// no entry is deleted after the first entry, the entries before id are trimmed.
+	if s.MaxDeletedID == (ID{}) || CompareID(s.MaxDeletedID, s.FirstID) < 0 {
+		switch cmp := CompareID(id, s.FirstID); {
+		case cmp < 0:
+			return s.EntriesAdded - int64(s.length)
+		case cmp == 0:
+			return s.EntriesAdded - int64(s.length) + 1
+		}
+	}
+	return InvalidEntriesRead
+}
+
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, ok := s.Groups[name]; !ok {
+		return false
+	}
+	delete(s.Groups, name)
+	return true
+}
+
+// GroupNames returns the names of the groups in order.
+func (s *Stream) GroupNames() []string {
+	names := make([]string, 0, len(s.Groups))
+	for name := range s.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Consumer returns the consumer, nil if it doesn't exist.
+func (g *ConsumerGroup) Consumer(name string) *Consumer {
+	return g.Consumers[name]
+}
+
+// CreateConsumer creates a consumer, it returns nil if the consumer exists.
+func (g *ConsumerGroup) CreateConsumer(name string, now int64) *Consumer {
+	if _, ok := g.Consumers[name]; ok {
+		return nil
+	}
+	c := &Consumer{Name: name, SeenTime: now, ActiveTime: -1, PEL: NewPendingList()}
+	g.Consumers[name] = c
+	return c
+}
+
+// DeleteConsumer deletes the consumer and its pending entries,
+// it returns the number of the pending entries, -1 if the consumer doesn't exist.
+func (g *ConsumerGroup) DeleteConsumer(name string) int {
+	c, ok := g.Consumers[name]
+	if !ok {
+		return -1
+	}
+	for _, id := range c.PEL.ids {
+		g.PEL.Remove(id)
+	}
+	delete(g.Consumers, name)
+	return c.PEL.Len()
+}
+
+// ConsumerNames returns the names of the consumers in order.
+func (g *ConsumerGroup) ConsumerNames() []string {
+	names := make([]string, 0, len(g.Consumers))
+	for name := range g.Consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Ack removes the entry from the pending entries lists.
+func (g *ConsumerGroup) Ack(id ID) bool {
+	pe := g.PEL.Get(id)
+	if pe == nil {
+		return false
+	}
+	g.PEL.Remove(id)
+	pe.Consumer.PEL.Remove(id)
+	return true
+}
+
+// Deliver adds the entry to the pending entries lists of the group and the consumer,
+// the entry pending for another consumer is moved to c.
+// The delivery count is incremented if count is true.
+func (g *ConsumerGroup) Deliver(id ID, c *Consumer, now int64, count bool) *PendingEntry {
+	pe := g.PEL.Get(id)
+	if pe == nil {
+		pe = &PendingEntry{ID: id, Consumer: c}
+		g.PEL.Add(pe)
+		c.PEL.Add(pe)
+	} else if pe.Consumer != c {
+		pe.Consumer.PEL.Remove(id)
+		pe.Consumer = c
+		c.PEL.Add(pe)
+	}
+	pe.DeliveryTime = now
+	if count {
+		pe.DeliveryCount++
+	}
+	return pe
+}
+
+// clone returns a deep copy of the group.
+func (g *ConsumerGroup) clone() *ConsumerGroup {
+	cg := &ConsumerGroup{Name: g.Name, LastID: g.LastID, EntriesRead: g.EntriesRead, PEL: NewPendingList(), Consumers: map[string]*Consumer{}}
+	for name, c := range g.Consumers {
+		cg.Consumers[name] = &Consumer{Name: c.Name, SeenTime: c.SeenTime, ActiveTime: c.ActiveTime, PEL: NewPendingList()}
+	}
+	for _, id := range g.PEL.ids {
+		pe := *g.PEL.m[id]
+		pe.Consumer = cg.Consumers[pe.Consumer.Name]
+		cg.PEL.Add(&pe)
+		pe.Consumer.PEL.Add(&pe)
+	}
+	return cg
+}
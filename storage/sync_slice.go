@@ -1,6 +1,9 @@
 package storage
 
-import "sync"
+import (
+	"slices"
+	"sync"
+)
 
 type SyncSlice[T interface{}] struct {
 	mu sync.Mutex
@@ -26,3 +29,10 @@ func (s *SyncSlice[T]) Len() int {
 	defer s.mu.Unlock()
 	return len(s.s)
 }
+
+// DeleteFunc removes the elements for which del returns true.
+func (s *SyncSlice[T]) DeleteFunc(del func(T) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s = slices.DeleteFunc(s.s, del)
+}
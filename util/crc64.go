@@ -0,0 +1,12 @@
+package util
+
+import "hash/crc64"
+
+// the reflected form of the Jones polynomial 0xad93d23594c935a9 used by redis.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// Crc64 updates crc with b, it is the checksum of rdb files and DUMP payloads.
+// Unlike hash/crc64, redis doesn't invert the crc before and after the update.
+func Crc64(crc uint64, b []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, b)
+}
@@ -11,3 +11,14 @@ func RandomAlphanumericString(n int) string {
 	}
 	return string(b)
 }
+
+const hexLetters = "0123456789abcdef"
+
+// RandomHexString returns a random string of n hex digits, e.g. a run id.
+func RandomHexString(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = hexLetters[rand.Int63()%int64(len(hexLetters))]
+	}
+	return string(b)
+}